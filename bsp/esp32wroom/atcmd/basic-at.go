@@ -16,6 +16,7 @@
 package atcmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,18 +31,18 @@ import (
 * 测试: AT- OK
 *
  */
-func AT(Esp32 device.Device) bool {
-	ATResponse, err := Esp32.AT("AT\r\n", 100)
+func AT(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT\r\n", device.WithTimeout(100*time.Millisecond))
 	if err != nil {
-		return false
+		return false, err
 	}
 	if len(ATResponse.Data) < 1 {
-		return false
+		return false, fmt.Errorf("request AT error:%v", ATResponse.Data)
 	}
 	if ATResponse.Data[0] == "OK" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, fmt.Errorf("request AT error:%v", ATResponse.Data)
 }
 
 /*
@@ -49,18 +50,19 @@ func AT(Esp32 device.Device) bool {
 * 重启
 *
  */
-func RST(Esp32 device.Device) bool {
-	ATResponse, err := Esp32.AT("AT+RST\r\n", 100)
+func RST(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+RST\r\n",
+		device.WithTimeout(100*time.Millisecond), device.WithPriority(device.PriorityUrgent))
 	if err != nil {
-		return false
+		return false, err
 	}
 	if len(ATResponse.Data) != 1 {
-		return false
+		return false, fmt.Errorf("request RST error:%v", ATResponse.Data)
 	}
 	if ATResponse.Data[0] == "OK" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, fmt.Errorf("request RST error:%v", ATResponse.Data)
 }
 
 /*
@@ -86,9 +88,9 @@ func (O GMRResponse) String() string {
 		return string(bytes)
 	}
 }
-func GMR(Esp32 device.Device) (GMRResponse, error) {
+func GMR(ctx context.Context, Esp32 device.Device) (GMRResponse, error) {
 	GMRResponse := GMRResponse{}
-	ATResponse, err := Esp32.AT("AT+GMR\r\n", 200*time.Millisecond)
+	ATResponse, err := Esp32.ATContext(ctx, "AT+GMR\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return GMRResponse, err
 	}
@@ -108,19 +110,19 @@ func GMR(Esp32 device.Device) (GMRResponse, error) {
 OK
 *
 */
-func Deep_sleep(Esp32 device.Device, sleepTime int) bool {
+func Deep_sleep(ctx context.Context, Esp32 device.Device, sleepTime int) (bool, error) {
 	var cmd string = fmt.Sprintf("AT+GSLP=%d\r\n", sleepTime)
-	ATResponse, err := Esp32.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
-		return false
+		return false, err
 	}
 	if len(ATResponse.Data) != 1 {
-		return false
+		return false, fmt.Errorf("request Deep_sleep error:%v", ATResponse.Data)
 	}
 	if ATResponse.Data[0] == "OK" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, fmt.Errorf("request Deep_sleep error:%v", ATResponse.Data)
 }
 
 /*
@@ -129,18 +131,18 @@ func Deep_sleep(Esp32 device.Device, sleepTime int) bool {
 OK
 *
 */
-func ATE0(Esp32 device.Device) bool {
-	ATResponse, err := Esp32.AT("ATE0\r\n", 200*time.Millisecond)
+func ATE0(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "ATE0\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
-		return false
+		return false, err
 	}
 	if len(ATResponse.Data) != 1 {
-		return false
+		return false, fmt.Errorf("request ATE0 error:%v", ATResponse.Data)
 	}
 	if ATResponse.Data[0] == "OK" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, fmt.Errorf("request ATE0 error:%v", ATResponse.Data)
 }
 
 /*
@@ -149,18 +151,18 @@ func ATE0(Esp32 device.Device) bool {
 OK
 *
 */
-func ATE1(Esp32 device.Device) bool {
-	ATResponse, err := Esp32.AT("ATE1\r\n", 200*time.Millisecond)
+func ATE1(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "ATE1\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
-		return false
+		return false, err
 	}
 	if len(ATResponse.Data) != 1 {
-		return false
+		return false, fmt.Errorf("request ATE1 error:%v", ATResponse.Data)
 	}
 	if ATResponse.Data[0] == "OK" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, fmt.Errorf("request ATE1 error:%v", ATResponse.Data)
 }
 
 /*
@@ -223,7 +225,7 @@ func NewTcpSslSTLRequest(request TcpSslSTLRequest) error {
 	return nil
 }
 
-func TcpSslSTL(Esp32 device.Device, request TcpSslSTLRequest) (bool, error) {
+func TcpSslSTL(ctx context.Context, Esp32 device.Device, request TcpSslSTLRequest) (bool, error) {
 	err := NewTcpSslSTLRequest(request)
 	if err != nil {
 		return false, err
@@ -240,7 +242,7 @@ func TcpSslSTL(Esp32 device.Device, request TcpSslSTLRequest) (bool, error) {
 			request.Keep_alive)
 	}
 
-	ATResponse, err := Esp32.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -306,7 +308,7 @@ func NewUDPRequest(request UDPRequest) error {
 	return nil
 }
 
-func UdpSTL(Esp32 device.Device, request UDPRequest) (bool, error) {
+func UdpSTL(ctx context.Context, Esp32 device.Device, request UDPRequest) (bool, error) {
 	err := NewUDPRequest(request)
 	if err != nil {
 		return false, err
@@ -323,7 +325,7 @@ func UdpSTL(Esp32 device.Device, request UDPRequest) (bool, error) {
 			request.Local_port)
 	}
 
-	ATResponse, err := Esp32.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -357,7 +359,7 @@ type BLERequest struct {
 	Peer_addr string `json:"Peer_addr"`
 }
 
-func BleSTL(Esp32 device.Device, request BLERequest) (bool, error) {
+func BleSTL(ctx context.Context, Esp32 device.Device, request BLERequest) (bool, error) {
 	var cmd string
 	if request.Mode == 0 {
 		cmd = fmt.Sprintf("AT+SAVETRANSLINK=%d\r\n", request.Mode)
@@ -372,7 +374,7 @@ func BleSTL(Esp32 device.Device, request BLERequest) (bool, error) {
 			request.Peer_addr)
 	}
 
-	ATResponse, err := Esp32.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
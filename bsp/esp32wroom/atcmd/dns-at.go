@@ -0,0 +1,69 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+/*
+*
+* LookupIP 由模组解析域名, network 决定地址类型:
+* "ip" 优先 IPv4, "ip4" 只要 IPv4, "ip6" 只要 IPv6
+* AT+CIPDOMAIN=<"domain name">[,<ip network>]
+*
+ */
+func LookupIP(ctx context.Context, Esp32 device.Device, network, name string) (net.IP, error) {
+	Network, ok := map[string]int{"ip": 1, "ip4": 2, "ip6": 3}[network]
+	if !ok {
+		return nil, net.UnknownNetworkError(network)
+	}
+	if name == "" || len(name) > 64 {
+		return nil, &net.DNSError{Err: "invalid domain name", Name: name}
+	}
+	cmd := fmt.Sprintf("AT+CIPDOMAIN=%s,%d\r\n", device.Quote(name), Network)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(10*time.Second))
+	if errors.Is(err, device.ErrCommand) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: errors.Is(err, device.ErrTimeout)}
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request CIPDOMAIN error:%v", ATResponse.Data)
+	}
+	IP := net.ParseIP(strings.Trim(strings.TrimPrefix(ATResponse.Data[0], "+CIPDOMAIN:"), "\""))
+	if IP == nil {
+		return nil, fmt.Errorf("request CIPDOMAIN error:%v", ATResponse.Data)
+	}
+	return IP, nil
+}
+
+// LookupHost 和 net.LookupHost 一样返回地址字符串, 模组只给出一个地址
+func LookupHost(ctx context.Context, Esp32 device.Device, name string) ([]string, error) {
+	IP, err := LookupIP(ctx, Esp32, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	return []string{IP.String()}, nil
+}
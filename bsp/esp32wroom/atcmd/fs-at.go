@@ -0,0 +1,526 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// AT+FS reads and writes files in chunks of maxFSChunk bytes.
+const maxFSChunk = 2048
+
+// AT+FS=<type>,<operation>: type 0 is FATFS.
+const (
+	fsDelete = 0
+	fsWrite  = 1
+	fsRead   = 2
+	fsSize   = 3
+	fsList   = 4
+)
+
+/*
+*
+* 挂载或卸载 FAT 文件系统
+* AT+FSMOUNT=<mount>
+*
+ */
+func MountFS(ctx context.Context, Esp32 device.Device, Mount bool) (bool, error) {
+	cmd := "AT+FSMOUNT=0\r\n"
+	if Mount {
+		cmd = "AT+FSMOUNT=1\r\n"
+	}
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(2*time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request FSMOUNT error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
+* FS: 模组上的 FAT 文件系统, 实现 fs.FS、fs.ReadDirFS、fs.StatFS 和 fs.ReadFileFS,
+* 文件按 2048 字节分块读写。fs.FS 的方法没有 ctx, 每条指令单独超时。
+* AT+FS=<type>,<operation>,<"filename">[,<offset>,<length>]
+*
+ */
+type FS struct {
+	Esp32 device.Device
+	// Timeout of one AT+FS command, 0 means 5s.
+	Timeout time.Duration
+}
+
+func NewFS(Esp32 device.Device) *FS {
+	return &FS{Esp32: Esp32}
+}
+
+// fsPath maps an fs.FS name to the module, the root is ".".
+func fsPath(Op, Name string) (string, error) {
+	if !fs.ValidPath(Name) {
+		return "", &fs.PathError{Op: Op, Path: Name, Err: fs.ErrInvalid}
+	}
+	return Name, nil
+}
+
+func (F *FS) at(cmd string, opts ...device.ATOption) (device.ATResponse, error) {
+	Timeout := F.Timeout
+	if Timeout <= 0 {
+		Timeout = 5 * time.Second
+	}
+	return F.Esp32.ATContext(context.Background(), cmd, append(opts, device.WithTimeout(Timeout))...)
+}
+
+func fsCommand(Operation int, Name string, Args ...int) string {
+	cmd := fmt.Sprintf("AT+FS=0,%d,%s", Operation, device.Quote(Name))
+	for _, Arg := range Args {
+		cmd += "," + strconv.Itoa(Arg)
+	}
+	return cmd + "\r\n"
+}
+
+/*
+*
++FS:<size>
+OK
+*
+*/
+func (F *FS) size(Name string) (int, error) {
+	ATResponse, err := F.at(fsCommand(fsSize, Name))
+	if err != nil {
+		return 0, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return 0, fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	Size, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+FS:"))
+	if err != nil {
+		return 0, fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	return Size, nil
+}
+
+/*
+*
++FS:
+.
+..
+<name>
+OK
+*
+*/
+func (F *FS) list(Name string) ([]string, error) {
+	ATResponse, err := F.at(fsCommand(fsList, Name))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) < 2 || ATResponse.Data[0] != "+FS:" {
+		return nil, fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	Names := []string{}
+	for _, Line := range ATResponse.Data[1 : len(ATResponse.Data)-1] {
+		if Line = strings.TrimSpace(Line); Line != "" && Line != "." && Line != ".." {
+			Names = append(Names, Line)
+		}
+	}
+	return Names, nil
+}
+
+/*
+*
++FS:<length>,<data>
+OK
+*
+*/
+func (F *FS) read(Name string, Offset, Length int) ([]byte, error) {
+	ATResponse, err := F.at(fsCommand(fsRead, Name, Offset, Length))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	Size, Data, ok := strings.Cut(strings.TrimPrefix(ATResponse.Data[0], "+FS:"), ",")
+	if N, err := strconv.Atoi(Size); !ok || err != nil || N != len(Data) {
+		return nil, fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	return []byte(Data), nil
+}
+
+// write with no data creates the file, there is no '>' prompt then.
+func (F *FS) write(Name string, Offset int, Data []byte) error {
+	Options := []device.ATOption{}
+	if len(Data) > 0 {
+		Options = append(Options, device.WithPayload(Data))
+	}
+	ATResponse, err := F.at(fsCommand(fsWrite, Name, Offset, len(Data)), Options...)
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request FS error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+// stat tells files from directories: only files have a size and only
+// directories can be listed.
+func (F *FS) stat(Op, Name string) (*fsInfo, error) {
+	Path, err := fsPath(Op, Name)
+	if err != nil {
+		return nil, err
+	}
+	Info := &fsInfo{name: path.Base(Name)}
+	if Name == "." {
+		Info.dir = true
+		return Info, nil
+	}
+	Size, err := F.size(Path)
+	if err == nil {
+		Info.size = int64(Size)
+		return Info, nil
+	}
+	if !errors.Is(err, device.ErrCommand) {
+		return nil, &fs.PathError{Op: Op, Path: Name, Err: err}
+	}
+	if _, err := F.list(Path); err != nil {
+		if errors.Is(err, device.ErrCommand) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: Op, Path: Name, Err: err}
+	}
+	Info.dir = true
+	return Info, nil
+}
+
+func (F *FS) Stat(Name string) (fs.FileInfo, error) {
+	Info, err := F.stat("stat", Name)
+	if err != nil {
+		return nil, err
+	}
+	return Info, nil
+}
+
+func (F *FS) Open(Name string) (fs.File, error) {
+	Info, err := F.stat("open", Name)
+	if err != nil {
+		return nil, err
+	}
+	if Info.dir {
+		return &fsDir{fs: F, name: Name, info: Info}, nil
+	}
+	return &fsFile{fs: F, name: Name, info: Info}, nil
+}
+
+// ReadDir lists a directory sorted by name, each entry costs one more
+// AT+FS to know whether it is a directory.
+func (F *FS) ReadDir(Name string) ([]fs.DirEntry, error) {
+	Path, err := fsPath("readdir", Name)
+	if err != nil {
+		return nil, err
+	}
+	Names, err := F.list(Path)
+	if err != nil {
+		if errors.Is(err, device.ErrCommand) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: Name, Err: err}
+	}
+	sort.Strings(Names)
+	Entries := []fs.DirEntry{}
+	for _, Entry := range Names {
+		Info, err := F.stat("readdir", path.Join(Name, Entry))
+		if err != nil {
+			return Entries, err
+		}
+		Entries = append(Entries, fs.FileInfoToDirEntry(Info))
+	}
+	return Entries, nil
+}
+
+func (F *FS) ReadFile(Name string) ([]byte, error) {
+	Info, err := F.stat("readfile", Name)
+	if err != nil {
+		return nil, err
+	}
+	if Info.dir {
+		return nil, &fs.PathError{Op: "readfile", Path: Name, Err: errors.New("is a directory")}
+	}
+	Data := make([]byte, 0, Info.size)
+	for len(Data) < int(Info.size) {
+		Chunk, err := F.read(Name, len(Data), min(maxFSChunk, int(Info.size)-len(Data)))
+		if err != nil {
+			return nil, &fs.PathError{Op: "readfile", Path: Name, Err: err}
+		}
+		if len(Chunk) == 0 {
+			break
+		}
+		Data = append(Data, Chunk...)
+	}
+	return Data, nil
+}
+
+// WriteFile 写入整个文件, 已有的文件先被删除
+func (F *FS) WriteFile(Name string, Data []byte) error {
+	W, err := F.Create(Name)
+	if err != nil {
+		return err
+	}
+	if _, err := W.Write(Data); err != nil {
+		W.Close()
+		return err
+	}
+	return W.Close()
+}
+
+/*
+*
+* 删除文件
+* AT+FS=0,0,<"filename">
+*
+ */
+func (F *FS) Remove(Name string) error {
+	Path, err := fsPath("remove", Name)
+	if err != nil {
+		return err
+	}
+	if Name == "." {
+		return &fs.PathError{Op: "remove", Path: Name, Err: fs.ErrInvalid}
+	}
+	ATResponse, err := F.at(fsCommand(fsDelete, Path))
+	if err != nil {
+		if errors.Is(err, device.ErrCommand) {
+			err = fs.ErrNotExist
+		}
+		return &fs.PathError{Op: "remove", Path: Name, Err: err}
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return &fs.PathError{Op: "remove", Path: Name, Err: fmt.Errorf("request FS error:%v", ATResponse.Data)}
+	}
+	return nil
+}
+
+/*
+*
+* Create 删除已有的文件后返回 io.WriteCloser, 数据攒满 2048 字节写一次,
+* Close 写入剩下的数据, 可以直接 io.Copy
+*
+ */
+func (F *FS) Create(Name string) (io.WriteCloser, error) {
+	Path, err := fsPath("create", Name)
+	if err != nil {
+		return nil, err
+	}
+	if Err := F.Remove(Name); Err != nil && !errors.Is(Err, fs.ErrNotExist) {
+		return nil, Err
+	}
+	// An empty file exists as soon as Create returns.
+	if err := F.write(Path, 0, nil); err != nil {
+		return nil, &fs.PathError{Op: "create", Path: Name, Err: err}
+	}
+	return &fsWriter{fs: F, name: Name}, nil
+}
+
+type fsInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (I *fsInfo) Name() string { return I.name }
+
+func (I *fsInfo) Size() int64 { return I.size }
+
+func (I *fsInfo) Mode() fs.FileMode {
+	if I.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (I *fsInfo) ModTime() time.Time { return time.Time{} }
+
+func (I *fsInfo) IsDir() bool { return I.dir }
+
+func (I *fsInfo) Sys() any { return nil }
+
+// fsFile reads a file in chunks, it implements io.ReaderAt and io.Seeker.
+type fsFile struct {
+	fs     *FS
+	name   string
+	info   *fsInfo
+	offset int64
+	closed bool
+}
+
+func (F *fsFile) Stat() (fs.FileInfo, error) { return F.info, nil }
+
+func (F *fsFile) Read(b []byte) (int, error) {
+	N, err := F.ReadAt(b, F.offset)
+	F.offset += int64(N)
+	if err == io.EOF && N > 0 {
+		err = nil
+	}
+	return N, err
+}
+
+func (F *fsFile) ReadAt(b []byte, Offset int64) (int, error) {
+	if F.closed {
+		return 0, &fs.PathError{Op: "read", Path: F.name, Err: fs.ErrClosed}
+	}
+	if Offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: F.name, Err: fs.ErrInvalid}
+	}
+	N := 0
+	for N < len(b) && Offset+int64(N) < F.info.size {
+		Length := min(len(b)-N, maxFSChunk, int(F.info.size-Offset)-N)
+		Chunk, err := F.fs.read(F.name, int(Offset)+N, Length)
+		if err != nil {
+			return N, &fs.PathError{Op: "read", Path: F.name, Err: err}
+		}
+		if len(Chunk) == 0 {
+			break
+		}
+		N += copy(b[N:], Chunk)
+	}
+	if N < len(b) {
+		return N, io.EOF
+	}
+	return N, nil
+}
+
+func (F *fsFile) Seek(Offset int64, Whence int) (int64, error) {
+	switch Whence {
+	case io.SeekCurrent:
+		Offset += F.offset
+	case io.SeekEnd:
+		Offset += F.info.size
+	}
+	if Offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: F.name, Err: fs.ErrInvalid}
+	}
+	F.offset = Offset
+	return Offset, nil
+}
+
+func (F *fsFile) Close() error {
+	if F.closed {
+		return &fs.PathError{Op: "close", Path: F.name, Err: fs.ErrClosed}
+	}
+	F.closed = true
+	return nil
+}
+
+// fsDir implements fs.ReadDirFile.
+type fsDir struct {
+	fs      *FS
+	name    string
+	info    *fsInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (D *fsDir) Stat() (fs.FileInfo, error) { return D.info, nil }
+
+func (D *fsDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: D.name, Err: errors.New("is a directory")}
+}
+
+func (D *fsDir) Close() error { return nil }
+
+func (D *fsDir) ReadDir(N int) ([]fs.DirEntry, error) {
+	if !D.read {
+		Entries, err := D.fs.ReadDir(D.name)
+		if err != nil {
+			return nil, err
+		}
+		D.entries, D.read = Entries, true
+	}
+	if N <= 0 {
+		Entries := D.entries
+		D.entries = nil
+		return Entries, nil
+	}
+	if len(D.entries) == 0 {
+		return nil, io.EOF
+	}
+	Entries := D.entries[:min(N, len(D.entries))]
+	D.entries = D.entries[len(Entries):]
+	return Entries, nil
+}
+
+// fsWriter appends to a file in chunks of maxFSChunk bytes.
+type fsWriter struct {
+	fs     *FS
+	name   string
+	offset int
+	buffer []byte
+	closed bool
+}
+
+func (W *fsWriter) Write(b []byte) (int, error) {
+	if W.closed {
+		return 0, &fs.PathError{Op: "write", Path: W.name, Err: fs.ErrClosed}
+	}
+	// A chunk that fails to write gives the bytes of b back, a retry of
+	// the rest of b does not write them twice.
+	N := 0
+	for N < len(b) {
+		Kept := len(W.buffer)
+		Take := min(maxFSChunk-Kept, len(b)-N)
+		W.buffer = append(W.buffer, b[N:N+Take]...)
+		if len(W.buffer) == maxFSChunk {
+			if err := W.flush(maxFSChunk); err != nil {
+				W.buffer = W.buffer[:Kept]
+				return N, err
+			}
+		}
+		N += Take
+	}
+	return N, nil
+}
+
+func (W *fsWriter) flush(N int) error {
+	if err := W.fs.write(W.name, W.offset, W.buffer[:N]); err != nil {
+		return &fs.PathError{Op: "write", Path: W.name, Err: err}
+	}
+	W.offset += N
+	W.buffer = W.buffer[N:]
+	return nil
+}
+
+func (W *fsWriter) Close() error {
+	if W.closed {
+		return &fs.PathError{Op: "close", Path: W.name, Err: fs.ErrClosed}
+	}
+	W.closed = true
+	if len(W.buffer) > 0 {
+		return W.flush(len(W.buffer))
+	}
+	return nil
+}
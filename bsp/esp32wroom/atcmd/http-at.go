@@ -0,0 +1,320 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+const (
+	// URLs longer than maxHTTPURL go through AT+HTTPURLCFG.
+	maxHTTPURL    = 256
+	maxHTTPURLCFG = 8192
+)
+
+// HTTP 失败时 ERR CODE 的扩展信息是 0x7000 + 状态码, 例如 0x7194 是 404
+const httpStatusBase = 0x7000
+
+/*
+*
+* HTTPTransport 用模组的 HTTP 客户端指令实现 http.RoundTripper:
+*
+*	Client := &http.Client{Transport: &esp32wroomAt.HTTPTransport{Esp32: Esp32}}
+*
+* 没有请求体的请求走 AT+HTTPCLIENT, POST/PUT 的请求体通过 AT+HTTPCPOST/AT+HTTPCPUT
+* 在 '>' 后发送; 请求头通过 AT+HTTPCHEAD 设置, 请求结束后清除。
+*
+* 限制: 模组不返回状态行和响应头, 成功的请求 (2xx, 以及跟随重定向之后的结果)
+* 一律报告为 200 OK, 201、204 等无法区分, Response.Header 为空。失败时的状态码
+* 来自 ERR CODE 的扩展信息, 所以请求期间会打开 AT+SYSLOG, 结束后恢复原来的值。
+*
+ */
+type HTTPTransport struct {
+	Esp32 device.Device
+	// Timeout of one request, 0 means 30s.
+	Timeout time.Duration
+	lock    sync.Mutex
+}
+
+var httpContentTypes = map[string]int{
+	"application/x-www-form-urlencoded": 0,
+	"application/json":                  1,
+	"multipart/form-data":               2,
+	"text/xml":                          3,
+}
+
+// AT+HTTPCLIENT=<opt>
+var httpOpts = map[string]int{
+	http.MethodHead:   1,
+	http.MethodGet:    2,
+	http.MethodPost:   3,
+	http.MethodPut:    4,
+	http.MethodDelete: 5,
+}
+
+func (T *HTTPTransport) timeout() time.Duration {
+	if T.Timeout > 0 {
+		return T.Timeout
+	}
+	return 30 * time.Second
+}
+
+func (T *HTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var Body []byte
+	if req.Body != nil {
+		defer req.Body.Close()
+		var err error
+		if Body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	Opt, ok := httpOpts[req.Method]
+	if !ok || (len(Body) > 0 && req.Method != http.MethodPost && req.Method != http.MethodPut) {
+		return nil, fmt.Errorf("unsupported method %s", req.Method)
+	}
+	URL := *req.URL
+	URL.Fragment = ""
+	if len(URL.String()) > maxHTTPURLCFG {
+		return nil, errors.New("url too long")
+	}
+	T.lock.Lock()
+	defer T.lock.Unlock()
+	ctx := req.Context()
+	Syslog, err := getSyslog(ctx, T.Esp32)
+	if err != nil {
+		return nil, err
+	}
+	if !Syslog {
+		if err := setSyslog(ctx, T.Esp32, true); err != nil {
+			return nil, err
+		}
+	}
+	Headers := httpHeaders(req)
+	defer T.reset(ctx, len(Headers) > 0, len(URL.String()) > maxHTTPURL, !Syslog)
+	for _, Header := range Headers {
+		if err := setHTTPHead(ctx, T.Esp32, Header); err != nil {
+			return nil, err
+		}
+	}
+	cmdURL := device.Quote(URL.String())
+	if len(URL.String()) > maxHTTPURL {
+		if err := setHTTPURL(ctx, T.Esp32, URL.String()); err != nil {
+			return nil, err
+		}
+		cmdURL = `""`
+	}
+	var cmd, Prefix string
+	opts := []device.ATOption{device.WithTimeout(T.timeout())}
+	if len(Body) == 0 {
+		Transport := 1
+		if req.URL.Scheme == "https" {
+			Transport = 2
+		}
+		ContentType := strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+		cmd = fmt.Sprintf("AT+HTTPCLIENT=%d,%d,%s,,,%d\r\n", Opt, httpContentTypes[ContentType], cmdURL, Transport)
+		Prefix = "+HTTPCLIENT:"
+	} else {
+		Name := map[string]string{http.MethodPost: "HTTPCPOST", http.MethodPut: "HTTPCPUT"}[req.Method]
+		cmd = fmt.Sprintf("AT+%s=%s,%d\r\n", Name, cmdURL, len(Body))
+		Prefix = "+" + Name + ":"
+		opts = append(opts, device.WithPayload(Body))
+	}
+	ATResponse, err := T.Esp32.ATContext(ctx, cmd, opts...)
+	if err != nil {
+		if Code, ok := httpStatus(err); ok {
+			return httpResponse(req, Code, nil), nil
+		}
+		return nil, err
+	}
+	Data, err := httpBody(Prefix, ATResponse.Data)
+	if err != nil {
+		return nil, err
+	}
+	return httpResponse(req, http.StatusOK, Data), nil
+}
+
+// reset clears the headers and the URL of the request and turns AT+SYSLOG
+// off again even after ctx ended, they would otherwise stick to the next
+// command.
+func (T *HTTPTransport) reset(ctx context.Context, Headers, URL, Syslog bool) {
+	ctx, Cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer Cancel()
+	if Headers {
+		T.Esp32.ATContext(ctx, "AT+HTTPCHEAD=0\r\n", device.WithTimeout(time.Second))
+	}
+	if URL {
+		T.Esp32.ATContext(ctx, "AT+HTTPURLCFG=0\r\n", device.WithTimeout(time.Second))
+	}
+	if Syslog {
+		setSyslog(ctx, T.Esp32, false)
+	}
+}
+
+// httpHeaders lists the request headers as "Key: Value" lines, the module
+// writes Content-Length by itself.
+func httpHeaders(req *http.Request) []string {
+	Keys := []string{}
+	for Key := range req.Header {
+		switch http.CanonicalHeaderKey(Key) {
+		case "Content-Length", "Transfer-Encoding", "Connection":
+			continue
+		}
+		Keys = append(Keys, Key)
+	}
+	sort.Strings(Keys)
+	Headers := []string{}
+	if req.Host != "" && req.Host != req.URL.Host {
+		Headers = append(Headers, "Host: "+req.Host)
+	}
+	for _, Key := range Keys {
+		for _, Value := range req.Header[Key] {
+			Headers = append(Headers, Key+": "+Value)
+		}
+	}
+	return Headers
+}
+
+/*
+*
++SYSLOG:<status>
+OK
+*
+*/
+func getSyslog(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+SYSLOG?\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 2 || !strings.HasPrefix(ATResponse.Data[0], "+SYSLOG:") {
+		return false, fmt.Errorf("request SYSLOG error:%v", ATResponse.Data)
+	}
+	return ATResponse.Data[0] == "+SYSLOG:1", nil
+}
+
+// setSyslog turns ERR CODE lines on or off, they carry the HTTP status code.
+func setSyslog(ctx context.Context, Esp32 device.Device, On bool) error {
+	ATResponse, err := Esp32.ATContext(ctx, fmt.Sprintf("AT+SYSLOG=%d\r\n", btoi(On)), device.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return fmt.Errorf("request SYSLOG error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+/*
+*
+* 添加一个请求头, AT+HTTPCHEAD=0 清除所有请求头
+* AT+HTTPCHEAD=<req_header_len>
+*
+ */
+func setHTTPHead(ctx context.Context, Esp32 device.Device, Header string) error {
+	cmd := fmt.Sprintf("AT+HTTPCHEAD=%d\r\n", len(Header))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithPayload([]byte(Header)), device.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request HTTPCHEAD error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+/*
+*
+* 设置长 URL, 之后的 HTTP 指令用空的 url 参数
+* AT+HTTPURLCFG=<url length>
+*
+ */
+func setHTTPURL(ctx context.Context, Esp32 device.Device, URL string) error {
+	cmd := fmt.Sprintf("AT+HTTPURLCFG=%d\r\n", len(URL))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithPayload([]byte(URL)), device.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "SET OK" {
+		return fmt.Errorf("request HTTPURLCFG error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+// httpStatus reads the HTTP status code out of the ERR CODE of a failed
+// request.
+func httpStatus(err error) (int, bool) {
+	var CommandError *device.CommandError
+	if !errors.As(err, &CommandError) {
+		return 0, false
+	}
+	Extension := int(CommandError.Code & 0xFFFF)
+	if Extension < httpStatusBase+100 || Extension >= httpStatusBase+600 {
+		return 0, false
+	}
+	return Extension - httpStatusBase, true
+}
+
+// httpBody joins the <prefix><size>,<data> chunks of a response.
+func httpBody(Prefix string, Lines []string) ([]byte, error) {
+	Body := []byte{}
+	for _, Line := range Lines {
+		Chunk, ok := strings.CutPrefix(Line, Prefix)
+		if !ok {
+			continue
+		}
+		Size, Data, ok := strings.Cut(Chunk, ",")
+		N, err := strconv.Atoi(Size)
+		if !ok || err != nil || N != len(Data) {
+			return nil, fmt.Errorf("request %s error:%v", strings.Trim(Prefix, "+:"), Lines)
+		}
+		Body = append(Body, Data...)
+	}
+	return Body, nil
+}
+
+func httpResponse(req *http.Request, Code int, Body []byte) *http.Response {
+	Response := &http.Response{
+		Status:     fmt.Sprintf("%d %s", Code, http.StatusText(Code)),
+		StatusCode: Code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if req.Method == http.MethodHead || Body == nil {
+		Response.ContentLength = -1
+		return Response
+	}
+	Response.Body = io.NopCloser(bytes.NewReader(Body))
+	Response.ContentLength = int64(len(Body))
+	return Response
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+/*
+接口 IP 地址
++CIPSTA:ip:<"ip">
++CIPSTA:gateway:<"gateway">
++CIPSTA:netmask:<"netmask">
++CIPSTA:ip6ll:<"ipv6 addr">
++CIPSTA:ip6gl:<"ipv6 addr">
+OK
+*/
+type IPConfig struct {
+	IP      net.IP     `json:"ip"`
+	Gateway net.IP     `json:"gateway"`
+	Netmask net.IPMask `json:"netmask"`
+	// IPv6 link-local and global addresses, only reported by AT+CIPSTA?
+	LinkLocal net.IP `json:"linkLocal"`
+	Global    net.IP `json:"global"`
+}
+
+func (O IPConfig) String() string {
+	if bytes, err := json.Marshal(map[string]string{
+		"ip": ipString(O.IP), "gateway": ipString(O.Gateway), "netmask": ipString(net.IP(O.Netmask)),
+		"linkLocal": ipString(O.LinkLocal), "global": ipString(O.Global),
+	}); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func ipString(IP net.IP) string {
+	if IP == nil {
+		return ""
+	}
+	return IP.String()
+}
+
+func NewIPConfig(config IPConfig) error {
+	if config.IP.To4() == nil {
+		return errors.New("ip must be an IPv4 address")
+	}
+	if config.Gateway == nil && config.Netmask == nil {
+		return nil
+	}
+	if config.Gateway.To4() == nil {
+		return errors.New("gateway must be an IPv4 address")
+	}
+	if Ones, Bits := config.Netmask.Size(); Bits == 0 || Ones == 0 {
+		return errors.New("netmask must be a valid IPv4 mask")
+	}
+	if !config.IP.Mask(config.Netmask).Equal(config.Gateway.Mask(config.Netmask)) {
+		return errors.New("gateway must be in the subnet of ip")
+	}
+	return nil
+}
+
+// ipCommand formats AT+CIPSTA/AT+CIPAP, the gateway and netmask are left
+// out when both are nil.
+func ipCommand(Name string, config IPConfig) string {
+	cmd := "AT+" + Name + "=" + device.Quote(config.IP.To4().String())
+	if config.Gateway != nil {
+		cmd += "," + device.Quote(config.Gateway.To4().String()) + "," +
+			device.Quote(net.IP(config.Netmask).To4().String())
+	}
+	return cmd + "\r\n"
+}
+
+// parseIPConfig reads the +CIPSTA:<key>:<"value"> lines.
+func parseIPConfig(Prefix string, Lines []string) (IPConfig, error) {
+	IPConfig := IPConfig{}
+	for _, Line := range Lines {
+		KeyValue, ok := strings.CutPrefix(Line, Prefix)
+		if !ok {
+			continue
+		}
+		Key, Value, ok := strings.Cut(KeyValue, ":")
+		if !ok {
+			return IPConfig, fmt.Errorf("invalid %s", Line)
+		}
+		IP := net.ParseIP(strings.Trim(Value, "\""))
+		if IP == nil {
+			return IPConfig, fmt.Errorf("invalid %s", Line)
+		}
+		switch Key {
+		case "ip":
+			IPConfig.IP = IP
+		case "gateway":
+			IPConfig.Gateway = IP
+		case "netmask":
+			IPConfig.Netmask = net.IPMask(IP.To4())
+		case "ip6ll":
+			IPConfig.LinkLocal = IP
+		case "ip6gl":
+			IPConfig.Global = IP
+		}
+	}
+	if IPConfig.IP == nil {
+		return IPConfig, errors.New("no ip in response")
+	}
+	return IPConfig, nil
+}
+
+/*
+*
+* 设置 Station 静态 IP, 会关闭 Station 的 DHCP
+* AT+CIPSTA=<"ip">[,<"gateway">,<"netmask">]
+*
+ */
+func SetStationIP(ctx context.Context, Esp32 device.Device, config IPConfig) (bool, error) {
+	if err := NewIPConfig(config); err != nil {
+		return false, err
+	}
+	ATResponse, err := Esp32.ATContext(ctx, ipCommand("CIPSTA", config), device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetStationIP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+func GetStationIP(ctx context.Context, Esp32 device.Device) (IPConfig, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPSTA?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return IPConfig{}, err
+	}
+	if len(ATResponse.Data) < 2 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return IPConfig{}, fmt.Errorf("request GetStationIP error:%v", ATResponse.Data)
+	}
+	IPConfig, err := parseIPConfig("+CIPSTA:", ATResponse.Data)
+	if err != nil {
+		return IPConfig, fmt.Errorf("request GetStationIP error:%v", err)
+	}
+	return IPConfig, nil
+}
+
+/*
+*
+* 设置 SoftAP 的 IP
+* AT+CIPAP=<"ip">[,<"gateway">,<"netmask">]
+*
+ */
+func SetAPIP(ctx context.Context, Esp32 device.Device, config IPConfig) (bool, error) {
+	if err := NewIPConfig(config); err != nil {
+		return false, err
+	}
+	ATResponse, err := Esp32.ATContext(ctx, ipCommand("CIPAP", config), device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetAPIP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+func GetAPIP(ctx context.Context, Esp32 device.Device) (IPConfig, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPAP?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return IPConfig{}, err
+	}
+	if len(ATResponse.Data) < 2 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return IPConfig{}, fmt.Errorf("request GetAPIP error:%v", ATResponse.Data)
+	}
+	IPConfig, err := parseIPConfig("+CIPAP:", ATResponse.Data)
+	if err != nil {
+		return IPConfig, fmt.Errorf("request GetAPIP error:%v", err)
+	}
+	return IPConfig, nil
+}
+
+/*
+*
+* MAC 地址
+* +CIPSTAMAC:<"mac">
+* +CIPAPMAC:<"mac">
+*
+ */
+func getMAC(ctx context.Context, Esp32 device.Device, Name string) (net.HardwareAddr, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+"+Name+"?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request %s error:%v", Name, ATResponse.Data)
+	}
+	MAC, err := net.ParseMAC(strings.Trim(strings.TrimPrefix(ATResponse.Data[0], "+"+Name+":"), "\""))
+	if err != nil {
+		return nil, fmt.Errorf("request %s error:%v", Name, ATResponse.Data)
+	}
+	return MAC, nil
+}
+
+func setMAC(ctx context.Context, Esp32 device.Device, Name string, MAC net.HardwareAddr) (bool, error) {
+	if len(MAC) != 6 {
+		return false, errors.New("mac must be a 48-bit address")
+	}
+	if MAC[0]&1 != 0 {
+		return false, errors.New("mac must not be a multicast address")
+	}
+	cmd := fmt.Sprintf("AT+%s=%s\r\n", Name, device.Quote(MAC.String()))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request %s error:%v", Name, ATResponse.Data)
+	}
+	return true, nil
+}
+
+func GetStationMAC(ctx context.Context, Esp32 device.Device) (net.HardwareAddr, error) {
+	return getMAC(ctx, Esp32, "CIPSTAMAC")
+}
+
+func SetStationMAC(ctx context.Context, Esp32 device.Device, MAC net.HardwareAddr) (bool, error) {
+	return setMAC(ctx, Esp32, "CIPSTAMAC", MAC)
+}
+
+func GetAPMAC(ctx context.Context, Esp32 device.Device) (net.HardwareAddr, error) {
+	return getMAC(ctx, Esp32, "CIPAPMAC")
+}
+
+func SetAPMAC(ctx context.Context, Esp32 device.Device, MAC net.HardwareAddr) (bool, error) {
+	return setMAC(ctx, Esp32, "CIPAPMAC", MAC)
+}
+
+/*
+*
+* 设置 DNS 服务器, 最多 3 个, 不传时恢复默认 DNS
+* AT+CIPDNS=<enable>[,<"DNS IP1">,<"DNS IP2">,<"DNS IP3">]
+*
+ */
+func SetDNS(ctx context.Context, Esp32 device.Device, Servers ...net.IP) (bool, error) {
+	if len(Servers) > 3 {
+		return false, errors.New("at most 3 dns servers")
+	}
+	cmd := "AT+CIPDNS=0"
+	if len(Servers) > 0 {
+		cmd = "AT+CIPDNS=1"
+		for _, Server := range Servers {
+			if Server == nil {
+				return false, errors.New("dns server must be an IP address")
+			}
+			cmd += "," + device.Quote(Server.String())
+		}
+	}
+	ATResponse, err := Esp32.ATContext(ctx, cmd+"\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetDNS error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CIPDNS:<enable>[,<"DNS IP1">,<"DNS IP2">,<"DNS IP3">]
+OK
+*
+*/
+func GetDNS(ctx context.Context, Esp32 device.Device) ([]net.IP, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPDNS?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request GetDNS error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(strings.TrimPrefix(ATResponse.Data[0], "+CIPDNS:"))
+	if _, err := strconv.Atoi(Fields[0]); err != nil {
+		return nil, fmt.Errorf("request GetDNS error:%v", ATResponse.Data)
+	}
+	Servers := []net.IP{}
+	for _, Field := range Fields[1:] {
+		Server := net.ParseIP(Field)
+		if Server == nil {
+			return nil, fmt.Errorf("request GetDNS error:%v", ATResponse.Data)
+		}
+		Servers = append(Servers, Server)
+	}
+	return Servers, nil
+}
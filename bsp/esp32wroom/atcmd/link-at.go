@@ -0,0 +1,496 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// MaxLinks is the number of link IDs of AT+CIPMUX=1.
+const MaxLinks = 5
+
+// ErrNoFreeLink: 所有 link ID 都已经被占用 (TCP/UDP 5 个, WebSocket 3 个)
+var ErrNoFreeLink = errors.New("no free link id")
+
+// ErrLinksOpen: 透传模式只能有一个连接, 需要先关闭其他连接和服务器;
+// 透传期间 Dial、Listen 等也返回它
+var ErrLinksOpen = errors.New("links are open")
+
+// link is the receiving end of one link ID.
+type link interface {
+	// receive is called with the payload of +IPD, From is set when
+	// AT+CIPDINFO=1 reports the sender.
+	receive(Data []byte, From *net.UDPAddr)
+	// closed is called on <link ID>,CLOSED, the link ID is free again.
+	closed()
+}
+
+// pulledLink is a link that reads with AT+CIPRECVDATA in passive receive
+// mode, available is called on +IPD,<link ID>,<len>.
+type pulledLink interface {
+	available(Size int)
+}
+
+/*
+*
+* netStack 管理一个模组上的 5 个连接, 由一个协程读取 +IPD、CONNECT、CLOSED
+* 等上报并分发给对应的连接。连接表挂在设备上 (device.Device.Value)。
+*
+ */
+type netStack struct {
+	Esp32 device.Device
+	urcs  <-chan device.URC
+	start sync.Once
+	setup sync.Mutex
+	ready bool
+	// passthrough is set under setup while OpenPassthrough owns the module.
+	passthrough bool
+
+	lock  sync.Mutex
+	links [MaxLinks]link
+	// passive is set by AT+CIPRECVMODE=1
+	passive bool
+	// ssl tells which link IDs still carry the SNI or PSK of an earlier
+	// connection, the module keeps them after the link is closed.
+	ssl [MaxLinks]sslSettings
+	// accept takes links opened by remote clients (AT+CIPSERVER).
+	accept func(id int) link
+}
+
+// netStackKey keys the netStack of a device in device.Device.Value.
+type netStackKey struct{}
+
+func stackOf(Esp32 device.Device) *netStack {
+	return Esp32.Value(netStackKey{}, func() any {
+		return &netStack{Esp32: Esp32}
+	}).(*netStack)
+}
+
+// openStack returns the link table of Esp32, switching the module to
+// multi-link mode the first time. AT+CIPDINFO=1 makes +IPD carry the
+// sender, which UDP needs for ReadFrom.
+func openStack(ctx context.Context, Esp32 device.Device) (*netStack, error) {
+	S := stackOf(Esp32)
+	S.start.Do(func() {
+		S.urcs = Esp32.Subscribe("")
+		go S.loop()
+	})
+	S.setup.Lock()
+	defer S.setup.Unlock()
+	if S.passthrough {
+		return nil, ErrLinksOpen
+	}
+	if S.ready {
+		return S, nil
+	}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPMUX?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request CIPMUX error:%v", ATResponse.Data)
+	}
+	if ATResponse.Data[0] != "+CIPMUX:1" {
+		ATResponse, err = Esp32.ATContext(ctx, "AT+CIPMUX=1\r\n", device.WithTimeout(200*time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+			return nil, fmt.Errorf("request CIPMUX error:%v", ATResponse.Data)
+		}
+	}
+	ATResponse, err = Esp32.ATContext(ctx, "AT+CIPDINFO=1\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return nil, fmt.Errorf("request CIPDINFO error:%v", ATResponse.Data)
+	}
+	S.ready = true
+	return S, nil
+}
+
+// leaveStack gives the module up for single-link passthrough mode, openStack
+// refuses until returnStack, the next Dial after it switches the module back
+// to multi-link mode.
+func leaveStack(Esp32 device.Device) error {
+	S := stackOf(Esp32)
+	S.setup.Lock()
+	defer S.setup.Unlock()
+	S.lock.Lock()
+	Busy := S.passthrough || S.accept != nil
+	for _, L := range S.links {
+		Busy = Busy || L != nil
+	}
+	S.lock.Unlock()
+	if Busy {
+		return ErrLinksOpen
+	}
+	S.ready = false
+	S.passthrough = true
+	return nil
+}
+
+// returnStack ends what leaveStack started, once AT+CIPMODE=0 was sent.
+func returnStack(Esp32 device.Device) {
+	S := stackOf(Esp32)
+	S.setup.Lock()
+	S.passthrough = false
+	S.setup.Unlock()
+}
+
+// reserve takes the lowest free link ID for L.
+func (S *netStack) reserve(L link) (int, error) {
+	return S.reserveFor(L, nil)
+}
+
+// reserveFor takes the lowest free link ID that Prefer accepts, or the
+// lowest free one when Prefer accepts none of them.
+func (S *netStack) reserveFor(L link, Prefer func(id int) bool) (int, error) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	Free := -1
+	for id := range S.links {
+		if S.links[id] != nil {
+			continue
+		}
+		if Prefer == nil || Prefer(id) {
+			Free = id
+			break
+		}
+		if Free < 0 {
+			Free = id
+		}
+	}
+	if Free < 0 {
+		return 0, ErrNoFreeLink
+	}
+	S.links[Free] = L
+	return Free, nil
+}
+
+// release frees the link ID if it still belongs to L.
+func (S *netStack) release(id int, L link) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if S.links[id] == L {
+		S.links[id] = nil
+	}
+}
+
+// close sends AT+CIPCLOSE and waits for <link ID>,CLOSED on gone, after
+// which the link ID can be used again.
+func (S *netStack) close(id int, L link, gone <-chan struct{}) error {
+	_, err := S.Esp32.ATContext(context.Background(), fmt.Sprintf("AT+CIPCLOSE=%d\r\n", id),
+		device.WithTimeout(5*time.Second))
+	if err != nil {
+		// The link is gone or the module is lost, either way nothing will
+		// confirm it any more.
+		S.release(id, L)
+		if errors.Is(err, device.ErrCommand) {
+			return nil
+		}
+		return err
+	}
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		S.release(id, L)
+	}
+	return nil
+}
+
+// abandon frees the link ID of a link whose AT+CIPSTART failed. Unless the
+// module answered, it may still connect, then the link ID stays taken until
+// AT+CIPCLOSE is done, so that a late CONNECT or CLOSED does not reach the
+// next link on it.
+func (S *netStack) abandon(id int, L link, gone <-chan struct{}, err error) {
+	if errors.Is(err, device.ErrCommand) || errors.Is(err, device.ErrBusy) {
+		S.release(id, L)
+		return
+	}
+	go S.abort(id, L, gone)
+}
+
+// abort closes a link that may be connecting, the module answers busy until
+// AT+CIPSTART is done.
+func (S *netStack) abort(id int, L link, gone <-chan struct{}) {
+	defer S.release(id, L)
+	cmd := fmt.Sprintf("AT+CIPCLOSE=%d\r\n", id)
+	for Try := 0; Try < 200; Try++ {
+		_, err := S.Esp32.ATContext(context.Background(), cmd, device.WithTimeout(5*time.Second))
+		if errors.Is(err, device.ErrBusy) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err == nil {
+			select {
+			case <-gone:
+			case <-time.After(time.Second):
+			}
+		}
+		return
+	}
+}
+
+func (S *netStack) get(id int) link {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if id < 0 || id >= MaxLinks {
+		return nil
+	}
+	return S.links[id]
+}
+
+func (S *netStack) loop() {
+	for U := range S.urcs {
+		switch {
+		case U.Data != nil && strings.HasPrefix(U.Line, "+IPD,"):
+			S.receive(U)
+		case strings.HasPrefix(U.Line, "+IPD,"):
+			S.announce(U.Line)
+		case U.Line == "ready":
+			// The module restarted, every link is gone.
+			S.setup.Lock()
+			S.ready = false
+			S.setup.Unlock()
+			S.lock.Lock()
+			S.passive = false
+			S.ssl = [MaxLinks]sslSettings{}
+			S.lock.Unlock()
+			S.closeAll()
+		default:
+			id, Event, ok := linkEvent(U.Line)
+			if !ok {
+				continue
+			}
+			switch Event {
+			case "CONNECT":
+				S.connected(id)
+			case "CLOSED", "CONNECT FAIL":
+				S.lock.Lock()
+				L := S.links[id]
+				S.links[id] = nil
+				S.lock.Unlock()
+				if L != nil {
+					L.closed()
+				}
+			}
+		}
+	}
+	// The engine is closed.
+	S.closeAll()
+}
+
+func (S *netStack) closeAll() {
+	S.lock.Lock()
+	Links := S.links
+	S.links = [MaxLinks]link{}
+	S.lock.Unlock()
+	for _, L := range Links {
+		if L != nil {
+			L.closed()
+		}
+	}
+}
+
+// connected handles <link ID>,CONNECT, links opened by Dial are already in
+// the table, others come from remote clients.
+func (S *netStack) connected(id int) {
+	S.lock.Lock()
+	if S.links[id] != nil {
+		S.lock.Unlock()
+		return
+	}
+	if S.accept != nil {
+		if L := S.accept(id); L != nil {
+			S.links[id] = L
+			S.lock.Unlock()
+			return
+		}
+	}
+	S.lock.Unlock()
+	// Nobody wants it, e.g. a Dial that gave up before the module connected.
+	go S.Esp32.ATContext(context.Background(), fmt.Sprintf("AT+CIPCLOSE=%d\r\n", id),
+		device.WithTimeout(5*time.Second))
+}
+
+// receive handles +IPD,<link ID>,<len>[,<"remote IP">,<remote port>]:<data>
+func (S *netStack) receive(U device.URC) {
+	Fields := device.SplitFields(strings.TrimPrefix(U.Line, "+IPD,"))
+	if len(Fields) != 2 && len(Fields) != 4 {
+		return
+	}
+	id, err := strconv.Atoi(Fields[0])
+	if err != nil {
+		return
+	}
+	var From *net.UDPAddr
+	if len(Fields) == 4 {
+		Port, _ := strconv.Atoi(Fields[3])
+		From = &net.UDPAddr{IP: net.ParseIP(Fields[2]), Port: Port}
+	}
+	if L := S.get(id); L != nil {
+		L.receive(U.Data, From)
+	}
+}
+
+// announce handles +IPD,<link ID>,<len> of passive receive mode, the data
+// waits in the module until AT+CIPRECVDATA.
+func (S *netStack) announce(Line string) {
+	Fields := device.SplitFields(strings.TrimPrefix(Line, "+IPD,"))
+	if len(Fields) < 2 {
+		return
+	}
+	id, err1 := strconv.Atoi(Fields[0])
+	Size, err2 := strconv.Atoi(Fields[1])
+	if err1 != nil || err2 != nil {
+		return
+	}
+	if L, ok := S.get(id).(pulledLink); ok {
+		L.available(Size)
+	}
+}
+
+// linkEvent splits "0,CONNECT" into the link ID and the event.
+func linkEvent(Line string) (int, string, bool) {
+	Id, Event, ok := strings.Cut(Line, ",")
+	if !ok {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(Id)
+	if err != nil || id < 0 || id >= MaxLinks {
+		return 0, "", false
+	}
+	return id, Event, true
+}
+
+/*
+*
+* Connection 是 AT+CIPSTATE? 中的一个连接
+* Server: <tetype> 为 1, 连接由 AT+CIPSERVER 接受
++CIPSTATE:<link ID>,<"type">,<"remote IP">,<remote port>,<local port>,<tetype>
+OK
+*
+*/
+type Connection struct {
+	LinkID     int    `json:"linkId"`
+	Type       string `json:"type"`
+	RemoteIP   net.IP `json:"remoteIp"`
+	RemotePort int    `json:"remotePort"`
+	LocalPort  int    `json:"localPort"`
+	Server     bool   `json:"server"`
+}
+
+func (O Connection) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+// Connections 列出模组上所有的连接
+func Connections(ctx context.Context, Esp32 device.Device) ([]Connection, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPSTATE?\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) < 1 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return nil, fmt.Errorf("request CIPSTATE error:%v", ATResponse.Data)
+	}
+	Connections := []Connection{}
+	for _, Line := range ATResponse.Data[:len(ATResponse.Data)-1] {
+		Line, ok := strings.CutPrefix(Line, "+CIPSTATE:")
+		if !ok {
+			continue
+		}
+		Fields := device.SplitFields(Line)
+		if len(Fields) != 6 {
+			return nil, fmt.Errorf("request CIPSTATE error:%v", ATResponse.Data)
+		}
+		Numbers := make([]int, 6)
+		for _, i := range []int{0, 3, 4, 5} {
+			if Numbers[i], err = strconv.Atoi(Fields[i]); err != nil {
+				return nil, fmt.Errorf("request CIPSTATE error:%v", ATResponse.Data)
+			}
+		}
+		Connections = append(Connections, Connection{LinkID: Numbers[0], Type: Fields[1],
+			RemoteIP: net.ParseIP(Fields[2]), RemotePort: Numbers[3], LocalPort: Numbers[4], Server: Numbers[5] == 1})
+	}
+	return Connections, nil
+}
+
+// stateOf returns the AT+CIPSTATE? entry of one link ID.
+func stateOf(ctx context.Context, Esp32 device.Device, id int) (Connection, bool) {
+	Connections, err := Connections(ctx, Esp32)
+	if err != nil {
+		return Connection{}, false
+	}
+	for _, Connection := range Connections {
+		if Connection.LinkID == id {
+			return Connection, true
+		}
+	}
+	return Connection{}, false
+}
+
+// wait blocks until wake fires or the deadline passes.
+func wait(wake <-chan struct{}, Deadline time.Time) error {
+	if Deadline.IsZero() {
+		<-wake
+		return nil
+	}
+	Timeout := time.Until(Deadline)
+	if Timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	Timer := time.NewTimer(Timeout)
+	defer Timer.Stop()
+	select {
+	case <-wake:
+		return nil
+	case <-Timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// notify wakes a goroutine blocked in wait without ever blocking.
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// deadlineContext bounds a read or write by its deadline.
+func deadlineContext(Deadline time.Time) (context.Context, context.CancelFunc) {
+	if Deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadlineCause(context.Background(), Deadline, os.ErrDeadlineExceeded)
+}
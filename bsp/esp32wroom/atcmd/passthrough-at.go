@@ -0,0 +1,201 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// escapeGuard is the silence ESP-AT needs before and after +++.
+const escapeGuard = 20 * time.Millisecond
+
+// exitWait is how long ESP-AT wants after +++ before the next command.
+const exitWait = time.Second
+
+/*
+*
+* 运行时透传连接参数
+* Type: TCP, TCPv6, SSL, SSLv6, UDP, UDPv6
+* KeepAlive: TCP/SSL 的 keepalive 秒数, 0 表示关闭
+* LocalPort: UDP 的本地端口, 0 表示随机
+*
+ */
+type PassthroughRequest struct {
+	Type       string `json:"type"`
+	RemoteHost string `json:"remoteHost"`
+	RemotePort int    `json:"remotePort"`
+	KeepAlive  int    `json:"keepAlive"`
+	LocalPort  int    `json:"localPort"`
+}
+
+func NewPassthroughRequest(request PassthroughRequest) error {
+	UDP := false
+	switch request.Type {
+	case "TCP", "TCPv6", "SSL", "SSLv6":
+	case "UDP", "UDPv6":
+		UDP = true
+	default:
+		return errors.New("type must be one of TCP, TCPv6, SSL, SSLv6, UDP, UDPv6")
+	}
+	if request.RemoteHost == "" || len(request.RemoteHost) > 64 {
+		return errors.New("remoteHost must be 1 to 64 bytes")
+	}
+	if request.RemotePort < 1 || request.RemotePort > 65535 {
+		return errors.New("remotePort must be between 1 and 65535")
+	}
+	if UDP && request.KeepAlive != 0 {
+		return errors.New("keepAlive is only for TCP and SSL")
+	}
+	if request.KeepAlive < 0 || request.KeepAlive > 7200 {
+		return errors.New("keepAlive must be between 0 and 7200")
+	}
+	if !UDP && request.LocalPort != 0 {
+		return errors.New("localPort is only for UDP")
+	}
+	if request.LocalPort < 0 || request.LocalPort > 65535 {
+		return errors.New("localPort must be between 0 and 65535")
+	}
+	return nil
+}
+
+func (request PassthroughRequest) command() string {
+	cmd := fmt.Sprintf("AT+CIPSTART=%s,%s,%d", device.Quote(request.Type), device.Quote(request.RemoteHost),
+		request.RemotePort)
+	switch {
+	case request.LocalPort != 0:
+		cmd += fmt.Sprintf(",%d,0", request.LocalPort)
+	case request.KeepAlive != 0:
+		cmd += fmt.Sprintf(",%d", request.KeepAlive)
+	}
+	return cmd + "\r\n"
+}
+
+/*
+*
+* PassthroughSession: 运行时进入的透传模式, 串口上的数据原样收发,
+* Close 发送前后静默 20ms 的 +++ 退出透传, 串口回到指令模式。
+* 透传期间其他指令排队等待。
+*
+ */
+type PassthroughSession struct {
+	Esp32     device.Device
+	port      *device.RawPort
+	writing   sync.Mutex
+	lastWrite time.Time
+	closed    bool
+}
+
+/*
+*
+* 建立单连接并进入透传:
+* AT+CIPMUX=0
+* AT+CIPMODE=1
+* AT+CIPSTART=<"type">,<"remote host">,<remote port>[,<keep_alive>|<local port>,0]
+* AT+CIPSEND
+*
+ */
+func OpenPassthrough(ctx context.Context, Esp32 device.Device, request PassthroughRequest) (*PassthroughSession, error) {
+	if err := NewPassthroughRequest(request); err != nil {
+		return nil, err
+	}
+	if err := leaveStack(Esp32); err != nil {
+		return nil, err
+	}
+	for _, cmd := range []string{"AT+CIPMUX=0\r\n", "AT+CIPMODE=1\r\n"} {
+		ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
+		if err != nil {
+			leavePassthrough(Esp32, false)
+			return nil, err
+		}
+		if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+			leavePassthrough(Esp32, false)
+			return nil, fmt.Errorf("request OpenPassthrough error:%v", ATResponse.Data)
+		}
+	}
+	if _, err := Esp32.ATContext(ctx, request.command(), device.WithTimeout(20*time.Second)); err != nil {
+		leavePassthrough(Esp32, false)
+		return nil, err
+	}
+	Port, err := Esp32.Passthrough(ctx, "AT+CIPSEND\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		leavePassthrough(Esp32, true)
+		return nil, err
+	}
+	return &PassthroughSession{Esp32: Esp32, port: Port}, nil
+}
+
+// leavePassthrough turns AT+CIPMODE off again and closes the link, then
+// Dial may use the module again.
+func leavePassthrough(Esp32 device.Device, Link bool) error {
+	defer returnStack(Esp32)
+	ctx := context.Background()
+	_, err := Esp32.ATContext(ctx, "AT+CIPMODE=0\r\n", device.WithTimeout(time.Second))
+	if Link {
+		_, errClose := Esp32.ATContext(ctx, "AT+CIPCLOSE\r\n", device.WithTimeout(5*time.Second))
+		// The peer may have closed it already.
+		if err == nil && !errors.Is(errClose, device.ErrCommand) {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// Read returns what the peer sent, net.ErrClosed after Close.
+func (P *PassthroughSession) Read(b []byte) (int, error) {
+	N, err := P.port.Read(b)
+	if errors.Is(err, device.ErrClosed) {
+		return N, net.ErrClosed
+	}
+	return N, err
+}
+
+func (P *PassthroughSession) Write(b []byte) (int, error) {
+	P.writing.Lock()
+	defer P.writing.Unlock()
+	if P.closed {
+		return 0, net.ErrClosed
+	}
+	N, err := P.port.Write(b)
+	P.lastWrite = time.Now()
+	return N, err
+}
+
+// Close leaves passthrough with +++ and closes the link, the module is
+// back in command mode afterwards.
+func (P *PassthroughSession) Close() error {
+	P.writing.Lock()
+	defer P.writing.Unlock()
+	if P.closed {
+		return net.ErrClosed
+	}
+	P.closed = true
+	// +++ must be a packet of its own, with silence on both sides.
+	time.Sleep(time.Until(P.lastWrite.Add(escapeGuard)))
+	_, err := P.port.Write([]byte("+++"))
+	time.Sleep(exitWait)
+	P.port.Release()
+	if err != nil {
+		return err
+	}
+	return leavePassthrough(P.Esp32, true)
+}
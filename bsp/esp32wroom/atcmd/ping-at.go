@@ -0,0 +1,116 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+/*
+*
+* PingStatistics 和 ping 命令最后的统计一样
+* Loss: 丢包率, 百分比
+*
+ */
+type PingStatistics struct {
+	Host     string          `json:"host"`
+	Sent     int             `json:"sent"`
+	Received int             `json:"received"`
+	Loss     float64         `json:"loss"`
+	Min      time.Duration   `json:"min"`
+	Avg      time.Duration   `json:"avg"`
+	Max      time.Duration   `json:"max"`
+	RTTs     []time.Duration `json:"-"`
+}
+
+func (O PingStatistics) String() string {
+	if bytes, err := json.Marshal(map[string]any{
+		"host": O.Host, "sent": O.Sent, "received": O.Received, "loss": O.Loss,
+		"min": O.Min.String(), "avg": O.Avg.String(), "max": O.Max.String(),
+	}); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+// add records one reply, a negative RTT is a lost one.
+func (O *PingStatistics) add(RTT time.Duration) {
+	O.Sent++
+	if RTT >= 0 {
+		O.Received++
+		O.RTTs = append(O.RTTs, RTT)
+		if O.Received == 1 || RTT < O.Min {
+			O.Min = RTT
+		}
+		O.Max = max(O.Max, RTT)
+		Total := time.Duration(0)
+		for _, RTT := range O.RTTs {
+			Total += RTT
+		}
+		O.Avg = Total / time.Duration(O.Received)
+	}
+	O.Loss = float64(O.Sent-O.Received) * 100 / float64(O.Sent)
+}
+
+/*
+*
+* Ping 依次执行 count 次 AT+PING, 超时算作丢包
+* ctx 取消时返回已经完成的统计和错误
+* AT+PING=<"host">
+* +PING:<time>
+* OK
+* +PING:TIMEOUT
+* ERROR
+*
+ */
+func Ping(ctx context.Context, Esp32 device.Device, host string, count int) (PingStatistics, error) {
+	Statistics := PingStatistics{Host: host}
+	if host == "" || len(host) > 64 {
+		return Statistics, errors.New("invalid host")
+	}
+	if count < 1 {
+		return Statistics, errors.New("count must be at least 1")
+	}
+	cmd := "AT+PING=" + device.Quote(host) + "\r\n"
+	for i := 0; i < count; i++ {
+		ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(5*time.Second))
+		if errors.Is(err, device.ErrCommand) || errors.Is(err, device.ErrTimeout) {
+			Statistics.add(-1)
+			continue
+		}
+		if err != nil {
+			return Statistics, err
+		}
+		if len(ATResponse.Data) != 2 {
+			return Statistics, fmt.Errorf("request PING error:%v", ATResponse.Data)
+		}
+		Ms, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+PING:"))
+		if err != nil {
+			return Statistics, fmt.Errorf("request PING error:%v", ATResponse.Data)
+		}
+		Statistics.add(time.Duration(Ms) * time.Millisecond)
+	}
+	return Statistics, nil
+}
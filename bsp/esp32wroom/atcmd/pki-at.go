@@ -0,0 +1,170 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+/*
+*
+* 客户端证书, 写入 mfg_nvs 分区的 client_cert/client_key/client_ca,
+* 不再需要 esp-at 的 Python 工具生成分区镜像
+* Index: 序号 n, 写入 client_cert.<n> 等, 对应 TLSConfig 的 PKINumber/CANumber
+* Key: PEM 格式的私钥, 必须和 Certificate 匹配
+* CA: PEM 格式的 CA 证书链
+* 为空的字段不写入
+*
+ */
+type ClientPKI struct {
+	Index       int               `json:"index"`
+	Certificate *x509.Certificate `json:"-"`
+	Key         []byte            `json:"-"`
+	CA          []byte            `json:"-"`
+}
+
+func NewClientPKI(pki ClientPKI) error {
+	if pki.Index < 0 || pki.Index > 1 {
+		return errors.New("index must be 0 or 1")
+	}
+	if pki.Certificate == nil && pki.Key == nil && pki.CA == nil {
+		return errors.New("nothing to write")
+	}
+	if pki.Key != nil {
+		Block, _ := pem.Decode(pki.Key)
+		if Block == nil {
+			return errors.New("key must be PEM encoded")
+		}
+		if !parsesAsKey(Block.Bytes) {
+			return errors.New("key is not a PKCS#1, PKCS#8 or EC private key")
+		}
+		if pki.Certificate != nil {
+			if _, err := tls.X509KeyPair(certificatePEM(pki.Certificate), pki.Key); err != nil {
+				return fmt.Errorf("key does not match certificate: %v", err)
+			}
+		}
+	}
+	if pki.CA != nil {
+		Rest, Count := pki.CA, 0
+		for {
+			var Block *pem.Block
+			if Block, Rest = pem.Decode(Rest); Block == nil {
+				break
+			}
+			if _, err := x509.ParseCertificate(Block.Bytes); Block.Type != "CERTIFICATE" || err != nil {
+				return errors.New("ca must contain only PEM certificates")
+			}
+			Count++
+		}
+		if Count == 0 {
+			return errors.New("ca must contain PEM certificates")
+		}
+	}
+	return nil
+}
+
+func parsesAsKey(der []byte) bool {
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return true
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return true
+	}
+	_, err := x509.ParseECPrivateKey(der)
+	return err == nil
+}
+
+func certificatePEM(Certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: Certificate.Raw})
+}
+
+/*
+*
+* 写入客户端证书、私钥和 CA:
+* AT+SYSMFG=2,<"namespace">,<"key">,8,<length>
+*
+ */
+func SetClientPKI(ctx context.Context, Esp32 device.Device, pki ClientPKI) (bool, error) {
+	if err := NewClientPKI(pki); err != nil {
+		return false, err
+	}
+	Values := []struct {
+		Namespace string
+		Value     []byte
+	}{{"client_cert", nil}, {"client_key", pki.Key}, {"client_ca", pki.CA}}
+	if pki.Certificate != nil {
+		Values[0].Value = certificatePEM(pki.Certificate)
+	}
+	for _, V := range Values {
+		if V.Value == nil {
+			continue
+		}
+		// mbedTLS only parses PEM that ends with a NUL.
+		if err := writeMfg(ctx, Esp32, V.Namespace, fmt.Sprintf("%s.%d", V.Namespace, pki.Index),
+			append(append([]byte{}, V.Value...), 0)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func writeMfg(ctx context.Context, Esp32 device.Device, Namespace, Key string, Value []byte) error {
+	cmd := fmt.Sprintf("AT+SYSMFG=2,%s,%s,8,%d\r\n", device.Quote(Namespace), device.Quote(Key), len(Value))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithPayload(Value), device.WithTimeout(5*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request SYSMFG error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+/*
+*
+* 删除一组客户端证书, 不存在的 key 返回 ERROR, 当作已经删除, 所以可以清理
+* 只写了一部分 (例如没有 CA) 的证书
+* AT+SYSMFG=0,<"namespace">,<"key">
+*
+ */
+func EraseClientPKI(ctx context.Context, Esp32 device.Device, Index int) (bool, error) {
+	if Index < 0 || Index > 1 {
+		return false, errors.New("index must be 0 or 1")
+	}
+	for _, Namespace := range []string{"client_cert", "client_key", "client_ca"} {
+		cmd := fmt.Sprintf("AT+SYSMFG=0,%s,%s\r\n", device.Quote(Namespace),
+			device.Quote(fmt.Sprintf("%s.%d", Namespace, Index)))
+		ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+		if errors.Is(err, device.ErrCommand) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+			return false, fmt.Errorf("request EraseClientPKI error:%v", ATResponse.Data)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// ErrServerRunning: 一个模组只能有一个 TCP 服务器
+var ErrServerRunning = errors.New("server already running")
+
+/*
+*
+* TCP 服务器参数
+* MaxConn: 最多同时连接的客户端, AT+CIPSERVERMAXCONN, 0 表示 5 个
+* IdleTimeout: 客户端空闲多久后断开, AT+CIPSTO, 0 表示不修改, 负数表示不断开
+*
+ */
+type ListenConfig struct {
+	MaxConn     int           `json:"maxConn"`
+	IdleTimeout time.Duration `json:"idleTimeout"`
+}
+
+func NewListenConfig(config ListenConfig) error {
+	if config.MaxConn < 0 || config.MaxConn > MaxLinks {
+		return fmt.Errorf("maxConn must be between 0 and %d", MaxLinks)
+	}
+	if config.IdleTimeout > 7200*time.Second {
+		return errors.New("idleTimeout must be at most 7200s")
+	}
+	return nil
+}
+
+/*
+*
+* tcpListener: AT+CIPSERVER 建立的服务器, 实现 net.Listener
+*
+ */
+type tcpListener struct {
+	stack   *netStack
+	addr    *net.TCPAddr
+	backlog chan *tcpConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// accept runs on the URC goroutine with the stack locked, it must not
+// block.
+func (T *tcpListener) accept(id int) link {
+	select {
+	case <-T.done:
+		return nil
+	default:
+	}
+	C := newTCPConn(T.stack, "tcp")
+	C.id = id
+	select {
+	case T.backlog <- C:
+		return C
+	default:
+		return nil
+	}
+}
+
+// Accept waits for the next <link ID>,CONNECT of a client.
+func (T *tcpListener) Accept() (net.Conn, error) {
+	select {
+	case C := <-T.backlog:
+		C.addrs(context.Background(), "", 0)
+		return C, nil
+	case <-T.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: T.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops the server with AT+CIPSERVER=0, accepted connections stay
+// open and the ones not accepted yet are closed.
+func (T *tcpListener) Close() error {
+	Closed := false
+	T.once.Do(func() {
+		Closed = true
+		close(T.done)
+		T.stack.lock.Lock()
+		T.stack.accept = nil
+		T.stack.lock.Unlock()
+	})
+	if !Closed {
+		return &net.OpError{Op: "close", Net: "tcp", Addr: T.addr, Err: net.ErrClosed}
+	}
+	_, err := T.stack.Esp32.ATContext(context.Background(), "AT+CIPSERVER=0\r\n", device.WithTimeout(time.Second))
+	// Nothing is added to the backlog once accept is gone.
+	for len(T.backlog) > 0 {
+		(<-T.backlog).Close()
+	}
+	if err != nil {
+		return &net.OpError{Op: "close", Net: "tcp", Addr: T.addr, Err: err}
+	}
+	return nil
+}
+
+func (T *tcpListener) Addr() net.Addr {
+	return T.addr
+}
+
+/*
+*
+* Listen 在模组上启动 TCP 服务器, 客户端连上后 (<link ID>,CONNECT) 由 Accept
+* 返回 net.Conn, 可以直接交给 http.Server 使用:
+* AT+CIPSERVERMAXCONN=<num>
+* AT+CIPSTO=<time>
+* AT+CIPSERVER=1,<port>
+*
+ */
+func (config ListenConfig) Listen(ctx context.Context, Esp32 device.Device, network, address string) (net.Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if err := NewListenConfig(config); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	_, Service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	Port, err := strconv.Atoi(Service)
+	if err != nil || Port < 1 || Port > 65535 {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: &net.AddrError{Err: "invalid port", Addr: address}}
+	}
+	Addr := &net.TCPAddr{Port: Port}
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: network, Addr: Addr, Err: err}
+	}
+	S, err := openStack(ctx, Esp32)
+	if err != nil {
+		return nil, opError(err)
+	}
+	T := &tcpListener{stack: S, addr: Addr, backlog: make(chan *tcpConn, MaxLinks), done: make(chan struct{})}
+	S.lock.Lock()
+	if S.accept != nil {
+		S.lock.Unlock()
+		return nil, opError(ErrServerRunning)
+	}
+	S.accept = T.accept
+	S.lock.Unlock()
+	if err := config.start(ctx, Esp32, Port); err != nil {
+		S.lock.Lock()
+		S.accept = nil
+		S.lock.Unlock()
+		return nil, opError(err)
+	}
+	return T, nil
+}
+
+func (config ListenConfig) start(ctx context.Context, Esp32 device.Device, Port int) error {
+	MaxConn := config.MaxConn
+	if MaxConn == 0 {
+		MaxConn = MaxLinks
+	}
+	Commands := []string{fmt.Sprintf("AT+CIPSERVERMAXCONN=%d\r\n", MaxConn)}
+	if config.IdleTimeout != 0 {
+		// Whole seconds, rounded up so that a short timeout is not 0 (never).
+		Seconds := max(int64((config.IdleTimeout+time.Second-1)/time.Second), 0)
+		Commands = append(Commands, fmt.Sprintf("AT+CIPSTO=%d\r\n", Seconds))
+	}
+	Commands = append(Commands, fmt.Sprintf("AT+CIPSERVER=1,%d\r\n", Port))
+	for _, cmd := range Commands {
+		ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+		if err != nil {
+			return err
+		}
+		if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+			Name, _, _ := strings.Cut(cmd[3:], "=")
+			return fmt.Errorf("request %s error:%v", Name, ATResponse.Data)
+		}
+	}
+	return nil
+}
+
+// Listen 使用默认参数启动 TCP 服务器
+func Listen(ctx context.Context, Esp32 device.Device, network, address string) (net.Listener, error) {
+	return ListenConfig{}.Listen(ctx, Esp32, network, address)
+}
@@ -0,0 +1,243 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// TimeUpdated 是 SNTP 同步成功后的主动上报, 可以用 Subscribe 订阅
+const TimeUpdated = "+TIME_UPDATED"
+
+// ErrTimeNotSynced: 模组还没有通过 SNTP 获得时间
+var ErrTimeNotSynced = errors.New("time not synced")
+
+/*
+*
+* SNTP 设置
+* UTCOffset: 时区, -12h 到 +14h, 精确到分钟, 例如 5h45m
+* Servers: 最多 3 个服务器, 为空时使用模组默认的服务器
+*
+ */
+type SNTPConfig struct {
+	Enable    bool          `json:"enable"`
+	UTCOffset time.Duration `json:"utcOffset"`
+	Servers   []string      `json:"servers"`
+}
+
+func (O SNTPConfig) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func NewSNTPConfig(config SNTPConfig) error {
+	if config.UTCOffset < -12*time.Hour || config.UTCOffset > 14*time.Hour {
+		return errors.New("utcOffset must be between -12h and +14h")
+	}
+	if config.UTCOffset%time.Minute != 0 {
+		return errors.New("utcOffset must be whole minutes")
+	}
+	if len(config.Servers) > 3 {
+		return errors.New("at most 3 sntp servers")
+	}
+	for _, Server := range config.Servers {
+		if Server == "" || len(Server) > 64 {
+			return errors.New("sntp server must be 1 to 64 bytes")
+		}
+	}
+	return nil
+}
+
+// timezone formats <timezone>: whole hours as they are, others as ±hhmm.
+func timezone(Offset time.Duration) string {
+	if Offset%time.Hour == 0 {
+		return strconv.Itoa(int(Offset / time.Hour))
+	}
+	Sign := ""
+	if Offset < 0 {
+		Sign, Offset = "-", -Offset
+	}
+	return fmt.Sprintf("%s%d%02d", Sign, Offset/time.Hour, Offset%time.Hour/time.Minute)
+}
+
+// parseTimezone reads <timezone>: hours from -12 to 14, or ±hhmm.
+func parseTimezone(Timezone string) (time.Duration, error) {
+	Value, err := strconv.Atoi(Timezone)
+	if err != nil {
+		return 0, err
+	}
+	if Value >= -12 && Value <= 14 {
+		return time.Duration(Value) * time.Hour, nil
+	}
+	Sign := time.Duration(1)
+	if Value < 0 {
+		Sign, Value = -1, -Value
+	}
+	if Value/100 > 14 || Value%100 > 59 {
+		return 0, fmt.Errorf("invalid timezone %s", Timezone)
+	}
+	return Sign * (time.Duration(Value/100)*time.Hour + time.Duration(Value%100)*time.Minute), nil
+}
+
+/*
+*
+* 设置 SNTP, 同步成功后模组上报 +TIME_UPDATED
+* AT+CIPSNTPCFG=<enable>,<timezone>[,<"SNTP server1">,<"SNTP server2">,<"SNTP server3">]
+*
+ */
+func SetSNTP(ctx context.Context, Esp32 device.Device, config SNTPConfig) (bool, error) {
+	if err := NewSNTPConfig(config); err != nil {
+		return false, err
+	}
+	cmd := fmt.Sprintf("AT+CIPSNTPCFG=%d,%s", btoi(config.Enable), timezone(config.UTCOffset))
+	for _, Server := range config.Servers {
+		cmd += "," + device.Quote(Server)
+	}
+	ATResponse, err := Esp32.ATContext(ctx, cmd+"\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetSNTP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CIPSNTPCFG:<enable>,<timezone>,<SNTP server1>[,<SNTP server2>,<SNTP server3>]
+OK
+*
+*/
+func GetSNTP(ctx context.Context, Esp32 device.Device) (SNTPConfig, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPSNTPCFG?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return SNTPConfig{}, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return SNTPConfig{}, fmt.Errorf("request GetSNTP error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(strings.TrimPrefix(ATResponse.Data[0], "+CIPSNTPCFG:"))
+	if len(Fields) < 2 {
+		return SNTPConfig{}, fmt.Errorf("request GetSNTP error:%v", ATResponse.Data)
+	}
+	Offset, err := parseTimezone(Fields[1])
+	if err != nil {
+		return SNTPConfig{}, fmt.Errorf("request GetSNTP error:%v", ATResponse.Data)
+	}
+	return SNTPConfig{Enable: Fields[0] == "1", UTCOffset: Offset, Servers: Fields[2:]}, nil
+}
+
+/*
+*
+* SNTP 同步间隔, 15s 到 4294967s
+* AT+CIPSNTPINTV=<interval second>
+*
+ */
+func SetSNTPInterval(ctx context.Context, Esp32 device.Device, Interval time.Duration) (bool, error) {
+	if Interval < 15*time.Second || Interval > 4294967*time.Second {
+		return false, errors.New("interval must be between 15s and 4294967s")
+	}
+	cmd := fmt.Sprintf("AT+CIPSNTPINTV=%d\r\n", int64(Interval/time.Second))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetSNTPInterval error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+func GetSNTPInterval(ctx context.Context, Esp32 device.Device) (time.Duration, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPSNTPINTV?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return 0, fmt.Errorf("request GetSNTPInterval error:%v", ATResponse.Data)
+	}
+	Seconds, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+CIPSNTPINTV:"))
+	if err != nil {
+		return 0, fmt.Errorf("request GetSNTPInterval error:%v", ATResponse.Data)
+	}
+	return time.Duration(Seconds) * time.Second, nil
+}
+
+/*
+*
+* 读取模组时间, 时区取自 AT+CIPSNTPCFG?, 还没有同步时返回 ErrTimeNotSynced
+* +CIPSNTPTIME:Thu Aug 04 14:48:05 2016
+*
+ */
+func GetSNTPTime(ctx context.Context, Esp32 device.Device) (time.Time, error) {
+	config, err := GetSNTP(ctx, Esp32)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPSNTPTIME?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return time.Time{}, fmt.Errorf("request GetSNTPTime error:%v", ATResponse.Data)
+	}
+	// asctime pads the day with a space or a zero depending on the firmware.
+	Text := strings.Join(strings.Fields(strings.TrimPrefix(ATResponse.Data[0], "+CIPSNTPTIME:")), " ")
+	Zone := time.FixedZone("", int(config.UTCOffset/time.Second))
+	Time, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", Text, Zone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("request GetSNTPTime error:%v", ATResponse.Data)
+	}
+	if Time.Year() < 2000 {
+		return Time, ErrTimeNotSynced
+	}
+	return Time, nil
+}
+
+/*
+*
+* SyncTime 启用 SNTP, 等待 +TIME_UPDATED 后返回模组时间
+*
+ */
+func SyncTime(ctx context.Context, Esp32 device.Device, config SNTPConfig) (time.Time, error) {
+	config.Enable = true
+	Events := Esp32.Subscribe(TimeUpdated)
+	defer Esp32.Unsubscribe(Events)
+	if ok, err := SetSNTP(ctx, Esp32, config); !ok {
+		return time.Time{}, err
+	}
+	select {
+	case _, ok := <-Events:
+		if !ok {
+			return time.Time{}, device.ErrClosed
+		}
+	case <-ctx.Done():
+		return time.Time{}, context.Cause(ctx)
+	}
+	return GetSNTPTime(ctx, Esp32)
+}
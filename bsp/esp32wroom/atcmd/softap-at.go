@@ -0,0 +1,399 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+/*
+*
+* 开启 SoftAP, 已经是 Station 模式时切换到 Station+SoftAP, 不影响 Station 连接。
+* 读取和修改 AT+CWMODE 之间持有 SetWifiMode 的锁, 不会覆盖其他协程的修改。
+*
+ */
+func EnableSoftAP(ctx context.Context, Esp32 device.Device) (bool, error) {
+	Lock := wifiModeLock(Esp32)
+	Lock.Lock()
+	defer Lock.Unlock()
+	Mode, err := GetWifiMode(ctx, Esp32)
+	if err != nil {
+		return false, err
+	}
+	switch Mode {
+	case WifiModeNull:
+		return setWifiMode(ctx, Esp32, WifiModeSoftAP)
+	case WifiModeStation:
+		return setWifiMode(ctx, Esp32, WifiModeStationSoftAP)
+	}
+	return true, nil
+}
+
+/*
+*
+* 关闭 SoftAP, Station 模式保持不变
+*
+ */
+func DisableSoftAP(ctx context.Context, Esp32 device.Device) (bool, error) {
+	Lock := wifiModeLock(Esp32)
+	Lock.Lock()
+	defer Lock.Unlock()
+	Mode, err := GetWifiMode(ctx, Esp32)
+	if err != nil {
+		return false, err
+	}
+	switch Mode {
+	case WifiModeSoftAP:
+		return setWifiMode(ctx, Esp32, WifiModeNull)
+	case WifiModeStationSoftAP:
+		return setWifiMode(ctx, Esp32, WifiModeStation)
+	}
+	return true, nil
+}
+
+/*
+配置 SoftAP
+AT+CWSAP=
+<ssid>,
+<pwd>,
+<chl>,
+<ecn>
+[,<max conn>]
+[,<ssid hidden>]
+*/
+type SoftAPConfig struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+	Channel  int    `json:"channel"`
+	// Encryption is one of Open, WPA_PSK, WPA2_PSK and WPA_WPA2_PSK.
+	Encryption Encryption `json:"encryption"`
+	// MaxConnections between 1 and 10, 0 keeps the firmware default (10).
+	MaxConnections int  `json:"maxConnections"`
+	Hidden         bool `json:"hidden"`
+}
+
+func (O SoftAPConfig) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func NewSoftAPConfig(config SoftAPConfig) error {
+	if len(config.SSID) < 1 || len(config.SSID) > 32 {
+		return errors.New("ssid must be 1 to 32 bytes")
+	}
+	switch config.Encryption {
+	case EncryptionOpen:
+	case EncryptionWPAPSK, EncryptionWPA2PSK, EncryptionWPAWPA2PSK:
+		if len(config.Password) < 8 || len(config.Password) > 64 {
+			return errors.New("password must be 8 to 64 bytes")
+		}
+	default:
+		return errors.New("encryption must be one of Open, WPA_PSK, WPA2_PSK, WPA_WPA2_PSK")
+	}
+	if config.Channel < 1 || config.Channel > 13 {
+		return errors.New("channel must be between 1 and 13")
+	}
+	if config.MaxConnections < 0 || config.MaxConnections > 10 {
+		return errors.New("max connections must be between 1 and 10")
+	}
+	return nil
+}
+
+// SetSoftAP enables the SoftAP interface if needed and configures it.
+func SetSoftAP(ctx context.Context, Esp32 device.Device, config SoftAPConfig) (bool, error) {
+	if err := NewSoftAPConfig(config); err != nil {
+		return false, err
+	}
+	if ok, err := EnableSoftAP(ctx, Esp32); !ok {
+		return false, err
+	}
+	MaxConnections := config.MaxConnections
+	if MaxConnections == 0 {
+		MaxConnections = 10
+	}
+	cmd := fmt.Sprintf("AT+CWSAP=%s,%s,%d,%d,%d,%d\r\n", device.Quote(config.SSID), device.Quote(config.Password),
+		config.Channel, config.Encryption, MaxConnections, btoi(config.Hidden))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetSoftAP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CWSAP:<ssid>,<pwd>,<channel>,<ecn>,<max conn>,<ssid hidden>
+OK
+*
+*/
+func GetSoftAP(ctx context.Context, Esp32 device.Device) (SoftAPConfig, error) {
+	SoftAPConfig := SoftAPConfig{}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWSAP?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return SoftAPConfig, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return SoftAPConfig, fmt.Errorf("request GetSoftAP error:%v", ATResponse.Data)
+	}
+	Line, ok := strings.CutPrefix(ATResponse.Data[0], "+CWSAP:")
+	Fields := device.SplitFields(Line)
+	if !ok || len(Fields) < 6 {
+		return SoftAPConfig, fmt.Errorf("request GetSoftAP error:%v", ATResponse.Data)
+	}
+	Numbers := make([]int, 6)
+	for i := 2; i < 6; i++ {
+		if Numbers[i], err = strconv.Atoi(Fields[i]); err != nil {
+			return SoftAPConfig, fmt.Errorf("request GetSoftAP error:%v", ATResponse.Data)
+		}
+	}
+	SoftAPConfig.SSID = Fields[0]
+	SoftAPConfig.Password = Fields[1]
+	SoftAPConfig.Channel = Numbers[2]
+	SoftAPConfig.Encryption = Encryption(Numbers[3])
+	SoftAPConfig.MaxConnections = Numbers[4]
+	SoftAPConfig.Hidden = Numbers[5] == 1
+	return SoftAPConfig, nil
+}
+
+/*
+*
++CWLIF:<ip addr>,<mac>
+OK
+*
+*/
+type Station struct {
+	IP  net.IP           `json:"ip"`
+	MAC net.HardwareAddr `json:"mac"`
+}
+
+func (O Station) String() string {
+	if bytes, err := json.Marshal(map[string]string{
+		"ip": O.IP.String(), "mac": O.MAC.String(),
+	}); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+// ListStations returns the stations connected to the SoftAP.
+func ListStations(ctx context.Context, Esp32 device.Device) ([]Station, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWLIF\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) < 1 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return nil, fmt.Errorf("request ListStations error:%v", ATResponse.Data)
+	}
+	Stations := []Station{}
+	for _, Line := range ATResponse.Data[:len(ATResponse.Data)-1] {
+		Line, ok := strings.CutPrefix(Line, "+CWLIF:")
+		if !ok {
+			continue
+		}
+		Fields := device.SplitFields(Line)
+		if len(Fields) != 2 {
+			return nil, fmt.Errorf("request ListStations error:%v", ATResponse.Data)
+		}
+		IP := net.ParseIP(Fields[0])
+		MAC, err := net.ParseMAC(Fields[1])
+		if IP == nil || err != nil {
+			return nil, fmt.Errorf("request ListStations error:%v", ATResponse.Data)
+		}
+		Stations = append(Stations, Station{IP: IP, MAC: MAC})
+	}
+	return Stations, nil
+}
+
+/*
+*
+断开连接到 SoftAP 的 Station, MAC 为 nil 时断开所有 Station
+AT+CWQIF[=<mac>]
+*
+*/
+func KickStation(ctx context.Context, Esp32 device.Device, MAC net.HardwareAddr) (bool, error) {
+	cmd := "AT+CWQIF\r\n"
+	if MAC != nil {
+		cmd = fmt.Sprintf("AT+CWQIF=%s\r\n", device.Quote(MAC.String()))
+	}
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request KickStation error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
+* DHCP 开关, 按位表示: bit0 Station, bit1 SoftAP
+* AT+CWDHCP=<operate>,<mode>
+*
+ */
+type DHCPMode int
+
+const (
+	DHCPStation DHCPMode = 1 << iota
+	DHCPSoftAP
+)
+
+func SetDHCP(ctx context.Context, Esp32 device.Device, Enable bool, Mode DHCPMode) (bool, error) {
+	if Mode < 1 || Mode > DHCPStation|DHCPSoftAP {
+		return false, errors.New("mode must be DHCPStation, DHCPSoftAP or both")
+	}
+	cmd := fmt.Sprintf("AT+CWDHCP=%d,%d\r\n", btoi(Enable), Mode)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetDHCP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CWDHCP:<state>
+OK
+*
+*/
+func GetDHCP(ctx context.Context, Esp32 device.Device) (DHCPMode, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWDHCP?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return 0, fmt.Errorf("request GetDHCP error:%v", ATResponse.Data)
+	}
+	State, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+CWDHCP:"))
+	if err != nil {
+		return 0, fmt.Errorf("request GetDHCP error:%v", ATResponse.Data)
+	}
+	return DHCPMode(State) & (DHCPStation | DHCPSoftAP), nil
+}
+
+/*
+SoftAP 分配的 IP 地址池
+AT+CWDHCPS=
+<enable>,
+<lease time>,
+<start IP>,
+<end IP>
+*/
+type DHCPPool struct {
+	// LeaseTime between 1 and 2880 minutes.
+	LeaseTime time.Duration `json:"leaseTime"`
+	Start     net.IP        `json:"start"`
+	End       net.IP        `json:"end"`
+}
+
+func (O DHCPPool) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func NewDHCPPool(Pool DHCPPool) error {
+	if Pool.LeaseTime < time.Minute || Pool.LeaseTime > 2880*time.Minute {
+		return errors.New("lease time must be between 1 and 2880 minutes")
+	}
+	Start, End := Pool.Start.To4(), Pool.End.To4()
+	if Start == nil || End == nil {
+		return errors.New("start and end must be IPv4 addresses")
+	}
+	if !Start.Mask(net.CIDRMask(24, 32)).Equal(End.Mask(net.CIDRMask(24, 32))) || Start[3] > End[3] {
+		return errors.New("start and end must be in the same /24 and in order")
+	}
+	return nil
+}
+
+func SetDHCPPool(ctx context.Context, Esp32 device.Device, Pool DHCPPool) (bool, error) {
+	if err := NewDHCPPool(Pool); err != nil {
+		return false, err
+	}
+	cmd := fmt.Sprintf("AT+CWDHCPS=1,%d,%s,%s\r\n", int(Pool.LeaseTime/time.Minute),
+		device.Quote(Pool.Start.String()), device.Quote(Pool.End.String()))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetDHCPPool error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+// ResetDHCPPool restores the default address pool.
+func ResetDHCPPool(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWDHCPS=0\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request ResetDHCPPool error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CWDHCPS:<lease time>,<start IP>,<end IP>
+OK
+*
+*/
+func GetDHCPPool(ctx context.Context, Esp32 device.Device) (DHCPPool, error) {
+	DHCPPool := DHCPPool{}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWDHCPS?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return DHCPPool, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return DHCPPool, fmt.Errorf("request GetDHCPPool error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(strings.TrimPrefix(ATResponse.Data[0], "+CWDHCPS:"))
+	if len(Fields) != 3 {
+		return DHCPPool, fmt.Errorf("request GetDHCPPool error:%v", ATResponse.Data)
+	}
+	Lease, err := strconv.Atoi(Fields[0])
+	Start, End := net.ParseIP(Fields[1]), net.ParseIP(Fields[2])
+	if err != nil || Start == nil || End == nil {
+		return DHCPPool, fmt.Errorf("request GetDHCPPool error:%v", ATResponse.Data)
+	}
+	DHCPPool.LeaseTime = time.Duration(Lease) * time.Minute
+	DHCPPool.Start = Start
+	DHCPPool.End = End
+	return DHCPPool, nil
+}
@@ -0,0 +1,290 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// FlashSector is the erase unit of the SPI flash, AT+SYSFLASH erases
+// whole sectors only.
+const FlashSector = 4096
+
+// AT+SYSFLASH reads and writes at most maxFlashChunk bytes at once.
+const maxFlashChunk = 2048
+
+// AT+SYSFLASH=<operation>
+const (
+	flashErase = 0
+	flashWrite = 1
+	flashRead  = 2
+)
+
+/*
+*
+* Partition: AT+SYSFLASH? 列出的用户分区
+* +SYSFLASH:<"partition">,<type>,<subtype>,<addr>,<size>
+*
+ */
+type Partition struct {
+	Name    string `json:"name"`
+	Type    int    `json:"type"`
+	SubType int    `json:"subType"`
+	Address int64  `json:"address"`
+	Size    int64  `json:"size"`
+}
+
+func (O Partition) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+/*
+*
+* 列出用户分区
+* AT+SYSFLASH?
+*
+ */
+func Partitions(ctx context.Context, Esp32 device.Device) ([]Partition, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+SYSFLASH?\r\n", device.WithTimeout(2*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return nil, fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	Partitions := []Partition{}
+	for _, Line := range ATResponse.Data[:len(ATResponse.Data)-1] {
+		Rest, ok := strings.CutPrefix(Line, "+SYSFLASH:")
+		if !ok {
+			continue
+		}
+		Fields := device.SplitFields(Rest)
+		if len(Fields) != 5 {
+			return nil, fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+		}
+		P := Partition{Name: Fields[0]}
+		P.Type, err = strconv.Atoi(Fields[1])
+		if err == nil {
+			P.SubType, err = strconv.Atoi(Fields[2])
+		}
+		if err == nil {
+			P.Address, err = strconv.ParseInt(Fields[3], 0, 64)
+		}
+		if err == nil {
+			P.Size, err = strconv.ParseInt(Fields[4], 0, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+		}
+		Partitions = append(Partitions, P)
+	}
+	return Partitions, nil
+}
+
+/*
+*
+* FlashPartition: 一个用户分区, 实现 io.ReaderAt 和 io.WriterAt, 配合
+* io.NewSectionReader/io.NewOffsetWriter 可以备份和恢复整个分区。
+* WriteAt 按扇区先读出原内容, 擦除后写回合并的数据, 内容没变的扇区跳过。
+* io.ReaderAt 没有 ctx, 每条指令单独超时。
+*
+ */
+type FlashPartition struct {
+	Partition
+	Esp32 device.Device
+	// Timeout of one AT+SYSFLASH command, 0 means 5s.
+	Timeout time.Duration
+	// Progress is called after each chunk of ReadAt and each sector of
+	// WriteAt with the bytes done so far and the total of the call.
+	Progress func(Done, Total int64)
+}
+
+// OpenPartition finds a partition by name in AT+SYSFLASH?.
+func OpenPartition(ctx context.Context, Esp32 device.Device, Name string) (*FlashPartition, error) {
+	Partitions, err := Partitions(ctx, Esp32)
+	if err != nil {
+		return nil, err
+	}
+	for _, P := range Partitions {
+		if P.Name == Name {
+			return &FlashPartition{Partition: P, Esp32: Esp32}, nil
+		}
+	}
+	return nil, fmt.Errorf("partition %s not found", Name)
+}
+
+func (P *FlashPartition) at(cmd string, opts ...device.ATOption) (device.ATResponse, error) {
+	Timeout := P.Timeout
+	if Timeout <= 0 {
+		Timeout = 5 * time.Second
+	}
+	return P.Esp32.ATContext(context.Background(), cmd, append(opts, device.WithTimeout(Timeout))...)
+}
+
+// check keeps an access inside the partition.
+func (P *FlashPartition) check(Op string, Offset int64, Length int) error {
+	if Offset < 0 || Offset+int64(Length) > P.Size {
+		return fmt.Errorf("partition %s: %s of %d bytes at 0x%x is out of range", P.Name, Op, Length, Offset)
+	}
+	return nil
+}
+
+func (P *FlashPartition) progress(Done, Total int64) {
+	if P.Progress != nil {
+		P.Progress(Done, Total)
+	}
+}
+
+/*
+*
++SYSFLASH:<length>,<data>
+OK
+*
+*/
+func (P *FlashPartition) read(Offset int64, Length int) ([]byte, error) {
+	cmd := fmt.Sprintf("AT+SYSFLASH=%d,%s,%d,%d\r\n", flashRead, device.Quote(P.Name), Offset, Length)
+	ATResponse, err := P.at(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return nil, fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	Size, Data, ok := strings.Cut(strings.TrimPrefix(ATResponse.Data[0], "+SYSFLASH:"), ",")
+	if N, err := strconv.Atoi(Size); !ok || err != nil || N != Length || len(Data) != Length {
+		return nil, fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	return []byte(Data), nil
+}
+
+// write needs the area erased, the flash only clears bits.
+func (P *FlashPartition) write(Offset int64, Data []byte) error {
+	cmd := fmt.Sprintf("AT+SYSFLASH=%d,%s,%d,%d\r\n", flashWrite, device.Quote(P.Name), Offset, len(Data))
+	ATResponse, err := P.at(cmd, device.WithPayload(Data))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+func (P *FlashPartition) erase(Offset int64, Length int) error {
+	cmd := fmt.Sprintf("AT+SYSFLASH=%d,%s,%d,%d\r\n", flashErase, device.Quote(P.Name), Offset, Length)
+	ATResponse, err := P.at(cmd, device.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+func (P *FlashPartition) ReadAt(b []byte, Offset int64) (int, error) {
+	if err := P.check("read", Offset, len(b)); err != nil {
+		return 0, err
+	}
+	return P.fill(b, Offset, func(N int) { P.progress(int64(N), int64(len(b))) })
+}
+
+// fill reads b in pieces of maxFlashChunk, Done sees the bytes read so far.
+func (P *FlashPartition) fill(b []byte, Offset int64, Done func(N int)) (int, error) {
+	N := 0
+	for N < len(b) {
+		Chunk, err := P.read(Offset+int64(N), min(len(b)-N, maxFlashChunk))
+		if err != nil {
+			return N, err
+		}
+		N += copy(b[N:], Chunk)
+		if Done != nil {
+			Done(N)
+		}
+	}
+	return N, nil
+}
+
+func (P *FlashPartition) WriteAt(b []byte, Offset int64) (int, error) {
+	if err := P.check("write", Offset, len(b)); err != nil {
+		return 0, err
+	}
+	N := 0
+	for N < len(b) {
+		At := Offset + int64(N)
+		Start := At - At%FlashSector
+		Length := int(min(FlashSector, P.Size-Start))
+		Sector := make([]byte, Length)
+		if _, err := P.fill(Sector, Start, nil); err != nil {
+			return N, err
+		}
+		Old := bytes.Clone(Sector)
+		Done := copy(Sector[At-Start:], b[N:])
+		if !bytes.Equal(Old, Sector) {
+			if err := P.rewrite(Start, Sector); err != nil {
+				return N, err
+			}
+		}
+		N += Done
+		P.progress(int64(N), int64(len(b)))
+	}
+	return N, nil
+}
+
+// rewrite erases a sector and writes it back, bytes left at 0xFF need no
+// write.
+func (P *FlashPartition) rewrite(Start int64, Sector []byte) error {
+	if err := P.erase(Start, FlashSector); err != nil {
+		return err
+	}
+	End := len(bytes.TrimRight(Sector, "\xff"))
+	for i := 0; i < End; i += maxFlashChunk {
+		if err := P.write(Start+int64(i), Sector[i:min(i+maxFlashChunk, End)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+*
+* 擦除整个分区, 之后每个字节都是 0xFF
+* AT+SYSFLASH=0,<"partition">
+*
+ */
+func (P *FlashPartition) Erase(ctx context.Context) error {
+	cmd := fmt.Sprintf("AT+SYSFLASH=%d,%s\r\n", flashErase, device.Quote(P.Name))
+	ATResponse, err := P.Esp32.ATContext(ctx, cmd, device.WithTimeout(30*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return fmt.Errorf("request SYSFLASH error:%v", ATResponse.Data)
+	}
+	return nil
+}
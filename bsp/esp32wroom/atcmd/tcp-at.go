@@ -13,4 +13,392 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package atcmd
\ No newline at end of file
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// maxSend is the size of one AT+CIPSEND, the firmware takes up to 8192.
+const maxSend = 2048
+
+// maxRecv is the size of one AT+CIPRECVDATA, it bounds the bursts on the
+// UART in passive receive mode.
+const maxRecv = 2048
+
+/*
+*
+* tcpConn: 模组上一个 TCP 连接, 实现 net.Conn
+*
+ */
+type tcpConn struct {
+	stack  *netStack
+	id     int
+	net    string
+	local  net.Addr
+	remote net.Addr
+	wake   chan struct{}
+	gone   chan struct{}
+	// one Write at a time, so that chunks of two writes do not interleave
+	writing sync.Mutex
+
+	lock          sync.Mutex
+	rx            []byte
+	pending       int
+	eof           bool
+	shut          bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newTCPConn(S *netStack, Network string) *tcpConn {
+	return &tcpConn{stack: S, net: Network, wake: make(chan struct{}, 1), gone: make(chan struct{})}
+}
+
+func (C *tcpConn) receive(Data []byte, From *net.UDPAddr) {
+	C.lock.Lock()
+	C.rx = append(C.rx, Data...)
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+func (C *tcpConn) available(Size int) {
+	C.lock.Lock()
+	C.pending = Size
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+func (C *tcpConn) closed() {
+	C.lock.Lock()
+	if !C.eof {
+		C.eof = true
+		close(C.gone)
+	}
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+func (C *tcpConn) opError(Op string, err error) error {
+	return &net.OpError{Op: Op, Net: C.net, Source: C.local, Addr: C.remote, Err: err}
+}
+
+// Read returns io.EOF once the data received before <link ID>,CLOSED is read.
+// In passive receive mode the data is pulled from the module as it is read.
+func (C *tcpConn) Read(b []byte) (int, error) {
+	for {
+		C.lock.Lock()
+		if C.shut {
+			C.lock.Unlock()
+			return 0, C.opError("read", net.ErrClosed)
+		}
+		if len(C.rx) > 0 || len(b) == 0 {
+			N := copy(b, C.rx)
+			C.rx = C.rx[N:]
+			C.lock.Unlock()
+			return N, nil
+		}
+		if C.eof {
+			C.lock.Unlock()
+			return 0, io.EOF
+		}
+		Deadline, Pending := C.readDeadline, C.pending
+		C.lock.Unlock()
+		if Pending > 0 {
+			N, err := C.pull(b, Deadline)
+			if N > 0 || err != nil {
+				return N, err
+			}
+			continue
+		}
+		if err := wait(C.wake, Deadline); err != nil {
+			return 0, C.opError("read", err)
+		}
+	}
+}
+
+// pull reads buffered data with AT+CIPRECVDATA=<link ID>,<len>
+func (C *tcpConn) pull(b []byte, Deadline time.Time) (int, error) {
+	ctx, Cancel := deadlineContext(Deadline)
+	defer Cancel()
+	Size := min(len(b), maxRecv)
+	ATResponse, err := C.stack.Esp32.ATContext(ctx, fmt.Sprintf("AT+CIPRECVDATA=%d,%d\r\n", C.id, Size),
+		device.WithTimeout(5*time.Second))
+	if errors.Is(err, device.ErrCommand) {
+		// Nothing left in the module, e.g. a stale +IPD.
+		C.lock.Lock()
+		C.pending = 0
+		C.lock.Unlock()
+		return 0, nil
+	}
+	if err != nil {
+		return 0, C.opError("read", err)
+	}
+	data, err := recvData(ATResponse.Data)
+	if err != nil {
+		return 0, C.opError("read", err)
+	}
+	if len(data) > Size {
+		return 0, C.opError("read", fmt.Errorf("request CIPRECVDATA error:%d bytes for %d", len(data), Size))
+	}
+	C.lock.Lock()
+	C.pending = max(C.pending-len(data), 0)
+	C.lock.Unlock()
+	return copy(b, data), nil
+}
+
+/*
+*
++CIPRECVDATA:<actual len>,<"remote IP">,<remote port>,<data>
+OK
+*
+*/
+func recvData(Lines []string) ([]byte, error) {
+	for _, Line := range Lines {
+		Rest, ok := strings.CutPrefix(Line, "+CIPRECVDATA:")
+		if !ok {
+			continue
+		}
+		Length, _, _ := strings.Cut(Rest, ",")
+		Size, err := strconv.Atoi(Length)
+		if err != nil || Size > len(Rest) {
+			break
+		}
+		return []byte(Rest[len(Rest)-Size:]), nil
+	}
+	return nil, fmt.Errorf("request CIPRECVDATA error:%v", Lines)
+}
+
+func (C *tcpConn) Write(b []byte) (int, error) {
+	C.writing.Lock()
+	defer C.writing.Unlock()
+	Sent := 0
+	for Sent < len(b) {
+		C.lock.Lock()
+		Shut, EOF, Deadline := C.shut, C.eof, C.writeDeadline
+		C.lock.Unlock()
+		if Shut {
+			return Sent, C.opError("write", net.ErrClosed)
+		}
+		if EOF {
+			return Sent, C.opError("write", io.ErrClosedPipe)
+		}
+		Chunk := b[Sent:min(Sent+maxSend, len(b))]
+		ctx, Cancel := deadlineContext(Deadline)
+		_, err := C.stack.Esp32.ATContext(ctx, fmt.Sprintf("AT+CIPSEND=%d,%d\r\n", C.id, len(Chunk)),
+			device.WithPayload(Chunk), device.WithTimeout(10*time.Second))
+		Cancel()
+		if err != nil {
+			return Sent, C.opError("write", err)
+		}
+		Sent += len(Chunk)
+	}
+	return Sent, nil
+}
+
+// Close sends AT+CIPCLOSE and waits for <link ID>,CLOSED, after which the
+// link ID can be used again.
+func (C *tcpConn) Close() error {
+	C.lock.Lock()
+	if C.shut {
+		C.lock.Unlock()
+		return C.opError("close", net.ErrClosed)
+	}
+	C.shut = true
+	EOF := C.eof
+	C.lock.Unlock()
+	notify(C.wake)
+	if EOF {
+		return nil
+	}
+	if err := C.stack.close(C.id, C, C.gone); err != nil {
+		return C.opError("close", err)
+	}
+	return nil
+}
+
+func (C *tcpConn) LocalAddr() net.Addr {
+	return C.local
+}
+
+func (C *tcpConn) RemoteAddr() net.Addr {
+	return C.remote
+}
+
+func (C *tcpConn) SetDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.readDeadline, C.writeDeadline = t, t
+	C.lock.Unlock()
+	notify(C.wake)
+	return nil
+}
+
+func (C *tcpConn) SetReadDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.readDeadline = t
+	C.lock.Unlock()
+	notify(C.wake)
+	return nil
+}
+
+func (C *tcpConn) SetWriteDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.writeDeadline = t
+	C.lock.Unlock()
+	return nil
+}
+
+// addrs fills in the addresses from AT+CIPSTATE?, the module knows the
+// resolved remote IP and the local port.
+func (C *tcpConn) addrs(ctx context.Context, Host string, Port int) {
+	C.remote = &net.TCPAddr{IP: net.ParseIP(Host), Port: Port}
+	C.local = &net.TCPAddr{}
+	if State, ok := stateOf(ctx, C.stack.Esp32, C.id); ok {
+		C.remote = &net.TCPAddr{IP: State.RemoteIP, Port: State.RemotePort}
+		C.local = &net.TCPAddr{Port: State.LocalPort}
+	}
+}
+
+/*
+*
+* Dial 通过模组建立 TCP 连接, 返回的 net.Conn 可以直接给 Modbus-TCP、HTTP
+* 等客户端使用, 最多同时 5 个连接:
+* AT+CIPSTART=<link ID>,<"TCP">,<"remote host">,<remote port>
+*
+ */
+func Dial(ctx context.Context, Esp32 device.Device, network, address string) (net.Conn, error) {
+	Type := map[string]string{"tcp": "TCP", "tcp4": "TCP", "tcp6": "TCPv6"}[network]
+	return dial(ctx, Esp32, network, address, Type, nil, nil)
+}
+
+// dial opens a TCP or SSL link, setup configures the reserved link ID
+// before AT+CIPSTART. Link IDs that prefer accepts are taken first.
+func dial(ctx context.Context, Esp32 device.Device, network, address, Type string,
+	prefer func(S *netStack, id int) bool, setup func(S *netStack, id int, Host string) error) (net.Conn, error) {
+	if Type == "" {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	Host, Service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	Port, err := strconv.Atoi(Service)
+	if err != nil || Port < 1 || Port > 65535 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "invalid port", Addr: address}}
+	}
+	S, err := openStack(ctx, Esp32)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	C := newTCPConn(S, network)
+	var Prefer func(id int) bool
+	if prefer != nil {
+		Prefer = func(id int) bool { return prefer(S, id) }
+	}
+	if C.id, err = S.reserveFor(C, Prefer); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if setup != nil {
+		if err := setup(S, C.id, Host); err != nil {
+			S.release(C.id, C)
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+	}
+	cmd := fmt.Sprintf("AT+CIPSTART=%d,%s,%s,%d\r\n", C.id, device.Quote(Type), device.Quote(Host), Port)
+	if _, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(20*time.Second)); err != nil {
+		S.abandon(C.id, C, C.gone, err)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	C.addrs(ctx, Host, Port)
+	return C, nil
+}
+
+// 接收模式: 主动模式收到数据立即通过 +IPD 上报, 被动模式数据留在模组里
+type RecvMode int
+
+const (
+	RecvActive  RecvMode = 0
+	RecvPassive RecvMode = 1
+)
+
+/*
+*
+* 设置 TCP 接收模式, 被动模式下模组只上报 +IPD,<link ID>,<len>, 连接的 Read
+* 按需用 AT+CIPRECVDATA 读取, 模组的缓冲区满后不再接收, 对端会被 TCP 流控:
+* AT+CIPRECVMODE=<mode>
+*
+ */
+func SetRecvMode(ctx context.Context, Esp32 device.Device, Mode RecvMode) (bool, error) {
+	if Mode != RecvActive && Mode != RecvPassive {
+		return false, fmt.Errorf("invalid recv mode %d", Mode)
+	}
+	S, err := openStack(ctx, Esp32)
+	if err != nil {
+		return false, err
+	}
+	ATResponse, err := Esp32.ATContext(ctx, fmt.Sprintf("AT+CIPRECVMODE=%d\r\n", Mode),
+		device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetRecvMode error:%v", ATResponse.Data)
+	}
+	S.lock.Lock()
+	S.passive = Mode == RecvPassive
+	S.lock.Unlock()
+	return true, nil
+}
+
+func GetRecvMode(ctx context.Context, Esp32 device.Device) (RecvMode, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPRECVMODE?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return RecvActive, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return RecvActive, fmt.Errorf("request GetRecvMode error:%v", ATResponse.Data)
+	}
+	Mode, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+CIPRECVMODE:"))
+	if err != nil {
+		return RecvActive, fmt.Errorf("request GetRecvMode error:%v", ATResponse.Data)
+	}
+	return RecvMode(Mode), nil
+}
+
+/*
+*
+* 被动模式下每个连接在模组里等待读取的字节数
+* +CIPRECVLEN:<len0>,<len1>,<len2>,<len3>,<len4>
+*
+ */
+func GetRecvLen(ctx context.Context, Esp32 device.Device) ([MaxLinks]int, error) {
+	Sizes := [MaxLinks]int{}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CIPRECVLEN?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return Sizes, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return Sizes, fmt.Errorf("request GetRecvLen error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(strings.TrimPrefix(ATResponse.Data[0], "+CIPRECVLEN:"))
+	if len(Fields) != MaxLinks {
+		return Sizes, fmt.Errorf("request GetRecvLen error:%v", ATResponse.Data)
+	}
+	for id, Field := range Fields {
+		// Links that are not connected may be reported as -1 or left empty.
+		if Size, err := strconv.Atoi(Field); err == nil && Size > 0 {
+			Sizes[id] = Size
+		}
+	}
+	return Sizes, nil
+}
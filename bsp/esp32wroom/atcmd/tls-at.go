@@ -0,0 +1,173 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// TLS 认证方式, AT+CIPSSLCCONF 的 <auth_mode>
+type TLSAuthMode int
+
+const (
+	TLSNoAuth     TLSAuthMode = 0 // 不验证证书
+	TLSClientCert TLSAuthMode = 1 // 提供客户端证书, 由服务器验证模组
+	TLSServerCert TLSAuthMode = 2 // 用 CA 验证服务器证书
+	TLSMutual     TLSAuthMode = 3 // 双向验证
+)
+
+/*
+*
+* TLS 连接参数
+* PKINumber: 客户端证书和私钥的序号 (client_cert.<n>/client_key.<n>)
+* CANumber: CA 的序号 (client_ca.<n>)
+* ServerName: SNI, 为空时使用域名, 地址是 IP 时不发送
+* ALPN: 最多 5 个协议
+* PSK/PSKHint: 预共享密钥身份和提示, 最长 32 字节
+*
+ */
+type TLSConfig struct {
+	AuthMode   TLSAuthMode `json:"authMode"`
+	PKINumber  int         `json:"pkiNumber"`
+	CANumber   int         `json:"caNumber"`
+	ServerName string      `json:"serverName"`
+	ALPN       []string    `json:"alpn"`
+	PSK        string      `json:"psk"`
+	PSKHint    string      `json:"pskHint"`
+}
+
+func NewTLSConfig(config TLSConfig) error {
+	if config.AuthMode < TLSNoAuth || config.AuthMode > TLSMutual {
+		return errors.New("authMode must be between 0 and 3")
+	}
+	if config.PKINumber < 0 || config.CANumber < 0 {
+		return errors.New("pkiNumber and caNumber must not be negative")
+	}
+	if len(config.ServerName) > 64 {
+		return errors.New("serverName must be at most 64 bytes")
+	}
+	if len(config.ALPN) > 5 {
+		return errors.New("at most 5 alpn protocols")
+	}
+	for _, Protocol := range config.ALPN {
+		if Protocol == "" || len(Protocol) > 64 {
+			return errors.New("alpn protocol must be 1 to 64 bytes")
+		}
+	}
+	if len(config.PSK) > 32 || len(config.PSKHint) > 32 {
+		return errors.New("psk and pskHint must be at most 32 bytes")
+	}
+	if config.PSK == "" && config.PSKHint != "" {
+		return errors.New("pskHint needs psk")
+	}
+	return nil
+}
+
+// sslSettings tells whether a link ID was given an SNI or a PSK.
+type sslSettings struct {
+	sni bool
+	psk bool
+}
+
+// serverName is the SNI of a connection to Host, none for an IP address.
+func (config TLSConfig) serverName(Host string) string {
+	if config.ServerName == "" && net.ParseIP(Host) == nil {
+		return Host
+	}
+	return config.ServerName
+}
+
+// clean reports whether the link ID carries no SNI or PSK that config would
+// have to clear, the caller holds S.lock.
+func (config TLSConfig) clean(S *netStack, id int, Host string) bool {
+	Old := S.ssl[id]
+	return (!Old.sni || config.serverName(Host) != "") && (!Old.psk || config.PSK != "")
+}
+
+// commands configures one link ID before AT+CIPSTART, ALPN is always sent
+// so that a link ID does not keep the protocols of an earlier connection.
+// SNI and PSK are only sent when set, or to clear what Old left on the link
+// ID with an empty value, which relies on the firmware accepting it.
+func (config TLSConfig) commands(id int, Host string, Old sslSettings) []string {
+	Commands := []string{fmt.Sprintf("AT+CIPSSLCCONF=%d,%d,%d,%d\r\n", id, config.AuthMode,
+		config.PKINumber, config.CANumber)}
+	if ServerName := config.serverName(Host); ServerName != "" || Old.sni {
+		Commands = append(Commands, fmt.Sprintf("AT+CIPSSLCSNI=%d,%s\r\n", id, device.Quote(ServerName)))
+	}
+	ALPN := fmt.Sprintf("AT+CIPSSLCALPN=%d,%d", id, len(config.ALPN))
+	for _, Protocol := range config.ALPN {
+		ALPN += "," + device.Quote(Protocol)
+	}
+	Commands = append(Commands, ALPN+"\r\n")
+	if config.PSK != "" || Old.psk {
+		Commands = append(Commands, fmt.Sprintf("AT+CIPSSLCPSK=%d,%s,%s\r\n", id, device.Quote(config.PSK),
+			device.Quote(config.PSKHint)))
+	}
+	return Commands
+}
+
+/*
+*
+* DialTLS 通过模组建立 TLS 连接, 证书验证由模组完成, 证书先用 SetClientPKI
+* 写入模组。SNI 和 PSK 只在设置了时发送, 模组关闭连接后仍然保留它们, 所以优先
+* 使用没有留下 SNI/PSK 的 link ID:
+* AT+CIPSSLCCONF=<link ID>,<auth_mode>,<pki_number>,<ca_number>
+* AT+CIPSSLCSNI=<link ID>,<"sni">
+* AT+CIPSSLCALPN=<link ID>,<counts>[,<"alpn">...]
+* AT+CIPSSLCPSK=<link ID>,<"psk">,<"hint">
+* AT+CIPSTART=<link ID>,"SSL",<"remote host">,<remote port>
+*
+ */
+func DialTLS(ctx context.Context, Esp32 device.Device, network, address string, config TLSConfig) (net.Conn, error) {
+	if err := NewTLSConfig(config); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	Type := map[string]string{"tcp": "SSL", "tcp4": "SSL", "tcp6": "SSLv6"}[network]
+	Host, _, _ := net.SplitHostPort(address)
+	// A link ID without an SNI or PSK to clear needs no empty values.
+	Prefer := func(S *netStack, id int) bool {
+		return config.clean(S, id, Host)
+	}
+	return dial(ctx, Esp32, network, address, Type, Prefer, func(S *netStack, id int, Host string) error {
+		S.lock.Lock()
+		Old := S.ssl[id]
+		New := sslSettings{sni: config.serverName(Host) != "", psk: config.PSK != ""}
+		// Until every command went through the link ID may carry both.
+		S.ssl[id] = sslSettings{sni: Old.sni || New.sni, psk: Old.psk || New.psk}
+		S.lock.Unlock()
+		for _, cmd := range config.commands(id, Host, Old) {
+			ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+			if err != nil {
+				return err
+			}
+			if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+				Name, _, _ := strings.Cut(cmd[3:], "=")
+				return fmt.Errorf("request %s error:%v", Name, ATResponse.Data)
+			}
+		}
+		S.lock.Lock()
+		S.ssl[id] = New
+		S.lock.Unlock()
+		return nil
+	})
+}
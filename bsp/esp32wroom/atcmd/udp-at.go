@@ -14,3 +14,335 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// UDP 的 <mode>: 对端地址是否随收到的报文变化
+type UDPMode int
+
+const (
+	UDPFixedPeer UDPMode = 0 // 对端地址固定
+	UDPFirstPeer UDPMode = 1 // 第一次收到报文后改为发送方地址
+	UDPAnyPeer   UDPMode = 2 // 每次收到报文后都改为发送方地址
+)
+
+// maxDatagram is the largest AT+CIPSEND the firmware takes.
+const maxDatagram = 8192
+
+// maxQueued datagrams wait for ReadFrom, further ones are dropped.
+const maxQueued = 64
+
+// ErrDatagramTooLong: 报文超过 AT+CIPSEND 的 8192 字节上限
+var ErrDatagramTooLong = errors.New("datagram too long")
+
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+/*
+*
+* udpConn: 模组上一个 UDP 连接, 实现 net.PacketConn, 由 DialUDP 建立时
+* 也实现 net.Conn
+*
+ */
+type udpConn struct {
+	stack  *netStack
+	id     int
+	net    string
+	local  *net.UDPAddr
+	remote *net.UDPAddr
+	wake   chan struct{}
+	gone   chan struct{}
+
+	lock          sync.Mutex
+	rx            []datagram
+	eof           bool
+	shut          bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUDPConn(S *netStack, Network string) *udpConn {
+	return &udpConn{stack: S, net: Network, wake: make(chan struct{}, 1), gone: make(chan struct{})}
+}
+
+func (C *udpConn) receive(Data []byte, From *net.UDPAddr) {
+	C.lock.Lock()
+	if len(C.rx) < maxQueued {
+		C.rx = append(C.rx, datagram{data: Data, from: From})
+	}
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+func (C *udpConn) closed() {
+	C.lock.Lock()
+	if !C.eof {
+		C.eof = true
+		close(C.gone)
+	}
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+func (C *udpConn) opError(Op string, Addr net.Addr, err error) error {
+	if Addr == nil && C.remote != nil {
+		Addr = C.remote
+	}
+	return &net.OpError{Op: Op, Net: C.net, Source: C.local, Addr: Addr, Err: err}
+}
+
+// ReadFrom returns one datagram, the rest of it is dropped when b is too
+// short. The sender is nil if the module does not report it.
+func (C *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		C.lock.Lock()
+		if C.shut {
+			C.lock.Unlock()
+			return 0, nil, C.opError("read", nil, net.ErrClosed)
+		}
+		if len(C.rx) > 0 {
+			D := C.rx[0]
+			C.rx = C.rx[1:]
+			C.lock.Unlock()
+			if D.from == nil {
+				return copy(b, D.data), nil, nil
+			}
+			return copy(b, D.data), D.from, nil
+		}
+		if C.eof {
+			C.lock.Unlock()
+			return 0, nil, C.opError("read", nil, net.ErrClosed)
+		}
+		Deadline := C.readDeadline
+		C.lock.Unlock()
+		if err := wait(C.wake, Deadline); err != nil {
+			return 0, nil, C.opError("read", nil, err)
+		}
+	}
+}
+
+// WriteTo sends b as one datagram to Addr:
+// AT+CIPSEND=<link ID>,<length>,<"remote IP">,<remote port>
+func (C *udpConn) WriteTo(b []byte, Addr net.Addr) (int, error) {
+	To, err := udpAddr(Addr)
+	if err != nil {
+		return 0, C.opError("write", Addr, err)
+	}
+	return C.send(b, To)
+}
+
+func (C *udpConn) send(b []byte, To *net.UDPAddr) (int, error) {
+	var Addr net.Addr
+	if To != nil {
+		Addr = To
+	}
+	if len(b) == 0 || len(b) > maxDatagram {
+		return 0, C.opError("write", Addr, ErrDatagramTooLong)
+	}
+	C.lock.Lock()
+	Shut, EOF, Deadline := C.shut, C.eof, C.writeDeadline
+	C.lock.Unlock()
+	if Shut || EOF {
+		return 0, C.opError("write", Addr, net.ErrClosed)
+	}
+	cmd := fmt.Sprintf("AT+CIPSEND=%d,%d\r\n", C.id, len(b))
+	if To != nil {
+		cmd = fmt.Sprintf("AT+CIPSEND=%d,%d,%s,%d\r\n", C.id, len(b), device.Quote(To.IP.String()), To.Port)
+	}
+	ctx, Cancel := deadlineContext(Deadline)
+	defer Cancel()
+	if _, err := C.stack.Esp32.ATContext(ctx, cmd, device.WithPayload(b), device.WithTimeout(10*time.Second)); err != nil {
+		return 0, C.opError("write", Addr, err)
+	}
+	return len(b), nil
+}
+
+// Read and Write use the peer given to DialUDP.
+func (C *udpConn) Read(b []byte) (int, error) {
+	N, _, err := C.ReadFrom(b)
+	return N, err
+}
+
+func (C *udpConn) Write(b []byte) (int, error) {
+	return C.send(b, nil)
+}
+
+func (C *udpConn) Close() error {
+	C.lock.Lock()
+	if C.shut {
+		C.lock.Unlock()
+		return C.opError("close", nil, net.ErrClosed)
+	}
+	C.shut = true
+	EOF := C.eof
+	C.lock.Unlock()
+	notify(C.wake)
+	if EOF {
+		return nil
+	}
+	if err := C.stack.close(C.id, C, C.gone); err != nil {
+		return C.opError("close", nil, err)
+	}
+	return nil
+}
+
+func (C *udpConn) LocalAddr() net.Addr {
+	return C.local
+}
+
+// RemoteAddr is the peer given to DialUDP, nil for ListenPacket.
+func (C *udpConn) RemoteAddr() net.Addr {
+	if C.remote == nil {
+		return nil
+	}
+	return C.remote
+}
+
+func (C *udpConn) SetDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.readDeadline, C.writeDeadline = t, t
+	C.lock.Unlock()
+	notify(C.wake)
+	return nil
+}
+
+func (C *udpConn) SetReadDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.readDeadline = t
+	C.lock.Unlock()
+	notify(C.wake)
+	return nil
+}
+
+func (C *udpConn) SetWriteDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.writeDeadline = t
+	C.lock.Unlock()
+	return nil
+}
+
+// udpAddr takes a *net.UDPAddr or any "ip:port" address, host names are
+// not resolved here.
+func udpAddr(Addr net.Addr) (*net.UDPAddr, error) {
+	if To, ok := Addr.(*net.UDPAddr); ok && To != nil && To.IP != nil {
+		return To, nil
+	}
+	if Addr == nil {
+		return nil, errors.New("missing address")
+	}
+	AddrPort, err := netip.ParseAddrPort(Addr.String())
+	if err != nil {
+		return nil, &net.AddrError{Err: "invalid address", Addr: Addr.String()}
+	}
+	return net.UDPAddrFromAddrPort(AddrPort), nil
+}
+
+// localPort parses the port of ListenPacket and DialUDP, the module needs
+// an explicit one to keep a UDP link open to any peer.
+func localPort(address string) (int, error) {
+	_, Service, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	Port, err := strconv.Atoi(Service)
+	if err != nil || Port < 1 || Port > 65535 {
+		return 0, &net.AddrError{Err: "invalid port", Addr: address}
+	}
+	return Port, nil
+}
+
+// startUDP opens a UDP link:
+// AT+CIPSTART=<link ID>,<"UDP">,<"remote host">,<remote port>,<local port>,<mode>
+func startUDP(ctx context.Context, Esp32 device.Device, network string, Local int,
+	Remote *net.UDPAddr, Mode UDPMode) (*udpConn, error) {
+	Type := map[string]string{"udp": "UDP", "udp4": "UDP", "udp6": "UDPv6"}[network]
+	if Type == "" {
+		return nil, net.UnknownNetworkError(network)
+	}
+	if Mode < UDPFixedPeer || Mode > UDPAnyPeer {
+		return nil, fmt.Errorf("invalid udp mode %d", Mode)
+	}
+	S, err := openStack(ctx, Esp32)
+	if err != nil {
+		return nil, err
+	}
+	C := newUDPConn(S, network)
+	C.local = &net.UDPAddr{Port: Local}
+	Host, Port := "0.0.0.0", 0
+	if Type == "UDPv6" {
+		Host = "::"
+	}
+	if Remote != nil {
+		C.remote = Remote
+		Host, Port = Remote.IP.String(), Remote.Port
+	}
+	if C.id, err = S.reserve(C); err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("AT+CIPSTART=%d,%s,%s,%d,%d,%d\r\n", C.id, device.Quote(Type), device.Quote(Host),
+		Port, Local, Mode)
+	if _, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(5*time.Second)); err != nil {
+		S.abandon(C.id, C, C.gone, err)
+		return nil, err
+	}
+	return C, nil
+}
+
+/*
+*
+* ListenPacket 在模组的本地端口上收发 UDP 报文, 每个报文可以发往不同的地址,
+* ReadFrom 返回发送方地址 (AT+CIPDINFO=1), 占用一个连接
+*
+* 限制: 没有对端时发送 AT+CIPSTART=<link ID>,"UDP","0.0.0.0",0,<local port>,2,
+* ESP-AT 文档要求 mode 2 也给出真实的对端地址和端口, 这种写法没有在硬件上验证过。
+* 固件返回 ERROR 时 (*device.CommandError), 可以改用 DialUDP 随便给一个对端并
+* 选 UDPAnyPeer, 返回值同样实现 net.PacketConn, WriteTo 照样可以发往任何地址。
+*
+ */
+func ListenPacket(ctx context.Context, Esp32 device.Device, network, address string) (net.PacketConn, error) {
+	Local, err := localPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	C, err := startUDP(ctx, Esp32, network, Local, nil, UDPAnyPeer)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Source: &net.UDPAddr{Port: Local}, Err: err}
+	}
+	return C, nil
+}
+
+/*
+*
+* DialUDP 建立有默认对端的 UDP 连接, Write 发往对端, Mode 决定收到其他地址的
+* 报文后对端是否改变, 返回值同时实现 net.Conn 和 net.PacketConn
+*
+ */
+func DialUDP(ctx context.Context, Esp32 device.Device, network, laddr, raddr string, Mode UDPMode) (net.Conn, error) {
+	Local, err := localPort(laddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	AddrPort, err := netip.ParseAddrPort(raddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "invalid address", Addr: raddr}}
+	}
+	Remote := net.UDPAddrFromAddrPort(AddrPort)
+	C, err := startUDP(ctx, Esp32, network, Local, Remote, Mode)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: Remote, Err: err}
+	}
+	return C, nil
+}
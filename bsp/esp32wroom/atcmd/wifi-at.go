@@ -0,0 +1,585 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+var (
+	// AT+CWJAP 失败原因, 和 *device.CommandError 一起返回
+	ErrJoinTimeout   = errors.New("wifi connection timeout")
+	ErrWrongPassword = errors.New("wifi wrong password")
+	ErrAPNotFound    = errors.New("wifi cannot find the target AP")
+	ErrJoinFailed    = errors.New("wifi connection failed")
+	// ErrNoAP: 没有连接到 AP
+	ErrNoAP = errors.New("wifi no AP connected")
+)
+
+/*
+*
+* Wi-Fi 模式
+* AT+CWMODE=<mode>
+*
+ */
+type WifiMode int
+
+const (
+	WifiModeNull WifiMode = iota
+	WifiModeStation
+	WifiModeSoftAP
+	WifiModeStationSoftAP
+)
+
+// wifiModeKey keys the lock of AT+CWMODE in device.Device.Value, SetWifiMode
+// and the read-modify-write of EnableSoftAP/DisableSoftAP take it.
+type wifiModeKey struct{}
+
+func wifiModeLock(Esp32 device.Device) *sync.Mutex {
+	return Esp32.Value(wifiModeKey{}, func() any {
+		return &sync.Mutex{}
+	}).(*sync.Mutex)
+}
+
+func SetWifiMode(ctx context.Context, Esp32 device.Device, Mode WifiMode) (bool, error) {
+	if Mode < WifiModeNull || Mode > WifiModeStationSoftAP {
+		return false, errors.New("mode must be between 0 and 3")
+	}
+	Lock := wifiModeLock(Esp32)
+	Lock.Lock()
+	defer Lock.Unlock()
+	return setWifiMode(ctx, Esp32, Mode)
+}
+
+// setWifiMode sends AT+CWMODE, the caller holds wifiModeLock.
+func setWifiMode(ctx context.Context, Esp32 device.Device, Mode WifiMode) (bool, error) {
+	cmd := fmt.Sprintf("AT+CWMODE=%d\r\n", Mode)
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request SetWifiMode error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CWMODE:<mode>
+OK
+*
+*/
+func GetWifiMode(ctx context.Context, Esp32 device.Device) (WifiMode, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWMODE?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return WifiModeNull, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return WifiModeNull, fmt.Errorf("request GetWifiMode error:%v", ATResponse.Data)
+	}
+	Mode, err := strconv.Atoi(strings.TrimPrefix(ATResponse.Data[0], "+CWMODE:"))
+	if err != nil {
+		return WifiModeNull, fmt.Errorf("request GetWifiMode error:%v", ATResponse.Data)
+	}
+	return WifiMode(Mode), nil
+}
+
+/*
+连接 AP
+AT+CWJAP=
+<ssid>,
+<pwd>
+[,<bssid>]
+[,<pci_en>]
+[,<reconn_interval>]
+[,<listen_interval>]
+*/
+type JoinAPRequest struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+	// BSSID picks one AP when several share the SSID.
+	BSSID string `json:"bssid"`
+	// PCIOnly refuses WEP and open APs.
+	PCIOnly bool `json:"pciOnly"`
+	// ReconnectInterval in seconds, 0 keeps the firmware default (1s).
+	ReconnectInterval int `json:"reconnectInterval"`
+	// NoReconnect stops the module from reconnecting when the AP drops.
+	NoReconnect bool `json:"noReconnect"`
+	// ListenInterval in beacon intervals, 0 keeps the firmware default (3).
+	ListenInterval int `json:"listenInterval"`
+}
+
+func (O JoinAPRequest) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func NewJoinAPRequest(request JoinAPRequest) error {
+	if len(request.SSID) < 1 || len(request.SSID) > 32 {
+		return errors.New("ssid must be 1 to 32 bytes")
+	}
+	if len(request.Password) > 64 {
+		return errors.New("password must be at most 64 bytes")
+	}
+	if request.BSSID != "" {
+		if _, err := net.ParseMAC(request.BSSID); err != nil {
+			return errors.New("bssid must be a MAC address")
+		}
+	}
+	if request.ReconnectInterval < 0 || request.ReconnectInterval > 7200 {
+		return errors.New("reconnect interval must be between 0 and 7200")
+	}
+	if request.ListenInterval < 0 || request.ListenInterval > 100 {
+		return errors.New("listen interval must be between 0 and 100")
+	}
+	return nil
+}
+
+func JoinAP(ctx context.Context, Esp32 device.Device, request JoinAPRequest) (bool, error) {
+	if err := NewJoinAPRequest(request); err != nil {
+		return false, err
+	}
+	cmd := "AT+CWJAP=" + device.Quote(request.SSID) + "," + device.Quote(request.Password)
+	if request.BSSID != "" || request.PCIOnly || request.ReconnectInterval != 0 ||
+		request.NoReconnect || request.ListenInterval != 0 {
+		Reconnect := request.ReconnectInterval
+		if Reconnect == 0 {
+			Reconnect = 1
+		}
+		if request.NoReconnect {
+			Reconnect = 0
+		}
+		Listen := request.ListenInterval
+		if Listen == 0 {
+			Listen = 3
+		}
+		BSSID := ""
+		if request.BSSID != "" {
+			BSSID = device.Quote(request.BSSID)
+		}
+		cmd += fmt.Sprintf(",%s,%d,%d,%d", BSSID, btoi(request.PCIOnly), Reconnect, Listen)
+	}
+	// The firmware gives up after 15s by itself.
+	ATResponse, err := Esp32.ATContext(ctx, cmd+"\r\n", device.WithTimeout(20*time.Second))
+	if err != nil {
+		return false, joinError(err)
+	}
+	if len(ATResponse.Data) < 1 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return false, fmt.Errorf("request JoinAP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+// joinError adds the +CWJAP:<code> reason to a failed AT+CWJAP.
+func joinError(err error) error {
+	var CommandError *device.CommandError
+	if !errors.As(err, &CommandError) || CommandError.Category != "WIFI" {
+		return err
+	}
+	switch CommandError.Code {
+	case 1:
+		return fmt.Errorf("%w: %w", ErrJoinTimeout, err)
+	case 2:
+		return fmt.Errorf("%w: %w", ErrWrongPassword, err)
+	case 3:
+		return fmt.Errorf("%w: %w", ErrAPNotFound, err)
+	case 4:
+		return fmt.Errorf("%w: %w", ErrJoinFailed, err)
+	}
+	return err
+}
+
+/*
+*
+断开 AP
+OK
+*
+*/
+func QuitAP(ctx context.Context, Esp32 device.Device) (bool, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWQAP\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request QuitAP error:%v", ATResponse.Data)
+	}
+	return true, nil
+}
+
+/*
+*
++CWJAP:<ssid>,<bssid>,<channel>,<rssi>,<pci_en>,<reconn_interval>,<listen_interval>,<scan_mode>,<pmf>
+OK
+*
+*/
+type ConnectedAP struct {
+	SSID              string `json:"ssid"`
+	BSSID             string `json:"bssid"`
+	Channel           int    `json:"channel"`
+	RSSI              int    `json:"rssi"`
+	PCIOnly           bool   `json:"pciOnly"`
+	ReconnectInterval int    `json:"reconnectInterval"`
+	ListenInterval    int    `json:"listenInterval"`
+	ScanMode          int    `json:"scanMode"`
+	PMF               int    `json:"pmf"`
+}
+
+func (O ConnectedAP) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+// GetConnectedAP returns ErrNoAP when the station is not connected.
+func GetConnectedAP(ctx context.Context, Esp32 device.Device) (ConnectedAP, error) {
+	ConnectedAP := ConnectedAP{}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWJAP?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return ConnectedAP, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return ConnectedAP, fmt.Errorf("request GetConnectedAP error:%v", ATResponse.Data)
+	}
+	if ATResponse.Data[0] == "No AP" {
+		return ConnectedAP, ErrNoAP
+	}
+	Line, ok := strings.CutPrefix(ATResponse.Data[0], "+CWJAP:")
+	if !ok {
+		return ConnectedAP, fmt.Errorf("request GetConnectedAP error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(Line)
+	if len(Fields) < 4 {
+		return ConnectedAP, fmt.Errorf("request GetConnectedAP error:%v", ATResponse.Data)
+	}
+	Numbers := make([]int, 9)
+	for i := 2; i < len(Fields) && i < len(Numbers); i++ {
+		if Numbers[i], err = strconv.Atoi(Fields[i]); err != nil {
+			return ConnectedAP, fmt.Errorf("request GetConnectedAP error:%v", ATResponse.Data)
+		}
+	}
+	ConnectedAP.SSID = Fields[0]
+	ConnectedAP.BSSID = Fields[1]
+	ConnectedAP.Channel = Numbers[2]
+	ConnectedAP.RSSI = Numbers[3]
+	ConnectedAP.PCIOnly = Numbers[4] == 1
+	ConnectedAP.ReconnectInterval = Numbers[5]
+	ConnectedAP.ListenInterval = Numbers[6]
+	ConnectedAP.ScanMode = Numbers[7]
+	ConnectedAP.PMF = Numbers[8]
+	return ConnectedAP, nil
+}
+
+/*
+*
+* Station 连接状态
+* +CWSTATE:<state>,<"ssid">
+*
+ */
+type StationState int
+
+const (
+	// StationIdle: 还没有开始连接
+	StationIdle StationState = iota
+	// StationConnected: 已连接 AP, 还没有获取到 IP
+	StationConnected
+	// StationGotIP: 已获取到 IP
+	StationGotIP
+	// StationConnecting: 正在连接或重连
+	StationConnecting
+	// StationDisconnected: 已断开
+	StationDisconnected
+)
+
+type WifiState struct {
+	State StationState `json:"state"`
+	SSID  string       `json:"ssid"`
+}
+
+func (O WifiState) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func GetState(ctx context.Context, Esp32 device.Device) (WifiState, error) {
+	WifiState := WifiState{}
+	ATResponse, err := Esp32.ATContext(ctx, "AT+CWSTATE?\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return WifiState, err
+	}
+	if len(ATResponse.Data) != 2 {
+		return WifiState, fmt.Errorf("request GetState error:%v", ATResponse.Data)
+	}
+	Line, ok := strings.CutPrefix(ATResponse.Data[0], "+CWSTATE:")
+	if !ok {
+		return WifiState, fmt.Errorf("request GetState error:%v", ATResponse.Data)
+	}
+	Fields := device.SplitFields(Line)
+	State, err := strconv.Atoi(Fields[0])
+	if err != nil || len(Fields) != 2 {
+		return WifiState, fmt.Errorf("request GetState error:%v", ATResponse.Data)
+	}
+	WifiState.State = StationState(State)
+	WifiState.SSID = Fields[1]
+	return WifiState, nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+*
+* 加密方式 <ecn>
+*
+ */
+type Encryption int
+
+const (
+	EncryptionOpen Encryption = iota
+	EncryptionWEP
+	EncryptionWPAPSK
+	EncryptionWPA2PSK
+	EncryptionWPAWPA2PSK
+	EncryptionWPA2Enterprise
+	EncryptionWPA3PSK
+	EncryptionWPA2WPA3PSK
+	EncryptionWAPIPSK
+	EncryptionOWE
+)
+
+/*
+*
+* 加密套件 <pairwise_cipher>/<group_cipher>
+*
+ */
+type Cipher int
+
+const (
+	CipherNone Cipher = iota
+	CipherWEP40
+	CipherWEP104
+	CipherTKIP
+	CipherCCMP
+	CipherTKIPCCMP
+	CipherAESCMAC128
+	CipherUnknown
+)
+
+/*
+*
++CWLAP:(<ecn>,<ssid>,<rssi>,<mac>,<channel>,<freq_offset>,<freqcal_val>,<pairwise_cipher>,<group_cipher>,<bgn>,<wps>)
+OK
+*
+*/
+type AccessPoint struct {
+	Encryption     Encryption `json:"encryption"`
+	SSID           string     `json:"ssid"`
+	RSSI           int        `json:"rssi"`
+	BSSID          string     `json:"bssid"`
+	Channel        int        `json:"channel"`
+	FreqOffset     int        `json:"freqOffset"`
+	FreqCal        int        `json:"freqCal"`
+	PairwiseCipher Cipher     `json:"pairwiseCipher"`
+	GroupCipher    Cipher     `json:"groupCipher"`
+	// BGN: bit0 802.11b, bit1 802.11g, bit2 802.11n
+	BGN int  `json:"bgn"`
+	WPS bool `json:"wps"`
+}
+
+func (O AccessPoint) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+/*
+扫描过滤条件
+AT+CWLAP=
+[<ssid>,
+<mac>,
+<channel>,
+<scan_type>,
+<scan_time_min>,
+<scan_time_max>]
+*/
+type ScanOptions struct {
+	SSID    string `json:"ssid"`
+	BSSID   string `json:"bssid"`
+	Channel int    `json:"channel"`
+	// Passive listens for beacons instead of sending probe requests.
+	Passive bool `json:"passive"`
+	// ScanTimeMin and ScanTimeMax bound the time per channel in ms, 0 keeps
+	// the firmware default.
+	ScanTimeMin int `json:"scanTimeMin"`
+	ScanTimeMax int `json:"scanTimeMax"`
+	// MinRSSI drops APs weaker than it, 0 keeps all.
+	MinRSSI int `json:"minRSSI"`
+}
+
+func NewScanOptions(opts ScanOptions) error {
+	if len(opts.SSID) > 32 {
+		return errors.New("ssid must be at most 32 bytes")
+	}
+	if opts.BSSID != "" {
+		if _, err := net.ParseMAC(opts.BSSID); err != nil {
+			return errors.New("bssid must be a MAC address")
+		}
+	}
+	if opts.Channel < 0 || opts.Channel > 14 {
+		return errors.New("channel must be between 0 and 14")
+	}
+	if opts.ScanTimeMin < 0 || opts.ScanTimeMax < 0 || opts.ScanTimeMax > 1500 {
+		return errors.New("scan time must be between 0 and 1500")
+	}
+	if opts.MinRSSI < -100 || opts.MinRSSI > 40 {
+		return errors.New("rssi filter must be between -100 and 40")
+	}
+	return nil
+}
+
+// cwlapMask prints every field of +CWLAP, AccessPoint relies on the order.
+const cwlapMask = 0x7FF
+
+/*
+*
+* ScanAPs 扫描周围的 AP, 扫描结果逐行解析, 不受响应长度限制
+*
+ */
+func ScanAPs(ctx context.Context, Esp32 device.Device, opts ScanOptions) ([]AccessPoint, error) {
+	if err := NewScanOptions(opts); err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("AT+CWLAPOPT=1,%d", cwlapMask)
+	if opts.MinRSSI != 0 {
+		cmd += fmt.Sprintf(",%d", opts.MinRSSI)
+	}
+	ATResponse, err := Esp32.ATContext(ctx, cmd+"\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return nil, fmt.Errorf("request ScanAPs error:%v", ATResponse.Data)
+	}
+	Params := []string{"", "", "", "", "", ""}
+	if opts.SSID != "" {
+		Params[0] = device.Quote(opts.SSID)
+	}
+	if opts.BSSID != "" {
+		Params[1] = device.Quote(opts.BSSID)
+	}
+	if opts.Channel != 0 {
+		Params[2] = strconv.Itoa(opts.Channel)
+	}
+	if opts.Passive || opts.ScanTimeMin != 0 || opts.ScanTimeMax != 0 {
+		Params[3] = strconv.Itoa(btoi(opts.Passive))
+	}
+	if opts.ScanTimeMin != 0 {
+		Params[4] = strconv.Itoa(opts.ScanTimeMin)
+	}
+	if opts.ScanTimeMax != 0 {
+		Params[5] = strconv.Itoa(opts.ScanTimeMax)
+	}
+	for len(Params) > 0 && Params[len(Params)-1] == "" {
+		Params = Params[:len(Params)-1]
+	}
+	cmd = "AT+CWLAP"
+	if len(Params) > 0 {
+		cmd += "=" + strings.Join(Params, ",")
+	}
+	AccessPoints := []AccessPoint{}
+	var errParse error
+	ATResponse, err = Esp32.ATContext(ctx, cmd+"\r\n", device.WithTimeout(15*time.Second),
+		device.WithLineHandler(func(Line string) bool {
+			Tuple, ok := strings.CutPrefix(Line, "+CWLAP:")
+			if !ok {
+				return false
+			}
+			AccessPoint, err := parseAccessPoint(Tuple)
+			if err != nil && errParse == nil {
+				errParse = err
+			}
+			if err == nil {
+				AccessPoints = append(AccessPoints, AccessPoint)
+			}
+			return true
+		}))
+	if err != nil {
+		return nil, err
+	}
+	if errParse != nil {
+		return AccessPoints, errParse
+	}
+	if len(ATResponse.Data) < 1 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return AccessPoints, fmt.Errorf("request ScanAPs error:%v", ATResponse.Data)
+	}
+	return AccessPoints, nil
+}
+
+// parseAccessPoint reads the tuple of one +CWLAP line.
+func parseAccessPoint(Tuple string) (AccessPoint, error) {
+	AccessPoint := AccessPoint{}
+	Fields := device.SplitFields(strings.TrimSuffix(strings.TrimPrefix(Tuple, "("), ")"))
+	if len(Fields) < 5 {
+		return AccessPoint, fmt.Errorf("invalid +CWLAP:%s", Tuple)
+	}
+	Numbers := make([]int, 11)
+	for i := 0; i < len(Fields) && i < len(Numbers); i++ {
+		if i == 1 || i == 3 {
+			continue
+		}
+		Number, err := strconv.Atoi(Fields[i])
+		if err != nil {
+			return AccessPoint, fmt.Errorf("invalid +CWLAP:%s", Tuple)
+		}
+		Numbers[i] = Number
+	}
+	AccessPoint.Encryption = Encryption(Numbers[0])
+	AccessPoint.SSID = Fields[1]
+	AccessPoint.RSSI = Numbers[2]
+	AccessPoint.BSSID = Fields[3]
+	AccessPoint.Channel = Numbers[4]
+	AccessPoint.FreqOffset = Numbers[5]
+	AccessPoint.FreqCal = Numbers[6]
+	AccessPoint.PairwiseCipher = Cipher(Numbers[7])
+	AccessPoint.GroupCipher = Cipher(Numbers[8])
+	AccessPoint.BGN = Numbers[9]
+	AccessPoint.WPS = Numbers[10] == 1
+	return AccessPoint, nil
+}
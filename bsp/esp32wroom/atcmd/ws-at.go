@@ -0,0 +1,495 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package atcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// WebSocket 消息类型, 即 AT+WSSEND 的 <opcode>
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// MaxWSLinks: 模组最多同时打开 3 个 WebSocket 连接, link ID 和 TCP 的互不影响
+const MaxWSLinks = 3
+
+// maxWSSend is the largest message of one AT+WSSEND.
+const maxWSSend = 8192
+
+// ErrMessageTooLong: 一条 WebSocket 消息最多 8192 字节
+var ErrMessageTooLong = errors.New("websocket message too long")
+
+/*
+*
+* WebSocket 连接参数
+* PingInterval: 心跳间隔, 0 时为 10 秒
+* PingTimeout: 心跳超时, 0 时为 120 秒
+* BufferSize: 接收缓冲区, 0 时为 1024 字节, 更长的消息会被模组分成多个 +WS_DATA
+* Subprotocol: Sec-WebSocket-Protocol
+* Timeout: 握手超时, 0 时为 15 秒
+*
+ */
+type WSConfig struct {
+	PingInterval time.Duration `json:"pingInterval"`
+	PingTimeout  time.Duration `json:"pingTimeout"`
+	BufferSize   int           `json:"bufferSize"`
+	Subprotocol  string        `json:"subprotocol"`
+	Timeout      time.Duration `json:"timeout"`
+}
+
+func NewWSConfig(config WSConfig) error {
+	if config.PingInterval < 0 || config.PingInterval > 7200*time.Second {
+		return errors.New("pingInterval must be between 0 and 7200s")
+	}
+	if config.PingTimeout < 0 || config.PingTimeout > 7200*time.Second {
+		return errors.New("pingTimeout must be between 0 and 7200s")
+	}
+	if config.BufferSize < 0 || config.BufferSize > maxWSSend {
+		return fmt.Errorf("bufferSize must be between 0 and %d", maxWSSend)
+	}
+	if config.Timeout < 0 || config.Timeout > 180*time.Second {
+		return errors.New("timeout must be between 0 and 180s")
+	}
+	return nil
+}
+
+// orDefault returns Value or Default when Value is zero.
+func orDefault[T int | time.Duration](Value, Default T) T {
+	if Value == 0 {
+		return Default
+	}
+	return Value
+}
+
+/*
+*
+* wsStack: 一个模组上的 WebSocket 连接表, 分发 +WS_DATA 和断开上报, 挂在设备上
+*
+ */
+type wsStack struct {
+	Esp32 device.Device
+	urcs  <-chan device.URC
+	start sync.Once
+	// AT+WSHEAD is global, one handshake at a time
+	setup sync.Mutex
+	lock  sync.Mutex
+	conns [MaxWSLinks]*WSConn
+}
+
+// wsStackKey keys the wsStack of a device in device.Device.Value.
+type wsStackKey struct{}
+
+func openWSStack(Esp32 device.Device) *wsStack {
+	S := Esp32.Value(wsStackKey{}, func() any {
+		return &wsStack{Esp32: Esp32}
+	}).(*wsStack)
+	S.start.Do(func() {
+		S.urcs = Esp32.Subscribe("")
+		go S.loop()
+	})
+	return S
+}
+
+func (S *wsStack) reserve(C *WSConn) (int, error) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	for id := range S.conns {
+		if S.conns[id] == nil {
+			S.conns[id] = C
+			return id, nil
+		}
+	}
+	return 0, ErrNoFreeLink
+}
+
+// take removes the connection of a link ID from the table, an aborted
+// Dial keeps its link ID until abort is done.
+func (S *wsStack) take(id int) *WSConn {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if id < 0 || id >= MaxWSLinks {
+		return nil
+	}
+	C := S.conns[id]
+	if C != nil && !C.aborted {
+		S.conns[id] = nil
+	}
+	return C
+}
+
+func (S *wsStack) release(id int, C *WSConn) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if S.conns[id] == C {
+		S.conns[id] = nil
+	}
+}
+
+func (S *wsStack) get(id int) *WSConn {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if id < 0 || id >= MaxWSLinks {
+		return nil
+	}
+	return S.conns[id]
+}
+
+func (S *wsStack) loop() {
+	for U := range S.urcs {
+		switch {
+		case U.Data != nil && strings.HasPrefix(U.Line, "+WS_DATA:"):
+			id, _, _ := strings.Cut(strings.TrimPrefix(U.Line, "+WS_DATA:"), ",")
+			if id, err := strconv.Atoi(id); err == nil {
+				if C := S.get(id); C != nil {
+					C.receive(U.Data)
+				}
+			}
+		case strings.HasPrefix(U.Line, "+WS_DISCONNECTED:"), strings.HasPrefix(U.Line, "+WS_CLOSED:"):
+			_, Id, _ := strings.Cut(U.Line, ":")
+			if id, err := strconv.Atoi(Id); err == nil {
+				if C := S.take(id); C != nil {
+					C.closed()
+				}
+			}
+		case U.Line == "ready":
+			S.closeAll()
+		}
+	}
+	S.closeAll()
+}
+
+func (S *wsStack) closeAll() {
+	S.lock.Lock()
+	Conns := S.conns
+	S.conns = [MaxWSLinks]*WSConn{}
+	S.lock.Unlock()
+	for _, C := range Conns {
+		if C != nil {
+			C.closed()
+		}
+	}
+}
+
+/*
+*
+* WSConn: 模组上的一个 WebSocket 连接, 用法和 gorilla/websocket 的 Conn 类似
+*
+ */
+type WSConn struct {
+	stack *wsStack
+	id    int
+	url   string
+	wake  chan struct{}
+	gone  chan struct{}
+	// aborted is set under stack.lock when AT+WSOPEN was given up.
+	aborted bool
+	// one AT+WSSEND at a time
+	writing sync.Mutex
+
+	lock          sync.Mutex
+	messages      [][]byte
+	eof           bool
+	shut          bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// DialWebSocket 用默认参数建立 WebSocket 连接
+func DialWebSocket(ctx context.Context, Esp32 device.Device, URL string, Header http.Header) (*WSConn, error) {
+	return WSConfig{}.Dial(ctx, Esp32, URL, Header)
+}
+
+/*
+*
+* Dial 建立 WebSocket 连接, Header 中的请求头用 AT+WSHEAD 设置, 握手后清除
+* AT+WSCFG=<link_id>,<ping_intv_sec>,<ping_timeout_sec>,<buffer_size>
+* AT+WSHEAD=<req_header_len>
+* AT+WSOPEN=<link_id>,<"uri">,<"subprotocol">,<timeout_ms>
+*
+ */
+func (config WSConfig) Dial(ctx context.Context, Esp32 device.Device, URL string, Header http.Header) (*WSConn, error) {
+	if err := NewWSConfig(config); err != nil {
+		return nil, err
+	}
+	if U, err := url.Parse(URL); err != nil || (U.Scheme != "ws" && U.Scheme != "wss") {
+		return nil, fmt.Errorf("invalid websocket url %q", URL)
+	}
+	S := openWSStack(Esp32)
+	C := &WSConn{stack: S, url: URL, wake: make(chan struct{}, 1), gone: make(chan struct{})}
+	id, err := S.reserve(C)
+	if err != nil {
+		return nil, err
+	}
+	C.id = id
+	S.setup.Lock()
+	defer S.setup.Unlock()
+	if Pending, err := config.open(ctx, C, Header); err != nil {
+		if !Pending {
+			S.release(id, C)
+			return nil, err
+		}
+		S.lock.Lock()
+		C.aborted = true
+		S.lock.Unlock()
+		go C.abort()
+		return nil, err
+	}
+	return C, nil
+}
+
+// open configures and opens the link of C, Pending reports an AT+WSOPEN
+// that got no answer, the handshake may still finish then.
+func (config WSConfig) open(ctx context.Context, C *WSConn, Header http.Header) (Pending bool, err error) {
+	Esp32 := C.stack.Esp32
+	cmd := fmt.Sprintf("AT+WSCFG=%d,%d,%d,%d\r\n", C.id,
+		int(orDefault(config.PingInterval, 10*time.Second)/time.Second),
+		int(orDefault(config.PingTimeout, 120*time.Second)/time.Second), orDefault(config.BufferSize, 1024))
+	ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithTimeout(time.Second))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request WSCFG error:%v", ATResponse.Data)
+	}
+	Headers := wsHeaders(Header)
+	if len(Headers) > 0 {
+		defer func() {
+			ctx, Cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+			defer Cancel()
+			Esp32.ATContext(ctx, "AT+WSHEAD=0\r\n", device.WithTimeout(time.Second))
+		}()
+	}
+	for _, Header := range Headers {
+		cmd := fmt.Sprintf("AT+WSHEAD=%d\r\n", len(Header))
+		ATResponse, err := Esp32.ATContext(ctx, cmd, device.WithPayload([]byte(Header)), device.WithTimeout(time.Second))
+		if err != nil {
+			return false, err
+		}
+		if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+			return false, fmt.Errorf("request WSHEAD error:%v", ATResponse.Data)
+		}
+	}
+	Timeout := orDefault(config.Timeout, 15*time.Second)
+	cmd = fmt.Sprintf("AT+WSOPEN=%d,%s,%s,%d\r\n", C.id, device.Quote(C.url), device.Quote(config.Subprotocol),
+		Timeout.Milliseconds())
+	ATResponse, err = Esp32.ATContext(ctx, cmd, device.WithTimeout(Timeout+time.Second))
+	if err != nil {
+		return !errors.Is(err, device.ErrCommand), err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request WSOPEN error:%v", ATResponse.Data)
+	}
+	return false, nil
+}
+
+// abort closes the link of a Dial that gave up on AT+WSOPEN. The link ID
+// stays taken until AT+WSCLOSE is done and the module confirmed it with
+// +WS_CLOSED, a later Dial could otherwise get closed by it.
+func (C *WSConn) abort() {
+	_, err := C.stack.Esp32.ATContext(context.Background(), fmt.Sprintf("AT+WSCLOSE=%d\r\n", C.id),
+		device.WithTimeout(5*time.Second))
+	if err == nil {
+		select {
+		case <-C.gone:
+		case <-time.After(time.Second):
+		}
+	}
+	C.stack.release(C.id, C)
+}
+
+// wsHeaders lists the headers as sorted "Key: Value" lines.
+func wsHeaders(Header http.Header) []string {
+	Keys := []string{}
+	for Key := range Header {
+		Keys = append(Keys, Key)
+	}
+	sort.Strings(Keys)
+	Headers := []string{}
+	for _, Key := range Keys {
+		for _, Value := range Header[Key] {
+			Headers = append(Headers, Key+": "+Value)
+		}
+	}
+	return Headers
+}
+
+func (C *WSConn) receive(Data []byte) {
+	C.lock.Lock()
+	C.messages = append(C.messages, Data)
+	C.lock.Unlock()
+	notify(C.wake)
+}
+
+// closed may be called again for an aborted Dial that keeps its link ID.
+func (C *WSConn) closed() {
+	C.lock.Lock()
+	if C.eof {
+		C.lock.Unlock()
+		return
+	}
+	C.eof = true
+	C.lock.Unlock()
+	close(C.gone)
+	notify(C.wake)
+}
+
+func (C *WSConn) opError(Op string, err error) error {
+	return &net.OpError{Op: Op, Net: "websocket", Err: err}
+}
+
+/*
+*
+* ReadMessage 返回下一条消息, 对端关闭后读完缓存的消息返回 io.EOF。
+* +WS_DATA 不带 opcode, UTF-8 的内容当作 TextMessage, 其他的当作 BinaryMessage
+*
+ */
+func (C *WSConn) ReadMessage() (int, []byte, error) {
+	for {
+		C.lock.Lock()
+		if C.shut {
+			C.lock.Unlock()
+			return 0, nil, C.opError("read", net.ErrClosed)
+		}
+		if len(C.messages) > 0 {
+			Data := C.messages[0]
+			C.messages = C.messages[1:]
+			C.lock.Unlock()
+			if utf8.Valid(Data) {
+				return TextMessage, Data, nil
+			}
+			return BinaryMessage, Data, nil
+		}
+		if C.eof {
+			C.lock.Unlock()
+			return 0, nil, io.EOF
+		}
+		Deadline := C.readDeadline
+		C.lock.Unlock()
+		if err := wait(C.wake, Deadline); err != nil {
+			return 0, nil, C.opError("read", err)
+		}
+	}
+}
+
+/*
+*
+* WriteMessage 发送一条消息
+* AT+WSSEND=<link_id>,<length>,<opcode>
+*
+ */
+func (C *WSConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage, CloseMessage, PingMessage, PongMessage:
+	default:
+		return fmt.Errorf("unknown message type %d", messageType)
+	}
+	if len(data) > maxWSSend {
+		return C.opError("write", ErrMessageTooLong)
+	}
+	C.writing.Lock()
+	defer C.writing.Unlock()
+	C.lock.Lock()
+	Shut, EOF, Deadline := C.shut, C.eof, C.writeDeadline
+	C.lock.Unlock()
+	if Shut {
+		return C.opError("write", net.ErrClosed)
+	}
+	if EOF {
+		return C.opError("write", io.ErrClosedPipe)
+	}
+	ctx, Cancel := deadlineContext(Deadline)
+	defer Cancel()
+	cmd := fmt.Sprintf("AT+WSSEND=%d,%d,%d\r\n", C.id, len(data), messageType)
+	opts := []device.ATOption{device.WithTimeout(10 * time.Second)}
+	// An empty frame goes out at once, there is no '>' prompt.
+	if len(data) > 0 {
+		opts = append(opts, device.WithPayload(data))
+	}
+	if _, err := C.stack.Esp32.ATContext(ctx, cmd, opts...); err != nil {
+		return C.opError("write", err)
+	}
+	return nil
+}
+
+/*
+*
+* Close 关闭连接, 等待模组的 +WS_CLOSED 后 link ID 才能再次使用
+* AT+WSCLOSE=<link_id>
+*
+ */
+func (C *WSConn) Close() error {
+	C.lock.Lock()
+	if C.shut {
+		C.lock.Unlock()
+		return C.opError("close", net.ErrClosed)
+	}
+	C.shut = true
+	EOF := C.eof
+	C.lock.Unlock()
+	notify(C.wake)
+	if EOF {
+		return nil
+	}
+	_, err := C.stack.Esp32.ATContext(context.Background(), fmt.Sprintf("AT+WSCLOSE=%d\r\n", C.id),
+		device.WithTimeout(5*time.Second))
+	if err != nil {
+		C.stack.release(C.id, C)
+		if errors.Is(err, device.ErrCommand) {
+			return nil
+		}
+		return C.opError("close", err)
+	}
+	select {
+	case <-C.gone:
+	case <-time.After(time.Second):
+		C.stack.release(C.id, C)
+	}
+	return nil
+}
+
+func (C *WSConn) SetReadDeadline(t time.Time) error {
+	C.lock.Lock()
+	C.readDeadline = t
+	C.lock.Unlock()
+	notify(C.wake)
+	return nil
+}
+
+func (C *WSConn) SetWriteDeadline(t time.Time) error {
+	C.lock.Lock()
+	defer C.lock.Unlock()
+	C.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,613 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// Scheme is the <scheme> of AT+MQTTUSERCFG.
+type Scheme int
+
+const (
+	SchemeTCP           Scheme = 1  // MQTT over TCP
+	SchemeTLSNoAuth     Scheme = 2  // TLS, 不验证证书
+	SchemeTLSServerCert Scheme = 3  // TLS, 验证服务器证书
+	SchemeTLSClientCert Scheme = 4  // TLS, 提供客户端证书
+	SchemeTLSMutual     Scheme = 5  // TLS, 双向验证
+	SchemeWS            Scheme = 6  // MQTT over WebSocket
+	SchemeWSSNoAuth     Scheme = 7  // WebSocket over TLS, 不验证证书
+	SchemeWSSServerCert Scheme = 8  // WebSocket over TLS, 验证服务器证书
+	SchemeWSSClientCert Scheme = 9  // WebSocket over TLS, 提供客户端证书
+	SchemeWSSMutual     Scheme = 10 // WebSocket over TLS, 双向验证
+)
+
+// AT+MQTTUSERCFG takes short values, longer ones go through
+// AT+MQTTLONGCLIENTID/LONGUSERNAME/LONGPASSWORD.
+const (
+	maxClientID = 256
+	maxUserLen  = 64
+	maxLongLen  = 1024
+	// Payloads up to maxPubLen printable bytes are sent inline by AT+MQTTPUB.
+	maxPubLen = 128
+)
+
+// Will is the last will set by AT+MQTTCONNCFG.
+type Will struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     int    `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+/*
+*
+* MQTT 连接参数
+* Scheme: 0 等同 SchemeTCP
+* Path: WebSocket 的路径
+* PKINumber/CANumber: TLS 证书序号, 见 atcmd.SetClientPKI
+* KeepAlive: 0 时模组使用 120 秒
+* ReconnectInterval: 断线后重连的间隔, 0 时为 1 秒
+*
+ */
+type ClientConfig struct {
+	Scheme              Scheme        `json:"scheme"`
+	Host                string        `json:"host"`
+	Port                int           `json:"port"`
+	Path                string        `json:"path"`
+	ClientID            string        `json:"clientId"`
+	Username            string        `json:"username"`
+	Password            string        `json:"password"`
+	PKINumber           int           `json:"pkiNumber"`
+	CANumber            int           `json:"caNumber"`
+	KeepAlive           time.Duration `json:"keepAlive"`
+	DisableCleanSession bool          `json:"disableCleanSession"`
+	Will                *Will         `json:"will"`
+	ReconnectInterval   time.Duration `json:"reconnectInterval"`
+}
+
+func (O ClientConfig) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+func NewClientConfig(config ClientConfig) error {
+	if config.Scheme < 0 || config.Scheme > SchemeWSSMutual {
+		return errors.New("scheme must be between 0 and 10, 0 means tcp")
+	}
+	if config.Host == "" || len(config.Host) > 128 {
+		return errors.New("host length must be between 1 and 128")
+	}
+	if config.Port < 1 || config.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if len(config.Path) > 32 {
+		return errors.New("path must be at most 32 bytes")
+	}
+	if config.ClientID == "" || len(config.ClientID) > maxLongLen {
+		return errors.New("clientId length must be between 1 and 1024")
+	}
+	if len(config.Username) > maxLongLen || len(config.Password) > maxLongLen {
+		return errors.New("username and password must be at most 1024 bytes")
+	}
+	if config.PKINumber < 0 || config.CANumber < 0 {
+		return errors.New("pkiNumber and caNumber must not be negative")
+	}
+	if config.KeepAlive < 0 || config.KeepAlive > 2*time.Hour {
+		return errors.New("keepAlive must be between 0 and 2h")
+	}
+	if config.ReconnectInterval < 0 {
+		return errors.New("reconnectInterval must not be negative")
+	}
+	if Will := config.Will; Will != nil {
+		if err := validTopic(Will.Topic); err != nil {
+			return err
+		}
+		if Will.QoS < 0 || Will.QoS > 2 {
+			return errors.New("will qos must be between 0 and 2")
+		}
+	}
+	return nil
+}
+
+// setup is one configuration command, payload follows the '>' prompt.
+type setup struct {
+	cmd     string
+	payload []byte
+}
+
+// commands lists AT+MQTTUSERCFG, the long values and AT+MQTTCONNCFG.
+func (config ClientConfig) commands() []setup {
+	Scheme := config.Scheme
+	if Scheme == 0 {
+		Scheme = SchemeTCP
+	}
+	Long := []setup{}
+	Short := func(Name, Value string, Max int) string {
+		if len(Value) <= Max {
+			return device.Quote(Value)
+		}
+		Long = append(Long, setup{fmt.Sprintf("AT+MQTTLONG%s=0,%d\r\n", Name, len(Value)), []byte(Value)})
+		return `""`
+	}
+	Commands := []setup{{cmd: fmt.Sprintf("AT+MQTTUSERCFG=0,%d,%s,%s,%s,%d,%d,%s\r\n", Scheme,
+		Short("CLIENTID", config.ClientID, maxClientID), Short("USERNAME", config.Username, maxUserLen),
+		Short("PASSWORD", config.Password, maxUserLen), config.PKINumber, config.CANumber,
+		device.Quote(config.Path))}}
+	Commands = append(Commands, Long...)
+	Will := Will{}
+	if config.Will != nil {
+		Will = *config.Will
+	}
+	Commands = append(Commands, setup{cmd: fmt.Sprintf("AT+MQTTCONNCFG=0,%d,%d,%s,%s,%d,%d\r\n",
+		int(config.KeepAlive/time.Second), btoi(config.DisableCleanSession), device.Quote(Will.Topic),
+		device.Quote(Will.Payload), Will.QoS, btoi(Will.Retain))})
+	return Commands
+}
+
+func (config ClientConfig) reconnectInterval() time.Duration {
+	if config.ReconnectInterval > 0 {
+		return config.ReconnectInterval
+	}
+	return time.Second
+}
+
+// Message is a message received on a subscription.
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+func (O Message) String() string {
+	if bytes, err := json.Marshal(map[string]string{"topic": O.Topic, "payload": string(O.Payload)}); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+// Handler is called for each message that matches its topic filter.
+type Handler func(Message)
+
+type subscription struct {
+	QoS     int
+	Handler Handler
+}
+
+/*
+*
+* Client: 模组 LinkID 0 上的 MQTT 连接
+* +MQTTSUBRECV 按 topic filter 分发给订阅时给出的 Handler, Handler 在 Client 的
+* 投递 goroutine 中依次执行, 不能调用 Close。消息先排队, 慢的 Handler 不会耽误
+* +MQTTDISCONNECTED 的处理。
+* +MQTTDISCONNECTED 后每隔 ReconnectInterval 重新 AT+MQTTCONN, 连上后重新订阅。
+*
+ */
+type Client struct {
+	Esp32     device.Device
+	config    ClientConfig
+	urcs      <-chan device.URC
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	lock      sync.Mutex
+	connected bool
+	closed    bool
+	handlers  map[string]subscription
+	// inbox holds the messages for deliver, wake tells it about new ones.
+	inbox     []Message
+	wake      chan struct{}
+	delivered chan struct{}
+}
+
+/*
+*
+* Connect 配置并连接 MQTT 服务器, 模组上残留的连接先用 AT+MQTTCLEAN 清掉
+* AT+MQTTUSERCFG=<LinkID>,<scheme>,<"client_id">,<"username">,<"password">,<cert_key_ID>,<CA_ID>,<"path">
+* AT+MQTTLONGCLIENTID=<LinkID>,<length>
+* AT+MQTTLONGUSERNAME=<LinkID>,<length>
+* AT+MQTTLONGPASSWORD=<LinkID>,<length>
+* AT+MQTTCONNCFG=<LinkID>,<keepalive>,<disable_clean_session>,<"lwt_topic">,<"lwt_msg">,<lwt_qos>,<lwt_retain>
+* AT+MQTTCONN=<LinkID>,<"host">,<port>,<reconnect>
+*
+ */
+func Connect(ctx context.Context, Esp32 device.Device, config ClientConfig) (*Client, error) {
+	if err := NewClientConfig(config); err != nil {
+		return nil, err
+	}
+	if err := clean(ctx, Esp32); err != nil {
+		return nil, err
+	}
+	for _, Setup := range config.commands() {
+		opts := []device.ATOption{device.WithTimeout(time.Second)}
+		if Setup.payload != nil {
+			opts = append(opts, device.WithPayload(Setup.payload))
+		}
+		ATResponse, err := Esp32.ATContext(ctx, Setup.cmd, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+			return nil, fmt.Errorf("request %s error:%v", device.CommandName(Setup.cmd), ATResponse.Data)
+		}
+	}
+	C := &Client{
+		Esp32:     Esp32,
+		config:    config,
+		urcs:      Esp32.Subscribe("+MQTT"),
+		done:      make(chan struct{}),
+		handlers:  map[string]subscription{},
+		wake:      make(chan struct{}, 1),
+		delivered: make(chan struct{}),
+	}
+	C.ctx, C.cancel = context.WithCancel(context.Background())
+	if err := C.connect(ctx); err != nil {
+		C.cancel()
+		Esp32.Unsubscribe(C.urcs)
+		return nil, err
+	}
+	go C.loop()
+	go C.deliver()
+	return C, nil
+}
+
+// mqttUninitiated is AT_MQTT_UNINITIATED_OR_ALREADY_CLEAN, the extension
+// of the ERR CODE that AT+MQTTCLEAN gives on an idle link.
+const mqttUninitiated = 0x6003
+
+// clean drops what an earlier client left on link 0. An idle link answers
+// ERROR, only that one is ignored: by its ERR CODE with AT+SYSLOG=1, without
+// the code by the state of AT+MQTTCONN?.
+func clean(ctx context.Context, Esp32 device.Device) error {
+	_, err := Esp32.ATContext(ctx, "AT+MQTTCLEAN=0\r\n", device.WithTimeout(time.Second))
+	var CommandError *device.CommandError
+	if err == nil || !errors.As(err, &CommandError) {
+		return err
+	}
+	if CommandError.Code&0xFFFF == mqttUninitiated {
+		return nil
+	}
+	if CommandError.Code == 0 {
+		if State, errState := linkState(ctx, Esp32); errState == nil && State == 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+/*
+*
++MQTTCONN:<LinkID>,<state>,<scheme>,<"host">,<port>,<"path">,<reconnect>
+OK
+* state 0 表示没有初始化
+*
+*/
+func linkState(ctx context.Context, Esp32 device.Device) (int, error) {
+	ATResponse, err := Esp32.ATContext(ctx, "AT+MQTTCONN?\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return 0, err
+	}
+	for _, Line := range ATResponse.Data {
+		Fields := device.SplitFields(strings.TrimPrefix(Line, "+MQTTCONN:"))
+		if !strings.HasPrefix(Line, "+MQTTCONN:") || len(Fields) < 2 || Fields[0] != "0" {
+			continue
+		}
+		State, err := strconv.Atoi(Fields[1])
+		if err != nil {
+			return 0, fmt.Errorf("request MQTTCONN error:%v", ATResponse.Data)
+		}
+		return State, nil
+	}
+	return 0, nil
+}
+
+// connect sends AT+MQTTCONN without the reconnect of the module, the
+// client reconnects by itself so that it can subscribe again.
+func (C *Client) connect(ctx context.Context) error {
+	cmd := fmt.Sprintf("AT+MQTTCONN=0,%s,%d,0\r\n", device.Quote(C.config.Host), C.config.Port)
+	ATResponse, err := C.Esp32.ATContext(ctx, cmd, device.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request MQTTCONN error:%v", ATResponse.Data)
+	}
+	C.lock.Lock()
+	C.connected = true
+	C.lock.Unlock()
+	return nil
+}
+
+func (C *Client) IsConnected() bool {
+	C.lock.Lock()
+	defer C.lock.Unlock()
+	return C.connected
+}
+
+// loop owns the connection state: messages, disconnects and the retries
+// of restore are handled in the order the module reports them.
+func (C *Client) loop() {
+	defer close(C.done)
+	var Retry <-chan time.Time
+	for {
+		select {
+		case U, ok := <-C.urcs:
+			if !ok {
+				return
+			}
+			switch {
+			case strings.HasPrefix(U.Line, "+MQTTSUBRECV:"):
+				C.enqueue(U)
+			case strings.HasPrefix(U.Line, "+MQTTDISCONNECTED:"):
+				C.lock.Lock()
+				C.connected = false
+				C.lock.Unlock()
+				Retry = time.After(C.config.reconnectInterval())
+			}
+		case <-Retry:
+			Retry = nil
+			if err := C.restore(); err != nil {
+				Retry = time.After(C.config.reconnectInterval())
+			}
+		}
+	}
+}
+
+// restore reconnects and subscribes every topic filter again.
+func (C *Client) restore() error {
+	if !C.IsConnected() {
+		if err := C.connect(C.ctx); err != nil {
+			return err
+		}
+	}
+	C.lock.Lock()
+	Subscriptions := map[string]int{}
+	for Filter, Subscription := range C.handlers {
+		Subscriptions[Filter] = Subscription.QoS
+	}
+	C.lock.Unlock()
+	for Filter, QoS := range Subscriptions {
+		if err := C.subscribe(C.ctx, Filter, QoS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+*
++MQTTSUBRECV:<LinkID>,<"topic">,<data_length>,data
+*
+*/
+func (C *Client) enqueue(U device.URC) {
+	Fields := device.SplitFields(strings.TrimPrefix(U.Line, "+MQTTSUBRECV:"))
+	if len(Fields) != 3 {
+		return
+	}
+	Message := Message{Topic: Fields[1], Payload: U.Data}
+	if Message.Payload == nil {
+		Message.Payload = []byte{}
+	}
+	C.lock.Lock()
+	C.inbox = append(C.inbox, Message)
+	C.lock.Unlock()
+	select {
+	case C.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands the queued messages to the handlers in order, until Close.
+func (C *Client) deliver() {
+	defer close(C.delivered)
+	for {
+		select {
+		case <-C.wake:
+		case <-C.ctx.Done():
+			return
+		}
+		for C.ctx.Err() == nil {
+			C.lock.Lock()
+			if len(C.inbox) == 0 {
+				C.lock.Unlock()
+				break
+			}
+			Next := C.inbox[0]
+			C.inbox[0] = Message{}
+			C.inbox = C.inbox[1:]
+			C.lock.Unlock()
+			C.dispatch(Next)
+		}
+	}
+}
+
+func (C *Client) dispatch(Message Message) {
+	Handlers := []Handler{}
+	C.lock.Lock()
+	for Filter, Subscription := range C.handlers {
+		if Match(Filter, Message.Topic) {
+			Handlers = append(Handlers, Subscription.Handler)
+		}
+	}
+	C.lock.Unlock()
+	for _, Handler := range Handlers {
+		Handler(Message)
+	}
+}
+
+/*
+*
+* 发布消息, 短的可打印内容直接放在 AT+MQTTPUB 中, 其他的用 AT+MQTTPUBRAW 在 '>' 后发送
+* AT+MQTTPUB=<LinkID>,<"topic">,<"data">,<qos>,<retain>
+* AT+MQTTPUBRAW=<LinkID>,<"topic">,<length>,<qos>,<retain>
+*
+ */
+func (C *Client) Publish(ctx context.Context, Topic string, Payload []byte, QoS int, Retain bool) error {
+	if err := validTopic(Topic); err != nil {
+		return err
+	}
+	if QoS < 0 || QoS > 2 {
+		return errors.New("qos must be between 0 and 2")
+	}
+	if len(Payload) == 0 || (len(Payload) <= maxPubLen && printable(Payload)) {
+		cmd := fmt.Sprintf("AT+MQTTPUB=0,%s,%s,%d,%d\r\n", device.Quote(Topic), device.Quote(string(Payload)),
+			QoS, btoi(Retain))
+		ATResponse, err := C.Esp32.ATContext(ctx, cmd, device.WithTimeout(5*time.Second))
+		if err != nil {
+			return err
+		}
+		if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+			return fmt.Errorf("request MQTTPUB error:%v", ATResponse.Data)
+		}
+		return nil
+	}
+	cmd := fmt.Sprintf("AT+MQTTPUBRAW=0,%s,%d,%d,%d\r\n", device.Quote(Topic), len(Payload), QoS, btoi(Retain))
+	ATResponse, err := C.Esp32.ATContext(ctx, cmd, device.WithPayload(Payload), device.WithTimeout(5*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "+MQTTPUB:OK" {
+		return fmt.Errorf("request MQTTPUBRAW error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+func printable(Payload []byte) bool {
+	for _, b := range Payload {
+		if b < 0x20 || b > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*
+* 订阅 topic filter, 支持 '+' 和 '#' 通配符, 同一个 filter 再次订阅时替换 Handler
+* AT+MQTTSUB=<LinkID>,<"topic">,<qos>
+*
+ */
+func (C *Client) Subscribe(ctx context.Context, Filter string, QoS int, Handler Handler) error {
+	if err := validFilter(Filter); err != nil {
+		return err
+	}
+	if QoS < 0 || QoS > 2 {
+		return errors.New("qos must be between 0 and 2")
+	}
+	if Handler == nil {
+		return errors.New("handler must not be nil")
+	}
+	// The handler goes first, retained messages follow the OK at once.
+	C.lock.Lock()
+	Old, Existed := C.handlers[Filter]
+	C.handlers[Filter] = subscription{QoS: QoS, Handler: Handler}
+	C.lock.Unlock()
+	if err := C.subscribe(ctx, Filter, QoS); err != nil {
+		C.lock.Lock()
+		if Existed {
+			C.handlers[Filter] = Old
+		} else {
+			delete(C.handlers, Filter)
+		}
+		C.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// subscribe accepts the ALREADY SUBSCRIBE of a filter the module still has.
+func (C *Client) subscribe(ctx context.Context, Filter string, QoS int) error {
+	cmd := fmt.Sprintf("AT+MQTTSUB=0,%s,%d\r\n", device.Quote(Filter), QoS)
+	ATResponse, err := C.Esp32.ATContext(ctx, cmd, device.WithTimeout(5*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request MQTTSUB error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+/*
+*
+* 取消订阅, Handler 即使指令失败也会被移除, 重连后不再订阅
+* AT+MQTTUNSUB=<LinkID>,<"topic">
+*
+ */
+func (C *Client) Unsubscribe(ctx context.Context, Filter string) error {
+	C.lock.Lock()
+	delete(C.handlers, Filter)
+	C.lock.Unlock()
+	cmd := fmt.Sprintf("AT+MQTTUNSUB=0,%s\r\n", device.Quote(Filter))
+	ATResponse, err := C.Esp32.ATContext(ctx, cmd, device.WithTimeout(5*time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) == 0 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return fmt.Errorf("request MQTTUNSUB error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+/*
+*
+* 断开连接并清除配置, 不会发布遗嘱
+* AT+MQTTCLEAN=<LinkID>
+*
+ */
+func (C *Client) Close() error {
+	C.lock.Lock()
+	if C.closed {
+		C.lock.Unlock()
+		return nil
+	}
+	C.closed = true
+	C.connected = false
+	C.lock.Unlock()
+	C.cancel()
+	C.Esp32.Unsubscribe(C.urcs)
+	<-C.done
+	<-C.delivered
+	ctx, Cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer Cancel()
+	ATResponse, err := C.Esp32.ATContext(ctx, "AT+MQTTCLEAN=0\r\n", device.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return fmt.Errorf("request MQTTCLEAN error:%v", ATResponse.Data)
+	}
+	return nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
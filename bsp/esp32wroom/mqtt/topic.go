@@ -0,0 +1,75 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+// ESP-AT limits topics and topic filters to 128 bytes.
+const maxTopicLen = 128
+
+/*
+*
+* Match 判断 topic 是否匹配订阅的 filter: '+' 匹配一级, '#' 匹配剩下的所有层级
+* (包括父级, "a/#" 匹配 "a"), 以 '$' 开头的 topic 不匹配以通配符开头的 filter
+*
+ */
+func Match(Filter, Topic string) bool {
+	if strings.HasPrefix(Topic, "$") && (strings.HasPrefix(Filter, "+") || strings.HasPrefix(Filter, "#")) {
+		return false
+	}
+	Filters, Topics := strings.Split(Filter, "/"), strings.Split(Topic, "/")
+	for i, F := range Filters {
+		if F == "#" {
+			return true
+		}
+		if i >= len(Topics) || (F != "+" && F != Topics[i]) {
+			return false
+		}
+	}
+	return len(Filters) == len(Topics)
+}
+
+// validTopic checks a topic to publish to, it must not have wildcards.
+func validTopic(Topic string) error {
+	if Topic == "" || len(Topic) > maxTopicLen {
+		return errors.New("topic length must be between 1 and 128")
+	}
+	if strings.ContainsAny(Topic, "+#") {
+		return errors.New("topic must not contain wildcards")
+	}
+	return nil
+}
+
+// validFilter checks a topic filter: '#' only as the last level and both
+// wildcards only as a whole level.
+func validFilter(Filter string) error {
+	if Filter == "" || len(Filter) > maxTopicLen {
+		return errors.New("topic filter length must be between 1 and 128")
+	}
+	Levels := strings.Split(Filter, "/")
+	for i, Level := range Levels {
+		if strings.Contains(Level, "#") && (Level != "#" || i != len(Levels)-1) {
+			return errors.New("'#' must be the last level of a topic filter")
+		}
+		if strings.Contains(Level, "+") && Level != "+" {
+			return errors.New("'+' must be a whole level of a topic filter")
+		}
+	}
+	return nil
+}
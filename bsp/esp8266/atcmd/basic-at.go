@@ -15,12 +15,34 @@
 
 package atcmd
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
 // AT
-func At() string {
-	return ""
+func At(ctx context.Context, Esp8266 device.Device) (bool, error) {
+	ATResponse, err := Esp8266.ATContext(ctx, "AT\r\n", device.WithTimeout(100*time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		return false, fmt.Errorf("request AT error:%v", ATResponse.Data)
+	}
+	return true, nil
 }
 
 // AT+GMR
-func GMR() string {
-	return ""
+func GMR(ctx context.Context, Esp8266 device.Device) ([]string, error) {
+	ATResponse, err := Esp8266.ATContext(ctx, "AT+GMR\r\n", device.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if len(ATResponse.Data) < 2 || ATResponse.Data[len(ATResponse.Data)-1] != "OK" {
+		return nil, fmt.Errorf("request GMR error:%v", ATResponse.Data)
+	}
+	return ATResponse.Data[:len(ATResponse.Data)-1], nil
 }
@@ -16,6 +16,7 @@
 package atcmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -29,8 +30,8 @@ import (
 * AT+MAC?
 *
  */
-func MAC(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+MAC?\r\n", 200*time.Millisecond)
+func MAC(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+MAC?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -60,13 +61,13 @@ func IsMAC(MAC string) error {
 	return nil
 }
 
-func SetMAC(Mx01 device.Device, MAC string) (bool, error) {
+func SetMAC(ctx context.Context, Mx01 device.Device, MAC string) (bool, error) {
 	err := IsMAC(MAC)
 	if err != nil {
 		return false, err
 	}
 	cmd := fmt.Sprintf("AT+MAC=%s\r\n", MAC)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -84,8 +85,8 @@ func SetMAC(Mx01 device.Device, MAC string) (bool, error) {
 * AT+NAME?
 *
  */
-func NAME(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+NAME?\r\n", 200*time.Millisecond)
+func NAME(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+NAME?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -101,12 +102,12 @@ func NAME(Mx01 device.Device) (string, error) {
 *
  */
 
-func SetNAME(Mx01 device.Device, NAME string) (bool, error) {
+func SetNAME(ctx context.Context, Mx01 device.Device, NAME string) (bool, error) {
 	if len(NAME) > 20 {
 		return false, errors.New("name length error")
 	}
 	cmd := fmt.Sprintf("AT+NAME=%s\r\n", NAME)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -125,8 +126,8 @@ func SetNAME(Mx01 device.Device, NAME string) (bool, error) {
 *
  */
 
-func ADV(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+ADV?\r\n", 200*time.Millisecond)
+func ADV(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+ADV?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -141,12 +142,12 @@ func ADV(Mx01 device.Device) (string, error) {
 *AT+ADV=<NUM>设置广播状态
 *
  */
-func SetADV(Mx01 device.Device, NUM int) (bool, error) {
+func SetADV(ctx context.Context, Mx01 device.Device, NUM int) (bool, error) {
 	if NUM != 1 && NUM != 0 {
 		return false, errors.New("num value error")
 	}
 	cmd := fmt.Sprintf("AT+ADV=%d\r\n", NUM)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -165,8 +166,8 @@ func SetADV(Mx01 device.Device, NUM int) (bool, error) {
 *
  */
 
-func UART(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+UART?\r\n", 200*time.Millisecond)
+func UART(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+UART?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -181,12 +182,12 @@ func UART(Mx01 device.Device) (string, error) {
 * AT+UART=<NUM>设置设备波特率
 *<NUM>:0:9600/ 1:14400/ 2:19200/ 3:38400/ 4:57600/ 5:115200
  */
-func SetUART(Mx01 device.Device, NUM int) (bool, error) {
+func SetUART(ctx context.Context, Mx01 device.Device, NUM int) (bool, error) {
 	if NUM < 0 || NUM > 5 {
 		return false, errors.New("num value error")
 	}
 	cmd := fmt.Sprintf("AT+UART=%d\r\n", NUM)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -205,8 +206,13 @@ func SetUART(Mx01 device.Device, NUM int) (bool, error) {
 *
  */
 
-func DEV(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+DEV?\r\n", 200*time.Millisecond)
+func DEV(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+DEV?\r\n",
+		device.WithTimeout(200*time.Millisecond), device.WithOptionalAnswer())
+	// 没有连接时模组不返回任何数据
+	if errors.Is(err, device.ErrTimeout) && len(ATResponse.Data) == 0 {
+		return "No device connected", nil
+	}
 	if err != nil {
 		return "", err
 	}
@@ -225,12 +231,12 @@ func DEV(Mx01 device.Device) (string, error) {
 *0-断开所有连接的从设备 1-主动断开与主机端设备的连接,
  */
 //还没有正确实现
-func DISCONN(Mx01 device.Device, NUM int) (string, error) {
+func DISCONN(ctx context.Context, Mx01 device.Device, NUM int) (string, error) {
 	if NUM != 1 && NUM != 0 {
 		return "", errors.New("num value error")
 	}
 	//cmd := fmt.Sprintf("AT+DISCONN=%d\r\n", NUM)
-	ATResponse, err := Mx01.AT("AT+DISCONN=1\r\n", 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, "AT+DISCONN=1\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -247,8 +253,8 @@ func DISCONN(Mx01 device.Device, NUM int) (string, error) {
 *
  */
 
-func AINTVL(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+AINTVL?\r\n", 200*time.Millisecond)
+func AINTVL(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+AINTVL?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -263,12 +269,12 @@ func AINTVL(Mx01 device.Device) (string, error) {
 * AT+AINTVL= <NUM>设置广播间隔
 *<NUM>：20-10000 单位毫秒
  */
-func SetAINTVL(Mx01 device.Device, NUM int) (bool, error) {
+func SetAINTVL(ctx context.Context, Mx01 device.Device, NUM int) (bool, error) {
 	if NUM < 20 || NUM > 10000 {
 		return false, errors.New("num value error")
 	}
 	cmd := fmt.Sprintf("AT+AINTVL=%d\r\n", NUM)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -287,8 +293,8 @@ func SetAINTVL(Mx01 device.Device, NUM int) (bool, error) {
 *
  */
 
-func VER(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+VER?\r\n", 200*time.Millisecond)
+func VER(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+VER?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -303,8 +309,9 @@ func VER(Mx01 device.Device) (string, error) {
 * AT+RESET=1 恢复出厂设置
 *
  */
-func RESET(Mx01 device.Device) (bool, error) {
-	ATResponse, err := Mx01.AT("AT+RESET=1\r\n", 200*time.Millisecond)
+func RESET(ctx context.Context, Mx01 device.Device) (bool, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+RESET=1\r\n",
+		device.WithTimeout(200*time.Millisecond), device.WithPriority(device.PriorityUrgent))
 	if err != nil {
 		return false, err
 	}
@@ -322,8 +329,9 @@ func RESET(Mx01 device.Device) (bool, error) {
 * AT+REBOOT=1 设置模组重启。
 *
  */
-func REBOOT(Mx01 device.Device) (bool, error) {
-	ATResponse, err := Mx01.AT("AT+REBOOT=1\r\n", 200*time.Millisecond)
+func REBOOT(ctx context.Context, Mx01 device.Device) (bool, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+REBOOT=1\r\n",
+		device.WithTimeout(200*time.Millisecond), device.WithPriority(device.PriorityUrgent))
 	if err != nil {
 		return false, err
 	}
@@ -341,8 +349,8 @@ func REBOOT(Mx01 device.Device) (bool, error) {
 * AT+TXPOWER? 查询模组的发射功率
 *
  */
-func TXPOWER(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+TXPOWER?\r\n", 200*time.Millisecond)
+func TXPOWER(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+TXPOWER?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -357,12 +365,12 @@ func TXPOWER(Mx01 device.Device) (string, error) {
 * AT+TXPOWER=<NUM> 设置模组的发射功率
 *NUM:0:5dbm/ 1:4dbm/ 2:3dbm/ 3:0dbm/ 4:-2dbm/ 5:-5dbm/ 6:-6dbm/ 7:-10dbm/ 8:-15dbm/
  */
-func SetTXPOWER(Mx01 device.Device, NUM int) (bool, error) {
+func SetTXPOWER(ctx context.Context, Mx01 device.Device, NUM int) (bool, error) {
 	if NUM < 0 || NUM > 8 {
 		return false, errors.New("num value error")
 	}
 	cmd := fmt.Sprintf("AT+TXPOWER=%d\r\n", NUM)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -380,8 +388,8 @@ func SetTXPOWER(Mx01 device.Device, NUM int) (bool, error) {
 * AT+UUIDS? 查询 BLE 主服务通道
 *
  */
-func UUIDS(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+UUIDS?\r\n", 200*time.Millisecond)
+func UUIDS(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+UUIDS?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -410,13 +418,13 @@ func IsUUID(UUID string) error {
 	return nil
 }
 
-func SetUUIDS(Mx01 device.Device, UUID string) (bool, error) {
+func SetUUIDS(ctx context.Context, Mx01 device.Device, UUID string) (bool, error) {
 	err := IsUUID(UUID)
 	if err != nil {
 		return false, err
 	}
 	cmd := fmt.Sprintf("AT+UUIDS=%s\r\n", UUID)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -434,8 +442,8 @@ func SetUUIDS(Mx01 device.Device, UUID string) (bool, error) {
 * AT+UUIDN? 查询 BLE 读服务通道
 *
  */
-func UUIDN(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+UUIDN?\r\n", 200*time.Millisecond)
+func UUIDN(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+UUIDN?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -450,13 +458,13 @@ func UUIDN(Mx01 device.Device) (string, error) {
 * AT+UUIDN=<UUID> 设置 BLE 读服务通道
 *支持参数：16bit 格式或 128bit 格式的 UUID
  */
-func SetUUIDN(Mx01 device.Device, UUID string) (bool, error) {
+func SetUUIDN(ctx context.Context, Mx01 device.Device, UUID string) (bool, error) {
 	err := IsUUID(UUID)
 	if err != nil {
 		return false, err
 	}
 	cmd := fmt.Sprintf("AT+UUIDN=%s\r\n", UUID)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -474,8 +482,8 @@ func SetUUIDN(Mx01 device.Device, UUID string) (bool, error) {
 * AT+UUIDW? 查询 BLE 写服务通道
 *
  */
-func UUIDW(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+UUIDW?\r\n", 200*time.Millisecond)
+func UUIDW(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+UUIDW?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -490,13 +498,13 @@ func UUIDW(Mx01 device.Device) (string, error) {
 * AT+UUIDW=<UUID> 设置 BLE 写服务通道
 *支持参数：16bit 格式或 128bit 格式的 UUID
  */
-func SetUUIDW(Mx01 device.Device, UUID string) (bool, error) {
+func SetUUIDW(ctx context.Context, Mx01 device.Device, UUID string) (bool, error) {
 	err := IsUUID(UUID)
 	if err != nil {
 		return false, err
 	}
 	cmd := fmt.Sprintf("AT+UUIDW=%s\r\n", UUID)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -514,8 +522,8 @@ func SetUUIDW(Mx01 device.Device, UUID string) (bool, error) {
 * AT+AMDATA? 查询自定义广播数据
 *
  */
-func AMDATA(Mx01 device.Device) (string, error) {
-	ATResponse, err := Mx01.AT("AT+AMDATA?\r\n", 200*time.Millisecond)
+func AMDATA(ctx context.Context, Mx01 device.Device) (string, error) {
+	ATResponse, err := Mx01.ATContext(ctx, "AT+AMDATA?\r\n", device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return "", err
 	}
@@ -543,13 +551,13 @@ func IsAMDATA(UUID string) error {
 	return nil
 }
 
-func SetAMDATA(Mx01 device.Device, AMDATA string) (bool, error) {
+func SetAMDATA(ctx context.Context, Mx01 device.Device, AMDATA string) (bool, error) {
 	err := IsAMDATA(AMDATA)
 	if err != nil {
 		return false, err
 	}
 	cmd := fmt.Sprintf("AT+AMDATA=%s\r\n", AMDATA)
-	ATResponse, err := Mx01.AT(cmd, 200*time.Millisecond)
+	ATResponse, err := Mx01.ATContext(ctx, cmd, device.WithTimeout(200*time.Millisecond))
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,574 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+* ATDialect 描述模组返回数据的格式
+*
+ */
+type ATDialect struct {
+	// Echo is true when the module echoes every command back (ATE1).
+	Echo bool
+	// IsFinal reports whether Line terminates the response of AtCmd.
+	IsFinal func(AtCmd, Line string) bool
+	// URCs lists the prefixes of unsolicited result codes.
+	URCs []string
+	// DecodeError turns a failed response into an error, the last line
+	// is the final result code. Nil means a plain *CommandError.
+	DecodeError func(AtCmd string, Lines []string) error
+	// Payload is asked about the head of a line each time a ':' or ','
+	// arrives, a head such as "+IPD,0,5:" announces Size bytes of binary
+	// data that are taken as they are instead of being split into lines.
+	Payload func(Head string) (Size int, ok bool)
+}
+
+// DefaultFinal recognises the final result codes of V.250 style firmwares.
+func DefaultFinal(AtCmd, Line string) bool {
+	switch Line {
+	case "OK", "ERROR", "FAIL", "SEND OK", "SEND FAIL":
+		return true
+	}
+	return false
+}
+
+// IsFailure reports whether a final result code means the command failed.
+func IsFailure(Line string) bool {
+	switch Line {
+	case "ERROR", "FAIL", "SEND FAIL":
+		return true
+	}
+	return false
+}
+
+type atRequest struct {
+	Command  string
+	Timeout  time.Duration
+	Priority Priority
+	echo     bool
+	lines    []string
+	handler  func(Line string) bool
+	optional bool
+	payload  []byte
+	raw      *RawPort
+	prompted bool
+	prompt   chan struct{}
+	done     chan struct{}
+	final    chan struct{}
+	err      error
+}
+
+func (R *atRequest) finish(err error) {
+	R.err = err
+	close(R.done)
+}
+
+// prompts reports whether R waits for the '>' prompt.
+func (R *atRequest) prompts() bool {
+	return R.payload != nil || R.raw != nil
+}
+
+/*
+*
+* ATOption 调整单条指令的执行方式
+*
+ */
+type ATOption func(R *atRequest)
+
+// WithTimeout bounds the wait for the final result code from the moment
+// the command leaves the queue, without it the command waits as long as its
+// context allows.
+func WithTimeout(Timeout time.Duration) ATOption {
+	return func(R *atRequest) {
+		R.Timeout = Timeout
+	}
+}
+
+// WithLineHandler streams the intermediate lines of a response to handler,
+// for commands such as AT+CWLAP whose answer has no upper bound. Lines the
+// handler returns true for are not kept in ATResponse.Data. The handler runs
+// on the reader goroutine and must not issue commands.
+func WithLineHandler(handler func(Line string) bool) ATOption {
+	return func(R *atRequest) {
+		R.handler = handler
+	}
+}
+
+// WithOptionalAnswer is for commands the module leaves unanswered in some
+// states, such as AT+DEV? of the MX01 without a link. A timeout ends such a
+// command for good, the next command does not wait for a late answer.
+func WithOptionalAnswer() ATOption {
+	return func(R *atRequest) {
+		R.optional = true
+	}
+}
+
+// WithPayload sends data after the '>' prompt of commands such as
+// AT+CIPSEND=0,5, the OK in front of the prompt does not end the command.
+func WithPayload(data []byte) ATOption {
+	return func(R *atRequest) {
+		R.payload = data
+	}
+}
+
+/*
+*
+* ATEngine 是通用的行式 AT 传输引擎, 由一个后台协程负责读取串口,
+* 按行切分后交给当前正在执行的指令, 收到最终结果码即返回。
+*
+ */
+type ATEngine struct {
+	io      io.ReadWriteCloser
+	dialect ATDialect
+	queue   atQueue
+	lock    sync.Mutex
+	pending *atRequest
+	orphan  *atRequest
+	echo    bool
+	buffer  []byte
+	data    *atPayload
+	raw     *RawPort
+	err     error
+	once    sync.Once
+	closed  chan struct{}
+	stopped chan struct{}
+
+	subscriptions []*subscription
+	values        map[any]any
+}
+
+// atPayload collects the binary data announced by a line head.
+type atPayload struct {
+	head string
+	size int
+	data []byte
+}
+
+func NewATEngine(io io.ReadWriteCloser, dialect ATDialect) *ATEngine {
+	if dialect.IsFinal == nil {
+		dialect.IsFinal = DefaultFinal
+	}
+	Engine := &ATEngine{
+		io:      io,
+		dialect: dialect,
+		echo:    dialect.Echo,
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go Engine.readLoop()
+	return Engine
+}
+
+func (Engine *ATEngine) readLoop() {
+	defer close(Engine.stopped)
+	var chunk [256]byte
+	for {
+		N, errRead := Engine.io.Read(chunk[:])
+		if N > 0 {
+			Engine.feed(chunk[:N])
+		}
+		select {
+		case <-Engine.closed:
+			return
+		default:
+		}
+		if errRead != nil {
+			if strings.Contains(errRead.Error(), "timeout") {
+				continue
+			}
+			Engine.fail(errRead)
+			return
+		}
+	}
+}
+
+func (Engine *ATEngine) fail(err error) {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	if Engine.err == nil {
+		Engine.err = err
+	}
+	if Engine.pending != nil {
+		Engine.pending.finish(err)
+		Engine.pending = nil
+	}
+	if Engine.raw != nil {
+		Engine.raw.stop()
+	}
+	Engine.closeSubscriptions()
+}
+
+func (Engine *ATEngine) feed(data []byte) {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	for len(data) > 0 {
+		if Engine.raw != nil {
+			Engine.raw.push(data)
+			return
+		}
+		if P := Engine.data; P != nil {
+			N := min(P.size-len(P.data), len(data))
+			P.data = append(P.data, data[:N]...)
+			data = data[N:]
+			if len(P.data) == P.size {
+				Engine.data = nil
+				Engine.dispatch(P.head, P.data)
+			}
+			continue
+		}
+		b := data[0]
+		data = data[1:]
+		if b != '\n' {
+			Engine.buffer = append(Engine.buffer, b)
+			Engine.frame(b)
+			continue
+		}
+		Line := strings.TrimRight(string(Engine.buffer), "\r")
+		Engine.buffer = Engine.buffer[:0]
+		if Line != "" {
+			Engine.dispatch(Line, nil)
+		}
+	}
+}
+
+// frame looks at the partial line after each byte for the '>' prompt and
+// for heads of binary payloads, the caller must hold Engine.lock.
+func (Engine *ATEngine) frame(b byte) {
+	if R := Engine.pending; R != nil && R.prompts() && !R.prompted &&
+		b == '>' && len(Engine.buffer) == 1 {
+		Engine.buffer = Engine.buffer[:0]
+		R.prompted = true
+		close(R.prompt)
+		if R.raw != nil {
+			// Everything after the prompt belongs to the raw port.
+			Engine.raw = R.raw
+			Engine.pending = nil
+			close(R.final)
+			R.finish(nil)
+		}
+		return
+	}
+	if (b != ':' && b != ',') || Engine.dialect.Payload == nil || Engine.buffer[0] != '+' {
+		return
+	}
+	Head := string(Engine.buffer)
+	Size, ok := Engine.dialect.Payload(Head)
+	if !ok {
+		return
+	}
+	Engine.buffer = Engine.buffer[:0]
+	if Size == 0 {
+		Engine.dispatch(Head, []byte{})
+		return
+	}
+	Engine.data = &atPayload{head: Head, size: Size, data: make([]byte, 0, Size)}
+}
+
+// dispatch hands a complete line to the pending command or to the URC
+// subscribers. Data is non-nil when Line is the head of a binary payload,
+// the caller must hold Engine.lock.
+func (Engine *ATEngine) dispatch(Line string, Data []byte) {
+	if Data != nil {
+		Engine.dispatchData(Line, Data)
+		return
+	}
+	R := Engine.pending
+	if O := Engine.orphan; O != nil && (R == nil || R.echo) &&
+		Engine.dialect.IsFinal(O.Command, Line) {
+		Engine.orphan = nil
+		close(O.final)
+		return
+	}
+	if R == nil {
+		// The tail of a cancelled command is not unsolicited.
+		if Engine.orphan == nil || Engine.isURC(Line) {
+			Engine.publish(Line, nil)
+		}
+		return
+	}
+	Final := Engine.dialect.IsFinal(R.Command, Line)
+	// The OK in front of the '>' prompt only accepts the command.
+	if R.prompts() && !R.prompted && Line == "OK" {
+		Final = false
+	}
+	// AT+BLECONN? is answered with lines that look like the +BLECONN: URC.
+	Owned := Final || strings.HasPrefix(Line, CommandName(R.Command)+":")
+	if !Owned && Engine.isURC(Line) {
+		Engine.publish(Line, nil)
+		return
+	}
+	// The module dropped the command, nothing else will come for it.
+	if strings.HasPrefix(Line, "busy ") {
+		Engine.pending = nil
+		R.finish(ErrBusy)
+		return
+	}
+	if R.echo {
+		if Line == strings.TrimSpace(R.Command) {
+			// The module has moved on, nothing is left of older commands.
+			R.echo = false
+			Engine.orphan = nil
+			return
+		}
+		// Noise in front of the echo is skipped, an answer without it is not.
+		if Final {
+			Engine.pending = nil
+			R.finish(ErrEchoMismatch)
+		}
+		return
+	}
+	if R.handler != nil && !Final && R.handler(Line) {
+		return
+	}
+	R.lines = append(R.lines, Line)
+	if Final {
+		Engine.pending = nil
+		Engine.track(R.Command, Line)
+		close(R.final)
+		R.finish(Engine.decode(R))
+	}
+}
+
+// dispatchData hands a binary payload to the pending command when it
+// answers with one (AT+CIPRECVDATA), otherwise to the subscribers of its
+// head without the trailing separator.
+func (Engine *ATEngine) dispatchData(Head string, Data []byte) {
+	R := Engine.pending
+	if R != nil && !R.echo && strings.HasPrefix(Head, CommandName(R.Command)+":") {
+		R.lines = append(R.lines, Head+string(Data))
+		return
+	}
+	Engine.publish(Head[:len(Head)-1], Data)
+}
+
+// decode maps a failed final result code to an error.
+func (Engine *ATEngine) decode(R *atRequest) error {
+	Final := R.lines[len(R.lines)-1]
+	if !IsFailure(Final) {
+		return nil
+	}
+	if Engine.dialect.DecodeError != nil {
+		if err := Engine.dialect.DecodeError(R.Command, R.lines); err != nil {
+			return err
+		}
+	}
+	return &CommandError{Command: strings.TrimSpace(R.Command), Result: Final}
+}
+
+// track follows ATE0/ATE1 so that the echo check matches the module.
+func (Engine *ATEngine) track(AtCmd, Line string) {
+	if Line != "OK" {
+		return
+	}
+	switch strings.TrimSpace(AtCmd) {
+	case "ATE0":
+		Engine.echo = false
+	case "ATE1":
+		Engine.echo = true
+	}
+}
+
+func (Engine *ATEngine) AT(AtCmd string, HwCardResponseTimeout time.Duration) (ATResponse, error) {
+	return Engine.ATContext(context.Background(), AtCmd, WithTimeout(HwCardResponseTimeout))
+}
+
+/*
+*
+* ATContext 执行一条指令, ctx 取消后立即返回, 被放弃指令的剩余响应会被丢弃,
+* 不会影响下一条指令。
+*
+ */
+func (Engine *ATEngine) ATContext(ctx context.Context, AtCmd string, opts ...ATOption) (ATResponse, error) {
+	ATResponse := ATResponse{Command: AtCmd}
+	R := &atRequest{
+		Command:  AtCmd,
+		Priority: PriorityNormal,
+		prompt:   make(chan struct{}),
+		done:     make(chan struct{}),
+		final:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(R)
+	}
+	if err := Engine.queue.acquire(ctx, R.Priority); err != nil {
+		return ATResponse, err
+	}
+	defer Engine.queue.release()
+	return Engine.run(ctx, R)
+}
+
+// run sends R and waits for its response, the caller holds the queue. The
+// timeout of R starts here, only ctx limits the wait in the queue.
+func (Engine *ATEngine) run(ctx context.Context, R *atRequest) (ATResponse, error) {
+	ATResponse := ATResponse{Command: R.Command}
+	if R.Timeout > 0 {
+		var Cancel context.CancelFunc
+		ctx, Cancel = context.WithTimeoutCause(ctx, R.Timeout, ErrTimeout)
+		defer Cancel()
+	}
+	if err := Engine.drain(ctx); err != nil {
+		return ATResponse, err
+	}
+	Engine.lock.Lock()
+	if Engine.err != nil {
+		Engine.lock.Unlock()
+		return ATResponse, Engine.err
+	}
+	R.echo = Engine.echo
+	Engine.pending = R
+	Engine.lock.Unlock()
+	if _, errWrite := Engine.io.Write([]byte(R.Command)); errWrite != nil {
+		Engine.abandon(R, errWrite)
+		Engine.lock.Lock()
+		if Engine.orphan == R {
+			Engine.orphan = nil
+		}
+		Engine.lock.Unlock()
+	}
+	if R.payload != nil {
+		Engine.send(ctx, R)
+	}
+	select {
+	case <-R.done:
+	case <-ctx.Done():
+		Engine.abandon(R, context.Cause(ctx))
+	}
+	<-R.done
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	ATResponse.Data = append([]string{}, R.lines...)
+	return ATResponse, R.err
+}
+
+// send writes the payload once the module prompts for it. The module is
+// deaf to commands until it has the announced number of bytes, so the
+// payload goes out even when ctx ends shortly after the command was sent.
+func (Engine *ATEngine) send(ctx context.Context, R *atRequest) {
+	select {
+	case <-R.prompt:
+	case <-R.done:
+		return
+	case <-ctx.Done():
+		Timer := time.NewTimer(drainTimeout)
+		defer Timer.Stop()
+		select {
+		case <-R.prompt:
+		case <-R.done:
+			return
+		case <-Timer.C:
+			return
+		}
+	}
+	if _, errWrite := Engine.io.Write(R.payload); errWrite != nil {
+		Engine.abandon(R, errWrite)
+		Engine.lock.Lock()
+		if Engine.orphan == R {
+			Engine.orphan = nil
+		}
+		Engine.lock.Unlock()
+	}
+}
+
+// drainTimeout bounds how long a payload still goes out after the command
+// that announced it was cancelled.
+const drainTimeout = time.Second
+
+// drain waits for the final result code of a cancelled command. With echo
+// on there is no need to wait, the echo of the next command tells the two
+// answers apart. Without echo a late OK or ERROR would be taken as the
+// answer of the next command, so nothing is sent before it arrives, however
+// long the module takes, unless the command may go unanswered. Flush gives
+// up on it.
+func (Engine *ATEngine) drain(ctx context.Context) error {
+	Engine.lock.Lock()
+	O := Engine.orphan
+	Echo := Engine.echo
+	if O != nil && O.optional && errors.Is(O.err, ErrTimeout) {
+		Engine.orphan, O = nil, nil
+	}
+	Engine.lock.Unlock()
+	if O == nil || Echo {
+		return nil
+	}
+	select {
+	case <-O.final:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// abandon stops waiting for R unless it finished in the meantime, the
+// rest of its response is swallowed.
+func (Engine *ATEngine) abandon(R *atRequest, err error) {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	if Engine.pending == R {
+		Engine.pending = nil
+		Engine.orphan = R
+		R.finish(err)
+	}
+}
+
+/*
+*
+* Value 返回设备上 Key 对应的状态, 第一次调用时由 New 创建。连接表这类按模组
+* 区分的状态挂在设备上, 不用全局表。New 执行时设备被锁住, 不能再调用设备的方法。
+*
+ */
+func (Engine *ATEngine) Value(Key any, New func() any) any {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	if Engine.values == nil {
+		Engine.values = map[any]any{}
+	}
+	V, ok := Engine.values[Key]
+	if !ok {
+		V = New()
+		Engine.values[Key] = V
+	}
+	return V
+}
+
+// Flush drops a partially received line and stops waiting for the answer
+// of a cancelled command, for a module that was reset in the meantime.
+func (Engine *ATEngine) Flush() {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	Engine.buffer = Engine.buffer[:0]
+	Engine.data = nil
+	Engine.orphan = nil
+}
+
+func (Engine *ATEngine) Close() error {
+	var errClose error
+	Engine.once.Do(func() {
+		close(Engine.closed)
+		errClose = Engine.io.Close()
+		<-Engine.stopped
+		Engine.fail(ErrClosed)
+	})
+	return errClose
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"strings"
+)
+
+// Quote wraps a string parameter in double quotes, escaping the characters
+// AT parsers treat specially (`"`, `,` and `\`).
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', ',', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+/*
+*
+* SplitFields 按逗号切分响应参数, 引号内的逗号不切分, 返回的字段去掉了引号:
+* `"rhilex","24:0a:c4:d6:e4:44",6,-40` => [rhilex 24:0a:c4:d6:e4:44 6 -40]
+*
+ */
+func SplitFields(s string) []string {
+	Fields := []string{}
+	var Field strings.Builder
+	Quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			Quoted = !Quoted
+		case c == ',' && !Quoted:
+			Fields = append(Fields, Field.String())
+			Field.Reset()
+		default:
+			Field.WriteByte(c)
+		}
+	}
+	return append(Fields, Field.String())
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+*
+* 指令优先级, 高优先级的指令(复位, 中止)排在普通轮询指令前面执行
+*
+ */
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityUrgent
+)
+
+func WithPriority(Priority Priority) ATOption {
+	return func(R *atRequest) {
+		R.Priority = Priority
+	}
+}
+
+/*
+*
+* 指令队列统计, 用来观察串口争用情况
+*
+ */
+type QueueStats struct {
+	Depth     int           `json:"depth"`
+	Busy      bool          `json:"busy"`
+	Executed  uint64        `json:"executed"`
+	TotalWait time.Duration `json:"totalWait"`
+	MaxWait   time.Duration `json:"maxWait"`
+	LastWait  time.Duration `json:"lastWait"`
+}
+
+func (O QueueStats) AverageWait() time.Duration {
+	if O.Executed == 0 {
+		return 0
+	}
+	return O.TotalWait / time.Duration(O.Executed)
+}
+
+func (O QueueStats) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+type atWaiter struct {
+	priority Priority
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+// atWaiters is a heap ordered by priority, then by arrival.
+type atWaiters []*atWaiter
+
+func (Q atWaiters) Len() int { return len(Q) }
+func (Q atWaiters) Less(i, j int) bool {
+	if Q[i].priority != Q[j].priority {
+		return Q[i].priority > Q[j].priority
+	}
+	return Q[i].seq < Q[j].seq
+}
+func (Q atWaiters) Swap(i, j int) {
+	Q[i], Q[j] = Q[j], Q[i]
+	Q[i].index = i
+	Q[j].index = j
+}
+func (Q *atWaiters) Push(x any) {
+	W := x.(*atWaiter)
+	W.index = len(*Q)
+	*Q = append(*Q, W)
+}
+func (Q *atWaiters) Pop() any {
+	old := *Q
+	W := old[len(old)-1]
+	old[len(old)-1] = nil
+	W.index = -1
+	*Q = old[:len(old)-1]
+	return W
+}
+
+// atQueue hands the port to one command at a time.
+type atQueue struct {
+	lock    sync.Mutex
+	busy    bool
+	seq     uint64
+	waiters atWaiters
+	stats   QueueStats
+}
+
+func (Q *atQueue) acquire(ctx context.Context, Priority Priority) error {
+	Start := time.Now()
+	Q.lock.Lock()
+	if !Q.busy && len(Q.waiters) == 0 {
+		Q.busy = true
+		Q.account(0)
+		Q.lock.Unlock()
+		return nil
+	}
+	Q.seq++
+	W := &atWaiter{priority: Priority, seq: Q.seq, ready: make(chan struct{})}
+	heap.Push(&Q.waiters, W)
+	Q.lock.Unlock()
+	select {
+	case <-W.ready:
+		Q.lock.Lock()
+		Q.account(time.Since(Start))
+		Q.lock.Unlock()
+		return nil
+	case <-ctx.Done():
+		Q.lock.Lock()
+		defer Q.lock.Unlock()
+		if W.index >= 0 {
+			heap.Remove(&Q.waiters, W.index)
+			return context.Cause(ctx)
+		}
+		// Granted while giving up: pass the turn on.
+		Q.next()
+		return context.Cause(ctx)
+	}
+}
+
+func (Q *atQueue) release() {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.next()
+}
+
+// next must be called with Q.lock held.
+func (Q *atQueue) next() {
+	if len(Q.waiters) == 0 {
+		Q.busy = false
+		return
+	}
+	W := heap.Pop(&Q.waiters).(*atWaiter)
+	close(W.ready)
+}
+
+// account must be called with Q.lock held.
+func (Q *atQueue) account(Wait time.Duration) {
+	Q.stats.Executed++
+	Q.stats.TotalWait += Wait
+	Q.stats.LastWait = Wait
+	if Wait > Q.stats.MaxWait {
+		Q.stats.MaxWait = Wait
+	}
+}
+
+// QueueStats reports how many commands wait for the port and how long
+// they waited so far.
+func (Engine *ATEngine) QueueStats() QueueStats {
+	Engine.queue.lock.Lock()
+	defer Engine.queue.lock.Unlock()
+	Stats := Engine.queue.stats
+	Stats.Depth = len(Engine.queue.waiters)
+	Stats.Busy = Engine.queue.busy
+	return Stats
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+*
+* RawPort 是透传模式下交出的串口, 收发的数据不再按 AT 指令解析,
+* Release 之后串口回到指令模式。
+*
+ */
+type RawPort struct {
+	Engine *ATEngine
+	lock   sync.Mutex
+	cond   *sync.Cond
+	rx     []byte
+	done   bool
+	once   sync.Once
+}
+
+// push is called by the reader with Engine.lock held.
+func (P *RawPort) push(data []byte) {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	P.rx = append(P.rx, data...)
+	P.cond.Broadcast()
+}
+
+// Read blocks until the module sends something, it returns ErrClosed after
+// Release or when the engine stops.
+func (P *RawPort) Read(b []byte) (int, error) {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	for len(P.rx) == 0 && !P.done {
+		P.cond.Wait()
+	}
+	if len(P.rx) == 0 {
+		return 0, ErrClosed
+	}
+	N := copy(b, P.rx)
+	P.rx = P.rx[N:]
+	return N, nil
+}
+
+func (P *RawPort) Write(b []byte) (int, error) {
+	P.lock.Lock()
+	Done := P.done
+	P.lock.Unlock()
+	if Done {
+		return 0, ErrClosed
+	}
+	return P.Engine.io.Write(b)
+}
+
+// Release hands the port back to command mode, the module must have left
+// passthrough already. Bytes that were not read are dropped.
+func (P *RawPort) Release() {
+	P.once.Do(func() {
+		P.Engine.lock.Lock()
+		if P.Engine.raw == P {
+			P.Engine.raw = nil
+		}
+		P.Engine.buffer = P.Engine.buffer[:0]
+		P.Engine.data = nil
+		P.Engine.lock.Unlock()
+		P.stop()
+		P.Engine.queue.release()
+	})
+}
+
+func (P *RawPort) stop() {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	P.done = true
+	P.cond.Broadcast()
+}
+
+/*
+*
+* Passthrough 执行 AtCmd (例如透传模式下的 AT+CIPSEND), 收到 '>' 之后串口
+* 交给返回的 RawPort, 在 Release 之前其他指令都会排队等待。
+*
+ */
+func (Engine *ATEngine) Passthrough(ctx context.Context, AtCmd string, opts ...ATOption) (*RawPort, error) {
+	P := &RawPort{Engine: Engine}
+	P.cond = sync.NewCond(&P.lock)
+	R := &atRequest{
+		Command:  AtCmd,
+		Priority: PriorityNormal,
+		raw:      P,
+		prompt:   make(chan struct{}),
+		done:     make(chan struct{}),
+		final:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(R)
+	}
+	// run starts the timeout, the wait in the queue only ends with ctx.
+	if err := Engine.queue.acquire(ctx, R.Priority); err != nil {
+		return nil, err
+	}
+	if _, err := Engine.run(ctx, R); err != nil {
+		Engine.queue.release()
+		return nil, err
+	}
+	if !R.prompted {
+		// A response without the prompt, e.g. a firmware that is not in
+		// passthrough mode.
+		Engine.queue.release()
+		return nil, ErrNoPrompt
+	}
+	return P, nil
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+/*
+*
+* URC: 模组主动上报的数据, 例如 WIFI CONNECTED, +IPD,...
+*
+ */
+type URC struct {
+	Line string `json:"line"`
+	// Data is the binary payload that follows heads such as "+IPD,0,5:",
+	// Line is then the head without the ':'.
+	Data []byte    `json:"data,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func (O URC) String() string {
+	if bytes, err := json.Marshal(O); err != nil {
+		return ""
+	} else {
+		return string(bytes)
+	}
+}
+
+const urcBufferSize = 32
+
+type subscription struct {
+	prefix string
+	ch     chan URC
+	// backlog holds what did not fit into ch once a payload had to wait,
+	// pump forwards it in order.
+	backlog []URC
+	pumping bool
+	// removed is set by Unsubscribe and ended by Close, pump closes ch
+	// when it stops.
+	removed bool
+	ended   bool
+	gone    chan struct{}
+}
+
+// MatchURC reports whether Line starts with Prefix. Multi-link events such
+// as "0,CONNECT" also match on the part after the link id.
+func MatchURC(Prefix, Line string) bool {
+	if strings.HasPrefix(Line, Prefix) {
+		return true
+	}
+	i := strings.IndexByte(Line, ',')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range Line[:i] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return strings.HasPrefix(Line[i+1:], Prefix)
+}
+
+// CommandName returns the "+NAME" part of AT+NAME?, AT+NAME=... and AT+NAME.
+func CommandName(AtCmd string) string {
+	Name := strings.TrimPrefix(strings.TrimSpace(AtCmd), "AT")
+	if i := strings.IndexAny(Name, "?="); i > 0 {
+		Name = Name[:i]
+	}
+	if !strings.HasPrefix(Name, "+") {
+		return ""
+	}
+	return Name
+}
+
+/*
+*
+* 订阅以 prefix 开头的上报, prefix 为空时订阅全部上报以及没有指令等待时收到的数据。
+* 非空的 prefix 同时会被当作 URC, 不再混入指令的响应中。
+*
+ */
+func (Engine *ATEngine) Subscribe(prefix string) <-chan URC {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	S := &subscription{prefix: prefix, ch: make(chan URC, urcBufferSize), gone: make(chan struct{})}
+	if Engine.err != nil {
+		close(S.ch)
+		return S.ch
+	}
+	Engine.subscriptions = append(Engine.subscriptions, S)
+	return S.ch
+}
+
+func (Engine *ATEngine) Unsubscribe(ch <-chan URC) {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	for i, S := range Engine.subscriptions {
+		if S.ch == ch {
+			Engine.subscriptions = append(Engine.subscriptions[:i], Engine.subscriptions[i+1:]...)
+			S.removed = true
+			close(S.gone)
+			if !S.pumping {
+				close(S.ch)
+			}
+			return
+		}
+	}
+}
+
+// isURC must be called with Engine.lock held.
+func (Engine *ATEngine) isURC(Line string) bool {
+	for _, Prefix := range Engine.dialect.URCs {
+		if MatchURC(Prefix, Line) {
+			return true
+		}
+	}
+	for _, S := range Engine.subscriptions {
+		if S.prefix != "" && MatchURC(S.prefix, Line) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+* publish 不会阻塞读取协程。订阅者来不及读时丢弃最新的一行, 但是带数据的上报
+* (+IPD、+WS_DATA 等) 不能丢, 它们和之后的所有上报按顺序排队, 不限长度, 由
+* pump 协程转发。必须在持有 Engine.lock 时调用。
+*
+ */
+func (Engine *ATEngine) publish(Line string, Data []byte) {
+	U := URC{Line: Line, Data: Data, Time: time.Now()}
+	for _, S := range Engine.subscriptions {
+		if !MatchURC(S.prefix, Line) {
+			continue
+		}
+		if len(S.backlog) > 0 {
+			S.backlog = append(S.backlog, U)
+			continue
+		}
+		select {
+		case S.ch <- U:
+			continue
+		default:
+		}
+		if Data == nil {
+			continue
+		}
+		S.backlog = append(S.backlog, U)
+		if !S.pumping {
+			S.pumping = true
+			go Engine.pump(S)
+		}
+	}
+}
+
+// pump forwards the backlog of S until it is empty.
+func (Engine *ATEngine) pump(S *subscription) {
+	Engine.lock.Lock()
+	defer Engine.lock.Unlock()
+	for len(S.backlog) > 0 && !S.removed {
+		U := S.backlog[0]
+		Engine.lock.Unlock()
+		select {
+		case S.ch <- U:
+		case <-S.gone:
+		}
+		Engine.lock.Lock()
+		S.backlog[0] = URC{}
+		S.backlog = S.backlog[1:]
+	}
+	S.backlog = nil
+	S.pumping = false
+	if S.removed || S.ended {
+		close(S.ch)
+	}
+}
+
+func (Engine *ATEngine) closeSubscriptions() {
+	for _, S := range Engine.subscriptions {
+		// A backlog is still delivered, ch is closed after it.
+		S.ended = true
+		if !S.pumping {
+			close(S.ch)
+		}
+	}
+	Engine.subscriptions = nil
+}
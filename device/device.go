@@ -16,12 +16,19 @@
 package device
 
 import (
+	"context"
 	"time"
 )
 
 type Device interface {
 	Init(config map[string]any) error
 	AT(AtCmd string, HwCardResponseTimeout time.Duration) (ATResponse, error)
+	ATContext(ctx context.Context, AtCmd string, opts ...ATOption) (ATResponse, error)
+	Passthrough(ctx context.Context, AtCmd string, opts ...ATOption) (*RawPort, error)
+	Subscribe(prefix string) <-chan URC
+	Unsubscribe(ch <-chan URC)
+	QueueStats() QueueStats
+	Value(Key any, New func() any) any
 	Flush()
 	Close() error
 }
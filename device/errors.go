@@ -0,0 +1,62 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTimeout: 在超时时间内没有收到最终结果码
+	ErrTimeout = errors.New("AT command timeout")
+	// ErrEchoMismatch: 模组返回的回显和发送的指令不一致
+	ErrEchoMismatch = errors.New("AT command echo mismatch")
+	// ErrBusy: 模组正在处理上一条指令(busy p... / busy s...)
+	ErrBusy = errors.New("AT module busy")
+	// ErrClosed: 引擎已经关闭
+	ErrClosed = errors.New("AT engine closed")
+	// ErrCommand: 所有 *CommandError 都满足 errors.Is(err, ErrCommand)
+	ErrCommand = errors.New("AT command failed")
+	// ErrNoPrompt: 指令成功了但模组没有给出 '>' 提示符
+	ErrNoPrompt = errors.New("AT command without prompt")
+)
+
+/*
+*
+* CommandError: 模组返回了 ERROR/FAIL/SEND FAIL,
+* Code 和 Category 来自模组给出的错误码(例如 ESP-AT 的 ERR CODE)
+*
+ */
+type CommandError struct {
+	Command  string `json:"command"`
+	Result   string `json:"result"`
+	Code     uint32 `json:"code"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+func (E *CommandError) Error() string {
+	if E.Category == "" {
+		return fmt.Sprintf("AT command %q failed: %s", E.Command, E.Result)
+	}
+	return fmt.Sprintf("AT command %q failed: %s (code 0x%08x, %s: %s)",
+		E.Command, E.Result, E.Code, E.Category, E.Message)
+}
+
+func (E *CommandError) Is(target error) bool {
+	return target == ErrCommand
+}
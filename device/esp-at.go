@@ -0,0 +1,273 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+*
+* ESP-AT 固件(ESP32/ESP8266)的响应格式
+*
+ */
+var EspATDialect = ATDialect{
+	Echo:    true,
+	IsFinal: EspFinal,
+	URCs: []string{
+		"ready",
+		"WIFI CONNECTED",
+		"WIFI GOT IP",
+		"WIFI DISCONNECT",
+		"+IPD",
+		"CONNECT",
+		"CLOSED",
+		"+STA_CONNECTED:",
+		"+STA_DISCONNECTED:",
+		"+DIST_STA_IP:",
+		"+TIME_UPDATED",
+		"+MQTTCONNECTED:",
+		"+MQTTDISCONNECTED:",
+		"+MQTTSUBRECV:",
+		"+WS_CONNECTED:",
+		"+WS_DISCONNECTED:",
+		"+WS_CLOSED:",
+		"+WS_DATA:",
+		"+BLECONN:",
+		"+BLEDISCONN:",
+		"+BLECONNPARAM:",
+		"+BLESCAN:",
+		"+WRITE:",
+		"+NOTIFY:",
+		"+INDICATE:",
+	},
+	DecodeError: DecodeEspError,
+	Payload:     EspPayload,
+}
+
+// EspFinal adds the SET OK that AT+HTTPURLCFG answers after its data and
+// the +MQTTPUB:OK/+MQTTPUB:FAIL of AT+MQTTPUBRAW.
+func EspFinal(AtCmd, Line string) bool {
+	switch Line {
+	case "SET OK", "+MQTTPUB:OK", "+MQTTPUB:FAIL":
+		return true
+	}
+	return DefaultFinal(AtCmd, Line)
+}
+
+/*
+*
+* +IPD 后面跟着二进制数据, 字段个数区分不同的格式:
+*
+*	+IPD,<len>:                          单连接
+*	+IPD,<link ID>,<len>:                多连接
+*	+IPD,<len>,<"remote IP">,<port>:     单连接, AT+CIPDINFO=1
+*	+IPD,<link ID>,<len>,<"remote IP">,<port>:
+*
+* IPv6 地址中的 ':' 在引号内, 不会被当作分隔符。被动接收模式下 AT+CIPRECVDATA
+* 的数据在最后一个 ',' 后面, 只支持 AT+CIPDINFO=1 的格式, 否则无法区分地址和数据:
+*
+*	+CIPRECVDATA:<actual len>,<"remote IP">,<remote port>,<data>
+*
+* HTTP 客户端的响应体分段返回, 每段前面是长度:
+*
+*	+HTTPCLIENT:<size>,<data>
+*	+HTTPCGET:<size>,<data>
+*	+HTTPCPOST:<size>,<data>
+*	+HTTPCPUT:<size>,<data>
+*
+* MQTT 订阅收到的消息也一样, topic 在引号内:
+*
+*	+MQTTSUBRECV:<LinkID>,<"topic">,<data_length>,<data>
+*	+WS_DATA:<link_id>,<data_len>,<data>
+*
+* AT+FS 读文件和 AT+SYSFLASH 读分区的数据也一样:
+*
+*	+FS:<length>,<data>
+*	+SYSFLASH:<length>,<data>
+*
+ */
+func EspPayload(Head string) (int, bool) {
+	if Rest, ok := strings.CutPrefix(Head, "+CIPRECVDATA:"); ok {
+		return recvDataPayload(Rest)
+	}
+	if Rest, ok := strings.CutPrefix(Head, "+MQTTSUBRECV:"); ok {
+		return subRecvPayload(Rest)
+	}
+	if Rest, ok := strings.CutPrefix(Head, "+WS_DATA:"); ok {
+		return wsPayload(Rest)
+	}
+	for _, Prefix := range []string{"+HTTPCLIENT:", "+HTTPCGET:", "+HTTPCPOST:", "+HTTPCPUT:", "+FS:", "+SYSFLASH:"} {
+		if Rest, ok := strings.CutPrefix(Head, Prefix); ok {
+			return sizePayload(Rest)
+		}
+	}
+	if !strings.HasPrefix(Head, "+IPD,") || !strings.HasSuffix(Head, ":") ||
+		strings.Count(Head, "\"")%2 != 0 {
+		return 0, false
+	}
+	Fields := SplitFields(Head[len("+IPD,") : len(Head)-1])
+	i := 0
+	switch len(Fields) {
+	case 1, 3:
+	case 2, 4:
+		i = 1
+	default:
+		return 0, false
+	}
+	Size, err := strconv.Atoi(Fields[i])
+	if err != nil || Size < 0 {
+		return 0, false
+	}
+	return Size, true
+}
+
+// sizePayload reads the "<size>," in front of the data.
+func sizePayload(Head string) (int, bool) {
+	Size, err := strconv.Atoi(strings.TrimSuffix(Head, ","))
+	if !strings.HasSuffix(Head, ",") || err != nil || Size < 0 {
+		return 0, false
+	}
+	return Size, true
+}
+
+func wsPayload(Head string) (int, bool) {
+	if !strings.HasSuffix(Head, ",") {
+		return 0, false
+	}
+	Fields := strings.Split(Head[:len(Head)-1], ",")
+	if len(Fields) != 2 {
+		return 0, false
+	}
+	Size, err := strconv.Atoi(Fields[1])
+	if err != nil || Size < 0 {
+		return 0, false
+	}
+	return Size, true
+}
+
+func subRecvPayload(Head string) (int, bool) {
+	if !strings.HasSuffix(Head, ",") || strings.Count(Head, "\"")%2 != 0 {
+		return 0, false
+	}
+	Fields := SplitFields(Head[:len(Head)-1])
+	if len(Fields) != 3 {
+		return 0, false
+	}
+	Size, err := strconv.Atoi(Fields[2])
+	if err != nil || Size < 0 {
+		return 0, false
+	}
+	return Size, true
+}
+
+func recvDataPayload(Head string) (int, bool) {
+	if !strings.HasSuffix(Head, ",") || strings.Count(Head, "\"")%2 != 0 {
+		return 0, false
+	}
+	Fields := SplitFields(Head[:len(Head)-1])
+	if len(Fields) != 3 {
+		return 0, false
+	}
+	Size, err := strconv.Atoi(Fields[0])
+	if err != nil || Size < 0 {
+		return 0, false
+	}
+	return Size, true
+}
+
+/*
+*
+* ESP-AT 错误码: ERR CODE:0x01090000
+* bit31~24: 固定 0x01, bit23~16: 错误类型, bit15~0: 扩展信息(例如出错的参数序号)
+*
+ */
+type espErrorType struct {
+	Category string
+	Message  string
+}
+
+var espErrorTypes = map[uint32]espErrorType{
+	0x00: {"ESP_AT_SUB_OK", "OK"},
+	0x01: {"ESP_AT_SUB_COMMON_ERROR", "common error"},
+	0x02: {"ESP_AT_SUB_NO_TERMINATOR", "terminator character not found, \\r\\n expected"},
+	0x03: {"ESP_AT_SUB_NO_AT", "starting AT not found"},
+	0x04: {"ESP_AT_SUB_PARA_LENGTH_MISMATCH", "parameter length mismatch"},
+	0x05: {"ESP_AT_SUB_PARA_TYPE_MISMATCH", "parameter type mismatch"},
+	0x06: {"ESP_AT_SUB_PARA_NUM_MISMATCH", "parameter number mismatch"},
+	0x07: {"ESP_AT_SUB_PARA_INVALID", "the parameter is invalid"},
+	0x08: {"ESP_AT_SUB_PARA_PARSE_FAIL", "parse parameter fail"},
+	0x09: {"ESP_AT_SUB_UNSUPPORT_CMD", "the command is not supported"},
+	0x0A: {"ESP_AT_SUB_CMD_EXEC_FAIL", "the command execution failed"},
+	0x0B: {"ESP_AT_SUB_CMD_PROCESSING", "processing of previous command is in progress"},
+	0x0C: {"ESP_AT_SUB_CMD_OP_ERROR", "the command operation type is error"},
+}
+
+/*
+*
+* AT+CWJAP 失败时返回 +CWJAP:<error code>
+*
+ */
+var cwjapErrors = map[uint32]string{
+	1: "connection timeout",
+	2: "wrong password",
+	3: "cannot find the target AP",
+	4: "connection failed",
+}
+
+// DecodeEspError reads "ERR CODE:0x..." and "+CWJAP:<code>" out of a failed
+// ESP-AT response.
+func DecodeEspError(AtCmd string, Lines []string) error {
+	CommandError := &CommandError{
+		Command: strings.TrimSpace(AtCmd),
+		Result:  Lines[len(Lines)-1],
+	}
+	for _, Line := range Lines {
+		if Hex, ok := strings.CutPrefix(Line, "ERR CODE:"); ok {
+			Code, err := strconv.ParseUint(strings.TrimPrefix(Hex, "0x"), 16, 32)
+			if err != nil {
+				continue
+			}
+			CommandError.Code = uint32(Code)
+			Type, ok := espErrorTypes[(CommandError.Code>>16)&0xFF]
+			if !ok {
+				Type = espErrorType{"ESP_AT_SUB_UNKNOWN", "unknown error"}
+			}
+			CommandError.Category = Type.Category
+			CommandError.Message = Type.Message
+			if Extension := CommandError.Code & 0xFFFF; Extension != 0 {
+				CommandError.Message += fmt.Sprintf(" (extension 0x%04x)", Extension)
+			}
+			return CommandError
+		}
+		if Reason, ok := strings.CutPrefix(Line, "+CWJAP:"); ok && CommandName(AtCmd) == "+CWJAP" {
+			Code, err := strconv.ParseUint(Reason, 10, 32)
+			if err != nil {
+				continue
+			}
+			CommandError.Code = uint32(Code)
+			CommandError.Category = "WIFI"
+			CommandError.Message = cwjapErrors[CommandError.Code]
+			if CommandError.Message == "" {
+				CommandError.Message = "unknown wifi error"
+			}
+			return CommandError
+		}
+	}
+	return CommandError
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"strings"
+)
+
+type CommandType int
+
+const (
+	// AT+CMD
+	Execute CommandType = iota
+	// AT+CMD=?
+	Test
+	// AT+CMD?
+	Query
+	// AT+CMD=<args>
+	Set
+)
+
+/*
+*
+* Command: 模组收到的一条指令, AT+CWJAP="ssid","pwd" 解析为
+* Name="+CWJAP", Type=Set, Args=["ssid", "pwd"]
+*
+ */
+type Command struct {
+	Line string
+	Name string
+	Type CommandType
+	Args []string
+}
+
+func parseCommand(Line string) Command {
+	C := Command{Line: Line, Name: Line}
+	if !strings.HasPrefix(Line, "AT+") {
+		return C
+	}
+	Rest := Line[2:]
+	switch {
+	case strings.HasSuffix(Rest, "=?"):
+		C.Name, C.Type = strings.TrimSuffix(Rest, "=?"), Test
+	case strings.HasSuffix(Rest, "?") && !strings.Contains(Rest, "="):
+		C.Name, C.Type = strings.TrimSuffix(Rest, "?"), Query
+	case strings.Contains(Rest, "="):
+		i := strings.IndexByte(Rest, '=')
+		C.Name, C.Type = Rest[:i], Set
+		C.Args = parseArgs(Rest[i+1:])
+	default:
+		C.Name = Rest
+	}
+	return C
+}
+
+// parseArgs splits ESP-AT parameters, quoted strings lose their quotes and
+// escapes (\", \, and \\).
+func parseArgs(s string) []string {
+	Args := []string{}
+	var Arg strings.Builder
+	Quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case Quoted && c == '\\' && i+1 < len(s):
+			i++
+			Arg.WriteByte(s[i])
+		case c == '"':
+			Quoted = !Quoted
+		case c == ',' && !Quoted:
+			Args = append(Args, Arg.String())
+			Arg.Reset()
+		default:
+			Arg.WriteByte(c)
+		}
+	}
+	return append(Args, Arg.String())
+}
+
+// Arg returns the i-th parameter or "" when it is missing.
+func (C Command) Arg(i int) string {
+	if i < len(C.Args) {
+		return C.Args[i]
+	}
+	return ""
+}
+
+// quote wraps a string in double quotes the way ESP-AT prints it.
+func quote(s string) string {
+	return "\"" + s + "\""
+}
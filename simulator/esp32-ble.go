@@ -0,0 +1,183 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+*
+* Peripheral: 模拟器周围的一个 BLE 设备
+*
+ */
+type Peripheral struct {
+	Address  string
+	RSSI     int
+	AdvData  string
+	ScanRsp  string
+	AddrType int
+}
+
+type bleState struct {
+	role        int
+	name        string
+	addr        string
+	advertising bool
+	peripherals []Peripheral
+	conns       map[int]string
+}
+
+// AddPeripheral makes a BLE device visible to AT+BLESCAN.
+func (S *Esp32) AddPeripheral(P Peripheral) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.ble.peripherals = append(S.ble.peripherals, P)
+}
+
+// ConnectBLE simulates a central connecting to the module.
+func (S *Esp32) ConnectBLE(Index int, Address string) {
+	S.lock.Lock()
+	S.ble.conns[Index] = Address
+	S.ble.advertising = false
+	S.lock.Unlock()
+	S.Send(fmt.Sprintf("+BLECONN:%d,%s", Index, quote(Address)))
+}
+
+// DisconnectBLE simulates a central going away.
+func (S *Esp32) DisconnectBLE(Index int) {
+	S.lock.Lock()
+	Address, ok := S.ble.conns[Index]
+	delete(S.ble.conns, Index)
+	S.lock.Unlock()
+	if ok {
+		S.Send(fmt.Sprintf("+BLEDISCONN:%d,%s", Index, quote(Address)))
+	}
+}
+
+func (S *Esp32) resetBle() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.ble.role = 0
+	S.ble.advertising = false
+	S.ble.conns = map[int]string{}
+}
+
+// bleReady wraps handlers that need AT+BLEINIT first.
+func bleReady(Handler Handler) Handler {
+	return func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		Role := S.ble.role
+		S.lock.Unlock()
+		if Role == 0 {
+			return ErrExecFail
+		}
+		return Handler(S, C)
+	}
+}
+
+func (S *Esp32) registerBle() {
+	S.ble = bleState{name: "ESP32", addr: "24:0a:c4:d6:e4:46", conns: map[int]string{}}
+	S.handlers["+BLEINIT"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+BLEINIT:%d", S.ble.role))
+			return nil
+		case Set:
+			Role, err := strconv.Atoi(C.Arg(0))
+			if err != nil || Role < 0 || Role > 2 {
+				return ErrParamValue
+			}
+			S.ble.role = Role
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+BLEADDR"] = bleReady(func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send("+BLEADDR:" + quote(S.ble.addr))
+			return nil
+		case Set:
+			S.ble.addr = C.Arg(1)
+			return nil
+		}
+		return ErrUnsupported
+	})
+	S.handlers["+BLENAME"] = bleReady(func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send("+BLENAME:" + S.ble.name)
+			return nil
+		case Set:
+			if len(C.Arg(0)) == 0 || len(C.Arg(0)) > 32 {
+				return ErrParamValue
+			}
+			S.ble.name = C.Arg(0)
+			return nil
+		}
+		return ErrUnsupported
+	})
+	S.handlers["+BLESCAN"] = bleReady(func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		if C.Arg(0) == "0" {
+			return nil
+		}
+		S.lock.Lock()
+		Peripherals := append([]Peripheral{}, S.ble.peripherals...)
+		S.lock.Unlock()
+		S.Send("", "OK")
+		for _, P := range Peripherals {
+			S.Send(fmt.Sprintf("+BLESCAN:%s,%d,%s,%s,%d", quote(P.Address), P.RSSI,
+				P.AdvData, P.ScanRsp, P.AddrType))
+		}
+		return ErrNoReply
+	})
+	S.handlers["+BLEADVSTART"] = bleReady(func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ble.advertising = true
+		return nil
+	})
+	S.handlers["+BLEADVSTOP"] = bleReady(func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ble.advertising = false
+		return nil
+	})
+	S.handlers["+BLECONN"] = bleReady(func(S *Esp32, C Command) error {
+		if C.Type != Query {
+			return ErrUnsupported
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		for Index := 0; Index < 10; Index++ {
+			if Address, ok := S.ble.conns[Index]; ok {
+				S.Send(fmt.Sprintf("+BLECONN:%d,%s", Index, quote(Address)))
+			}
+		}
+		return nil
+	})
+}
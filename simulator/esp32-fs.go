@@ -0,0 +1,199 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fsChunk is the largest length AT+FS reads or writes at once.
+const fsChunk = 2048
+
+/*
+*
+* fsState: AT+FS 的 FAT 文件系统, 文件保存在内存里, 重启后保留, 只有挂载状态复位
+*
+ */
+type fsState struct {
+	mounted bool
+	files   map[string][]byte
+	dirs    map[string]bool
+}
+
+// WriteFS puts a file on the simulated file system, its directories are
+// created as needed.
+func (S *Esp32) WriteFS(Name string, Data []byte) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	Name = path.Clean(Name)
+	S.fsMkdir(path.Dir(Name))
+	S.fs.files[Name] = append([]byte{}, Data...)
+}
+
+// ReadFS returns a file of the simulated file system.
+func (S *Esp32) ReadFS(Name string) ([]byte, bool) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	Data, ok := S.fs.files[path.Clean(Name)]
+	return append([]byte{}, Data...), ok
+}
+
+// MkdirFS creates a directory and its parents, AT+FS cannot do it.
+func (S *Esp32) MkdirFS(Name string) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.fsMkdir(path.Clean(Name))
+}
+
+// fsMkdir must be called with S.lock held.
+func (S *Esp32) fsMkdir(Name string) {
+	for ; Name != "." && Name != "/"; Name = path.Dir(Name) {
+		S.fs.dirs[Name] = true
+	}
+}
+
+func (S *Esp32) resetFS() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.fs.mounted = true
+}
+
+// fsList returns the names in a directory, the caller must hold S.lock.
+func (S *Esp32) fsList(Dir string) []string {
+	Names := []string{}
+	for _, All := range []map[string]bool{S.fs.dirs, fsNames(S.fs.files)} {
+		for Name := range All {
+			if path.Dir(Name) == Dir {
+				Names = append(Names, path.Base(Name))
+			}
+		}
+	}
+	sort.Strings(Names)
+	return Names
+}
+
+func fsNames(Files map[string][]byte) map[string]bool {
+	Names := map[string]bool{}
+	for Name := range Files {
+		Names[Name] = true
+	}
+	return Names
+}
+
+func (S *Esp32) registerFS() {
+	S.fs = fsState{files: map[string][]byte{}, dirs: map[string]bool{".": true}}
+	S.resetFS()
+	S.handlers["+FSMOUNT"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) != 1 {
+			return ErrParamNum
+		}
+		Mount, err := intArg(C, 0, 0, 1)
+		if err != nil {
+			return err
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.fs.mounted = Mount == 1
+		return nil
+	}
+	S.handlers["+FS"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 3 || len(C.Args) > 5 {
+			return ErrParamNum
+		}
+		if _, err := intArg(C, 0, 0, 0); err != nil {
+			return err
+		}
+		Operation, err := intArg(C, 1, 0, 4)
+		if err != nil {
+			return err
+		}
+		Name := path.Clean(strings.TrimPrefix(C.Arg(2), "/"))
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.fs.mounted || C.Arg(2) == "" {
+			return ErrExecFail
+		}
+		Data, IsFile := S.fs.files[Name]
+		switch Operation {
+		case 0:
+			if IsFile {
+				delete(S.fs.files, Name)
+				return nil
+			}
+			if S.fs.dirs[Name] && Name != "." && len(S.fsList(Name)) == 0 {
+				delete(S.fs.dirs, Name)
+				return nil
+			}
+			return ErrExecFail
+		case 1, 2:
+			if len(C.Args) != 5 {
+				return ErrParamNum
+			}
+			Offset, err := intArg(C, 3, 0, 1<<24)
+			if err != nil {
+				return err
+			}
+			Length, err := intArg(C, 4, 0, fsChunk)
+			if err != nil {
+				return err
+			}
+			if Operation == 2 {
+				if !IsFile || Offset >= len(Data) {
+					return ErrExecFail
+				}
+				Data = Data[Offset:min(Offset+Length, len(Data))]
+				S.Raw(append(append([]byte(fmt.Sprintf("+FS:%d,", len(Data))), Data...), '\r', '\n'))
+				return nil
+			}
+			if !S.fs.dirs[path.Dir(Name)] || S.fs.dirs[Name] || Offset > len(Data) {
+				return ErrExecFail
+			}
+			if Length == 0 {
+				S.fs.files[Name] = Data
+				return nil
+			}
+			S.Send("", "OK")
+			S.Raw([]byte("\r\n>"))
+			S.Expect(Length, func(data []byte) {
+				S.lock.Lock()
+				Data := S.fs.files[Name]
+				Data = append(Data[:Offset:Offset], data...)
+				if End := Offset + len(data); End < len(S.fs.files[Name]) {
+					Data = append(Data, S.fs.files[Name][End:]...)
+				}
+				S.fs.files[Name] = Data
+				S.lock.Unlock()
+				S.Send("", "OK")
+			})
+			return ErrNoReply
+		case 3:
+			if !IsFile {
+				return ErrExecFail
+			}
+			S.Send(fmt.Sprintf("+FS:%d", len(Data)))
+			return nil
+		}
+		if !S.fs.dirs[Name] {
+			return ErrExecFail
+		}
+		S.Send("+FS:", ".", "..")
+		S.Send(S.fsList(Name)...)
+		return nil
+	}
+}
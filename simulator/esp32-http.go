@@ -0,0 +1,274 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrExecFail with 0x7000 + status in the extension, as ESP-AT reports a
+// failed HTTP request.
+func httpError(Status int) CodeError {
+	return ErrExecFail | CodeError(0x7000+Status)
+}
+
+var httpContentTypes = []string{"application/x-www-form-urlencoded", "application/json",
+	"multipart/form-data", "text/xml"}
+
+/*
+*
+* httpState: AT+HTTPCHEAD 和 AT+HTTPURLCFG 的设置, 请求由主机的 http.Client 完成
+*
+ */
+type httpState struct {
+	headers []string
+	url     string
+}
+
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+func (S *Esp32) resetHTTP() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.http = httpState{}
+}
+
+// httpURL picks the URL of a request, an empty one means the URL of
+// AT+HTTPURLCFG.
+func (S *Esp32) httpURL(URL string) string {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if URL == "" {
+		return S.http.url
+	}
+	return URL
+}
+
+// request runs one HTTP request with the headers of AT+HTTPCHEAD in front
+// of Headers.
+func (S *Esp32) request(Method, URL string, Headers []string, Body []byte) ([]byte, error) {
+	if !S.online() {
+		return nil, ErrExecFail
+	}
+	Request, err := http.NewRequest(Method, URL, bytes.NewReader(Body))
+	if err != nil || URL == "" {
+		return nil, ErrParamValue
+	}
+	S.lock.Lock()
+	Headers = append(append([]string{}, S.http.headers...), Headers...)
+	S.lock.Unlock()
+	for _, Header := range Headers {
+		Key, Value, ok := strings.Cut(Header, ":")
+		if !ok {
+			return nil, ErrParamValue
+		}
+		if Key, Value = strings.TrimSpace(Key), strings.TrimSpace(Value); http.CanonicalHeaderKey(Key) == "Host" {
+			Request.Host = Value
+		} else {
+			Request.Header.Add(Key, Value)
+		}
+	}
+	Response, err := httpClient.Do(Request)
+	if err != nil {
+		return nil, ErrExecFail
+	}
+	defer Response.Body.Close()
+	data, err := io.ReadAll(Response.Body)
+	if err != nil {
+		return nil, ErrExecFail
+	}
+	if Response.StatusCode < 200 || Response.StatusCode > 299 {
+		return nil, httpError(Response.StatusCode)
+	}
+	return data, nil
+}
+
+// sendBody prints a response body as <prefix><size>,<data> chunks.
+func (S *Esp32) sendBody(Prefix string, data []byte) {
+	for len(data) > 0 {
+		N := min(len(data), 512)
+		Chunk := append([]byte(fmt.Sprintf("%s%d,", Prefix, N)), data[:N]...)
+		S.Raw(append(Chunk, '\r', '\n'))
+		data = data[N:]
+	}
+}
+
+// upload handles AT+HTTPCPOST and AT+HTTPCPUT: the body follows the '>'
+// prompt and the result is SEND OK or SEND FAIL.
+func (S *Esp32) upload(Method string, C Command) error {
+	if C.Type != Set || len(C.Args) < 2 {
+		return ErrParamNum
+	}
+	Size, err := strconv.Atoi(C.Arg(1))
+	if err != nil || Size <= 0 {
+		return ErrParamValue
+	}
+	Headers := []string{}
+	if len(C.Args) > 2 {
+		Count, err := strconv.Atoi(C.Arg(2))
+		if err != nil || Count != len(C.Args)-3 {
+			return ErrParamNum
+		}
+		Headers = C.Args[3:]
+	}
+	URL := S.httpURL(C.Arg(0))
+	S.Send("", "OK")
+	S.Raw([]byte("\r\n>"))
+	S.Expect(Size, func(data []byte) {
+		Body, err := S.request(Method, URL, Headers, data)
+		if err != nil {
+			S.errCode(err)
+			S.Send("", "SEND FAIL")
+			return
+		}
+		S.sendBody(C.Name+":", Body)
+		S.Send("", "SEND OK")
+	})
+	return ErrNoReply
+}
+
+func (S *Esp32) registerHTTP() {
+	S.handlers["+HTTPCLIENT"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 6 {
+			return ErrParamNum
+		}
+		Opt, err := strconv.Atoi(C.Arg(0))
+		if err != nil || Opt < 1 || Opt > 5 {
+			return ErrParamValue
+		}
+		ContentType, err := strconv.Atoi(C.Arg(1))
+		if err != nil || ContentType < 0 || ContentType > 3 {
+			return ErrParamValue
+		}
+		Transport := C.Arg(5)
+		if Transport != "1" && Transport != "2" {
+			return ErrParamValue
+		}
+		URL := S.httpURL(C.Arg(2))
+		if URL == "" && C.Arg(3) != "" {
+			URL = map[string]string{"1": "http://", "2": "https://"}[Transport] + C.Arg(3) + C.Arg(4)
+		}
+		Method := []string{"", http.MethodHead, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}[Opt]
+		var Body []byte
+		Headers := []string{}
+		if len(C.Args) > 6 {
+			Body = []byte(C.Arg(6))
+			Headers = C.Args[7:]
+		}
+		if Method == http.MethodPost || Method == http.MethodPut {
+			Headers = append([]string{"Content-Type: " + httpContentTypes[ContentType]}, Headers...)
+		}
+		data, err := S.request(Method, URL, Headers, Body)
+		if err != nil {
+			return err
+		}
+		if Method != http.MethodHead {
+			S.sendBody("+HTTPCLIENT:", data)
+		}
+		return nil
+	}
+	S.handlers["+HTTPCGET"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 1 {
+			return ErrParamNum
+		}
+		data, err := S.request(http.MethodGet, S.httpURL(C.Arg(0)), nil, nil)
+		if err != nil {
+			return err
+		}
+		S.sendBody("+HTTPCGET:", data)
+		return nil
+	}
+	S.handlers["+HTTPCPOST"] = func(S *Esp32, C Command) error {
+		return S.upload(http.MethodPost, C)
+	}
+	S.handlers["+HTTPCPUT"] = func(S *Esp32, C Command) error {
+		return S.upload(http.MethodPut, C)
+	}
+	S.handlers["+HTTPCHEAD"] = func(S *Esp32, C Command) error {
+		switch C.Type {
+		case Query:
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			for i, Header := range S.http.headers {
+				S.Send(fmt.Sprintf("+HTTPCHEAD:%d,%s", i, quote(Header)))
+			}
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		Size, err := strconv.Atoi(C.Arg(0))
+		if err != nil || Size < 0 || Size > 256 {
+			return ErrParamValue
+		}
+		if Size == 0 {
+			S.resetHTTPHeaders()
+			return nil
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			S.lock.Lock()
+			S.http.headers = append(S.http.headers, string(data))
+			S.lock.Unlock()
+			S.Send("", "OK")
+		})
+		return ErrNoReply
+	}
+	S.handlers["+HTTPURLCFG"] = func(S *Esp32, C Command) error {
+		switch C.Type {
+		case Query:
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			S.Send(fmt.Sprintf("+HTTPURLCFG:%d,%s", len(S.http.url), S.http.url))
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		Size, err := strconv.Atoi(C.Arg(0))
+		if err != nil || Size != 0 && (Size < 8 || Size > 8192) {
+			return ErrParamValue
+		}
+		if Size == 0 {
+			S.lock.Lock()
+			S.http.url = ""
+			S.lock.Unlock()
+			return nil
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			S.lock.Lock()
+			S.http.url = string(data)
+			S.lock.Unlock()
+			S.Send("", "SET OK")
+		})
+		return ErrNoReply
+	}
+}
+
+func (S *Esp32) resetHTTPHeaders() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.http.headers = nil
+}
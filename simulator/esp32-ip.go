@@ -0,0 +1,242 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+var defaultDNS = []string{"208.67.222.222", "8.8.8.8"}
+
+// SetStationIPv6 sets the IPv6 addresses AT+CIPSTA? reports once the
+// station has an IP address, an empty Global hides ip6gl.
+func (S *Esp32) SetStationIPv6(LinkLocal, Global string) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.wifi.ip6ll, S.wifi.ip6gl = LinkLocal, Global
+}
+
+// AddHost makes AT+CIPDOMAIN resolve Name to IPs.
+func (S *Esp32) AddHost(Name string, IPs ...string) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.wifi.hosts[Name] = append(S.wifi.hosts[Name], IPs...)
+}
+
+// SetPing sets the round trip times AT+PING answers for Host one after the
+// other, the last one repeats. A negative time or a Host without times
+// answers +PING:TIMEOUT.
+func (S *Esp32) SetPing(Host string, RTTs ...time.Duration) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.wifi.pings[Host] = RTTs
+}
+
+// resolve picks the address of AT+CIPDOMAIN=<"domain">,<ip network>, the
+// caller must hold S.lock.
+func (S *Esp32) resolve(Name string, Network int) string {
+	IPs := S.wifi.hosts[Name]
+	if IP := net.ParseIP(Name); IP != nil {
+		IPs = []string{Name}
+	}
+	for _, Want4 := range map[int][]bool{1: {true, false}, 2: {true}, 3: {false}}[Network] {
+		for _, IP := range IPs {
+			if (net.ParseIP(IP).To4() != nil) == Want4 {
+				return IP
+			}
+		}
+	}
+	return ""
+}
+
+// ipArgs checks the "ip"[,"gateway","netmask"] parameters of AT+CIPSTA and
+// AT+CIPAP.
+func ipArgs(C Command) error {
+	if C.Type != Set || len(C.Args) < 1 || len(C.Args) == 2 || len(C.Args) > 3 {
+		return ErrParamNum
+	}
+	for _, Arg := range C.Args {
+		if net.ParseIP(Arg).To4() == nil {
+			return ErrParamValue
+		}
+	}
+	return nil
+}
+
+func (S *Esp32) registerIP() {
+	S.handlers["+CIPSTA"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.station() {
+			return ErrExecFail
+		}
+		if C.Type == Query {
+			IP, Gateway, Netmask := "0.0.0.0", "0.0.0.0", "0.0.0.0"
+			if S.wifi.state == wifiStateGotIP {
+				IP, Gateway, Netmask = S.wifi.ip, S.wifi.gateway, S.wifi.netmask
+			}
+			S.Send("+CIPSTA:ip:"+quote(IP), "+CIPSTA:gateway:"+quote(Gateway), "+CIPSTA:netmask:"+quote(Netmask))
+			if S.wifi.state == wifiStateGotIP {
+				S.Send("+CIPSTA:ip6ll:" + quote(S.wifi.ip6ll))
+				if S.wifi.ip6gl != "" {
+					S.Send("+CIPSTA:ip6gl:" + quote(S.wifi.ip6gl))
+				}
+			}
+			return nil
+		}
+		if err := ipArgs(C); err != nil {
+			return err
+		}
+		S.wifi.ip = C.Arg(0)
+		if len(C.Args) == 3 {
+			S.wifi.gateway, S.wifi.netmask = C.Arg(1), C.Arg(2)
+		}
+		// A static address turns the DHCP client off.
+		S.softap.dhcp &^= 1
+		return nil
+	}
+	S.handlers["+CIPAP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.softAP() {
+			return ErrExecFail
+		}
+		if C.Type == Query {
+			S.Send("+CIPAP:ip:"+quote(S.softap.ip), "+CIPAP:gateway:"+quote(S.softap.gateway),
+				"+CIPAP:netmask:"+quote(S.softap.netmask))
+			return nil
+		}
+		if err := ipArgs(C); err != nil {
+			return err
+		}
+		S.softap.ip = C.Arg(0)
+		if len(C.Args) == 3 {
+			S.softap.gateway, S.softap.netmask = C.Arg(1), C.Arg(2)
+		}
+		return nil
+	}
+	for Name, MAC := range map[string]func(S *Esp32) *string{
+		"+CIPSTAMAC": func(S *Esp32) *string { return &S.wifi.mac },
+		"+CIPAPMAC":  func(S *Esp32) *string { return &S.wifi.apMAC },
+	} {
+		S.handlers[Name] = func(S *Esp32, C Command) error {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			switch C.Type {
+			case Query:
+				S.Send(Name + ":" + quote(*MAC(S)))
+				return nil
+			case Set:
+				Addr, err := net.ParseMAC(C.Arg(0))
+				// bit0 of the first byte is the multicast bit
+				if err != nil || len(Addr) != 6 || Addr[0]&1 != 0 {
+					return ErrParamValue
+				}
+				*MAC(S) = Addr.String()
+				return nil
+			}
+			return ErrUnsupported
+		}
+	}
+	S.handlers["+CIPDOMAIN"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		Network := 1
+		if C.Arg(1) != "" {
+			var err error
+			if Network, err = strconv.Atoi(C.Arg(1)); err != nil || Network < 1 || Network > 3 {
+				return ErrParamValue
+			}
+		}
+		if !S.online() {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		IP := S.resolve(C.Arg(0), Network)
+		if IP == "" {
+			return ErrExecFail
+		}
+		S.Send("+CIPDOMAIN:" + quote(IP))
+		return nil
+	}
+	S.handlers["+PING"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) != 1 {
+			return ErrParamNum
+		}
+		if !S.online() {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		RTT := time.Duration(-1)
+		if S.resolve(C.Arg(0), 1) != "" {
+			if RTTs := S.wifi.pings[C.Arg(0)]; len(RTTs) > 0 {
+				RTT = RTTs[0]
+				if len(RTTs) > 1 {
+					S.wifi.pings[C.Arg(0)] = RTTs[1:]
+				}
+			}
+		}
+		S.lock.Unlock()
+		if RTT < 0 {
+			S.Send("+PING:TIMEOUT")
+			return ErrExecFail
+		}
+		time.Sleep(RTT)
+		S.Send(fmt.Sprintf("+PING:%d", RTT.Milliseconds()))
+		return nil
+	}
+	S.handlers["+CIPDNS"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			Line := fmt.Sprintf("+CIPDNS:%d", btoi(S.wifi.dnsSet))
+			for _, Server := range S.wifi.dns {
+				Line += "," + quote(Server)
+			}
+			S.Send(Line)
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		switch C.Arg(0) {
+		case "0":
+			S.wifi.dnsSet, S.wifi.dns = false, defaultDNS
+			return nil
+		case "1":
+		default:
+			return ErrParamValue
+		}
+		if len(C.Args) < 2 || len(C.Args) > 4 {
+			return ErrParamNum
+		}
+		Servers := []string{}
+		for _, Arg := range C.Args[1:] {
+			if net.ParseIP(Arg) == nil {
+				return ErrParamValue
+			}
+			Servers = append(Servers, Arg)
+		}
+		S.wifi.dnsSet, S.wifi.dns = true, Servers
+		return nil
+	}
+}
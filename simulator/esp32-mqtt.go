@@ -0,0 +1,371 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+*
+* mqttState: LinkID 0 的 MQTT 连接, brokers 是 AddMQTTBroker 注册的地址, 重启后保留
+*
+ */
+type mqttState struct {
+	brokers   map[string]*MQTTBroker
+	userSet   bool
+	connSet   bool
+	scheme    int
+	clientID  string
+	username  string
+	password  string
+	path      string
+	keepalive int
+	will      *MQTTMessage
+	host      string
+	port      string
+	reconnect int
+	broker    *MQTTBroker
+	subs      map[string]int
+}
+
+// AddMQTTBroker makes AT+MQTTCONN reach Broker at Address (host:port).
+func (S *Esp32) AddMQTTBroker(Address string, Broker *MQTTBroker) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.mqtt.brokers[Address] = Broker
+}
+
+func (S *Esp32) resetMQTT() {
+	S.lock.Lock()
+	Broker := S.mqtt.broker
+	S.mqtt = mqttState{brokers: S.mqtt.brokers, subs: map[string]int{}}
+	S.lock.Unlock()
+	if Broker != nil {
+		Broker.disconnect(S)
+	}
+}
+
+// mqttLost drops the connection without AT+MQTTCLEAN, the configuration
+// stays for the next AT+MQTTCONN.
+func (S *Esp32) mqttLost() (MQTTMessage, bool) {
+	S.lock.Lock()
+	if S.mqtt.broker == nil {
+		S.lock.Unlock()
+		return MQTTMessage{}, false
+	}
+	S.mqtt.broker = nil
+	S.mqtt.subs = map[string]int{}
+	Will := S.mqtt.will
+	S.lock.Unlock()
+	S.Send("+MQTTDISCONNECTED:0")
+	if Will == nil {
+		return MQTTMessage{}, false
+	}
+	return *Will, true
+}
+
+// mqttDeliver prints M as +MQTTSUBRECV when a subscription matches.
+func (S *Esp32) mqttDeliver(M MQTTMessage) {
+	S.lock.Lock()
+	Match := false
+	for Filter := range S.mqtt.subs {
+		Match = Match || topicMatch(Filter, M.Topic)
+	}
+	Match = Match && S.mqtt.broker != nil
+	S.lock.Unlock()
+	if Match {
+		Head := fmt.Sprintf("+MQTTSUBRECV:0,%s,%d,", quote(M.Topic), len(M.Payload))
+		S.Raw(append(append([]byte(Head), M.Payload...), '\r', '\n'))
+	}
+}
+
+func (S *Esp32) subscribed(Filter string) bool {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	_, ok := S.mqtt.subs[Filter]
+	return ok && S.mqtt.broker != nil
+}
+
+// mqttBroker returns the broker of a connected link 0.
+func (S *Esp32) mqttBroker() *MQTTBroker {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.mqtt.broker
+}
+
+// mqttArgs checks the number of parameters and the LinkID, only link 0
+// exists.
+func mqttArgs(C Command, N int) error {
+	if C.Type != Set || len(C.Args) != N {
+		return ErrParamNum
+	}
+	if C.Arg(0) != "0" {
+		return ErrParamValue
+	}
+	return nil
+}
+
+// intArg reads parameter i within [Min, Max].
+func intArg(C Command, i, Min, Max int) (int, error) {
+	Value, err := strconv.Atoi(C.Arg(i))
+	if err != nil || Value < Min || Value > Max {
+		return 0, ErrParamValue
+	}
+	return Value, nil
+}
+
+// mqttLong handles AT+MQTTLONGCLIENTID/LONGUSERNAME/LONGPASSWORD, the
+// value follows the '>' prompt.
+func (S *Esp32) mqttLong(C Command, Value func(S *Esp32) *string) error {
+	if err := mqttArgs(C, 2); err != nil {
+		return err
+	}
+	Size, err := intArg(C, 1, 1, 1024)
+	if err != nil {
+		return err
+	}
+	S.Send("", "OK")
+	S.Raw([]byte("\r\n>"))
+	S.Expect(Size, func(data []byte) {
+		S.lock.Lock()
+		*Value(S) = string(data)
+		S.lock.Unlock()
+		S.Send("", "OK")
+	})
+	return ErrNoReply
+}
+
+func (S *Esp32) registerMQTT() {
+	S.mqtt.brokers = map[string]*MQTTBroker{}
+	S.resetMQTT()
+	S.handlers["+MQTTUSERCFG"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 8); err != nil {
+			return err
+		}
+		Scheme, err := intArg(C, 1, 1, 10)
+		if err != nil {
+			return err
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if S.mqtt.broker != nil {
+			return ErrExecFail
+		}
+		S.mqtt.userSet, S.mqtt.scheme = true, Scheme
+		S.mqtt.clientID, S.mqtt.username, S.mqtt.password = C.Arg(2), C.Arg(3), C.Arg(4)
+		S.mqtt.path = C.Arg(7)
+		return nil
+	}
+	S.handlers["+MQTTLONGCLIENTID"] = func(S *Esp32, C Command) error {
+		return S.mqttLong(C, func(S *Esp32) *string { return &S.mqtt.clientID })
+	}
+	S.handlers["+MQTTLONGUSERNAME"] = func(S *Esp32, C Command) error {
+		return S.mqttLong(C, func(S *Esp32) *string { return &S.mqtt.username })
+	}
+	S.handlers["+MQTTLONGPASSWORD"] = func(S *Esp32, C Command) error {
+		return S.mqttLong(C, func(S *Esp32) *string { return &S.mqtt.password })
+	}
+	S.handlers["+MQTTCONNCFG"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 7); err != nil {
+			return err
+		}
+		Keepalive, err := intArg(C, 1, 0, 7200)
+		if err != nil {
+			return err
+		}
+		Values := [3]int{}
+		for i, Arg := range []int{2, 5, 6} {
+			if Values[i], err = intArg(C, Arg, 0, map[int]int{2: 1, 5: 2, 6: 1}[Arg]); err != nil {
+				return err
+			}
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.mqtt.connSet, S.mqtt.keepalive, S.mqtt.will = true, Keepalive, nil
+		if C.Arg(3) != "" {
+			S.mqtt.will = &MQTTMessage{Topic: C.Arg(3), Payload: []byte(C.Arg(4)), QoS: Values[1], Retain: Values[2] == 1}
+		}
+		return nil
+	}
+	S.handlers["+MQTTCONN"] = func(S *Esp32, C Command) error {
+		if C.Type == Query {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			State := 0
+			switch {
+			case S.mqtt.broker != nil && len(S.mqtt.subs) > 0:
+				State = 6
+			case S.mqtt.broker != nil:
+				State = 4
+			case S.mqtt.host != "":
+				State = 3
+			case S.mqtt.connSet:
+				State = 2
+			case S.mqtt.userSet:
+				State = 1
+			}
+			S.Send(fmt.Sprintf("+MQTTCONN:0,%d,%d,%s,%s,%s,%d", State, S.mqtt.scheme,
+				quote(S.mqtt.host), quote(S.mqtt.port), quote(S.mqtt.path), S.mqtt.reconnect))
+			return nil
+		}
+		if err := mqttArgs(C, 4); err != nil {
+			return err
+		}
+		if _, err := intArg(C, 2, 1, 65535); err != nil {
+			return err
+		}
+		Reconnect, err := intArg(C, 3, 0, 1)
+		if err != nil {
+			return err
+		}
+		if !S.online() {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		Broker := S.mqtt.brokers[C.Arg(1)+":"+C.Arg(2)]
+		Ready := S.mqtt.userSet && S.mqtt.broker == nil
+		Username, Password, Scheme, Path := S.mqtt.username, S.mqtt.password, S.mqtt.scheme, S.mqtt.path
+		S.lock.Unlock()
+		if !Ready || Broker == nil || !Broker.connect(S, Username, Password) {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		S.mqtt.broker, S.mqtt.host, S.mqtt.port, S.mqtt.reconnect = Broker, C.Arg(1), C.Arg(2), Reconnect
+		S.lock.Unlock()
+		S.Send(fmt.Sprintf("+MQTTCONNECTED:0,%d,%s,%s,%s,%d", Scheme, quote(C.Arg(1)), quote(C.Arg(2)),
+			quote(Path), Reconnect))
+		return nil
+	}
+	S.handlers["+MQTTPUB"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 5); err != nil {
+			return err
+		}
+		QoS, err := intArg(C, 3, 0, 2)
+		if err != nil {
+			return err
+		}
+		Retain, err := intArg(C, 4, 0, 1)
+		if err != nil {
+			return err
+		}
+		Broker := S.mqttBroker()
+		if Broker == nil || C.Arg(1) == "" {
+			return ErrExecFail
+		}
+		Broker.publish(MQTTMessage{Topic: C.Arg(1), Payload: []byte(C.Arg(2)), QoS: QoS, Retain: Retain == 1}, true)
+		return nil
+	}
+	S.handlers["+MQTTPUBRAW"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 5); err != nil {
+			return err
+		}
+		Size, err := intArg(C, 2, 1, 65535)
+		if err != nil {
+			return err
+		}
+		QoS, err := intArg(C, 3, 0, 2)
+		if err != nil {
+			return err
+		}
+		Retain, err := intArg(C, 4, 0, 1)
+		if err != nil {
+			return err
+		}
+		if S.mqttBroker() == nil || C.Arg(1) == "" {
+			return ErrExecFail
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			Broker := S.mqttBroker()
+			if Broker == nil {
+				S.Send("", "+MQTTPUB:FAIL")
+				return
+			}
+			Broker.publish(MQTTMessage{Topic: C.Arg(1), Payload: data, QoS: QoS, Retain: Retain == 1}, true)
+			S.Send("", "+MQTTPUB:OK")
+		})
+		return ErrNoReply
+	}
+	S.handlers["+MQTTSUB"] = func(S *Esp32, C Command) error {
+		if C.Type == Query {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			for Filter, QoS := range S.mqtt.subs {
+				S.Send(fmt.Sprintf("+MQTTSUB:0,6,%s,%d", quote(Filter), QoS))
+			}
+			return nil
+		}
+		if err := mqttArgs(C, 3); err != nil {
+			return err
+		}
+		QoS, err := intArg(C, 2, 0, 2)
+		if err != nil {
+			return err
+		}
+		S.lock.Lock()
+		Broker := S.mqtt.broker
+		_, Already := S.mqtt.subs[C.Arg(1)]
+		if Broker != nil && C.Arg(1) != "" {
+			S.mqtt.subs[C.Arg(1)] = QoS
+		}
+		S.lock.Unlock()
+		if Broker == nil || C.Arg(1) == "" {
+			return ErrExecFail
+		}
+		if Already {
+			S.Send("ALREADY SUBSCRIBE")
+			return nil
+		}
+		S.Send("", "OK")
+		for _, M := range Broker.retainedFor(C.Arg(1)) {
+			S.mqttDeliver(M)
+		}
+		return ErrNoReply
+	}
+	S.handlers["+MQTTUNSUB"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 2); err != nil {
+			return err
+		}
+		S.lock.Lock()
+		Connected := S.mqtt.broker != nil
+		_, ok := S.mqtt.subs[C.Arg(1)]
+		delete(S.mqtt.subs, C.Arg(1))
+		S.lock.Unlock()
+		if !Connected {
+			return ErrExecFail
+		}
+		if !ok {
+			S.Send("NO UNSUBSCRIBE")
+		}
+		return nil
+	}
+	S.handlers["+MQTTCLEAN"] = func(S *Esp32, C Command) error {
+		if err := mqttArgs(C, 1); err != nil {
+			return err
+		}
+		S.lock.Lock()
+		Configured := S.mqtt.userSet
+		S.lock.Unlock()
+		if !Configured {
+			return ErrMQTTUninitiated
+		}
+		S.resetMQTT()
+		return nil
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"time"
+)
+
+// escapeGuard is the silence required before and after +++.
+const escapeGuard = 20 * time.Millisecond
+
+/*
+*
+* transState: AT+CIPMODE=1 之后 AT+CIPSEND 进入的透传模式, 主机发来的数据
+* 原样转发给连接, 前后各静默 20ms 的单独一包 +++ 退出透传
+*
+ */
+type transState struct {
+	link   *link
+	lastRx time.Time
+	escape *time.Timer
+}
+
+// Passthrough reports whether the module is in passthrough mode.
+func (S *Esp32) Passthrough() bool {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.trans.link != nil
+}
+
+// enterPassthrough answers AT+CIPSEND in AT+CIPMODE=1.
+func (S *Esp32) enterPassthrough() error {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if !S.tcp.cipmode || S.tcp.mux {
+		return ErrExecFail
+	}
+	L := S.tcp.links[0]
+	if L == nil {
+		return ErrExecFail
+	}
+	S.Send("", "OK")
+	S.Raw([]byte("\r\n>"))
+	S.trans = transState{link: L, lastRx: time.Now()}
+	return ErrNoReply
+}
+
+// passthrough takes the data from the host while in passthrough mode.
+func (S *Esp32) passthrough(data []byte) bool {
+	S.lock.Lock()
+	T := &S.trans
+	L := T.link
+	if L == nil {
+		S.lock.Unlock()
+		return false
+	}
+	Now := time.Now()
+	Quiet := Now.Sub(T.lastRx) >= escapeGuard
+	T.lastRx = Now
+	if string(data) == "+++" && Quiet {
+		var Timer *time.Timer
+		Timer = time.AfterFunc(escapeGuard, func() {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			if S.trans.escape == Timer {
+				S.trans = transState{}
+			}
+		})
+		T.escape = Timer
+		S.lock.Unlock()
+		return true
+	}
+	if T.escape != nil {
+		// Data right after +++, it was payload after all.
+		T.escape.Stop()
+		T.escape = nil
+		data = append([]byte("+++"), data...)
+	}
+	S.lock.Unlock()
+	S.write(L, data, nil)
+	return true
+}
+
+func (S *Esp32) registerPassthrough() {
+	S.handlers["+CIPMODE"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPMODE:%d", btoi(S.tcp.cipmode)))
+			return nil
+		case Set:
+			if C.Arg(0) != "0" && C.Arg(0) != "1" {
+				return ErrParamValue
+			}
+			if C.Arg(0) == "1" && (S.tcp.mux || S.tcp.listener != nil) {
+				return ErrExecFail
+			}
+			S.tcp.cipmode = C.Arg(0) == "1"
+			return nil
+		}
+		return ErrUnsupported
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+*
+* sntpState: AT+CIPSNTPCFG 和 AT+CIPSNTPINTV 的设置, 时间取自主机
+*
+ */
+type sntpState struct {
+	enable   bool
+	timezone string
+	offset   time.Duration
+	servers  []string
+	interval int
+	synced   bool
+}
+
+var defaultSNTPServers = []string{"cn.ntp.org.cn", "ntp.sjtu.edu.cn", "us.pool.ntp.org"}
+
+func (S *Esp32) resetSNTP() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.sntp = sntpState{timezone: "0", servers: defaultSNTPServers, interval: 3600}
+}
+
+// parseTimezone reads the <timezone> of AT+CIPSNTPCFG: hours from -12 to
+// 14, or a UTC offset written as ±hhmm.
+func parseTimezone(Timezone string) (time.Duration, bool) {
+	Value, err := strconv.Atoi(Timezone)
+	if err != nil {
+		return 0, false
+	}
+	if Value >= -12 && Value <= 14 {
+		return time.Duration(Value) * time.Hour, true
+	}
+	Sign := time.Duration(1)
+	if Value < 0 {
+		Sign, Value = -1, -Value
+	}
+	Hours, Minutes := Value/100, Value%100
+	if Hours > 14 || Minutes > 59 {
+		return 0, false
+	}
+	return Sign * (time.Duration(Hours)*time.Hour + time.Duration(Minutes)*time.Minute), true
+}
+
+func (S *Esp32) registerSNTP() {
+	S.resetSNTP()
+	S.handlers["+CIPSNTPCFG"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			Line := fmt.Sprintf("+CIPSNTPCFG:%d,%s", btoi(S.sntp.enable), S.sntp.timezone)
+			for _, Server := range S.sntp.servers {
+				Line += "," + quote(Server)
+			}
+			S.Send(Line)
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		if C.Arg(0) != "0" && C.Arg(0) != "1" {
+			return ErrParamValue
+		}
+		if len(C.Args) > 5 {
+			return ErrParamNum
+		}
+		Timezone := "0"
+		if C.Arg(1) != "" {
+			Timezone = C.Arg(1)
+		}
+		Offset, ok := parseTimezone(Timezone)
+		if !ok {
+			return ErrParamValue
+		}
+		S.sntp.enable, S.sntp.timezone, S.sntp.offset = C.Arg(0) == "1", Timezone, Offset
+		if len(C.Args) > 2 {
+			S.sntp.servers = append([]string{}, C.Args[2:]...)
+		}
+		S.sntp.synced = false
+		if S.sntp.enable && S.wifi.state == wifiStateGotIP {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				S.lock.Lock()
+				Enable := S.sntp.enable
+				S.sntp.synced = Enable
+				S.lock.Unlock()
+				if Enable {
+					S.Send("", "+TIME_UPDATED")
+				}
+			}()
+		}
+		return nil
+	}
+	S.handlers["+CIPSNTPINTV"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPSNTPINTV:%d", S.sntp.interval))
+			return nil
+		case Set:
+			Interval, err := strconv.Atoi(C.Arg(0))
+			if err != nil || Interval < 15 || Interval > 4294967 {
+				return ErrParamValue
+			}
+			S.sntp.interval = Interval
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CIPSNTPTIME"] = func(S *Esp32, C Command) error {
+		if C.Type != Query {
+			return ErrUnsupported
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		Now := time.Unix(0, 0)
+		if S.sntp.synced {
+			Now = time.Now()
+		}
+		Zone := time.FixedZone("", int(S.sntp.offset/time.Second))
+		S.Send("+CIPSNTPTIME:" + Now.In(Zone).Format("Mon Jan 02 15:04:05 2006"))
+		return nil
+	}
+}
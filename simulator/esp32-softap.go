@@ -0,0 +1,215 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+type softapStation struct {
+	mac string
+	ip  string
+}
+
+type softapState struct {
+	ssid     string
+	password string
+	channel  int
+	ecn      int
+	maxConn  int
+	hidden   int
+	// bit0 station, bit1 SoftAP
+	dhcp     int
+	lease    int
+	start    string
+	end      string
+	ip       string
+	gateway  string
+	netmask  string
+	stations []softapStation
+}
+
+// softAP reports whether the SoftAP interface is enabled, the caller must
+// hold S.lock.
+func (S *Esp32) softAP() bool {
+	return S.wifi.mode == 2 || S.wifi.mode == 3
+}
+
+// JoinStation simulates a station associating with the SoftAP, it gets the
+// next address of the DHCP pool.
+func (S *Esp32) JoinStation(MAC string) error {
+	S.lock.Lock()
+	if !S.softAP() {
+		S.lock.Unlock()
+		return fmt.Errorf("simulator: SoftAP is not enabled")
+	}
+	if len(S.softap.stations) >= S.softap.maxConn {
+		S.lock.Unlock()
+		return fmt.Errorf("simulator: SoftAP is full")
+	}
+	IP := net.ParseIP(S.softap.start).To4()
+	IP[3] += byte(len(S.softap.stations))
+	S.softap.stations = append(S.softap.stations, softapStation{mac: MAC, ip: IP.String()})
+	S.lock.Unlock()
+	S.Send("+STA_CONNECTED:"+quote(MAC), "+DIST_STA_IP:"+quote(MAC)+","+quote(IP.String()))
+	return nil
+}
+
+// LeaveStation simulates a station leaving the SoftAP.
+func (S *Esp32) LeaveStation(MAC string) {
+	if S.kick(MAC) {
+		S.Send("+STA_DISCONNECTED:" + quote(MAC))
+	}
+}
+
+func (S *Esp32) kick(MAC string) bool {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	for i, Station := range S.softap.stations {
+		if Station.mac == MAC {
+			S.softap.stations = append(S.softap.stations[:i], S.softap.stations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (S *Esp32) resetSoftAP() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.softap.stations = nil
+}
+
+func (S *Esp32) registerSoftAP() {
+	S.softap = softapState{ssid: "ESP_D6E445", channel: 1, ecn: 0, maxConn: 10,
+		dhcp: 3, lease: 120, start: "192.168.4.2", end: "192.168.4.101",
+		ip: "192.168.4.1", gateway: "192.168.4.1", netmask: "255.255.255.0"}
+	S.handlers["+CWSAP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.softAP() {
+			return ErrExecFail
+		}
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CWSAP:%s,%s,%d,%d,%d,%d", quote(S.softap.ssid), quote(S.softap.password),
+				S.softap.channel, S.softap.ecn, S.softap.maxConn, S.softap.hidden))
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		if len(C.Args) < 4 {
+			return ErrParamNum
+		}
+		Numbers := []int{0, 0, 10, 0}
+		for i := 2; i < len(C.Args) && i < 6; i++ {
+			Number, err := strconv.Atoi(C.Arg(i))
+			if err != nil {
+				return ErrParamValue
+			}
+			Numbers[i-2] = Number
+		}
+		Channel, Ecn, MaxConn, Hidden := Numbers[0], Numbers[1], Numbers[2], Numbers[3]
+		if C.Arg(0) == "" || Channel < 1 || Channel > 13 || Ecn == 1 || Ecn > 4 ||
+			(Ecn != 0 && len(C.Arg(1)) < 8) || MaxConn < 1 || MaxConn > 10 {
+			return ErrParamValue
+		}
+		S.softap.ssid, S.softap.password = C.Arg(0), C.Arg(1)
+		S.softap.channel, S.softap.ecn, S.softap.maxConn, S.softap.hidden = Channel, Ecn, MaxConn, Hidden
+		return nil
+	}
+	S.handlers["+CWLIF"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		for _, Station := range S.softap.stations {
+			S.Send(fmt.Sprintf("+CWLIF:%s,%s", quote(Station.ip), quote(Station.mac)))
+		}
+		return nil
+	}
+	S.handlers["+CWQIF"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		Kicked := []string{}
+		for _, Station := range S.softap.stations {
+			if C.Arg(0) == "" || C.Arg(0) == Station.mac {
+				Kicked = append(Kicked, Station.mac)
+			}
+		}
+		S.lock.Unlock()
+		if C.Arg(0) != "" && len(Kicked) == 0 {
+			return ErrExecFail
+		}
+		for _, MAC := range Kicked {
+			S.kick(MAC)
+		}
+		S.Reply(nil)
+		for _, MAC := range Kicked {
+			S.Send("+STA_DISCONNECTED:" + quote(MAC))
+		}
+		return ErrNoReply
+	}
+	S.handlers["+CWDHCP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CWDHCP:%d", S.softap.dhcp))
+			return nil
+		case Set:
+			Operate, err1 := strconv.Atoi(C.Arg(0))
+			Mode, err2 := strconv.Atoi(C.Arg(1))
+			if err1 != nil || err2 != nil || Operate > 1 || Mode < 0 || Mode > 3 {
+				return ErrParamValue
+			}
+			if Operate == 1 {
+				S.softap.dhcp |= Mode
+			} else {
+				S.softap.dhcp &^= Mode
+			}
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CWDHCPS"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CWDHCPS:%d,%s,%s", S.softap.lease, quote(S.softap.start), quote(S.softap.end)))
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		if !S.softAP() {
+			return ErrExecFail
+		}
+		if C.Arg(0) == "0" {
+			S.softap.lease, S.softap.start, S.softap.end = 120, "192.168.4.2", "192.168.4.101"
+			return nil
+		}
+		Lease, err := strconv.Atoi(C.Arg(1))
+		Start, End := net.ParseIP(C.Arg(2)).To4(), net.ParseIP(C.Arg(3)).To4()
+		if C.Arg(0) != "1" || err != nil || Lease < 1 || Lease > 2880 || Start == nil || End == nil ||
+			Start[3] > End[3] || End[3]-Start[3] > 100 {
+			return ErrParamValue
+		}
+		S.softap.lease, S.softap.start, S.softap.end = Lease, Start.String(), End.String()
+		return nil
+	}
+}
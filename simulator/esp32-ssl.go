@@ -0,0 +1,290 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+*
+* sslConfig: AT+CIPSSLCCONF/CIPSSLCSNI/CIPSSLCALPN/CIPSSLCPSK 对一个连接的设置
+*
+ */
+type sslConfig struct {
+	auth int
+	pki  int
+	ca   int
+	sni  string
+	alpn []string
+	psk  string
+	hint string
+}
+
+type sslState struct {
+	links [maxLinks]sslConfig
+	// mfg_nvs: namespace -> key -> value, kept over reboots like flash
+	mfg map[string]map[string][]byte
+}
+
+// mfgNamespaces are the namespaces of the mfg_nvs partition of ESP-AT.
+var mfgNamespaces = []string{
+	"client_cert", "client_key", "client_ca",
+	"server_cert", "server_key", "server_ca",
+	"mqtt_cert", "mqtt_key", "mqtt_ca",
+	"factory_param",
+}
+
+// MfgValue returns what AT+SYSMFG stored under Namespace and Key.
+func (S *Esp32) MfgValue(Namespace, Key string) []byte {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return append([]byte{}, S.ssl.mfg[Namespace][Key]...)
+}
+
+// SSLConfig returns the SNI and ALPN set for a link ID.
+func (S *Esp32) SSLConfig(id int) (SNI string, ALPN []string) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.ssl.links[id].sni, append([]string{}, S.ssl.links[id].alpn...)
+}
+
+// SSLPSK returns the PSK and hint set for a link ID.
+func (S *Esp32) SSLPSK(id int) (PSK, Hint string) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.ssl.links[id].psk, S.ssl.links[id].hint
+}
+
+// tlsConfig builds the handshake of an SSL link out of its settings and the
+// certificates in mfg_nvs, the caller must hold S.lock.
+func (S *Esp32) tlsConfig(id int, Host string) (*tls.Config, error) {
+	C := S.ssl.links[id]
+	Config := &tls.Config{ServerName: Host, NextProtos: C.alpn}
+	if C.sni != "" {
+		Config.ServerName = C.sni
+	}
+	// Stored PEM is NUL terminated for mbedTLS.
+	value := func(Namespace string, Index int) []byte {
+		return bytes.TrimRight(S.ssl.mfg[Namespace][fmt.Sprintf("%s.%d", Namespace, Index)], "\x00")
+	}
+	if C.auth&1 != 0 {
+		Certificate, err := tls.X509KeyPair(value("client_cert", C.pki), value("client_key", C.pki))
+		if err != nil {
+			return nil, err
+		}
+		Config.Certificates = []tls.Certificate{Certificate}
+	}
+	if C.auth&2 != 0 {
+		Pool := x509.NewCertPool()
+		if !Pool.AppendCertsFromPEM(value("client_ca", C.ca)) {
+			return nil, fmt.Errorf("no ca")
+		}
+		Config.RootCAs = Pool
+	} else {
+		Config.InsecureSkipVerify = true
+	}
+	return Config, nil
+}
+
+// handshake turns the socket of an SSL link into a TLS client, Conn is
+// closed when it fails.
+func (S *Esp32) handshake(id int, Host string, Conn net.Conn) (net.Conn, error) {
+	S.lock.Lock()
+	Config, err := S.tlsConfig(id, Host)
+	S.lock.Unlock()
+	if err != nil {
+		Conn.Close()
+		return nil, err
+	}
+	Client := tls.Client(Conn, Config)
+	Client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := Client.Handshake(); err != nil {
+		Conn.Close()
+		return nil, err
+	}
+	Client.SetDeadline(time.Time{})
+	return Client, nil
+}
+
+func (S *Esp32) registerSSL() {
+	S.ssl.mfg = map[string]map[string][]byte{}
+	for _, Namespace := range mfgNamespaces {
+		S.ssl.mfg[Namespace] = map[string][]byte{}
+	}
+	S.handlers["+CIPSSLCCONF"] = func(S *Esp32, C Command) error {
+		if C.Type == Query {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			for id, L := range S.ssl.links {
+				S.Send(fmt.Sprintf("+CIPSSLCCONF:%d,%d,%d,%d", id, L.auth, L.pki, L.ca))
+			}
+			return nil
+		}
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		Numbers := []int{0, 0, 0}
+		for i, Arg := range Args {
+			if i >= 3 {
+				return ErrParamNum
+			}
+			if Numbers[i], err = strconv.Atoi(Arg); err != nil || Numbers[i] < 0 {
+				return ErrParamValue
+			}
+		}
+		if Numbers[0] > 3 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		L := &S.ssl.links[id]
+		L.auth, L.pki, L.ca = Numbers[0], Numbers[1], Numbers[2]
+		return nil
+	}
+	S.handlers["+CIPSSLCSNI"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		if len(Args) != 1 || len(Args[0]) < 1 || len(Args[0]) > 64 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ssl.links[id].sni = Args[0]
+		return nil
+	}
+	S.handlers["+CIPSSLCALPN"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		if len(Args) < 1 {
+			return ErrParamNum
+		}
+		Count, err := strconv.Atoi(Args[0])
+		if err != nil || Count < 0 || Count > 5 || Count != len(Args)-1 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ssl.links[id].alpn = append([]string{}, Args[1:]...)
+		return nil
+	}
+	S.handlers["+CIPSSLCPSK"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		if len(Args) != 2 || len(Args[0]) < 1 || len(Args[0]) > 32 || len(Args[1]) > 32 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ssl.links[id].psk, S.ssl.links[id].hint = Args[0], Args[1]
+		return nil
+	}
+	S.handlers["+SYSMFG"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if C.Type == Query {
+			for _, Namespace := range mfgNamespaces {
+				S.Send("+SYSMFG:" + quote(Namespace))
+			}
+			return nil
+		}
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		Namespace, Key := C.Arg(1), C.Arg(2)
+		Values, ok := S.ssl.mfg[Namespace]
+		if Namespace != "" && !ok {
+			return ErrParamValue
+		}
+		switch C.Arg(0) {
+		case "0":
+			switch {
+			case Namespace == "":
+				for _, Values := range S.ssl.mfg {
+					clear(Values)
+				}
+			case Key == "":
+				clear(Values)
+			default:
+				// nvs_erase_key fails on a missing key.
+				if _, ok := Values[Key]; !ok {
+					return ErrExecFail
+				}
+				delete(Values, Key)
+			}
+			return nil
+		case "1":
+			Value, ok := Values[Key]
+			if !ok {
+				return ErrExecFail
+			}
+			S.Raw([]byte(fmt.Sprintf("+SYSMFG:%s,%s,8,%d,", quote(Namespace), quote(Key), len(Value))))
+			S.Raw(append(append([]byte{}, Value...), '\r', '\n'))
+			return nil
+		case "2":
+			if Key == "" || len(C.Args) != 5 {
+				return ErrParamNum
+			}
+			Type, err := strconv.Atoi(C.Arg(3))
+			if err != nil || Type < 1 || Type > 8 {
+				return ErrParamValue
+			}
+			if Type < 7 {
+				Values[Key] = []byte(C.Arg(4))
+				return nil
+			}
+			Size, err := strconv.Atoi(C.Arg(4))
+			if err != nil || Size <= 0 {
+				return ErrParamValue
+			}
+			S.Send("", "OK")
+			S.Raw([]byte("\r\n>"))
+			S.Expect(Size, func(data []byte) {
+				S.lock.Lock()
+				Values[Key] = data
+				S.lock.Unlock()
+				S.Send("", "OK")
+			})
+			return ErrNoReply
+		}
+		return ErrParamValue
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// flashSector is the erase unit of the simulated SPI flash.
+const flashSector = 4096
+
+// flashChunk is the most AT+SYSFLASH reads or writes in one command.
+const flashChunk = 2048
+
+/*
+*
+* FlashPartition: AT+SYSFLASH? 列出的一个用户分区
+*
+ */
+type FlashPartition struct {
+	Name    string
+	Type    int
+	SubType int
+	Address int
+	Size    int
+}
+
+/*
+*
+* flashState: 用户分区和它们的内容, 和真实的 Flash 一样写入只能把 1 变成 0,
+* 写之前要先擦除, 重启后保留
+*
+ */
+type flashState struct {
+	partitions []FlashPartition
+	data       map[string][]byte
+	erases     int
+}
+
+// The user partitions of the ESP-AT v3 partition table.
+var defaultPartitions = []FlashPartition{
+	{"mfg_nvs", 1, 2, 0x21000, 0x1c000},
+	{"fatfs", 1, 129, 0x47000, 0x19000},
+	{"ble_data", 64, 1, 0x60000, 0x3000},
+}
+
+// AddPartition adds an erased partition, or erases the one with the same name.
+func (S *Esp32) AddPartition(P FlashPartition) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	for i := range S.flash.partitions {
+		if S.flash.partitions[i].Name == P.Name {
+			S.flash.partitions = append(S.flash.partitions[:i], S.flash.partitions[i+1:]...)
+			break
+		}
+	}
+	S.flash.partitions = append(S.flash.partitions, P)
+	S.flash.data[P.Name] = bytes.Repeat([]byte{0xFF}, P.Size)
+}
+
+// ReadFlash returns the content of a partition.
+func (S *Esp32) ReadFlash(Name string) []byte {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return bytes.Clone(S.flash.data[Name])
+}
+
+// FlashErases counts the sectors erased by AT+SYSFLASH.
+func (S *Esp32) FlashErases() int {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.flash.erases
+}
+
+func (S *Esp32) registerSysflash() {
+	S.flash = flashState{data: map[string][]byte{}}
+	for _, P := range defaultPartitions {
+		S.AddPartition(P)
+	}
+	S.handlers["+SYSFLASH"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if C.Type == Query {
+			for _, P := range S.flash.partitions {
+				S.Send(fmt.Sprintf("+SYSFLASH:%s,%d,%d,0x%x,0x%x", quote(P.Name), P.Type, P.SubType,
+					P.Address, P.Size))
+			}
+			return nil
+		}
+		if C.Type != Set || len(C.Args) < 2 || len(C.Args) > 4 || len(C.Args) == 3 {
+			return ErrParamNum
+		}
+		Operation, err := intArg(C, 0, 0, 2)
+		if err != nil {
+			return err
+		}
+		Data, ok := S.flash.data[C.Arg(1)]
+		if !ok {
+			return ErrParamValue
+		}
+		Offset, Length := 0, len(Data)
+		if len(C.Args) == 4 {
+			if Offset, err = intArg(C, 2, 0, len(Data)); err != nil {
+				return err
+			}
+			if Length, err = intArg(C, 3, 1, len(Data)-Offset); err != nil {
+				return err
+			}
+		} else if Operation != 0 {
+			return ErrParamNum
+		}
+		switch Operation {
+		case 0:
+			if Offset%flashSector != 0 || Length%flashSector != 0 {
+				return ErrParamValue
+			}
+			copy(Data[Offset:Offset+Length], bytes.Repeat([]byte{0xFF}, Length))
+			S.flash.erases += Length / flashSector
+			return nil
+		case 2:
+			if Length > flashChunk {
+				return ErrParamValue
+			}
+			Head := fmt.Sprintf("+SYSFLASH:%d,", Length)
+			S.Raw(append(append([]byte(Head), Data[Offset:Offset+Length]...), '\r', '\n'))
+			return nil
+		}
+		if Length > flashChunk {
+			return ErrParamValue
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Length, func(data []byte) {
+			S.lock.Lock()
+			for i, b := range data {
+				Data[Offset+i] &= b
+			}
+			S.lock.Unlock()
+			S.Send("", "OK")
+		})
+		return ErrNoReply
+	}
+}
@@ -0,0 +1,665 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*
+* link: 模拟器通过真实的 socket 完成 AT+CIPSTART 建立的连接
+*
+ */
+type link struct {
+	id     int
+	typ    string
+	conn   net.Conn
+	remote string
+	port   int
+	local  int
+	// UDP links: <mode> of AT+CIPSTART and the current peer
+	udp  *net.UDPConn
+	mode int
+	peer *net.UDPAddr
+	// accepted by AT+CIPSERVER
+	server bool
+	// data held for AT+CIPRECVDATA in passive receive mode
+	buffer []byte
+	from   net.Addr
+}
+
+type tcpState struct {
+	mux     bool
+	dinfo   bool
+	passive bool
+	cipmode bool
+	links   map[int]*link
+	dial    func(network, address string) (net.Conn, error)
+	// AT+CIPSERVER, AT+CIPSERVERMAXCONN and AT+CIPSTO
+	listener net.Listener
+	port     int
+	maxConn  int
+	timeout  int
+}
+
+const maxLinks = 5
+
+// SetDialer replaces the function used to open the sockets behind
+// AT+CIPSTART, net.Dial is used by default.
+func (S *Esp32) SetDialer(Dial func(network, address string) (net.Conn, error)) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.tcp.dial = Dial
+}
+
+func (S *Esp32) resetTcpip() {
+	S.lock.Lock()
+	Links := S.tcp.links
+	S.tcp.links = map[int]*link{}
+	S.tcp.mux = false
+	S.tcp.dinfo = false
+	S.tcp.passive = false
+	S.tcp.cipmode = false
+	S.trans = transState{}
+	S.ssl.links = [maxLinks]sslConfig{}
+	S.tcp.maxConn = maxLinks
+	S.tcp.timeout = 180
+	Listener := S.tcp.listener
+	S.tcp.listener = nil
+	S.lock.Unlock()
+	if Listener != nil {
+		Listener.Close()
+	}
+	for _, L := range Links {
+		L.close()
+	}
+}
+
+// linkEvent prints "<id>,CONNECT" in multi-link mode and "CONNECT" otherwise.
+func (S *Esp32) linkEvent(id int, Event string) {
+	S.lock.Lock()
+	Mux := S.tcp.mux
+	S.lock.Unlock()
+	if Mux {
+		S.Send(fmt.Sprintf("%d,%s", id, Event))
+		return
+	}
+	S.Send(Event)
+}
+
+func (S *Esp32) serve(L *link) {
+	var data [2048]byte
+	for {
+		var From net.Addr
+		var N int
+		var err error
+		if L.udp != nil {
+			var Peer *net.UDPAddr
+			N, Peer, err = L.udp.ReadFromUDP(data[:])
+			S.lock.Lock()
+			if N > 0 && (L.mode == 2 || (L.mode == 1 && L.peer == nil)) {
+				L.peer = Peer
+			}
+			S.lock.Unlock()
+			From = Peer
+		} else {
+			S.lock.Lock()
+			Timeout := S.tcp.timeout
+			S.lock.Unlock()
+			if L.server && Timeout > 0 {
+				// AT+CIPSTO closes idle clients of the server.
+				L.conn.SetReadDeadline(time.Now().Add(time.Duration(Timeout) * time.Second))
+			}
+			N, err = L.conn.Read(data[:])
+			From = L.conn.RemoteAddr()
+		}
+		if N > 0 {
+			S.deliver(L, data[:N], From)
+		}
+		if err != nil {
+			break
+		}
+	}
+	S.lock.Lock()
+	Own := S.tcp.links[L.id] == L
+	if Own {
+		delete(S.tcp.links, L.id)
+	}
+	S.lock.Unlock()
+	if Own {
+		S.linkEvent(L.id, "CLOSED")
+	}
+}
+
+// deliver passes data received on a link to the host as +IPD, TCP links
+// in passive receive mode only announce the buffered length.
+func (S *Esp32) deliver(L *link, data []byte, From net.Addr) {
+	S.lock.Lock()
+	Mux, Dinfo := S.tcp.mux, S.tcp.dinfo
+	if S.trans.link == L {
+		S.lock.Unlock()
+		S.Raw(data)
+		return
+	}
+	if S.tcp.passive && L.udp == nil {
+		L.buffer = append(L.buffer, data...)
+		L.from = From
+		Size := len(L.buffer)
+		S.lock.Unlock()
+		if Mux {
+			S.Send("", fmt.Sprintf("+IPD,%d,%d", L.id, Size))
+		} else {
+			S.Send("", fmt.Sprintf("+IPD,%d", Size))
+		}
+		return
+	}
+	S.lock.Unlock()
+	Head := fmt.Sprintf("+IPD,%d", len(data))
+	if Mux {
+		Head = fmt.Sprintf("+IPD,%d,%d", L.id, len(data))
+	}
+	if Host, Port, err := net.SplitHostPort(From.String()); Dinfo && err == nil {
+		Head += fmt.Sprintf(",%s,%s", quote(Host), Port)
+	}
+	S.Raw(append([]byte("\r\n"+Head+":"), data...))
+}
+
+// accept hands the clients of AT+CIPSERVER to free link IDs.
+func (S *Esp32) accept(Listener net.Listener) {
+	for {
+		Conn, err := Listener.Accept()
+		if err != nil {
+			return
+		}
+		S.lock.Lock()
+		id, Clients := -1, 0
+		for i := maxLinks - 1; i >= 0; i-- {
+			if L := S.tcp.links[i]; L == nil {
+				id = i
+			} else if L.server {
+				Clients++
+			}
+		}
+		if id < 0 || Clients >= S.tcp.maxConn {
+			S.lock.Unlock()
+			Conn.Close()
+			continue
+		}
+		L := &link{id: id, typ: "TCP", conn: Conn, local: S.tcp.port, server: true}
+		if Host, Port, err := net.SplitHostPort(Conn.RemoteAddr().String()); err == nil {
+			L.remote = Host
+			L.port, _ = strconv.Atoi(Port)
+		}
+		S.tcp.links[id] = L
+		S.lock.Unlock()
+		S.linkEvent(id, "CONNECT")
+		go S.serve(L)
+	}
+}
+
+// close releases the socket of a link.
+func (L *link) close() {
+	if L.udp != nil {
+		L.udp.Close()
+		return
+	}
+	L.conn.Close()
+}
+
+// listen opens the socket of a UDP link:
+// AT+CIPSTART=<id>,"UDP",<"remote host">,<remote port>[,<local port>,<mode>]
+func (L *link) listen(Host string, Port int, Args []string) error {
+	Local, Mode := 0, 0
+	var err error
+	if len(Args) >= 1 && Args[0] != "" {
+		if Local, err = strconv.Atoi(Args[0]); err != nil {
+			return ErrParamValue
+		}
+	}
+	if len(Args) >= 2 {
+		if Mode, err = strconv.Atoi(Args[1]); err != nil || Mode < 0 || Mode > 2 {
+			return ErrParamValue
+		}
+	}
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: Local})
+	if err != nil {
+		return ErrExecFail
+	}
+	L.udp, L.mode = Conn, Mode
+	L.local = Conn.LocalAddr().(*net.UDPAddr).Port
+	if IP := net.ParseIP(Host); IP != nil && !IP.IsUnspecified() && Port != 0 {
+		L.peer = &net.UDPAddr{IP: IP, Port: Port}
+	}
+	return nil
+}
+
+// write sends data on a link, To overrides the peer of a UDP link.
+func (S *Esp32) write(L *link, data []byte, To *net.UDPAddr) error {
+	if L.udp == nil {
+		_, err := L.conn.Write(data)
+		return err
+	}
+	S.lock.Lock()
+	if To == nil {
+		To = L.peer
+	}
+	S.lock.Unlock()
+	if To == nil {
+		return fmt.Errorf("no peer")
+	}
+	_, err := L.udp.WriteToUDP(data, To)
+	return err
+}
+
+// linkArgs strips the link id of multi-link commands.
+func (S *Esp32) linkArgs(C Command) (int, []string, error) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if !S.tcp.mux {
+		return 0, C.Args, nil
+	}
+	id, err := strconv.Atoi(C.Arg(0))
+	if err != nil || id < 0 || id >= maxLinks {
+		return 0, nil, ErrParamValue
+	}
+	return id, C.Args[1:], nil
+}
+
+func (S *Esp32) registerTcpip() {
+	S.tcp.links = map[int]*link{}
+	S.tcp.maxConn = maxLinks
+	S.tcp.timeout = 180
+	S.tcp.dial = func(network, address string) (net.Conn, error) {
+		return net.DialTimeout(network, address, 3*time.Second)
+	}
+	S.handlers["+CIPMUX"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPMUX:%d", btoi(S.tcp.mux)))
+			return nil
+		case Set:
+			if len(S.tcp.links) > 0 || S.tcp.listener != nil || (C.Arg(0) == "1" && S.tcp.cipmode) {
+				return ErrExecFail
+			}
+			S.tcp.mux = C.Arg(0) == "1"
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CIPSTART"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		if len(Args) < 3 {
+			return ErrParamNum
+		}
+		Type := Args[0]
+		Port, err := strconv.Atoi(Args[2])
+		if err != nil || (Type != "TCP" && Type != "UDP" && Type != "SSL") {
+			return ErrParamValue
+		}
+		if !S.online() {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		_, Busy := S.tcp.links[id]
+		Dial := S.tcp.dial
+		S.lock.Unlock()
+		if Busy {
+			S.Send("ALREADY CONNECTED")
+			return ErrExecFail
+		}
+		L := &link{id: id, typ: Type, remote: Args[1], port: Port}
+		if Type == "UDP" {
+			if err := L.listen(Args[1], Port, Args[3:]); err != nil {
+				return err
+			}
+		} else {
+			Conn, err := Dial("tcp", net.JoinHostPort(Args[1], strconv.Itoa(Port)))
+			if err != nil {
+				return ErrExecFail
+			}
+			if Type == "SSL" {
+				if Conn, err = S.handshake(id, Args[1], Conn); err != nil {
+					return ErrExecFail
+				}
+			}
+			L.conn = Conn
+			if _, Local, err := net.SplitHostPort(Conn.LocalAddr().String()); err == nil {
+				L.local, _ = strconv.Atoi(Local)
+			}
+		}
+		S.lock.Lock()
+		S.tcp.links[id] = L
+		S.lock.Unlock()
+		S.linkEvent(id, "CONNECT")
+		go S.serve(L)
+		return nil
+	}
+	S.handlers["+CIPSEND"] = func(S *Esp32, C Command) error {
+		if C.Type == Execute {
+			return S.enterPassthrough()
+		}
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		Size, err := strconv.Atoi(Args[0])
+		if err != nil || Size <= 0 || Size > 8192 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		L := S.tcp.links[id]
+		S.lock.Unlock()
+		if L == nil {
+			S.Send("link is not valid")
+			return ErrExecFail
+		}
+		// UDP datagrams may name their own destination.
+		var To *net.UDPAddr
+		if len(Args) >= 3 {
+			Port, err := strconv.Atoi(Args[2])
+			IP := net.ParseIP(Args[1])
+			if L.udp == nil || err != nil || IP == nil {
+				return ErrParamValue
+			}
+			To = &net.UDPAddr{IP: IP, Port: Port}
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			S.Send("", fmt.Sprintf("Recv %d bytes", len(data)))
+			if err := S.write(L, data, To); err != nil {
+				S.Send("", "SEND FAIL")
+				return
+			}
+			S.Send("", "SEND OK")
+		})
+		return ErrNoReply
+	}
+	S.handlers["+CIPDINFO"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPDINFO:%s", map[bool]string{false: "false", true: "true"}[S.tcp.dinfo]))
+			return nil
+		case Set:
+			S.tcp.dinfo = C.Arg(0) == "1"
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CIPCLOSE"] = func(S *Esp32, C Command) error {
+		Ids := []int{0}
+		S.lock.Lock()
+		Mux := S.tcp.mux
+		S.lock.Unlock()
+		if Mux {
+			id, err := strconv.Atoi(C.Arg(0))
+			if err != nil || id < 0 || id > maxLinks {
+				return ErrParamValue
+			}
+			Ids = []int{id}
+			if id == maxLinks {
+				Ids = []int{0, 1, 2, 3, 4}
+			}
+		}
+		Closed := 0
+		for _, id := range Ids {
+			S.lock.Lock()
+			L := S.tcp.links[id]
+			delete(S.tcp.links, id)
+			S.lock.Unlock()
+			if L != nil {
+				L.close()
+				S.linkEvent(id, "CLOSED")
+				Closed++
+			}
+		}
+		if Closed == 0 && len(Ids) == 1 {
+			return ErrExecFail
+		}
+		return nil
+	}
+	S.handlers["+CIPSTATE"] = func(S *Esp32, C Command) error {
+		if C.Type != Query {
+			return ErrUnsupported
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		for id := 0; id < maxLinks; id++ {
+			if L := S.tcp.links[id]; L != nil {
+				S.Send(fmt.Sprintf("+CIPSTATE:%d,%s,%s,%d,%d,%d", id, quote(L.typ),
+					quote(L.remote), L.port, L.local, btoi(L.server)))
+			}
+		}
+		return nil
+	}
+	S.handlers["+CIPSTATUS"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		Status := 5
+		switch {
+		case len(S.tcp.links) > 0:
+			Status = 3
+		case S.wifi.state == wifiStateGotIP:
+			Status = 2
+		}
+		S.Send(fmt.Sprintf("STATUS:%d", Status))
+		for id := 0; id < maxLinks; id++ {
+			if L := S.tcp.links[id]; L != nil {
+				S.Send(fmt.Sprintf("+CIPSTATUS:%d,%s,%s,%d,%d,%d", id, quote(L.typ),
+					quote(L.remote), L.port, L.local, btoi(L.server)))
+			}
+		}
+		return nil
+	}
+	S.handlers["+CIPSERVER"] = func(S *Esp32, C Command) error {
+		switch C.Type {
+		case Query:
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			if S.tcp.listener == nil {
+				S.Send("+CIPSERVER:0")
+			} else {
+				S.Send(fmt.Sprintf("+CIPSERVER:1,%d,\"TCP\"", S.tcp.port))
+			}
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		if C.Arg(0) == "0" {
+			S.lock.Lock()
+			Listener := S.tcp.listener
+			S.tcp.listener = nil
+			Clients := []*link{}
+			if C.Arg(1) == "1" {
+				for id, L := range S.tcp.links {
+					if L.server {
+						delete(S.tcp.links, id)
+						Clients = append(Clients, L)
+					}
+				}
+			}
+			S.lock.Unlock()
+			if Listener == nil {
+				return ErrExecFail
+			}
+			Listener.Close()
+			for _, L := range Clients {
+				L.close()
+				S.linkEvent(L.id, "CLOSED")
+			}
+			return nil
+		}
+		if C.Arg(0) != "1" {
+			return ErrParamValue
+		}
+		Port := 333
+		if C.Arg(1) != "" {
+			var err error
+			if Port, err = strconv.Atoi(C.Arg(1)); err != nil || Port < 1 || Port > 65535 {
+				return ErrParamValue
+			}
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.tcp.mux {
+			return ErrExecFail
+		}
+		if S.tcp.listener != nil {
+			S.Send("no change")
+			return nil
+		}
+		Listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)))
+		if err != nil {
+			return ErrExecFail
+		}
+		S.tcp.listener, S.tcp.port = Listener, Port
+		go S.accept(Listener)
+		return nil
+	}
+	S.handlers["+CIPRECVMODE"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPRECVMODE:%d", btoi(S.tcp.passive)))
+			S.lock.Unlock()
+			return nil
+		case Set:
+			if C.Arg(0) != "0" && C.Arg(0) != "1" {
+				S.lock.Unlock()
+				return ErrParamValue
+			}
+			S.tcp.passive = C.Arg(0) == "1"
+			// Back to active mode, whatever is buffered goes out as +IPD.
+			Pending := []*link{}
+			for _, L := range S.tcp.links {
+				if !S.tcp.passive && len(L.buffer) > 0 {
+					Pending = append(Pending, L)
+				}
+			}
+			S.lock.Unlock()
+			for _, L := range Pending {
+				S.lock.Lock()
+				data, From := L.buffer, L.from
+				L.buffer = nil
+				S.lock.Unlock()
+				S.deliver(L, data, From)
+			}
+			return nil
+		}
+		S.lock.Unlock()
+		return ErrUnsupported
+	}
+	S.handlers["+CIPRECVDATA"] = func(S *Esp32, C Command) error {
+		if C.Type != Set {
+			return ErrUnsupported
+		}
+		id, Args, err := S.linkArgs(C)
+		if err != nil {
+			return err
+		}
+		Size, err := strconv.Atoi(Args[0])
+		if err != nil || Size <= 0 {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		L := S.tcp.links[id]
+		if L == nil || len(L.buffer) == 0 {
+			S.lock.Unlock()
+			return ErrExecFail
+		}
+		data := L.buffer[:min(Size, len(L.buffer))]
+		L.buffer = L.buffer[len(data):]
+		Head := fmt.Sprintf("+CIPRECVDATA:%d,", len(data))
+		if Host, Port, err := net.SplitHostPort(L.from.String()); S.tcp.dinfo && err == nil {
+			Head += fmt.Sprintf("%s,%s,", quote(Host), Port)
+		}
+		S.lock.Unlock()
+		S.Raw(append(append([]byte(Head), data...), '\r', '\n'))
+		return nil
+	}
+	S.handlers["+CIPRECVLEN"] = func(S *Esp32, C Command) error {
+		if C.Type != Query {
+			return ErrUnsupported
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		Sizes := make([]string, maxLinks)
+		for id := range Sizes {
+			Sizes[id] = "0"
+			if L := S.tcp.links[id]; L != nil {
+				Sizes[id] = strconv.Itoa(len(L.buffer))
+			}
+		}
+		S.Send("+CIPRECVLEN:" + strings.Join(Sizes, ","))
+		return nil
+	}
+	S.handlers["+CIPSERVERMAXCONN"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPSERVERMAXCONN:%d", S.tcp.maxConn))
+			return nil
+		case Set:
+			Max, err := strconv.Atoi(C.Arg(0))
+			if err != nil || Max < 1 || Max > maxLinks {
+				return ErrParamValue
+			}
+			if S.tcp.listener != nil {
+				return ErrExecFail
+			}
+			S.tcp.maxConn = Max
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CIPSTO"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CIPSTO:%d", S.tcp.timeout))
+			return nil
+		case Set:
+			Timeout, err := strconv.Atoi(C.Arg(0))
+			if err != nil || Timeout < 0 || Timeout > 7200 {
+				return ErrParamValue
+			}
+			S.tcp.timeout = Timeout
+			return nil
+		}
+		return ErrUnsupported
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*
+* AccessPoint: 模拟器周围的一个 Wi-Fi 热点
+*
+ */
+type AccessPoint struct {
+	SSID       string
+	Password   string
+	BSSID      string
+	Encryption int
+	RSSI       int
+	Channel    int
+	WPS        bool
+}
+
+const (
+	wifiStateIdle = iota
+	wifiStateConnected
+	wifiStateGotIP
+	wifiStateConnecting
+	wifiStateDisconnected
+)
+
+type wifiState struct {
+	mode  int
+	state int
+	ap    *AccessPoint
+	aps   []AccessPoint
+	ip    string
+	mac   string
+	// AT+CIPSTA, AT+CIPAPMAC and AT+CIPDNS
+	gateway string
+	netmask string
+	ip6ll   string
+	ip6gl   string
+	apMAC   string
+	dnsSet  bool
+	dns     []string
+	// names answered by AT+CIPDOMAIN
+	hosts map[string][]string
+	// round trip times answered by AT+PING, negative ones time out
+	pings map[string][]time.Duration
+	// AT+CWLAPOPT print mask and RSSI filter
+	lapMask int
+	lapRSSI int
+}
+
+// AddAccessPoint makes an access point visible to AT+CWLAP and AT+CWJAP.
+func (S *Esp32) AddAccessPoint(AP AccessPoint) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.wifi.aps = append(S.wifi.aps, AP)
+}
+
+// DropWifi simulates the access point going away.
+func (S *Esp32) DropWifi() {
+	S.lock.Lock()
+	Connected := S.wifi.ap != nil
+	S.wifi.ap = nil
+	S.wifi.state = wifiStateDisconnected
+	S.lock.Unlock()
+	if Connected {
+		S.Send("WIFI DISCONNECT")
+	}
+}
+
+func (S *Esp32) resetWifi() {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.wifi.ap = nil
+	S.wifi.state = wifiStateIdle
+}
+
+// station reports whether the station interface is enabled, the caller
+// must hold S.lock.
+func (S *Esp32) station() bool {
+	return S.wifi.mode == 1 || S.wifi.mode == 3
+}
+
+// online reports whether the station has an IP address.
+func (S *Esp32) online() bool {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.wifi.state == wifiStateGotIP
+}
+
+func (S *Esp32) registerWifi() {
+	S.wifi = wifiState{mode: 1, lapMask: 0x7FF, ip: "192.168.1.100", mac: "24:0a:c4:d6:e4:44",
+		gateway: "192.168.1.1", netmask: "255.255.255.0", ip6ll: "fe80::260a:c4ff:fed6:e444",
+		apMAC: "26:0a:c4:d6:e4:44", dns: defaultDNS, hosts: map[string][]string{},
+		pings: map[string][]time.Duration{}}
+	S.handlers["+CWMODE"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+CWMODE:%d", S.wifi.mode))
+			return nil
+		case Set:
+			Mode, err := strconv.Atoi(C.Arg(0))
+			if err != nil || Mode < 0 || Mode > 3 {
+				return ErrParamValue
+			}
+			S.wifi.mode = Mode
+			if !S.station() {
+				S.wifi.ap = nil
+				S.wifi.state = wifiStateIdle
+			}
+			if !S.softAP() {
+				S.softap.stations = nil
+			}
+			return nil
+		}
+		return ErrUnsupported
+	}
+	S.handlers["+CWJAP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		switch C.Type {
+		case Query:
+			defer S.lock.Unlock()
+			if S.wifi.ap == nil {
+				S.Send("No AP")
+				return nil
+			}
+			S.Send(fmt.Sprintf("+CWJAP:%s,%s,%d,%d,0,1,3,0,1", quote(S.wifi.ap.SSID),
+				quote(S.wifi.ap.BSSID), S.wifi.ap.Channel, S.wifi.ap.RSSI))
+			return nil
+		case Set:
+		default:
+			S.lock.Unlock()
+			return ErrUnsupported
+		}
+		if !S.station() || len(C.Args) < 1 {
+			S.lock.Unlock()
+			return ErrParamValue
+		}
+		Was := S.wifi.ap
+		var Found *AccessPoint
+		for i := range S.wifi.aps {
+			AP := &S.wifi.aps[i]
+			if AP.SSID == C.Arg(0) && (C.Arg(2) == "" || AP.BSSID == C.Arg(2)) {
+				Found = AP
+				break
+			}
+		}
+		S.wifi.ap = nil
+		S.wifi.state = wifiStateDisconnected
+		if Found != nil && Found.Password == C.Arg(1) {
+			S.wifi.ap = Found
+			S.wifi.state = wifiStateGotIP
+		}
+		S.lock.Unlock()
+		if Was != nil {
+			S.Send("WIFI DISCONNECT")
+		}
+		switch {
+		case Found == nil:
+			S.Send("+CWJAP:3")
+			return ErrExecFail
+		case Found.Password != C.Arg(1):
+			S.Send("+CWJAP:2")
+			return ErrExecFail
+		}
+		S.Send("WIFI CONNECTED", "WIFI GOT IP")
+		return nil
+	}
+	S.handlers["+CWQAP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		Was := S.wifi.ap
+		S.wifi.ap = nil
+		S.wifi.state = wifiStateDisconnected
+		S.lock.Unlock()
+		S.Send("", "OK")
+		if Was != nil {
+			S.Send("WIFI DISCONNECT")
+		}
+		return ErrNoReply
+	}
+	S.handlers["+CWSTATE"] = func(S *Esp32, C Command) error {
+		if C.Type != Query {
+			return ErrUnsupported
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		SSID := ""
+		if S.wifi.ap != nil {
+			SSID = S.wifi.ap.SSID
+		}
+		S.Send(fmt.Sprintf("+CWSTATE:%d,%s", S.wifi.state, quote(SSID)))
+		return nil
+	}
+	S.handlers["+CWLAPOPT"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 2 {
+			return ErrParamNum
+		}
+		Mask, err := strconv.Atoi(C.Arg(1))
+		if err != nil || Mask < 0 || Mask > 0x7FF {
+			return ErrParamValue
+		}
+		RSSI, _ := strconv.Atoi(C.Arg(2))
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.wifi.lapMask = Mask
+		S.wifi.lapRSSI = RSSI
+		return nil
+	}
+	S.handlers["+CWLAP"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		if !S.station() {
+			return ErrExecFail
+		}
+		Channel, _ := strconv.Atoi(C.Arg(2))
+		for _, AP := range S.wifi.aps {
+			if (C.Arg(0) != "" && AP.SSID != C.Arg(0)) || (C.Arg(1) != "" && AP.BSSID != C.Arg(1)) ||
+				(Channel != 0 && AP.Channel != Channel) ||
+				(S.wifi.lapRSSI != 0 && AP.RSSI < S.wifi.lapRSSI) {
+				continue
+			}
+			// ecn, ssid, rssi, mac, channel, freq_offset, freqcal_val,
+			// pairwise_cipher, group_cipher, bgn, wps
+			All := []string{strconv.Itoa(AP.Encryption), quote(AP.SSID), strconv.Itoa(AP.RSSI),
+				quote(AP.BSSID), strconv.Itoa(AP.Channel), "0", "0", "4", "4", "7", strconv.Itoa(btoi(AP.WPS))}
+			Fields := []string{}
+			for i, Field := range All {
+				if S.wifi.lapMask&(1<<i) != 0 {
+					Fields = append(Fields, Field)
+				}
+			}
+			S.Send("+CWLAP:(" + strings.Join(Fields, ",") + ")")
+		}
+		return nil
+	}
+	S.handlers["+CIFSR"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		IP := "0.0.0.0"
+		if S.wifi.state == wifiStateGotIP {
+			IP = S.wifi.ip
+		}
+		S.Send("+CIFSR:STAIP,"+quote(IP), "+CIFSR:STAMAC,"+quote(S.wifi.mac))
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const wsLinks = 3
+
+// wsLink is an open AT+WSOPEN connection.
+type wsLink struct {
+	S      *Esp32
+	id     int
+	uri    string
+	server *WSServer
+}
+
+/*
+*
+* wsState: WebSocket 连接和 AT+WSCFG/AT+WSHEAD 的设置, servers 是 AddWSServer
+* 注册的地址, 重启后保留
+*
+ */
+type wsState struct {
+	servers map[string]*WSServer
+	headers []string
+	buffers [wsLinks]int
+	links   [wsLinks]*wsLink
+}
+
+// AddWSServer makes AT+WSOPEN reach Server at URI.
+func (S *Esp32) AddWSServer(URI string, Server *WSServer) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.ws.servers[URI] = Server
+}
+
+func (S *Esp32) resetWS() {
+	S.lock.Lock()
+	Links := S.ws.links
+	S.ws = wsState{servers: S.ws.servers, buffers: [wsLinks]int{1024, 1024, 1024}}
+	S.lock.Unlock()
+	for _, L := range Links {
+		if L != nil {
+			L.server.leave(L)
+		}
+	}
+}
+
+// wsDeliver prints data as +WS_DATA, split by the buffer size of the link.
+func (S *Esp32) wsDeliver(L *wsLink, data []byte) {
+	S.lock.Lock()
+	Open := S.ws.links[L.id] == L
+	Size := S.ws.buffers[L.id]
+	S.lock.Unlock()
+	for Open && len(data) > 0 {
+		N := min(len(data), Size)
+		Head := fmt.Sprintf("+WS_DATA:%d,%d,", L.id, N)
+		S.Raw(append(append([]byte(Head), data[:N]...), '\r', '\n'))
+		data = data[N:]
+	}
+}
+
+// wsLost drops a link closed by the server.
+func (S *Esp32) wsLost(L *wsLink) {
+	S.lock.Lock()
+	Open := S.ws.links[L.id] == L
+	if Open {
+		S.ws.links[L.id] = nil
+	}
+	S.lock.Unlock()
+	if Open {
+		S.Send(fmt.Sprintf("+WS_DISCONNECTED:%d", L.id))
+	}
+}
+
+// wsLink returns the open link of parameter 0.
+func (S *Esp32) wsLink(C Command) (*wsLink, error) {
+	id, err := intArg(C, 0, 0, wsLinks-1)
+	if err != nil {
+		return nil, err
+	}
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	if S.ws.links[id] == nil {
+		return nil, ErrExecFail
+	}
+	return S.ws.links[id], nil
+}
+
+func (S *Esp32) registerWS() {
+	S.ws.servers = map[string]*WSServer{}
+	S.resetWS()
+	S.handlers["+WSCFG"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 3 || len(C.Args) > 4 {
+			return ErrParamNum
+		}
+		id, err := intArg(C, 0, 0, wsLinks-1)
+		if err != nil {
+			return err
+		}
+		for _, i := range []int{1, 2} {
+			if _, err := intArg(C, i, 1, 7200); err != nil {
+				return err
+			}
+		}
+		Size := 1024
+		if len(C.Args) == 4 {
+			if Size, err = intArg(C, 3, 1, 8192); err != nil {
+				return err
+			}
+		}
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.ws.buffers[id] = Size
+		return nil
+	}
+	S.handlers["+WSHEAD"] = func(S *Esp32, C Command) error {
+		switch C.Type {
+		case Query:
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			for i, Header := range S.ws.headers {
+				S.Send(fmt.Sprintf("+WSHEAD:%d,%s", i, quote(Header)))
+			}
+			return nil
+		case Set:
+		default:
+			return ErrUnsupported
+		}
+		Size, err := intArg(C, 0, 0, 256)
+		if err != nil {
+			return err
+		}
+		if Size == 0 {
+			S.lock.Lock()
+			S.ws.headers = nil
+			S.lock.Unlock()
+			return nil
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			S.lock.Lock()
+			S.ws.headers = append(S.ws.headers, string(data))
+			S.lock.Unlock()
+			S.Send("", "OK")
+		})
+		return ErrNoReply
+	}
+	S.handlers["+WSOPEN"] = func(S *Esp32, C Command) error {
+		if C.Type == Query {
+			S.lock.Lock()
+			defer S.lock.Unlock()
+			for id, L := range S.ws.links {
+				if L != nil {
+					S.Send(fmt.Sprintf("+WSOPEN:%d,4,%s", id, quote(L.uri)))
+				}
+			}
+			return nil
+		}
+		if C.Type != Set || len(C.Args) < 2 || len(C.Args) > 5 {
+			return ErrParamNum
+		}
+		id, err := intArg(C, 0, 0, wsLinks-1)
+		if err != nil {
+			return err
+		}
+		if C.Arg(3) != "" {
+			if _, err := intArg(C, 3, 0, 180000); err != nil {
+				return err
+			}
+		}
+		if !S.online() {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		Server := S.ws.servers[C.Arg(1)]
+		Busy := S.ws.links[id] != nil
+		Headers := S.ws.headers
+		S.lock.Unlock()
+		L := &wsLink{S: S, id: id, uri: C.Arg(1), server: Server}
+		if Busy || Server == nil || !Server.accept(L, Headers) {
+			return ErrExecFail
+		}
+		S.lock.Lock()
+		S.ws.links[id] = L
+		S.lock.Unlock()
+		S.Send("+WS_CONNECTED:" + strconv.Itoa(id))
+		return nil
+	}
+	S.handlers["+WSSEND"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) < 2 || len(C.Args) > 4 {
+			return ErrParamNum
+		}
+		L, err := S.wsLink(C)
+		if err != nil {
+			return err
+		}
+		Size, err := intArg(C, 1, 0, 8192)
+		if err != nil {
+			return err
+		}
+		Opcode := 1
+		if C.Arg(2) != "" {
+			if Opcode, err = intArg(C, 2, 0, 10); err != nil {
+				return err
+			}
+		}
+		if Size == 0 {
+			L.server.receive(L, WSMessage{Opcode: Opcode, Data: []byte{}})
+			return nil
+		}
+		S.Send("", "OK")
+		S.Raw([]byte("\r\n>"))
+		S.Expect(Size, func(data []byte) {
+			L.server.receive(L, WSMessage{Opcode: Opcode, Data: data})
+			S.Send("", "SEND OK")
+		})
+		return ErrNoReply
+	}
+	S.handlers["+WSCLOSE"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || len(C.Args) != 1 {
+			return ErrParamNum
+		}
+		L, err := S.wsLink(C)
+		if err != nil {
+			return err
+		}
+		S.lock.Lock()
+		S.ws.links[L.id] = nil
+		S.lock.Unlock()
+		L.server.leave(L)
+		S.Send("", "OK")
+		S.Send(fmt.Sprintf("+WS_CLOSED:%d", L.id))
+		return ErrNoReply
+	}
+}
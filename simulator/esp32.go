@@ -0,0 +1,413 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoReply: the handler sends the final result code by itself.
+	ErrNoReply = errors.New("simulator: no reply")
+	// ESP-AT error codes, printed as ERR CODE:0x... when AT+SYSLOG=1
+	ErrParamNum    = CodeError(0x01060000)
+	ErrParamValue  = CodeError(0x01070000)
+	ErrUnsupported = CodeError(0x01090000)
+	ErrExecFail    = CodeError(0x010A0000)
+	// ErrMQTTUninitiated: AT+MQTTCLEAN on an idle link
+	ErrMQTTUninitiated = CodeError(0x010A6003)
+)
+
+// CodeError makes a handler answer ERROR with the given ESP-AT error code.
+type CodeError uint32
+
+func (E CodeError) Error() string {
+	return fmt.Sprintf("ERR CODE:0x%08x", uint32(E))
+}
+
+// Handler answers one command. A nil error is followed by OK, ErrNoReply by
+// nothing and any other error by ERROR.
+type Handler func(S *Esp32, C Command) error
+
+/*
+*
+* Fault: 注入到下一条匹配指令上的故障
+*
+ */
+type Fault int
+
+const (
+	// FaultError answers ERROR instead of running the command.
+	FaultError Fault = iota + 1
+	// FaultBusy answers busy p... and drops the command.
+	FaultBusy
+	// FaultSilent drops the command without any answer.
+	FaultSilent
+	// FaultNoEcho runs the command but skips the echo.
+	FaultNoEcho
+	// FaultNoise sends a line of garbage in front of the echo.
+	FaultNoise
+)
+
+type payload struct {
+	size int
+	data []byte
+	done func(data []byte)
+}
+
+/*
+*
+* Esp32: 运行 ESP-AT 固件的 ESP32 模组模拟器, 实现 io.ReadWriteCloser,
+* 可以直接传给 esp32wroom.NewEsp32Wroom
+*
+ */
+type Esp32 struct {
+	*uart
+	lock     sync.Mutex
+	echo     bool
+	syslog   bool
+	latency  time.Duration
+	asleep   time.Time
+	handlers map[string]Handler
+	delays   map[string]time.Duration
+	faults   map[string][]Fault
+	commands []string
+
+	// module goroutine only
+	input   []byte
+	payload *payload
+
+	wifi   wifiState
+	softap softapState
+	ble    bleState
+	tcp    tcpState
+	trans  transState
+	ssl    sslState
+	sntp   sntpState
+	http   httpState
+	mqtt   mqttState
+	ws     wsState
+	fs     fsState
+	flash  flashState
+}
+
+func NewEsp32() *Esp32 {
+	S := &Esp32{
+		echo:     true,
+		latency:  time.Millisecond,
+		handlers: map[string]Handler{},
+		delays: map[string]time.Duration{
+			"+RST":   20 * time.Millisecond,
+			"+CWJAP": 50 * time.Millisecond,
+			"+CWLAP": 30 * time.Millisecond,
+		},
+		faults: map[string][]Fault{},
+	}
+	S.uart = newUart(S.receive)
+	S.registerBasic()
+	S.registerWifi()
+	S.registerSoftAP()
+	S.registerIP()
+	S.registerTcpip()
+	S.registerPassthrough()
+	S.registerSSL()
+	S.registerSNTP()
+	S.registerHTTP()
+	S.registerMQTT()
+	S.registerWS()
+	S.registerFS()
+	S.registerSysflash()
+	S.registerBle()
+	return S
+}
+
+// Handle installs or replaces the handler of a command name such as "+GMR"
+// or "ATE0".
+func (S *Esp32) Handle(Name string, Handler Handler) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.handlers[Name] = Handler
+}
+
+// SetLatency sets the delay in front of every answer.
+func (S *Esp32) SetLatency(Latency time.Duration) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.latency = Latency
+}
+
+// SetDelay sets how long a command takes on top of the latency.
+func (S *Esp32) SetDelay(Name string, Delay time.Duration) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.delays[Name] = Delay
+}
+
+// InjectFault arms a one shot fault for the next command called Name.
+func (S *Esp32) InjectFault(Name string, Fault Fault) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.faults[Name] = append(S.faults[Name], Fault)
+}
+
+// InjectURC sends an unsolicited line to the host.
+func (S *Esp32) InjectURC(Line string) {
+	S.Send(Line)
+}
+
+// Commands returns every command line received so far.
+func (S *Esp32) Commands() []string {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return append([]string{}, S.commands...)
+}
+
+// Send writes lines terminated by \r\n to the host.
+func (S *Esp32) Send(Lines ...string) {
+	var data []byte
+	for _, Line := range Lines {
+		data = append(data, Line...)
+		data = append(data, '\r', '\n')
+	}
+	S.uart.send(data)
+}
+
+// Raw writes bytes to the host as they are.
+func (S *Esp32) Raw(data []byte) {
+	S.uart.send(data)
+}
+
+// Expect collects the next size bytes from the host as raw data, used
+// after a > prompt.
+func (S *Esp32) Expect(size int, done func(data []byte)) {
+	S.payload = &payload{size: size, done: done}
+}
+
+func (S *Esp32) receive(data []byte) {
+	if S.passthrough(data) {
+		return
+	}
+	for len(data) > 0 {
+		if P := S.payload; P != nil {
+			N := min(P.size-len(P.data), len(data))
+			P.data = append(P.data, data[:N]...)
+			data = data[N:]
+			if len(P.data) == P.size {
+				S.payload = nil
+				P.done(P.data)
+			}
+			continue
+		}
+		i := indexLineEnd(data)
+		if i < 0 {
+			S.input = append(S.input, data...)
+			return
+		}
+		S.input = append(S.input, data[:i]...)
+		data = data[i+1:]
+		Line := string(S.input)
+		S.input = S.input[:0]
+		if len(Line) > 0 && Line[len(Line)-1] == '\r' {
+			Line = Line[:len(Line)-1]
+		}
+		if Line != "" {
+			S.execute(Line)
+		}
+	}
+}
+
+func indexLineEnd(data []byte) int {
+	for i, b := range data {
+		if b == '\n' {
+			return i
+		}
+	}
+	return -1
+}
+
+func (S *Esp32) takeFault(Name string) Fault {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	Faults := S.faults[Name]
+	if len(Faults) == 0 {
+		return 0
+	}
+	S.faults[Name] = Faults[1:]
+	return Faults[0]
+}
+
+func (S *Esp32) execute(Line string) {
+	C := parseCommand(Line)
+	S.lock.Lock()
+	S.commands = append(S.commands, Line)
+	Asleep := time.Now().Before(S.asleep)
+	Echo := S.echo
+	Delay := S.latency + S.delays[C.Name]
+	Handler := S.handlers[C.Name]
+	S.lock.Unlock()
+	if Asleep {
+		return
+	}
+	Fault := S.takeFault(C.Name)
+	switch Fault {
+	case FaultSilent:
+		return
+	case FaultBusy:
+		S.Send("busy p...")
+		return
+	}
+	if Fault == FaultNoise {
+		S.Raw([]byte("\x00\xff\xfe?!\r\n"))
+	}
+	if Echo && Fault != FaultNoEcho {
+		S.Send(Line)
+	}
+	time.Sleep(Delay)
+	if Fault == FaultError {
+		S.Reply(ErrExecFail)
+		return
+	}
+	if Handler == nil {
+		S.Reply(ErrUnsupported)
+		return
+	}
+	S.Reply(Handler(S, C))
+}
+
+// Reply sends the final result code for err, see Handler.
+func (S *Esp32) Reply(err error) {
+	if err == nil {
+		S.Send("", "OK")
+		return
+	}
+	if errors.Is(err, ErrNoReply) {
+		return
+	}
+	S.errCode(err)
+	S.Send("", "ERROR")
+}
+
+// errCode prints the ERR CODE line of err when AT+SYSLOG=1.
+func (S *Esp32) errCode(err error) {
+	S.lock.Lock()
+	Syslog := S.syslog
+	S.lock.Unlock()
+	var Code CodeError
+	if Syslog && errors.As(err, &Code) {
+		S.Send(Code.Error())
+	}
+}
+
+/*
+*
+* 基础 AT 指令
+*
+ */
+func (S *Esp32) registerBasic() {
+	S.handlers["AT"] = func(S *Esp32, C Command) error {
+		return nil
+	}
+	S.handlers["ATE0"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.echo = false
+		return nil
+	}
+	S.handlers["ATE1"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		S.echo = true
+		return nil
+	}
+	S.handlers["+GMR"] = func(S *Esp32, C Command) error {
+		S.Send("AT version:3.2.0.0(s-ec2dec2 - ESP32 - Jul 28 2023 07:05:28)",
+			"SDK version:v5.0.2-376-g24b9d38a24-dirty",
+			"compile time(6118fc22):Jul 28 2023 09:47:28",
+			"Bin version:v3.2.0.0(WROOM-32)")
+		return nil
+	}
+	S.handlers["+RST"] = func(S *Esp32, C Command) error {
+		S.Send("", "OK")
+		time.AfterFunc(S.delay("+RST"), S.reboot)
+		return ErrNoReply
+	}
+	S.handlers["+GSLP"] = func(S *Esp32, C Command) error {
+		var Ms int
+		if _, err := fmt.Sscan(C.Arg(0), &Ms); err != nil || C.Type != Set {
+			return ErrParamValue
+		}
+		S.lock.Lock()
+		S.asleep = time.Now().Add(time.Duration(Ms) * time.Millisecond)
+		S.lock.Unlock()
+		S.Send("", "OK")
+		time.AfterFunc(time.Duration(Ms)*time.Millisecond, S.reboot)
+		return ErrNoReply
+	}
+	S.handlers["+SYSLOG"] = func(S *Esp32, C Command) error {
+		S.lock.Lock()
+		defer S.lock.Unlock()
+		switch C.Type {
+		case Query:
+			S.Send(fmt.Sprintf("+SYSLOG:%d", btoi(S.syslog)))
+		case Set:
+			S.syslog = C.Arg(0) == "1"
+		default:
+			return ErrUnsupported
+		}
+		return nil
+	}
+	S.handlers["+SAVETRANSLINK"] = func(S *Esp32, C Command) error {
+		if C.Type != Set || (C.Arg(0) != "0" && C.Arg(0) != "1") {
+			return ErrParamValue
+		}
+		return nil
+	}
+}
+
+func (S *Esp32) delay(Name string) time.Duration {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return S.delays[Name]
+}
+
+// reboot drops all volatile state like the firmware does on a reset.
+func (S *Esp32) reboot() {
+	S.lock.Lock()
+	S.echo = true
+	S.asleep = time.Time{}
+	S.lock.Unlock()
+	S.resetWifi()
+	S.resetSoftAP()
+	S.resetTcpip()
+	S.resetSNTP()
+	S.resetHTTP()
+	S.resetMQTT()
+	S.resetWS()
+	S.resetFS()
+	S.resetBle()
+	S.Raw([]byte("ets Jul 29 2019 12:21:46\r\n\r\nrst:0x1 (POWERON_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)\r\n"))
+	S.Send("", "ready")
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
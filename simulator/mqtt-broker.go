@@ -0,0 +1,175 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"strings"
+	"sync"
+)
+
+// MQTTMessage is a message published through an MQTTBroker.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     int
+	Retain  bool
+}
+
+/*
+*
+* MQTTBroker: 内存中的 MQTT broker 替身, 模拟器用 AddMQTTBroker 注册后,
+* AT+MQTTCONN 连接到它, 多个模拟器可以共用一个 broker 互相收发消息
+*
+ */
+type MQTTBroker struct {
+	lock      sync.Mutex
+	down      bool
+	username  string
+	password  string
+	clients   map[*Esp32]bool
+	retained  map[string]MQTTMessage
+	published []MQTTMessage
+}
+
+func NewMQTTBroker() *MQTTBroker {
+	return &MQTTBroker{clients: map[*Esp32]bool{}, retained: map[string]MQTTMessage{}}
+}
+
+// SetAuth makes the broker refuse clients without these credentials.
+func (B *MQTTBroker) SetAuth(Username, Password string) {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	B.username, B.password = Username, Password
+}
+
+// SetDown makes the broker refuse new connections while Down is true.
+func (B *MQTTBroker) SetDown(Down bool) {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	B.down = Down
+}
+
+// Messages returns every message the clients have published so far,
+// will messages included.
+func (B *MQTTBroker) Messages() []MQTTMessage {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	return append([]MQTTMessage{}, B.published...)
+}
+
+// Subscribed reports whether a connected client has subscribed Filter.
+func (B *MQTTBroker) Subscribed(Filter string) bool {
+	for _, S := range B.connected() {
+		if S.subscribed(Filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends a message to every client with a matching subscription.
+func (B *MQTTBroker) Publish(Topic string, Payload []byte) {
+	B.publish(MQTTMessage{Topic: Topic, Payload: Payload}, false)
+}
+
+// Kick drops every client as if the connection broke, their will
+// messages are published.
+func (B *MQTTBroker) Kick() {
+	B.lock.Lock()
+	Clients := B.clients
+	B.clients = map[*Esp32]bool{}
+	B.lock.Unlock()
+	for S := range Clients {
+		if Will, ok := S.mqttLost(); ok {
+			B.publish(Will, true)
+		}
+	}
+}
+
+func (B *MQTTBroker) connect(S *Esp32, Username, Password string) bool {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	if B.down || (B.username != "" && (Username != B.username || Password != B.password)) {
+		return false
+	}
+	B.clients[S] = true
+	return true
+}
+
+func (B *MQTTBroker) disconnect(S *Esp32) {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	delete(B.clients, S)
+}
+
+func (B *MQTTBroker) connected() []*Esp32 {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	Clients := []*Esp32{}
+	for S := range B.clients {
+		Clients = append(Clients, S)
+	}
+	return Clients
+}
+
+// publish records messages from clients and hands them to subscribers.
+func (B *MQTTBroker) publish(M MQTTMessage, FromClient bool) {
+	B.lock.Lock()
+	if FromClient {
+		B.published = append(B.published, M)
+	}
+	if M.Retain {
+		if len(M.Payload) == 0 {
+			delete(B.retained, M.Topic)
+		} else {
+			B.retained[M.Topic] = M
+		}
+	}
+	B.lock.Unlock()
+	for _, S := range B.connected() {
+		S.mqttDeliver(M)
+	}
+}
+
+// retainedFor returns the retained messages that match Filter.
+func (B *MQTTBroker) retainedFor(Filter string) []MQTTMessage {
+	B.lock.Lock()
+	defer B.lock.Unlock()
+	Messages := []MQTTMessage{}
+	for Topic, M := range B.retained {
+		if topicMatch(Filter, Topic) {
+			Messages = append(Messages, M)
+		}
+	}
+	return Messages
+}
+
+// topicMatch applies the MQTT wildcards + and # of Filter to Topic.
+func topicMatch(Filter, Topic string) bool {
+	if strings.HasPrefix(Topic, "$") && (strings.HasPrefix(Filter, "+") || strings.HasPrefix(Filter, "#")) {
+		return false
+	}
+	Filters, Topics := strings.Split(Filter, "/"), strings.Split(Topic, "/")
+	for i, F := range Filters {
+		if F == "#" {
+			return true
+		}
+		if i >= len(Topics) || (F != "+" && F != Topics[i]) {
+			return false
+		}
+	}
+	return len(Filters) == len(Topics)
+}
@@ -0,0 +1,326 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*
+* mx01Config: 保存在模组 Flash 中的配置, 重启后保留, AT+RESET=1 恢复出厂设置(MAC 除外)
+*
+ */
+type mx01Config struct {
+	mac     string
+	name    string
+	uart    int
+	aintvl  int
+	txpower int
+	uuids   string
+	uuidn   string
+	uuidw   string
+	amdata  string
+}
+
+func mx01Factory(mac string) mx01Config {
+	return mx01Config{
+		mac:     mac,
+		name:    "MX-01",
+		uart:    0,
+		aintvl:  200,
+		txpower: 3,
+		uuids:   "FFF0",
+		uuidn:   "FFF1",
+		uuidw:   "FFF2",
+	}
+}
+
+var (
+	mx01Hex  = regexp.MustCompile("^[0-9a-fA-F]*$")
+	mx01Args = map[string]func(string) bool{
+		"+MAC":     func(s string) bool { return len(s) == 12 && mx01Hex.MatchString(s) },
+		"+NAME":    func(s string) bool { return len(s) > 0 && len(s) <= 20 },
+		"+ADV":     func(s string) bool { return s == "0" || s == "1" },
+		"+UART":    mx01Range(0, 5),
+		"+AINTVL":  mx01Range(20, 10000),
+		"+TXPOWER": mx01Range(0, 9),
+		"+UUIDS":   mx01UUID,
+		"+UUIDN":   mx01UUID,
+		"+UUIDW":   mx01UUID,
+		"+AMDATA":  func(s string) bool { return len(s)%2 == 0 && len(s) <= 58 && mx01Hex.MatchString(s) },
+		"+DISCONN": func(s string) bool { return s == "0" || s == "1" },
+		"+RESET":   func(s string) bool { return s == "1" },
+		"+REBOOT":  func(s string) bool { return s == "1" },
+	}
+)
+
+func mx01Range(Min, Max int) func(string) bool {
+	return func(s string) bool {
+		N, err := strconv.Atoi(s)
+		return err == nil && N >= Min && N <= Max
+	}
+}
+
+func mx01UUID(s string) bool {
+	return (len(s) == 4 || len(s) == 32) && mx01Hex.MatchString(s)
+}
+
+/*
+*
+* MX01: MX-01 蓝牙透传模组模拟器, 实现 io.ReadWriteCloser,
+* 可以直接传给 mx01.NewMX01。手机连上后模组进入透传模式,
+* 串口数据直接转发给手机, 除非 CDS 引脚切到 AT 模式(SetCommandMode)。
+*
+ */
+type MX01 struct {
+	*uart
+	lock     sync.Mutex
+	latency  time.Duration
+	flash    mx01Config
+	adv      bool
+	booting  bool
+	phone    string
+	command  bool
+	received []byte
+	commands []string
+	input    []byte
+}
+
+func NewMX01() *MX01 {
+	S := &MX01{
+		latency: time.Millisecond,
+		flash:   mx01Factory("00:01:02:03:04:05"),
+		adv:     true,
+	}
+	S.uart = newUart(S.receive)
+	return S
+}
+
+// SetLatency sets the delay in front of every answer.
+func (S *MX01) SetLatency(Latency time.Duration) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.latency = Latency
+}
+
+// SetCommandMode mirrors the CDS pin: AT commands are parsed while a phone
+// is connected instead of being passed through.
+func (S *MX01) SetCommandMode(On bool) {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	S.command = On
+}
+
+// Connect simulates a phone connecting, the module switches to pass-through.
+func (S *MX01) Connect(MAC string) {
+	S.lock.Lock()
+	S.phone = MAC
+	S.adv = false
+	S.lock.Unlock()
+	S.send([]byte("+CONNECTED:1," + MAC + "\r\n"))
+}
+
+// Disconnect simulates the phone going away.
+func (S *MX01) Disconnect() {
+	S.lock.Lock()
+	MAC := S.phone
+	S.phone = ""
+	S.adv = true
+	S.lock.Unlock()
+	if MAC != "" {
+		S.send([]byte("+DISCONN:1," + MAC + "\r\n"))
+	}
+}
+
+// PhoneSend writes data from the phone to the serial port.
+func (S *MX01) PhoneSend(data []byte) {
+	S.lock.Lock()
+	Connected := S.phone != ""
+	S.lock.Unlock()
+	if Connected {
+		S.send(data)
+	}
+}
+
+// PhoneReceived returns and clears what the phone got over pass-through.
+func (S *MX01) PhoneReceived() []byte {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	data := S.received
+	S.received = nil
+	return data
+}
+
+// Commands returns every command line received so far.
+func (S *MX01) Commands() []string {
+	S.lock.Lock()
+	defer S.lock.Unlock()
+	return append([]string{}, S.commands...)
+}
+
+func (S *MX01) receive(data []byte) {
+	S.lock.Lock()
+	if S.phone != "" && !S.command {
+		S.received = append(S.received, data...)
+		S.lock.Unlock()
+		return
+	}
+	S.lock.Unlock()
+	S.input = append(S.input, data...)
+	for {
+		i := strings.Index(string(S.input), "\r\n")
+		if i < 0 {
+			return
+		}
+		Line := string(S.input[:i])
+		S.input = S.input[i+2:]
+		if Line != "" {
+			S.execute(Line)
+		}
+	}
+}
+
+func (S *MX01) execute(Line string) {
+	C := parseCommand(Line)
+	S.lock.Lock()
+	S.commands = append(S.commands, Line)
+	Latency := S.latency
+	Booting := S.booting
+	S.lock.Unlock()
+	if Booting {
+		return
+	}
+	time.Sleep(Latency)
+	if C.Type == Set {
+		if Valid := mx01Args[C.Name]; Valid == nil || len(C.Args) != 1 || !Valid(C.Args[0]) {
+			S.send([]byte("ERROR\r\n"))
+			return
+		}
+	}
+	S.lock.Lock()
+	Reply, Reboot := S.handle(C)
+	S.lock.Unlock()
+	if Reply != "" {
+		S.send([]byte(Reply + "\r\n"))
+	}
+	if Reboot {
+		S.reboot()
+	}
+}
+
+// handle runs one command with S.lock held, it returns the answer line.
+func (S *MX01) handle(C Command) (string, bool) {
+	F := &S.flash
+	if C.Type == Query || C.Type == Execute {
+		switch C.Name {
+		case "+MAC":
+			return "+MAC:" + F.mac, false
+		case "+NAME":
+			return "+NAME:" + F.name, false
+		case "+ADV":
+			return fmt.Sprintf("+ADV:%d", btoi(S.adv)), false
+		case "+UART":
+			return fmt.Sprintf("+UART:%d", F.uart), false
+		case "+AINTVL":
+			return fmt.Sprintf("+AINTVL:%d", F.aintvl), false
+		case "+VER":
+			return "+VER:V0.0.1", false
+		case "+TXPOWER":
+			return fmt.Sprintf("+TXPOWER:%d", F.txpower), false
+		case "+UUIDS":
+			return "+UUIDS:" + F.uuids, false
+		case "+UUIDN":
+			return "+UUIDN:" + F.uuidn, false
+		case "+UUIDW":
+			return "+UUIDW:" + F.uuidw, false
+		case "+AMDATA":
+			return "+AMDATA:" + F.amdata, false
+		case "+DEV":
+			if S.phone == "" {
+				// 没有连接时模组不返回任何数据
+				return "", false
+			}
+			return "+DEV:1," + S.phone, false
+		}
+		return "ERROR", false
+	}
+	if C.Type != Set {
+		return "ERROR", false
+	}
+	Arg := C.Args[0]
+	N, _ := strconv.Atoi(Arg)
+	switch C.Name {
+	case "+MAC":
+		var MAC []string
+		for i := 0; i < 12; i += 2 {
+			MAC = append(MAC, strings.ToUpper(Arg[i:i+2]))
+		}
+		F.mac = strings.Join(MAC, ":")
+	case "+NAME":
+		F.name = Arg
+	case "+ADV":
+		S.adv = N == 1
+	case "+UART":
+		F.uart = N
+	case "+AINTVL":
+		F.aintvl = N
+	case "+TXPOWER":
+		F.txpower = N
+	case "+UUIDS":
+		F.uuids = strings.ToUpper(Arg)
+	case "+UUIDN":
+		F.uuidn = strings.ToUpper(Arg)
+	case "+UUIDW":
+		F.uuidw = strings.ToUpper(Arg)
+	case "+AMDATA":
+		F.amdata = strings.ToUpper(Arg)
+	case "+DISCONN":
+		if S.phone == "" {
+			return "ERROR", false
+		}
+		MAC := S.phone
+		S.phone = ""
+		S.adv = true
+		return "+DISCONN:1," + MAC, false
+	case "+RESET":
+		*F = mx01Factory(F.mac)
+		return "OK", true
+	case "+REBOOT":
+		return "OK", true
+	}
+	return "OK", false
+}
+
+// reboot keeps the flash, drops the link and restarts advertising.
+func (S *MX01) reboot() {
+	S.lock.Lock()
+	S.booting = true
+	S.phone = ""
+	S.adv = true
+	S.lock.Unlock()
+	time.AfterFunc(20*time.Millisecond, func() {
+		S.lock.Lock()
+		S.booting = false
+		S.lock.Unlock()
+		S.send([]byte("+READY\r\n"))
+	})
+}
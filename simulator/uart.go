@@ -0,0 +1,110 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+*
+* uart: 内存中的串口, 主机一侧实现 io.ReadWriteCloser,
+* 模组一侧通过 send 写数据, 主机写入的数据按顺序交给 handle。
+*
+ */
+type uart struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	rx     []byte
+	closed bool
+	tx     chan []byte
+	done   chan struct{}
+}
+
+func newUart(handle func(data []byte)) *uart {
+	U := &uart{tx: make(chan []byte, 256), done: make(chan struct{})}
+	U.cond = sync.NewCond(&U.lock)
+	go func() {
+		for {
+			select {
+			case data := <-U.tx:
+				handle(data)
+			case <-U.done:
+				return
+			}
+		}
+	}()
+	return U
+}
+
+// Read blocks until the module sent something or the port is closed.
+func (U *uart) Read(b []byte) (int, error) {
+	U.lock.Lock()
+	defer U.lock.Unlock()
+	for len(U.rx) == 0 && !U.closed {
+		U.cond.Wait()
+	}
+	if len(U.rx) == 0 {
+		return 0, io.EOF
+	}
+	N := copy(b, U.rx)
+	U.rx = U.rx[N:]
+	return N, nil
+}
+
+func (U *uart) Write(b []byte) (int, error) {
+	U.lock.Lock()
+	closed := U.closed
+	U.lock.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	select {
+	case U.tx <- append([]byte{}, b...):
+		return len(b), nil
+	case <-U.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (U *uart) Close() error {
+	U.lock.Lock()
+	defer U.lock.Unlock()
+	if !U.closed {
+		U.closed = true
+		close(U.done)
+		U.cond.Broadcast()
+	}
+	return nil
+}
+
+func (U *uart) isClosed() bool {
+	U.lock.Lock()
+	defer U.lock.Unlock()
+	return U.closed
+}
+
+// send queues bytes for the host, a write is never split by other writes.
+func (U *uart) send(data []byte) {
+	U.lock.Lock()
+	defer U.lock.Unlock()
+	if U.closed {
+		return
+	}
+	U.rx = append(U.rx, data...)
+	U.cond.Broadcast()
+}
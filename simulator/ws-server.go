@@ -0,0 +1,134 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import "sync"
+
+// WSMessage is a WebSocket message a client has sent, Opcode as in
+// AT+WSSEND.
+type WSMessage struct {
+	Opcode int
+	Data   []byte
+}
+
+/*
+*
+* WSServer: 内存中的 WebSocket 服务端替身, 模拟器用 AddWSServer 注册后,
+* AT+WSOPEN 连接到它
+*
+ */
+type WSServer struct {
+	lock     sync.Mutex
+	down     bool
+	echo     bool
+	headers  []string
+	clients  map[*wsLink]bool
+	messages []WSMessage
+}
+
+func NewWSServer() *WSServer {
+	return &WSServer{clients: map[*wsLink]bool{}}
+}
+
+// SetDown makes the server refuse handshakes while Down is true.
+func (W *WSServer) SetDown(Down bool) {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	W.down = Down
+}
+
+// SetEcho makes the server send text and binary messages back.
+func (W *WSServer) SetEcho(Echo bool) {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	W.echo = Echo
+}
+
+// Headers returns the request headers of the last handshake.
+func (W *WSServer) Headers() []string {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	return append([]string{}, W.headers...)
+}
+
+// Messages returns every message the clients have sent so far.
+func (W *WSServer) Messages() []WSMessage {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	return append([]WSMessage{}, W.messages...)
+}
+
+// Clients returns the number of open connections.
+func (W *WSServer) Clients() int {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	return len(W.clients)
+}
+
+// Send sends a message to every client.
+func (W *WSServer) Send(Data []byte) {
+	for _, L := range W.connected() {
+		L.S.wsDeliver(L, Data)
+	}
+}
+
+// Disconnect closes every connection from the server side.
+func (W *WSServer) Disconnect() {
+	W.lock.Lock()
+	Clients := W.clients
+	W.clients = map[*wsLink]bool{}
+	W.lock.Unlock()
+	for L := range Clients {
+		L.S.wsLost(L)
+	}
+}
+
+func (W *WSServer) accept(L *wsLink, Headers []string) bool {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	if W.down {
+		return false
+	}
+	W.headers = append([]string{}, Headers...)
+	W.clients[L] = true
+	return true
+}
+
+func (W *WSServer) leave(L *wsLink) {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	delete(W.clients, L)
+}
+
+func (W *WSServer) connected() []*wsLink {
+	W.lock.Lock()
+	defer W.lock.Unlock()
+	Clients := []*wsLink{}
+	for L := range W.clients {
+		Clients = append(Clients, L)
+	}
+	return Clients
+}
+
+func (W *WSServer) receive(L *wsLink, M WSMessage) {
+	W.lock.Lock()
+	W.messages = append(W.messages, M)
+	Echo := W.echo && (M.Opcode == 1 || M.Opcode == 2)
+	W.lock.Unlock()
+	if Echo {
+		L.S.wsDeliver(L, M.Data)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	esp32wroom "github.com/hootrhino/rhilex-goat/bsp/esp32wroom"
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/device"
+)
+
+// scriptPort answers every command with a canned reply, split into small
+// chunks to mimic a slow UART. Every "<pause>" in a reply waits 100ms.
+type scriptPort struct {
+	replies map[string]string
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	lock    sync.Mutex
+	sent    []string
+}
+
+func newScriptPort(replies map[string]string) *scriptPort {
+	r, w := io.Pipe()
+	return &scriptPort{replies: replies, r: r, w: w}
+}
+
+func (P *scriptPort) Read(b []byte) (int, error) {
+	return P.r.Read(b)
+}
+
+func (P *scriptPort) Write(b []byte) (int, error) {
+	P.lock.Lock()
+	P.sent = append(P.sent, string(b))
+	P.lock.Unlock()
+	reply, ok := P.replies[string(b)]
+	if ok {
+		go func() {
+			for len(reply) > 0 {
+				if strings.HasPrefix(reply, "<pause>") {
+					time.Sleep(100 * time.Millisecond)
+					reply = reply[len("<pause>"):]
+					continue
+				}
+				n := min(7, len(reply))
+				if i := strings.Index(reply, "<pause>"); i > 0 {
+					n = min(n, i)
+				}
+				P.w.Write([]byte(reply[:n]))
+				reply = reply[n:]
+			}
+		}()
+	}
+	return len(b), nil
+}
+
+func (P *scriptPort) Close() error {
+	P.w.Close()
+	return P.r.Close()
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_GMR$ rhilex-goat/test -v -count=1
+func Test_ATEngine_GMR(t *testing.T) {
+	Version := "AT version:3.2.0.0(s-ec2dec2 - ESP32 - Jul 28 2023 07:05:28)" + strings.Repeat(" ", 200)
+	Port := newScriptPort(map[string]string{
+		"AT+GMR\r\n": "AT+GMR\r\n" + Version + "\r\nSDK version:v5.0.2\r\n" +
+			"compile time(6118fc22):Jul 28 2023 09:47:28\r\nBin version:v3.2.0.0(WROOM-32)\r\n\r\nOK\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	Start := time.Now()
+	GMRResponse, err := esp32wroomAt.GMR(context.Background(), Esp32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GMRResponse.AtVersion != Version || GMRResponse.BinVersion != "Bin version:v3.2.0.0(WROOM-32)" {
+		t.Fatal("unexpected GMR:", GMRResponse)
+	}
+	if time.Since(Start) > 150*time.Millisecond {
+		t.Fatal("GMR did not finish on OK")
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_Timeout$ rhilex-goat/test -v -count=1
+func Test_ATEngine_Timeout(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT\r\n": "AT\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	_, err := Esp32.AT("AT\r\n", 50*time.Millisecond)
+	if !errors.Is(err, device.ErrTimeout) {
+		t.Fatal("expected timeout, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_URC$ rhilex-goat/test -v -count=1
+func Test_ATEngine_URC(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CWJAP=\"rhilex\",\"12345678\"\r\n": "AT+CWJAP=\"rhilex\",\"12345678\"\r\n" +
+			"WIFI CONNECTED\r\nWIFI GOT IP\r\n\r\nOK\r\n0,CLOSED\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	Wifi := Esp32.Subscribe("WIFI")
+	Closed := Esp32.Subscribe("CLOSED")
+	ATResponse, err := Esp32.AT("AT+CWJAP=\"rhilex\",\"12345678\"\r\n", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		t.Fatal("URC leaked into response:", ATResponse.Data)
+	}
+	for _, Expect := range []string{"WIFI CONNECTED", "WIFI GOT IP"} {
+		if U := <-Wifi; U.Line != Expect {
+			t.Fatal("unexpected URC:", U)
+		}
+	}
+	if U := <-Closed; U.Line != "0,CLOSED" {
+		t.Fatal("unexpected URC:", U)
+	}
+	Esp32.Unsubscribe(Wifi)
+	if _, ok := <-Wifi; ok {
+		t.Fatal("channel not closed after Unsubscribe")
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_URCBacklog$ rhilex-goat/test -v -count=1
+func Test_ATEngine_URCBacklog(t *testing.T) {
+	Reply := "AT\r\n"
+	for i := 0; i < 100; i++ {
+		Reply += fmt.Sprintf("+IPD,0,3:%03d\r\n", i)
+	}
+	for i := 0; i < 100; i++ {
+		Reply += "WIFI GOT IP\r\n"
+	}
+	Port := newScriptPort(map[string]string{"AT\r\n": Reply + "0,CLOSED\r\n\r\nOK\r\n"})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	URCs := Esp32.Subscribe("")
+	Wifi := Esp32.Subscribe("WIFI")
+	// Nobody reads while the module sends, the payloads must wait and the
+	// lines behind them keep their place.
+	if _, err := Esp32.AT("AT\r\n", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if U := <-URCs; U.Line != "+IPD,0,3" || string(U.Data) != fmt.Sprintf("%03d", i) {
+			t.Fatal("unexpected URC:", U)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if U := <-URCs; U.Line != "WIFI GOT IP" {
+			t.Fatal("unexpected URC:", U)
+		}
+	}
+	if U := <-URCs; U.Line != "0,CLOSED" {
+		t.Fatal("unexpected URC:", U)
+	}
+	// Plain lines alone are still dropped when the reader falls behind.
+	Lines := 0
+	for len(Wifi) > 0 {
+		<-Wifi
+		Lines++
+	}
+	if Lines != 32 {
+		t.Fatal("unexpected number of buffered lines", Lines)
+	}
+	Esp32.Close()
+	if _, ok := <-URCs; ok {
+		t.Fatal("channel not closed after Close")
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_Cancel$ rhilex-goat/test -v -count=1
+func Test_ATEngine_Cancel(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CWLAP\r\n": "AT+CWLAP\r\n+CWLAP:(3,\"rhilex\",-40)\r\n<pause><pause>+CWLAP:(3,\"goat\",-70)\r\n\r\nOK\r\n",
+		"AT\r\n":       "AT\r\n\r\nOK\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	ctx, Cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer Cancel()
+	_, err := Esp32.ATContext(ctx, "AT+CWLAP\r\n")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	ATResponse, err := Esp32.AT("AT\r\n", time.Second)
+	if err != nil || len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		t.Fatal("port not usable after cancel:", ATResponse.Data, err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_LateFinal$ rhilex-goat/test -v -count=1
+func Test_ATEngine_LateFinal(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CWLAP\r\n": "<pause><pause><pause>OK\r\n",
+		"AT+FOO\r\n":   "<pause><pause><pause><pause>ERROR\r\n",
+	})
+	Engine := device.NewATEngine(Port, device.ATDialect{Echo: false})
+	defer Engine.Close()
+	if _, err := Engine.AT("AT+CWLAP\r\n", 50*time.Millisecond); !errors.Is(err, device.ErrTimeout) {
+		t.Fatal("expected timeout, got", err)
+	}
+	// Without echo the late OK of AT+CWLAP is not the answer of AT+FOO.
+	_, err := Engine.AT("AT+FOO\r\n", 2*time.Second)
+	if !errors.Is(err, device.ErrCommand) {
+		t.Fatal("expected ERROR, got", err)
+	}
+	Port.lock.Lock()
+	defer Port.lock.Unlock()
+	if len(Port.sent) != 2 {
+		t.Fatalf("unexpected commands: %q", Port.sent)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_Priority$ rhilex-goat/test -v -count=1
+func Test_ATEngine_Priority(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CWLAP\r\n": "AT+CWLAP\r\n<pause><pause>OK\r\n",
+		"AT\r\n":       "AT\r\nOK\r\n",
+		"AT+RST\r\n":   "AT+RST\r\nOK\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	wg := sync.WaitGroup{}
+	Run := func(AtCmd string, Priority device.Priority) {
+		defer wg.Done()
+		if _, err := Esp32.ATContext(context.Background(), AtCmd,
+			device.WithTimeout(time.Second), device.WithPriority(Priority)); err != nil {
+			t.Error(AtCmd, err)
+		}
+	}
+	wg.Add(1)
+	go Run("AT+CWLAP\r\n", device.PriorityNormal)
+	time.Sleep(50 * time.Millisecond)
+	wg.Add(1)
+	go Run("AT\r\n", device.PriorityLow)
+	time.Sleep(20 * time.Millisecond)
+	wg.Add(1)
+	go Run("AT+RST\r\n", device.PriorityUrgent)
+	time.Sleep(20 * time.Millisecond)
+	if Stats := Esp32.QueueStats(); Stats.Depth != 2 || !Stats.Busy {
+		t.Fatal("unexpected queue stats:", Stats)
+	}
+	wg.Wait()
+	Port.lock.Lock()
+	defer Port.lock.Unlock()
+	if strings.Join(Port.sent, "") != "AT+CWLAP\r\nAT+RST\r\nAT\r\n" {
+		t.Fatalf("unexpected order: %q", Port.sent)
+	}
+	if Stats := Esp32.QueueStats(); Stats.Executed != 3 || Stats.MaxWait < 100*time.Millisecond {
+		t.Fatal("unexpected queue stats:", Stats)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_QueueTimeout$ rhilex-goat/test -v -count=1
+func Test_ATEngine_QueueTimeout(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CWLAP\r\n": "AT+CWLAP\r\n<pause><pause>OK\r\n",
+		"AT\r\n":       "AT\r\nOK\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	go Esp32.ATContext(context.Background(), "AT+CWLAP\r\n", device.WithTimeout(time.Second))
+	time.Sleep(20 * time.Millisecond)
+	// The wait behind AT+CWLAP does not count against the 100ms.
+	ATResponse, err := Esp32.ATContext(context.Background(), "AT\r\n",
+		device.WithTimeout(100*time.Millisecond), device.WithPriority(device.PriorityLow))
+	if err != nil || len(ATResponse.Data) != 1 || ATResponse.Data[0] != "OK" {
+		t.Fatal("AT behind AT+CWLAP:", ATResponse.Data, err)
+	}
+	// The caller's ctx still limits the wait in the queue.
+	go Esp32.ATContext(context.Background(), "AT+CWLAP\r\n", device.WithTimeout(time.Second))
+	time.Sleep(20 * time.Millisecond)
+	ctx, Cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer Cancel()
+	if _, err := Esp32.ATContext(ctx, "AT\r\n", device.WithTimeout(time.Second)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_Errors$ rhilex-goat/test -v -count=1
+func Test_ATEngine_Errors(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+FOO\r\n":                    "AT+FOO\r\nERR CODE:0x01090000\r\n\r\nERROR\r\n",
+		"AT+CWJAP=\"rhilex\",\"x\"\r\n": "AT+CWJAP=\"rhilex\",\"x\"\r\n+CWJAP:2\r\n\r\nERROR\r\n",
+		"AT+GMR\r\n":                    "busy p...\r\n",
+		"AT\r\n":                        "OK\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	_, err := Esp32.AT("AT+FOO\r\n", time.Second)
+	var CommandError *device.CommandError
+	if !errors.As(err, &CommandError) || !errors.Is(err, device.ErrCommand) {
+		t.Fatal("expected CommandError, got", err)
+	}
+	if CommandError.Code != 0x01090000 || CommandError.Category != "ESP_AT_SUB_UNSUPPORT_CMD" {
+		t.Fatal("unexpected decode:", CommandError)
+	}
+	_, err = Esp32.AT("AT+CWJAP=\"rhilex\",\"x\"\r\n", time.Second)
+	if !errors.As(err, &CommandError) || CommandError.Code != 2 || CommandError.Message != "wrong password" {
+		t.Fatal("unexpected CWJAP error:", err)
+	}
+	if _, err = esp32wroomAt.GMR(context.Background(), Esp32); !errors.Is(err, device.ErrBusy) {
+		t.Fatal("expected busy, got", err)
+	}
+	if _, err = esp32wroomAt.AT(context.Background(), Esp32); !errors.Is(err, device.ErrEchoMismatch) {
+		t.Fatal("expected echo mismatch, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_ATEngine_Payload$ rhilex-goat/test -v -count=1
+func Test_ATEngine_Payload(t *testing.T) {
+	Port := newScriptPort(map[string]string{
+		"AT+CIPSEND=0,4\r\n": "AT+CIPSEND=0,4\r\n\r\nOK\r\n\r\n>",
+		"a\r\nb": "\r\nRecv 4 bytes\r\n\r\nSEND OK\r\n" +
+			"\r\n+IPD,0,4,\"fe80::1\",8080:\r\nOK\r\n+IPD,1,2:>\n\r\n1,CLOSED\r\n",
+	})
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+	defer Esp32.Close()
+	Data := Esp32.Subscribe("+IPD")
+	Closed := Esp32.Subscribe("CLOSED")
+	ATResponse, err := Esp32.ATContext(context.Background(), "AT+CIPSEND=0,4\r\n",
+		device.WithPayload([]byte("a\r\nb")), device.WithTimeout(time.Second))
+	if err != nil || ATResponse.Data[len(ATResponse.Data)-1] != "SEND OK" {
+		t.Fatal("CIPSEND:", ATResponse, err)
+	}
+	if U := <-Data; U.Line != `+IPD,0,4,"fe80::1",8080` || string(U.Data) != "\r\nOK" {
+		t.Fatalf("unexpected +IPD: %q %q", U.Line, U.Data)
+	}
+	if U := <-Data; U.Line != "+IPD,1,2" || string(U.Data) != ">\n" {
+		t.Fatalf("unexpected +IPD: %q %q", U.Line, U.Data)
+	}
+	if U := <-Closed; U.Line != "1,CLOSED" {
+		t.Fatal("unexpected URC:", U)
+	}
+}
@@ -16,6 +16,7 @@
 package test
 
 import (
+	"context"
 	"testing"
 
 	"fmt"
@@ -39,16 +40,19 @@ func Test_Esp32Wroom_AT_Mac(t *testing.T) {
 	}
 	serialPort, err := serial.Open(&config)
 	if err != nil {
-		panic(err)
+		t.Skip("no module attached:", err)
 	}
 	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", serialPort)
 	Esp32.Flush()
-	GMRResponse, err := esp32wroomAt.GMR(Esp32)
+	GMRResponse, err := esp32wroomAt.GMR(context.Background(), Esp32)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("AT GMRResponse=", GMRResponse)
-	RSTResponse := esp32wroomAt.RST(Esp32)
+	RSTResponse, err := esp32wroomAt.RST(context.Background(), Esp32)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println("AT RSTResponse=", RSTResponse)
 	serialPort.Close()
 }
@@ -0,0 +1,79 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_Ping$ rhilex-goat/test -v -count=1
+func Test_Esp32_Ping(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Sim.AddHost("rhilex.io", "93.184.216.34")
+	Sim.SetPing("rhilex.io", 10*time.Millisecond, -1, 30*time.Millisecond, 20*time.Millisecond)
+	Statistics, err := esp32wroomAt.Ping(ctx, Esp32, "rhilex.io", 4)
+	if err != nil {
+		t.Fatal("Ping:", err)
+	}
+	t.Log(Statistics)
+	if Statistics.Sent != 4 || Statistics.Received != 3 || Statistics.Loss != 25 {
+		t.Fatal("unexpected count", Statistics)
+	}
+	if Statistics.Min != 10*time.Millisecond || Statistics.Avg != 20*time.Millisecond ||
+		Statistics.Max != 30*time.Millisecond {
+		t.Fatal("unexpected rtt", Statistics)
+	}
+	// An unknown host loses every reply.
+	Statistics, err = esp32wroomAt.Ping(ctx, Esp32, "nowhere.io", 2)
+	if err != nil || Statistics.Received != 0 || Statistics.Loss != 100 {
+		t.Fatal("expected full loss, got", Statistics, err)
+	}
+	if _, err := esp32wroomAt.Ping(ctx, Esp32, "rhilex.io", 0); err == nil {
+		t.Fatal("count 0 accepted")
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Connections$ rhilex-goat/test -v -count=1
+func Test_Esp32_Connections(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Connections, err := esp32wroomAt.Connections(ctx, Esp32)
+	if err != nil || len(Connections) != 0 {
+		t.Fatal("expected no connection, got", Connections, err)
+	}
+	Listener := echoServer(t)
+	Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer Conn.Close()
+	Connections, err = esp32wroomAt.Connections(ctx, Esp32)
+	if err != nil || len(Connections) != 1 {
+		t.Fatal("expected one connection, got", Connections, err)
+	}
+	t.Log(Connections[0])
+	Remote := Listener.Addr().(*net.TCPAddr)
+	if Connection := Connections[0]; Connection.Type != "TCP" || !Connection.RemoteIP.Equal(Remote.IP) ||
+		Connection.RemotePort != Remote.Port || Connection.LocalPort == 0 || Connection.Server {
+		t.Fatal("unexpected connection", Connection)
+	}
+}
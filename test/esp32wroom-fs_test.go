@@ -0,0 +1,133 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_FS$ rhilex-goat/test -v -count=1
+func Test_Esp32_FS(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.WriteFS("www/index.html", []byte("<h1>rhilex</h1>"))
+	Sim.WriteFS("log/boot.log", []byte("boot ok\r\nready\r\n"))
+	Sim.MkdirFS("certs")
+	FS := esp32wroomAt.NewFS(Esp32)
+	if err := fstest.TestFS(FS, "www/index.html", "log/boot.log", "certs"); err != nil {
+		t.Fatal("TestFS:", err)
+	}
+	// A certificate bigger than one AT+FS chunk, with bytes that look
+	// like response lines.
+	Cert := bytes.Repeat([]byte("-----BEGIN CERTIFICATE-----\r\nOK\r\n\x00\xff,"), 300)
+	W, err := FS.Create("certs/ca.pem")
+	if err != nil {
+		t.Fatal("Create:", err)
+	}
+	if _, err := io.Copy(W, bytes.NewReader(Cert)); err != nil {
+		t.Fatal("io.Copy:", err)
+	}
+	if err := W.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if Data, ok := Sim.ReadFS("certs/ca.pem"); !ok || !bytes.Equal(Data, Cert) {
+		t.Fatal("unexpected upload", len(Data), ok)
+	}
+	if Data, err := fs.ReadFile(FS, "certs/ca.pem"); err != nil || !bytes.Equal(Data, Cert) {
+		t.Fatal("ReadFile:", len(Data), err)
+	}
+	File, err := FS.Open("certs/ca.pem")
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	Tail := make([]byte, 5)
+	if N, err := File.(io.ReaderAt).ReadAt(Tail, int64(len(Cert)-5)); N != 5 || err != nil ||
+		!bytes.Equal(Tail, Cert[len(Cert)-5:]) {
+		t.Fatal("ReadAt:", N, err)
+	}
+	File.Close()
+	if Info, err := fs.Stat(FS, "certs/ca.pem"); err != nil || Info.Size() != int64(len(Cert)) || Info.IsDir() {
+		t.Fatal("Stat:", Info, err)
+	}
+	// A failed chunk is not kept, writing the same bytes again does not
+	// duplicate them.
+	W, err = FS.Create("www/app.js")
+	if err != nil {
+		t.Fatal("Create:", err)
+	}
+	Script := bytes.Repeat([]byte("console.log(1);\n"), 200)
+	Sim.InjectFault("+FS", simulator.FaultError)
+	if N, err := W.Write(Script); N != 0 || err == nil {
+		t.Fatal("expected a failed write, got", N, err)
+	}
+	if N, err := W.Write(Script); N != len(Script) || err != nil {
+		t.Fatal("Write:", N, err)
+	}
+	if err := W.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if Data, _ := Sim.ReadFS("www/app.js"); !bytes.Equal(Data, Script) {
+		t.Fatal("unexpected content after a retry", len(Data))
+	}
+	if err := FS.WriteFile("config.json", []byte(`{"id":1}`)); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	if err := FS.WriteFile("config.json", []byte(`{}`)); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	if Data, _ := Sim.ReadFS("config.json"); string(Data) != `{}` {
+		t.Fatal("WriteFile did not replace the file", string(Data))
+	}
+	Entries, err := FS.ReadDir(".")
+	Names := []string{}
+	for _, Entry := range Entries {
+		Names = append(Names, Entry.Name())
+	}
+	if err != nil || strings.Join(Names, ",") != "certs,config.json,log,www" || !Entries[0].IsDir() {
+		t.Fatal("ReadDir:", Names, err)
+	}
+	if err := FS.Remove("config.json"); err != nil {
+		t.Fatal("Remove:", err)
+	}
+	if _, err := FS.Stat("config.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("expected ErrNotExist, got", err)
+	}
+	if _, err := FS.Open("../etc/passwd"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatal("expected ErrInvalid, got", err)
+	}
+	if ok, err := esp32wroomAt.MountFS(ctx, Esp32, false); !ok {
+		t.Fatal("MountFS:", err)
+	}
+	if _, err := FS.Stat("www/index.html"); err == nil {
+		t.Fatal("expected an error on an unmounted file system")
+	}
+	if ok, err := esp32wroomAt.MountFS(ctx, Esp32, true); !ok {
+		t.Fatal("MountFS:", err)
+	}
+	if Data, err := FS.ReadFile("log/boot.log"); err != nil || string(Data) != "boot ok\r\nready\r\n" {
+		t.Fatal("ReadFile:", string(Data), err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_HTTP$ rhilex-goat/test -v -count=1
+func Test_Esp32_HTTP(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		Body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, r.Method+" "+r.Header.Get("X-Token")+" "+r.Header.Get("Content-Type")+" "+r.URL.Query().Get("q")+"\r\n")
+		w.Write(Body)
+	}))
+	defer Server.Close()
+	Client := &http.Client{Transport: &esp32wroomAt.HTTPTransport{Esp32: Esp32}}
+
+	Request, _ := http.NewRequest(http.MethodGet, Server.URL+"/get?q=1", nil)
+	Request.Header.Set("X-Token", "rhilex")
+	Response, err := Client.Do(Request)
+	if err != nil {
+		t.Fatal("GET:", err)
+	}
+	Body, _ := io.ReadAll(Response.Body)
+	Response.Body.Close()
+	if Response.StatusCode != http.StatusOK || string(Body) != "GET rhilex  1\r\n" {
+		t.Fatalf("unexpected GET response %d %q", Response.StatusCode, Body)
+	}
+	// The body spans many UART lines and many response chunks.
+	Payload := bytes.Repeat([]byte("{\"rhilex\":\"esp32\"}\r\n"), 200)
+	Response, err = Client.Post(Server.URL+"/post", "application/json", bytes.NewReader(Payload))
+	if err != nil {
+		t.Fatal("POST:", err)
+	}
+	Body, _ = io.ReadAll(Response.Body)
+	Response.Body.Close()
+	if Want := append([]byte("POST  application/json \r\n"), Payload...); !bytes.Equal(Body, Want) {
+		t.Fatalf("unexpected POST response %q", Body[:min(len(Body), 64)])
+	}
+	Request, _ = http.NewRequest(http.MethodPut, Server.URL+"/put", strings.NewReader("on"))
+	if Response, err = Client.Do(Request); err != nil {
+		t.Fatal("PUT:", err)
+	}
+	Body, _ = io.ReadAll(Response.Body)
+	Response.Body.Close()
+	if string(Body) != "PUT   \r\non" {
+		t.Fatalf("unexpected PUT response %q", Body)
+	}
+	if Response, err = Client.Head(Server.URL + "/head"); err != nil || Response.StatusCode != http.StatusOK {
+		t.Fatal("HEAD:", Response, err)
+	}
+	// Failed requests carry their status code.
+	if Response, err = Client.Get(Server.URL + "/missing"); err != nil || Response.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", Response, err)
+	}
+	// Long URLs go through AT+HTTPURLCFG.
+	Long := strings.Repeat("a", 300)
+	if Response, err = Client.Get(Server.URL + "/long?q=" + Long); err != nil {
+		t.Fatal("long GET:", err)
+	}
+	Body, _ = io.ReadAll(Response.Body)
+	Response.Body.Close()
+	if string(Body) != "GET   "+Long+"\r\n" {
+		t.Fatalf("unexpected long GET response %q", Body)
+	}
+	// AT+SYSLOG is only on during a request.
+	if ATResponse, err := Esp32.AT("AT+SYSLOG?\r\n", time.Second); err != nil || ATResponse.Data[0] != "+SYSLOG:0" {
+		t.Fatal("AT+SYSLOG left on:", ATResponse.Data, err)
+	}
+	Commands := strings.Join(Sim.Commands(), "\n")
+	for _, Want := range []string{"AT+HTTPCHEAD=0", "AT+HTTPURLCFG=0", "AT+HTTPCPOST=", "AT+SYSLOG=0"} {
+		if !strings.Contains(Commands, Want) {
+			t.Fatal("missing command", Want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rhilex-goat/bsp/esp32wroom/mqtt"
+	"github.com/hootrhino/rhilex-goat/device"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// go test -timeout 30s -run ^Test_Mqtt_Match$ rhilex-goat/test -v -count=1
+func Test_Mqtt_Match(t *testing.T) {
+	for _, Case := range []struct {
+		Filter, Topic string
+		Match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/b", "/b", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/b", "a/c", false},
+	} {
+		if mqtt.Match(Case.Filter, Case.Topic) != Case.Match {
+			t.Fatal("Match", Case.Filter, Case.Topic, "expected", Case.Match)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, What string, cond func() bool) {
+	for Deadline := time.Now().Add(time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(Deadline) {
+			t.Fatal("timeout waiting for", What)
+		}
+	}
+}
+
+func receive(t *testing.T, Messages <-chan mqtt.Message) mqtt.Message {
+	select {
+	case Message := <-Messages:
+		return Message
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+	return mqtt.Message{}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_MQTT$ rhilex-goat/test -v -count=1
+func Test_Esp32_MQTT(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Broker := simulator.NewMQTTBroker()
+	Password := strings.Repeat("p", 100)
+	Broker.SetAuth("rhilex", Password)
+	Sim.AddMQTTBroker("broker.rhilex.io:1883", Broker)
+	Client, err := mqtt.Connect(ctx, Esp32, mqtt.ClientConfig{
+		Host: "broker.rhilex.io", Port: 1883, ClientID: "esp32-001", Username: "rhilex", Password: Password,
+		Will:              &mqtt.Will{Topic: "rhilex/esp32-001/status", Payload: "offline"},
+		ReconnectInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Connect:", err)
+	}
+	defer Client.Close()
+	// Only the ERROR of an idle link is ignored by AT+MQTTCLEAN.
+	Sim.InjectFault("+MQTTCLEAN", simulator.FaultSilent)
+	if _, err := mqtt.Connect(ctx, Esp32, mqtt.ClientConfig{Host: "broker.rhilex.io", Port: 1883,
+		ClientID: "esp32-002"}); !errors.Is(err, device.ErrTimeout) {
+		t.Fatal("expected ErrTimeout, got", err)
+	}
+	Sim.InjectFault("+MQTTCLEAN", simulator.FaultError)
+	if _, err := mqtt.Connect(ctx, Esp32, mqtt.ClientConfig{Host: "broker.rhilex.io", Port: 1883,
+		ClientID: "esp32-002"}); !errors.Is(err, device.ErrCommand) {
+		t.Fatal("expected ErrCommand, got", err)
+	}
+	Temps, All := make(chan mqtt.Message, 8), make(chan mqtt.Message, 8)
+	if err := Client.Subscribe(ctx, "rhilex/+/temp", 1, func(M mqtt.Message) { Temps <- M }); err != nil {
+		t.Fatal("Subscribe:", err)
+	}
+	if err := Client.Subscribe(ctx, "rhilex/#", 0, func(M mqtt.Message) { All <- M }); err != nil {
+		t.Fatal("Subscribe:", err)
+	}
+	if err := Client.Subscribe(ctx, "rhilex/#/temp", 0, func(M mqtt.Message) {}); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+	// Payloads keep their commas and line breaks.
+	Broker.Publish("rhilex/1/temp", []byte("25.5,\r\n26"))
+	if M := receive(t, Temps); M.Topic != "rhilex/1/temp" || string(M.Payload) != "25.5,\r\n26" {
+		t.Fatal("unexpected message", M)
+	}
+	if M := receive(t, All); M.Topic != "rhilex/1/temp" {
+		t.Fatal("unexpected message", M)
+	}
+	// Short text goes through AT+MQTTPUB, binary through AT+MQTTPUBRAW.
+	Binary := bytes.Repeat([]byte{0x00, 0xFF, '\r', '\n', ','}, 60)
+	if err := Client.Publish(ctx, "rhilex/esp32-001/data", []byte(`{"a":"b,c"}`), 0, false); err != nil {
+		t.Fatal("Publish:", err)
+	}
+	if err := Client.Publish(ctx, "rhilex/esp32-001/raw", Binary, 1, true); err != nil {
+		t.Fatal("Publish raw:", err)
+	}
+	Messages := Broker.Messages()
+	if len(Messages) != 2 || string(Messages[0].Payload) != `{"a":"b,c"}` ||
+		!bytes.Equal(Messages[1].Payload, Binary) || !Messages[1].Retain {
+		t.Fatal("unexpected published messages", Messages)
+	}
+	receive(t, All)
+	receive(t, All)
+	// A broken connection publishes the will, the client reconnects and
+	// subscribes again.
+	Broker.Kick()
+	waitFor(t, "resubscribe", func() bool { return Broker.Subscribed("rhilex/+/temp") && Broker.Subscribed("rhilex/#") })
+	if Messages := Broker.Messages(); Messages[len(Messages)-1].Topic != "rhilex/esp32-001/status" {
+		t.Fatal("expected will, got", Messages[len(Messages)-1])
+	}
+	if !Client.IsConnected() {
+		t.Fatal("not connected after reconnect")
+	}
+	// The retained message comes again with the new subscription.
+	if M := receive(t, All); !bytes.Equal(M.Payload, Binary) {
+		t.Fatal("expected retained message, got", M)
+	}
+	if err := Client.Unsubscribe(ctx, "rhilex/#"); err != nil {
+		t.Fatal("Unsubscribe:", err)
+	}
+	Broker.Publish("rhilex/2/temp", []byte("30"))
+	if M := receive(t, Temps); string(M.Payload) != "30" {
+		t.Fatal("unexpected message", M)
+	}
+	select {
+	case M := <-All:
+		t.Fatal("message after Unsubscribe", M)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := Client.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if Broker.Subscribed("rhilex/+/temp") {
+		t.Fatal("still subscribed after Close")
+	}
+	// Wrong credentials are refused.
+	if _, err := mqtt.Connect(ctx, Esp32, mqtt.ClientConfig{Host: "broker.rhilex.io", Port: 1883,
+		ClientID: "esp32-001", Username: "rhilex"}); err == nil {
+		t.Fatal("connected without password")
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_MQTT_Clean$ rhilex-goat/test -v -count=1
+func Test_Esp32_MQTT_Clean(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Sim.AddMQTTBroker("broker.rhilex.io:1883", simulator.NewMQTTBroker())
+	if _, err := Esp32.ATContext(ctx, "AT+SYSLOG=1\r\n", device.WithTimeout(time.Second)); err != nil {
+		t.Fatal("SYSLOG:", err)
+	}
+	Config := mqtt.ClientConfig{Host: "broker.rhilex.io", Port: 1883, ClientID: "esp32-001"}
+	// The ERR CODE of an idle link is ignored.
+	Client, err := mqtt.Connect(ctx, Esp32, Config)
+	if err != nil {
+		t.Fatal("Connect:", err)
+	}
+	if err := Client.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	// Any other ERR CODE is not.
+	Sim.InjectFault("+MQTTCLEAN", simulator.FaultError)
+	var CommandError *device.CommandError
+	if _, err := mqtt.Connect(ctx, Esp32, Config); !errors.As(err, &CommandError) || CommandError.Code != 0x010A0000 {
+		t.Fatal("expected CommandError, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_MQTT_SlowHandler$ rhilex-goat/test -v -count=1
+func Test_Esp32_MQTT_SlowHandler(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Broker := simulator.NewMQTTBroker()
+	Sim.AddMQTTBroker("broker.rhilex.io:1883", Broker)
+	Client, err := mqtt.Connect(ctx, Esp32, mqtt.ClientConfig{Host: "broker.rhilex.io", Port: 1883,
+		ClientID: "esp32-001", ReconnectInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Connect:", err)
+	}
+	defer Client.Close()
+	Release := make(chan struct{})
+	defer close(Release)
+	Received := make(chan mqtt.Message, 128)
+	if err := Client.Subscribe(ctx, "rhilex/#", 0, func(M mqtt.Message) {
+		<-Release
+		Received <- M
+	}); err != nil {
+		t.Fatal("Subscribe:", err)
+	}
+	// A handler that hangs does not hold up the disconnect behind a burst.
+	for i := 0; i < 100; i++ {
+		Broker.Publish("rhilex/1/temp", []byte("25.5"))
+	}
+	Broker.Kick()
+	waitFor(t, "resubscribe", func() bool { return Broker.Subscribed("rhilex/#") && Client.IsConnected() })
+}
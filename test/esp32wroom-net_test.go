@@ -0,0 +1,476 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	esp32wroom "github.com/hootrhino/rhilex-goat/bsp/esp32wroom"
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// newOnlineEsp32 returns a simulated module that has joined an AP.
+func newOnlineEsp32(t *testing.T) (*simulator.Esp32, *esp32wroom.Esp32Wroom) {
+	Sim, Esp32 := newSimEsp32(t)
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "rhilex", Password: "12345678", Channel: 6})
+	if ok, err := esp32wroomAt.JoinAP(context.Background(), Esp32,
+		esp32wroomAt.JoinAPRequest{SSID: "rhilex", Password: "12345678"}); !ok {
+		t.Fatal("JoinAP:", err)
+	}
+	return Sim, Esp32
+}
+
+// echoServer answers every TCP connection with what it receives.
+func echoServer(t *testing.T) net.Listener {
+	Listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Listener.Close() })
+	go func() {
+		for {
+			Conn, err := Listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer Conn.Close()
+				io.Copy(Conn, Conn)
+			}()
+		}
+	}()
+	return Listener
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_Dial$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_Dial(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Listener := echoServer(t)
+	Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer Conn.Close()
+	if Conn.RemoteAddr().String() != Listener.Addr().String() {
+		t.Fatal("unexpected remote address:", Conn.RemoteAddr())
+	}
+	// Binary data that looks like AT responses must come back untouched.
+	Data := bytes.Repeat([]byte("\r\nOK\r\n+IPD,1,3:\x00\xff>"), 400)
+	go Conn.Write(Data)
+	Got := make([]byte, len(Data))
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(Conn, Got); err != nil || !bytes.Equal(Got, Data) {
+		t.Fatal("echo mismatch:", err)
+	}
+	Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var NetError net.Error
+	if _, err := Conn.Read(Got); !errors.As(err, &NetError) || !NetError.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_Links$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_Links(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Listener.Close()
+	Accepted := make(chan net.Conn, esp32wroomAt.MaxLinks)
+	go func() {
+		for {
+			Conn, err := Listener.Accept()
+			if err != nil {
+				return
+			}
+			Accepted <- Conn
+		}
+	}()
+	Conns := []net.Conn{}
+	for i := 0; i < esp32wroomAt.MaxLinks; i++ {
+		Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+		if err != nil {
+			t.Fatal("Dial:", i, err)
+		}
+		Conns = append(Conns, Conn)
+	}
+	if _, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String()); !errors.Is(err, esp32wroomAt.ErrNoFreeLink) {
+		t.Fatal("expected no free link, got", err)
+	}
+	// The peer hangs up after a last message, it is read before io.EOF.
+	Peer := <-Accepted
+	Peer.Write([]byte("bye"))
+	Peer.Close()
+	Last, err := io.ReadAll(Conns[0])
+	if err != nil || string(Last) != "bye" {
+		t.Fatal("expected bye and EOF, got", string(Last), err)
+	}
+	if _, err := Conns[0].Write([]byte("x")); err == nil {
+		t.Fatal("write on a closed link succeeded")
+	}
+	Conns[0].Close()
+	if err := Conns[1].Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	// Both link IDs are free again.
+	for i := 0; i < 2; i++ {
+		Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+		if err != nil {
+			t.Fatal("Dial after close:", err)
+		}
+		defer Conn.Close()
+	}
+	if _, err := Conns[1].Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected closed, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_DialAbort$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_DialAbort(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	Listener := echoServer(t)
+	// The module connects after Dial gave up, its CONNECT must not hit the
+	// next link.
+	Sim.SetDelay("+CIPSTART", 300*time.Millisecond)
+	ctx, Cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer Cancel()
+	if _, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	Sim.SetDelay("+CIPSTART", 0)
+	Conn, err := esp32wroomAt.Dial(context.Background(), Esp32, "tcp", Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer Conn.Close()
+	time.Sleep(500 * time.Millisecond)
+	Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := Conn.Write([]byte("alive")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	Got := make([]byte, 5)
+	if _, err := io.ReadFull(Conn, Got); err != nil || string(Got) != "alive" {
+		t.Fatal("unexpected echo", string(Got), err)
+	}
+	// The link ID of the aborted Dial is free again.
+	for i := 1; i < esp32wroomAt.MaxLinks; i++ {
+		Conn, err := esp32wroomAt.Dial(context.Background(), Esp32, "tcp", Listener.Addr().String())
+		if err != nil {
+			t.Fatal("Dial:", i, err)
+		}
+		defer Conn.Close()
+	}
+}
+
+// freeUDPPort returns a local port that nobody listens on.
+func freeUDPPort(t *testing.T) int {
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Conn.Close()
+	return Conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_UDP$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_UDP(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Port := freeUDPPort(t)
+	Conn, err := esp32wroomAt.ListenPacket(ctx, Esp32, "udp", fmt.Sprintf(":%d", Port))
+	if err != nil {
+		t.Fatal("ListenPacket:", err)
+	}
+	defer Conn.Close()
+	// Telemetry goes to two collectors from the same link.
+	Collectors := []*net.UDPConn{}
+	for i := 0; i < 2; i++ {
+		Collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer Collector.Close()
+		Collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		Collectors = append(Collectors, Collector)
+	}
+	Buffer := make([]byte, 64)
+	for i, Collector := range Collectors {
+		Message := fmt.Sprintf("temp=%d", 20+i)
+		if _, err := Conn.WriteTo([]byte(Message), Collector.LocalAddr()); err != nil {
+			t.Fatal("WriteTo:", err)
+		}
+		N, From, err := Collector.ReadFromUDP(Buffer)
+		if err != nil || string(Buffer[:N]) != Message || From.Port != Port {
+			t.Fatal("collector got", string(Buffer[:N]), From, err)
+		}
+	}
+	// Replies carry their sender.
+	Module := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: Port}
+	Collectors[1].WriteToUDP([]byte("ack"), Module)
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	N, From, err := Conn.ReadFrom(Buffer)
+	if err != nil || string(Buffer[:N]) != "ack" || From.String() != Collectors[1].LocalAddr().String() {
+		t.Fatal("ReadFrom got", string(Buffer[:N]), From, err)
+	}
+	if _, err := Conn.WriteTo(make([]byte, 8193), Module); !errors.Is(err, esp32wroomAt.ErrDatagramTooLong) {
+		t.Fatal("expected datagram too long, got", err)
+	}
+	Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var NetError net.Error
+	if _, _, err := Conn.ReadFrom(Buffer); !errors.As(err, &NetError) || !NetError.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_DialUDP$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_DialUDP(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Peer.Close()
+	Peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	Port := freeUDPPort(t)
+	Conn, err := esp32wroomAt.DialUDP(ctx, Esp32, "udp", fmt.Sprintf(":%d", Port),
+		Peer.LocalAddr().String(), esp32wroomAt.UDPFixedPeer)
+	if err != nil {
+		t.Fatal("DialUDP:", err)
+	}
+	defer Conn.Close()
+	if _, err := Conn.Write([]byte("ping")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	Buffer := make([]byte, 64)
+	N, From, err := Peer.ReadFromUDP(Buffer)
+	if err != nil || string(Buffer[:N]) != "ping" {
+		t.Fatal("peer got", string(Buffer[:N]), err)
+	}
+	Peer.WriteToUDP([]byte("pong"), From)
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if N, err := Conn.Read(Buffer); err != nil || string(Buffer[:N]) != "pong" {
+		t.Fatal("Read got", string(Buffer[:N]), err)
+	}
+	if Conn.RemoteAddr().String() != Peer.LocalAddr().String() {
+		t.Fatal("unexpected remote address:", Conn.RemoteAddr())
+	}
+}
+
+// freeTCPPort returns a local port that nobody listens on.
+func freeTCPPort(t *testing.T) int {
+	Listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Listener.Close()
+	return Listener.Addr().(*net.TCPAddr).Port
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_Listen$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_Listen(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Port := freeTCPPort(t)
+	Listener, err := esp32wroomAt.Listen(ctx, Esp32, "tcp", fmt.Sprintf(":%d", Port))
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	if _, err := esp32wroomAt.Listen(ctx, Esp32, "tcp", ":8080"); !errors.Is(err, esp32wroomAt.ErrServerRunning) {
+		t.Fatal("expected server running, got", err)
+	}
+	// A config API on the module, served by net/http.
+	Server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	})}
+	go Server.Serve(Listener)
+	defer Server.Close()
+	Client := &http.Client{Timeout: 5 * time.Second}
+	for _, Path := range []string{"/config", "/status"} {
+		Response, err := Client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", Port, Path))
+		if err != nil {
+			t.Fatal("Get:", err)
+		}
+		Body, _ := io.ReadAll(Response.Body)
+		Response.Body.Close()
+		if string(Body) != fmt.Sprintf(`{"path":%q}`, Path) {
+			t.Fatal("unexpected body:", string(Body))
+		}
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_ListenConfig$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_ListenConfig(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	if err := esp32wroomAt.NewListenConfig(esp32wroomAt.ListenConfig{MaxConn: 6}); err == nil {
+		t.Fatal("maxConn 6 accepted")
+	}
+	Port := freeTCPPort(t)
+	Listener, err := esp32wroomAt.ListenConfig{MaxConn: 1, IdleTimeout: time.Second}.Listen(ctx, Esp32,
+		"tcp", fmt.Sprintf(":%d", Port))
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	Address := fmt.Sprintf("127.0.0.1:%d", Port)
+	Client, err := net.Dial("tcp", Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Client.Close()
+	Conn, err := Listener.Accept()
+	if err != nil {
+		t.Fatal("Accept:", err)
+	}
+	if Conn.RemoteAddr().String() != Client.LocalAddr().String() {
+		t.Fatal("unexpected remote address:", Conn.RemoteAddr())
+	}
+	// Only one client is allowed, the second one is dropped by the module.
+	Second, err := net.Dial("tcp", Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Second.Close()
+	Second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := Second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected the second client to be dropped, got", err)
+	}
+	// The idle client is closed after AT+CIPSTO.
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := Conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected EOF after the idle timeout, got", err)
+	}
+	if err := Listener.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if _, err := Listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected closed, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_Passive$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_Passive(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	if ok, err := esp32wroomAt.SetRecvMode(ctx, Esp32, esp32wroomAt.RecvPassive); !ok {
+		t.Fatal("SetRecvMode:", err)
+	}
+	if Mode, err := esp32wroomAt.GetRecvMode(ctx, Esp32); err != nil || Mode != esp32wroomAt.RecvPassive {
+		t.Fatal("GetRecvMode:", Mode, err)
+	}
+	Listener := echoServer(t)
+	Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer Conn.Close()
+	Data := bytes.Repeat([]byte("\r\nOK\r\n+CIPRECVDATA:1,\x00\xff"), 300)
+	if _, err := Conn.Write(Data); err != nil {
+		t.Fatal("Write:", err)
+	}
+	// Nothing is sent to the host until it reads.
+	Deadline := time.Now().Add(5 * time.Second)
+	for {
+		Sizes, err := esp32wroomAt.GetRecvLen(ctx, Esp32)
+		if err != nil {
+			t.Fatal("GetRecvLen:", err)
+		}
+		if Sizes[0] == len(Data) {
+			break
+		}
+		if time.Now().After(Deadline) {
+			t.Fatal("unexpected buffered length:", Sizes)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	Got := make([]byte, len(Data))
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(Conn, Got); err != nil || !bytes.Equal(Got, Data) {
+		t.Fatal("echo mismatch:", err)
+	}
+	if Sizes, err := esp32wroomAt.GetRecvLen(ctx, Esp32); err != nil || Sizes[0] != 0 {
+		t.Fatal("expected an empty buffer:", Sizes, err)
+	}
+	Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var NetError net.Error
+	if _, err := Conn.Read(Got); !errors.As(err, &NetError) || !NetError.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Net_Passthrough$ rhilex-goat/test -v -count=1
+func Test_Esp32_Net_Passthrough(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Listener := echoServer(t)
+	Host, Port, _ := net.SplitHostPort(Listener.Addr().String())
+	RemotePort, _ := strconv.Atoi(Port)
+	Session, err := esp32wroomAt.OpenPassthrough(ctx, Esp32, esp32wroomAt.PassthroughRequest{
+		Type: "TCP", RemoteHost: Host, RemotePort: RemotePort,
+	})
+	if err != nil {
+		t.Fatal("OpenPassthrough:", err)
+	}
+	if !Sim.Passthrough() {
+		t.Fatal("module is not in passthrough mode")
+	}
+	// Raw bytes both ways, AT look-alikes and +++ inside data included.
+	Data := []byte("\r\nOK\r\n+IPD,0,3:>+++AT\r\n\x00\xff")
+	if _, err := Session.Write(Data); err != nil {
+		t.Fatal("Write:", err)
+	}
+	Got := make([]byte, len(Data))
+	if _, err := io.ReadFull(Session, Got); err != nil || !bytes.Equal(Got, Data) {
+		t.Fatalf("echo mismatch: %q %v", Got, err)
+	}
+	// The module stays in single-link mode while the session is open.
+	if _, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String()); !errors.Is(err, esp32wroomAt.ErrLinksOpen) {
+		t.Fatal("expected links open, got", err)
+	}
+	if _, err := esp32wroomAt.OpenPassthrough(ctx, Esp32, esp32wroomAt.PassthroughRequest{
+		Type: "TCP", RemoteHost: Host, RemotePort: RemotePort,
+	}); !errors.Is(err, esp32wroomAt.ErrLinksOpen) {
+		t.Fatal("expected links open, got", err)
+	}
+	if err := Session.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if Sim.Passthrough() {
+		t.Fatal("module is still in passthrough mode")
+	}
+	if _, err := Session.Read(Got); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected closed, got", err)
+	}
+	// Command mode again, multi-link mode comes back with the next Dial.
+	Conn, err := esp32wroomAt.Dial(ctx, Esp32, "tcp", Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial after passthrough:", err)
+	}
+	Conn.Close()
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_Sysflash$ rhilex-goat/test -v -count=1
+func Test_Esp32_Sysflash(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.AddPartition(simulator.FlashPartition{Name: "ble_data", Type: 64, SubType: 1, Address: 0x60000, Size: 0x3000})
+	Partitions, err := esp32wroomAt.Partitions(ctx, Esp32)
+	if err != nil || len(Partitions) != 3 || Partitions[0].Name != "mfg_nvs" ||
+		Partitions[0].Address != 0x21000 || Partitions[0].Size != 0x1c000 {
+		t.Fatal("Partitions:", Partitions, err)
+	}
+	if _, err := esp32wroomAt.OpenPartition(ctx, Esp32, "nvs_keys"); err == nil {
+		t.Fatal("expected an error for a missing partition")
+	}
+	GATT, err := esp32wroomAt.OpenPartition(ctx, Esp32, "ble_data")
+	if err != nil {
+		t.Fatal("OpenPartition:", err)
+	}
+	// A table bigger than one sector, then a patch across the sector
+	// boundary that has to keep the bytes around it.
+	Table := bytes.Repeat([]byte("\x00\x01\r\nOK\r\n,"), 700)
+	if N, err := GATT.WriteAt(Table, 0); N != len(Table) || err != nil {
+		t.Fatal("WriteAt:", N, err)
+	}
+	Patch := []byte{0xA5, 0x00, 0x5A, 0xFF, 0x12}
+	Progress := []int64{}
+	GATT.Progress = func(Done, Total int64) {
+		if Total != int64(len(Patch)) {
+			t.Error("unexpected total", Total)
+		}
+		Progress = append(Progress, Done)
+	}
+	if N, err := GATT.WriteAt(Patch, 4094); N != len(Patch) || err != nil {
+		t.Fatal("WriteAt:", N, err)
+	}
+	if len(Progress) != 2 || Progress[0] != 2 || Progress[1] != 5 {
+		t.Fatal("unexpected progress", Progress)
+	}
+	copy(Table[4094:], Patch)
+	Flash := Sim.ReadFlash("ble_data")
+	if !bytes.Equal(Flash[:len(Table)], Table) || !bytes.Equal(Flash[len(Table):], bytes.Repeat([]byte{0xFF}, len(Flash)-len(Table))) {
+		t.Fatal("unexpected flash content")
+	}
+	// Writing what is already there erases nothing.
+	Erases := Sim.FlashErases()
+	GATT.Progress = nil
+	if _, err := GATT.WriteAt(Patch, 4094); err != nil || Sim.FlashErases() != Erases {
+		t.Fatal("unexpected erase", err, Sim.FlashErases()-Erases)
+	}
+	Read := make([]byte, 10)
+	if N, err := GATT.ReadAt(Read, 4090); N != 10 || err != nil || !bytes.Equal(Read, Table[4090:4100]) {
+		t.Fatal("ReadAt:", N, err)
+	}
+	if _, err := GATT.WriteAt(Patch, GATT.Size-2); err == nil {
+		t.Fatal("expected an error past the end of the partition")
+	}
+	// Back up mfg_nvs, wipe it and restore it.
+	NVS, err := esp32wroomAt.OpenPartition(ctx, Esp32, "mfg_nvs")
+	if err != nil {
+		t.Fatal("OpenPartition:", err)
+	}
+	Factory := bytes.Repeat([]byte("rhilex-sn-0001\x00"), 500)
+	if _, err := NVS.WriteAt(Factory, 0); err != nil {
+		t.Fatal("WriteAt:", err)
+	}
+	Backup := bytes.Buffer{}
+	if N, err := io.Copy(&Backup, io.NewSectionReader(NVS, 0, NVS.Size)); N != NVS.Size || err != nil {
+		t.Fatal("backup:", N, err)
+	}
+	if err := NVS.Erase(ctx); err != nil {
+		t.Fatal("Erase:", err)
+	}
+	if !bytes.Equal(Sim.ReadFlash("mfg_nvs"), bytes.Repeat([]byte{0xFF}, int(NVS.Size))) {
+		t.Fatal("partition not erased")
+	}
+	if N, err := io.Copy(io.NewOffsetWriter(NVS, 0), &Backup); N != NVS.Size || err != nil {
+		t.Fatal("restore:", N, err)
+	}
+	if Flash := Sim.ReadFlash("mfg_nvs"); !bytes.Equal(Flash[:len(Factory)], Factory) {
+		t.Fatal("unexpected restored content")
+	}
+}
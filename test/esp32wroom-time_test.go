@@ -0,0 +1,76 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_LookupHost$ rhilex-goat/test -v -count=1
+func Test_Esp32_LookupHost(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Sim.AddHost("broker.local", "2001:db8::1", "10.0.0.7")
+	if Hosts, err := esp32wroomAt.LookupHost(ctx, Esp32, "broker.local"); err != nil || len(Hosts) != 1 || Hosts[0] != "10.0.0.7" {
+		t.Fatal("LookupHost:", Hosts, err)
+	}
+	if IP, err := esp32wroomAt.LookupIP(ctx, Esp32, "ip6", "broker.local"); err != nil || !IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatal("LookupIP ip6:", IP, err)
+	}
+	var DNSError *net.DNSError
+	if _, err := esp32wroomAt.LookupHost(ctx, Esp32, "missing.local"); !errors.As(err, &DNSError) || !DNSError.IsNotFound {
+		t.Fatal("expected not found, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_SNTP$ rhilex-goat/test -v -count=1
+func Test_Esp32_SNTP(t *testing.T) {
+	_, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	if _, err := esp32wroomAt.GetSNTPTime(ctx, Esp32); !errors.Is(err, esp32wroomAt.ErrTimeNotSynced) {
+		t.Fatal("expected not synced, got", err)
+	}
+	if err := esp32wroomAt.NewSNTPConfig(esp32wroomAt.SNTPConfig{UTCOffset: 15 * time.Hour}); err == nil {
+		t.Fatal("utcOffset 15h accepted")
+	}
+	if ok, err := esp32wroomAt.SetSNTPInterval(ctx, Esp32, 10*time.Minute); !ok {
+		t.Fatal("SetSNTPInterval:", err)
+	}
+	if Interval, err := esp32wroomAt.GetSNTPInterval(ctx, Esp32); err != nil || Interval != 10*time.Minute {
+		t.Fatal("GetSNTPInterval:", Interval, err)
+	}
+	// Nepal is UTC+05:45, the module takes it as 545.
+	Config := esp32wroomAt.SNTPConfig{UTCOffset: 5*time.Hour + 45*time.Minute, Servers: []string{"pool.ntp.org"}}
+	ctx, Cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer Cancel()
+	Now, err := esp32wroomAt.SyncTime(ctx, Esp32, Config)
+	if err != nil {
+		t.Fatal("SyncTime:", err)
+	}
+	if _, Offset := Now.Zone(); Offset != 5*3600+45*60 || time.Since(Now).Abs() > 2*time.Second {
+		t.Fatal("unexpected time:", Now)
+	}
+	if Got, err := esp32wroomAt.GetSNTP(ctx, Esp32); err != nil || !Got.Enable ||
+		Got.UTCOffset != Config.UTCOffset || len(Got.Servers) != 1 || Got.Servers[0] != "pool.ntp.org" {
+		t.Fatal("GetSNTP:", Got, err)
+	}
+}
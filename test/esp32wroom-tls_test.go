@@ -0,0 +1,235 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+)
+
+// issue creates a certificate signed by Parent, a nil Parent makes a CA.
+func issue(t *testing.T, Name string, Parent *x509.Certificate, ParentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: Name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{Name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if Parent == nil {
+		Template.IsCA, Template.BasicConstraintsValid = true, true
+		Template.KeyUsage = x509.KeyUsageCertSign
+		Parent, ParentKey = Template, Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, Template, Parent, &Key.PublicKey, ParentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate, Key
+}
+
+func keyPEM(t *testing.T, Key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func certPEM(Certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: Certificate.Raw})
+}
+
+// go test -timeout 30s -run ^Test_Esp32_TLS_Mutual$ rhilex-goat/test -v -count=1
+func Test_Esp32_TLS_Mutual(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	CA, CAKey := issue(t, "rhilex-ca", nil, nil)
+	Server, ServerKey := issue(t, "broker.local", CA, CAKey)
+	Client, ClientKey := issue(t, "esp32-0001", CA, CAKey)
+	_, OtherKey := issue(t, "other", CA, CAKey)
+	if err := esp32wroomAt.NewClientPKI(esp32wroomAt.ClientPKI{Certificate: Client,
+		Key: keyPEM(t, OtherKey)}); err == nil {
+		t.Fatal("a key of another certificate was accepted")
+	}
+	if ok, err := esp32wroomAt.SetClientPKI(ctx, Esp32, esp32wroomAt.ClientPKI{
+		Certificate: Client, Key: keyPEM(t, ClientKey), CA: certPEM(CA),
+	}); !ok {
+		t.Fatal("SetClientPKI:", err)
+	}
+	if Stored := Sim.MfgValue("client_cert", "client_cert.0"); string(Stored) != string(certPEM(Client))+"\x00" {
+		t.Fatalf("unexpected client_cert.0: %q", Stored)
+	}
+	// The broker only talks to clients signed by the CA.
+	Pool := x509.NewCertPool()
+	Pool.AddCert(CA)
+	Listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{Server.Raw}, PrivateKey: ServerKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    Pool,
+		NextProtos:   []string{"mqtt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Listener.Close()
+	States := make(chan tls.ConnectionState, 1)
+	go func() {
+		for {
+			Conn, err := Listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer Conn.Close()
+				if err := Conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				States <- Conn.(*tls.Conn).ConnectionState()
+				io.Copy(Conn, Conn)
+			}()
+		}
+	}()
+	Conn, err := esp32wroomAt.DialTLS(ctx, Esp32, "tcp", Listener.Addr().String(), esp32wroomAt.TLSConfig{
+		AuthMode: esp32wroomAt.TLSMutual, ServerName: "broker.local", ALPN: []string{"mqtt"},
+	})
+	if err != nil {
+		t.Fatal("DialTLS:", err)
+	}
+	defer Conn.Close()
+	State := <-States
+	if State.ServerName != "broker.local" || State.NegotiatedProtocol != "mqtt" ||
+		len(State.PeerCertificates) == 0 || State.PeerCertificates[0].Subject.CommonName != "esp32-0001" {
+		t.Fatal("unexpected handshake:", State.ServerName, State.NegotiatedProtocol)
+	}
+	Conn.Write([]byte("hello"))
+	Got := make([]byte, 5)
+	Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(Conn, Got); err != nil || string(Got) != "hello" {
+		t.Fatal("echo mismatch:", string(Got), err)
+	}
+	// The module checks the broker's certificate against the SNI.
+	if _, err := esp32wroomAt.DialTLS(ctx, Esp32, "tcp", Listener.Addr().String(), esp32wroomAt.TLSConfig{
+		AuthMode: esp32wroomAt.TLSMutual, ServerName: "evil.local",
+	}); err == nil {
+		t.Fatal("DialTLS accepted a wrong server name")
+	}
+	if ok, err := esp32wroomAt.EraseClientPKI(ctx, Esp32, 0); !ok || len(Sim.MfgValue("client_key", "client_key.0")) != 0 {
+		t.Fatal("EraseClientPKI:", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_TLS_Reuse$ rhilex-goat/test -v -count=1
+func Test_Esp32_TLS_Reuse(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	CA, CAKey := issue(t, "rhilex-ca", nil, nil)
+	Server, ServerKey := issue(t, "broker.local", CA, CAKey)
+	Listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{Server.Raw}, PrivateKey: ServerKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Listener.Close()
+	go func() {
+		for {
+			Conn, err := Listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer Conn.Close()
+				io.Copy(Conn, Conn)
+			}()
+		}
+	}()
+	Conn, err := esp32wroomAt.DialTLS(ctx, Esp32, "tcp", Listener.Addr().String(), esp32wroomAt.TLSConfig{
+		ServerName: "broker.local", ALPN: []string{"mqtt"}, PSK: "rhilex", PSKHint: "goat",
+	})
+	if err != nil {
+		t.Fatal("DialTLS:", err)
+	}
+	if PSK, Hint := Sim.SSLPSK(0); PSK != "rhilex" || Hint != "goat" {
+		t.Fatal("unexpected PSK:", PSK, Hint)
+	}
+	Conn.Close()
+	// A plain connection does not inherit SNI or PSK, it takes a link ID
+	// that has none and sends no empty values.
+	Sent := len(Sim.Commands())
+	Conn, err = esp32wroomAt.DialTLS(ctx, Esp32, "tcp", Listener.Addr().String(), esp32wroomAt.TLSConfig{})
+	if err != nil {
+		t.Fatal("DialTLS:", err)
+	}
+	defer Conn.Close()
+	if SNI, ALPN := Sim.SSLConfig(1); SNI != "" || len(ALPN) != 0 {
+		t.Fatal("link 1 has SNI or ALPN:", SNI, ALPN)
+	}
+	if PSK, Hint := Sim.SSLPSK(1); PSK != "" || Hint != "" {
+		t.Fatal("link 1 has PSK:", PSK, Hint)
+	}
+	for _, Command := range Sim.Commands()[Sent:] {
+		if strings.HasPrefix(Command, "AT+CIPSSLCSNI") || strings.HasPrefix(Command, "AT+CIPSSLCPSK") {
+			t.Fatal("unexpected command:", Command)
+		}
+	}
+	// The next connection on link 0 replaces its SNI and PSK and clears ALPN.
+	Other, err := esp32wroomAt.DialTLS(ctx, Esp32, "tcp", Listener.Addr().String(), esp32wroomAt.TLSConfig{
+		ServerName: "broker.local", PSK: "goat",
+	})
+	if err != nil {
+		t.Fatal("DialTLS:", err)
+	}
+	defer Other.Close()
+	if SNI, ALPN := Sim.SSLConfig(0); SNI != "broker.local" || len(ALPN) != 0 {
+		t.Fatal("link 0 kept ALPN:", SNI, ALPN)
+	}
+	if PSK, Hint := Sim.SSLPSK(0); PSK != "goat" || Hint != "" {
+		t.Fatal("unexpected PSK:", PSK, Hint)
+	}
+	// Erasing works after a provision without a CA.
+	Client, ClientKey := issue(t, "esp32-0002", CA, CAKey)
+	if ok, err := esp32wroomAt.SetClientPKI(ctx, Esp32, esp32wroomAt.ClientPKI{
+		Index: 1, Certificate: Client, Key: keyPEM(t, ClientKey),
+	}); !ok {
+		t.Fatal("SetClientPKI:", err)
+	}
+	if ok, err := esp32wroomAt.EraseClientPKI(ctx, Esp32, 1); !ok || len(Sim.MfgValue("client_cert", "client_cert.1")) != 0 {
+		t.Fatal("EraseClientPKI:", err)
+	}
+}
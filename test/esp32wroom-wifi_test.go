@@ -0,0 +1,259 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/device"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_Wifi_Station$ rhilex-goat/test -v -count=1
+func Test_Esp32_Wifi_Station(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "rhilex", Password: "12345678",
+		BSSID: "24:0a:c4:00:00:01", Channel: 6, RSSI: -40, Encryption: 3})
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: `goat,"5G"`, Password: `p\w,d`,
+		BSSID: "24:0a:c4:00:00:02", Channel: 11, RSSI: -60, Encryption: 4})
+	if ok, err := esp32wroomAt.SetWifiMode(ctx, Esp32, esp32wroomAt.WifiModeStation); !ok {
+		t.Fatal("SetWifiMode:", err)
+	}
+	if Mode, err := esp32wroomAt.GetWifiMode(ctx, Esp32); err != nil || Mode != esp32wroomAt.WifiModeStation {
+		t.Fatal("GetWifiMode:", Mode, err)
+	}
+	if _, err := esp32wroomAt.GetConnectedAP(ctx, Esp32); !errors.Is(err, esp32wroomAt.ErrNoAP) {
+		t.Fatal("expected no AP, got", err)
+	}
+	_, err := esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{SSID: "rhilex", Password: "x"})
+	if !errors.Is(err, esp32wroomAt.ErrWrongPassword) || !errors.Is(err, device.ErrCommand) {
+		t.Fatal("expected wrong password, got", err)
+	}
+	_, err = esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{SSID: "nowhere"})
+	if !errors.Is(err, esp32wroomAt.ErrAPNotFound) {
+		t.Fatal("expected AP not found, got", err)
+	}
+	if ok, err := esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{
+		SSID: `goat,"5G"`, Password: `p\w,d`,
+	}); !ok {
+		t.Fatal("JoinAP with escaped SSID:", err)
+	}
+	if ok, err := esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{
+		SSID: "rhilex", Password: "12345678", BSSID: "24:0a:c4:00:00:01", PCIOnly: true, ListenInterval: 5,
+	}); !ok {
+		t.Fatal("JoinAP:", err)
+	}
+	Commands := Sim.Commands()
+	if Last := Commands[len(Commands)-1]; Last != `AT+CWJAP="rhilex","12345678","24:0a:c4:00:00:01",1,1,5` {
+		t.Fatal("unexpected command:", Last)
+	}
+	if Escaped := Commands[len(Commands)-2]; Escaped != `AT+CWJAP="goat\,\"5G\"","p\\w\,d"` {
+		t.Fatal("unexpected escaping:", Escaped)
+	}
+	AP, err := esp32wroomAt.GetConnectedAP(ctx, Esp32)
+	if err != nil || AP.SSID != "rhilex" || AP.BSSID != "24:0a:c4:00:00:01" || AP.Channel != 6 || AP.RSSI != -40 {
+		t.Fatal("GetConnectedAP:", AP, err)
+	}
+	State, err := esp32wroomAt.GetState(ctx, Esp32)
+	if err != nil || State.State != esp32wroomAt.StationGotIP || State.SSID != "rhilex" {
+		t.Fatal("GetState:", State, err)
+	}
+	if ok, err := esp32wroomAt.QuitAP(ctx, Esp32); !ok {
+		t.Fatal("QuitAP:", err)
+	}
+	if State, err = esp32wroomAt.GetState(ctx, Esp32); err != nil || State.State != esp32wroomAt.StationDisconnected {
+		t.Fatal("GetState after QuitAP:", State, err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Wifi_Scan$ rhilex-goat/test -v -count=1
+func Test_Esp32_Wifi_Scan(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		Sim.AddAccessPoint(simulator.AccessPoint{SSID: fmt.Sprintf("site-survey-%02d", i),
+			BSSID: fmt.Sprintf("24:0a:c4:00:00:%02x", i), Channel: 1 + i%13, RSSI: -30 - 3*i,
+			Encryption: 3, WPS: i == 0})
+	}
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "goat,lab", BSSID: "24:0a:c4:00:01:00", Channel: 6, RSSI: -50})
+	AccessPoints, err := esp32wroomAt.ScanAPs(ctx, Esp32, esp32wroomAt.ScanOptions{})
+	if err != nil || len(AccessPoints) != 21 {
+		t.Fatal("ScanAPs:", len(AccessPoints), err)
+	}
+	First := AccessPoints[0]
+	if First.SSID != "site-survey-00" || First.RSSI != -30 || First.BSSID != "24:0a:c4:00:00:00" ||
+		First.Encryption != esp32wroomAt.EncryptionWPA2PSK || First.PairwiseCipher != esp32wroomAt.CipherCCMP ||
+		First.BGN != 7 || !First.WPS {
+		t.Fatal("unexpected AP:", First)
+	}
+	if Last := AccessPoints[20]; Last.SSID != "goat,lab" || Last.Encryption != esp32wroomAt.EncryptionOpen {
+		t.Fatal("unexpected AP:", Last)
+	}
+	AccessPoints, err = esp32wroomAt.ScanAPs(ctx, Esp32, esp32wroomAt.ScanOptions{Channel: 6, MinRSSI: -60})
+	if err != nil || len(AccessPoints) != 2 {
+		t.Fatal("ScanAPs by channel:", AccessPoints, err)
+	}
+	AccessPoints, err = esp32wroomAt.ScanAPs(ctx, Esp32, esp32wroomAt.ScanOptions{SSID: "goat,lab", Passive: true})
+	if err != nil || len(AccessPoints) != 1 || AccessPoints[0].BSSID != "24:0a:c4:00:01:00" {
+		t.Fatal("ScanAPs by SSID:", AccessPoints, err)
+	}
+	Commands := Sim.Commands()
+	if Last := Commands[len(Commands)-1]; Last != `AT+CWLAP="goat\,lab",,,1` {
+		t.Fatal("unexpected command:", Last)
+	}
+	if _, err := esp32wroomAt.SetWifiMode(ctx, Esp32, esp32wroomAt.WifiModeSoftAP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := esp32wroomAt.ScanAPs(ctx, Esp32, esp32wroomAt.ScanOptions{}); !errors.Is(err, device.ErrCommand) {
+		t.Fatal("expected scan to fail without station, got", err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Wifi_SoftAP$ rhilex-goat/test -v -count=1
+func Test_Esp32_Wifi_SoftAP(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "rhilex", Password: "12345678", Channel: 6})
+	if ok, err := esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{SSID: "rhilex", Password: "12345678"}); !ok {
+		t.Fatal("JoinAP:", err)
+	}
+	Config := esp32wroomAt.SoftAPConfig{SSID: "goat-setup", Password: "provision", Channel: 11,
+		Encryption: esp32wroomAt.EncryptionWPA2PSK, MaxConnections: 4, Hidden: true}
+	if ok, err := esp32wroomAt.SetSoftAP(ctx, Esp32, Config); !ok {
+		t.Fatal("SetSoftAP:", err)
+	}
+	if Mode, _ := esp32wroomAt.GetWifiMode(ctx, Esp32); Mode != esp32wroomAt.WifiModeStationSoftAP {
+		t.Fatal("unexpected mode:", Mode)
+	}
+	if State, _ := esp32wroomAt.GetState(ctx, Esp32); State.State != esp32wroomAt.StationGotIP {
+		t.Fatal("station dropped by SoftAP:", State)
+	}
+	if Got, err := esp32wroomAt.GetSoftAP(ctx, Esp32); err != nil || Got != Config {
+		t.Fatal("GetSoftAP:", Got, err)
+	}
+	Pool := esp32wroomAt.DHCPPool{LeaseTime: 30 * time.Minute,
+		Start: net.ParseIP("192.168.4.10"), End: net.ParseIP("192.168.4.20")}
+	if ok, err := esp32wroomAt.SetDHCPPool(ctx, Esp32, Pool); !ok {
+		t.Fatal("SetDHCPPool:", err)
+	}
+	if Got, err := esp32wroomAt.GetDHCPPool(ctx, Esp32); err != nil || Got.LeaseTime != Pool.LeaseTime ||
+		!Got.Start.Equal(Pool.Start) || !Got.End.Equal(Pool.End) {
+		t.Fatal("GetDHCPPool:", Got, err)
+	}
+	if ok, err := esp32wroomAt.SetDHCP(ctx, Esp32, false, esp32wroomAt.DHCPStation); !ok {
+		t.Fatal("SetDHCP:", err)
+	}
+	if Mode, err := esp32wroomAt.GetDHCP(ctx, Esp32); err != nil || Mode != esp32wroomAt.DHCPSoftAP {
+		t.Fatal("GetDHCP:", Mode, err)
+	}
+	Left := Esp32.Subscribe("+STA_DISCONNECTED:")
+	for _, MAC := range []string{"5c:cf:7f:00:00:01", "5c:cf:7f:00:00:02"} {
+		if err := Sim.JoinStation(MAC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Stations, err := esp32wroomAt.ListStations(ctx, Esp32)
+	if err != nil || len(Stations) != 2 || !Stations[1].IP.Equal(net.ParseIP("192.168.4.11")) ||
+		Stations[1].MAC.String() != "5c:cf:7f:00:00:02" {
+		t.Fatal("ListStations:", Stations, err)
+	}
+	if ok, err := esp32wroomAt.KickStation(ctx, Esp32, Stations[0].MAC); !ok {
+		t.Fatal("KickStation:", err)
+	}
+	if U := <-Left; U.Line != `+STA_DISCONNECTED:"5c:cf:7f:00:00:01"` {
+		t.Fatal("unexpected URC:", U)
+	}
+	if Stations, _ = esp32wroomAt.ListStations(ctx, Esp32); len(Stations) != 1 {
+		t.Fatal("station not kicked:", Stations)
+	}
+	if ok, err := esp32wroomAt.DisableSoftAP(ctx, Esp32); !ok {
+		t.Fatal("DisableSoftAP:", err)
+	}
+	if Mode, _ := esp32wroomAt.GetWifiMode(ctx, Esp32); Mode != esp32wroomAt.WifiModeStation {
+		t.Fatal("unexpected mode:", Mode)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_Wifi_StaticIP$ rhilex-goat/test -v -count=1
+func Test_Esp32_Wifi_StaticIP(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "rhilex", Password: "12345678", Channel: 6})
+	Sim.SetStationIPv6("fe80::260a:c4ff:fed6:e444", "2001:db8::1")
+	Config := esp32wroomAt.IPConfig{IP: net.ParseIP("10.0.8.20"), Gateway: net.ParseIP("10.0.8.1"),
+		Netmask: net.CIDRMask(24, 32)}
+	if ok, err := esp32wroomAt.SetStationIP(ctx, Esp32, Config); !ok {
+		t.Fatal("SetStationIP:", err)
+	}
+	if Mode, _ := esp32wroomAt.GetDHCP(ctx, Esp32); Mode&esp32wroomAt.DHCPStation != 0 {
+		t.Fatal("DHCP still on:", Mode)
+	}
+	if ok, err := esp32wroomAt.JoinAP(ctx, Esp32, esp32wroomAt.JoinAPRequest{SSID: "rhilex", Password: "12345678"}); !ok {
+		t.Fatal("JoinAP:", err)
+	}
+	Got, err := esp32wroomAt.GetStationIP(ctx, Esp32)
+	if err != nil || !Got.IP.Equal(Config.IP) || !Got.Gateway.Equal(Config.Gateway) ||
+		Got.Netmask.String() != Config.Netmask.String() ||
+		!Got.LinkLocal.Equal(net.ParseIP("fe80::260a:c4ff:fed6:e444")) || !Got.Global.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatal("GetStationIP:", Got, err)
+	}
+	if _, err := esp32wroomAt.SetStationIP(ctx, Esp32, esp32wroomAt.IPConfig{IP: net.ParseIP("10.0.8.20"),
+		Gateway: net.ParseIP("10.0.9.1"), Netmask: net.CIDRMask(24, 32)}); err == nil {
+		t.Fatal("expected gateway outside the subnet to be refused")
+	}
+	if _, err := esp32wroomAt.EnableSoftAP(ctx, Esp32); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := esp32wroomAt.SetAPIP(ctx, Esp32, esp32wroomAt.IPConfig{IP: net.ParseIP("192.168.10.1")}); !ok {
+		t.Fatal("SetAPIP:", err)
+	}
+	if Got, err = esp32wroomAt.GetAPIP(ctx, Esp32); err != nil || !Got.IP.Equal(net.ParseIP("192.168.10.1")) {
+		t.Fatal("GetAPIP:", Got, err)
+	}
+	MAC, _ := net.ParseMAC("1a:fe:34:00:00:01")
+	if ok, err := esp32wroomAt.SetStationMAC(ctx, Esp32, MAC); !ok {
+		t.Fatal("SetStationMAC:", err)
+	}
+	if Got, err := esp32wroomAt.GetStationMAC(ctx, Esp32); err != nil || Got.String() != MAC.String() {
+		t.Fatal("GetStationMAC:", Got, err)
+	}
+	if Got, err := esp32wroomAt.GetAPMAC(ctx, Esp32); err != nil || Got.String() != "26:0a:c4:d6:e4:44" {
+		t.Fatal("GetAPMAC:", Got, err)
+	}
+	Multicast, _ := net.ParseMAC("01:00:5e:00:00:01")
+	if _, err := esp32wroomAt.SetAPMAC(ctx, Esp32, Multicast); err == nil {
+		t.Fatal("expected multicast MAC to be refused")
+	}
+	if ok, err := esp32wroomAt.SetDNS(ctx, Esp32, net.ParseIP("10.0.8.2"), net.ParseIP("1.1.1.1")); !ok {
+		t.Fatal("SetDNS:", err)
+	}
+	if Servers, err := esp32wroomAt.GetDNS(ctx, Esp32); err != nil || len(Servers) != 2 || !Servers[1].Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatal("GetDNS:", Servers, err)
+	}
+	if ok, err := esp32wroomAt.SetDNS(ctx, Esp32); !ok {
+		t.Fatal("SetDNS default:", err)
+	}
+	if Servers, _ := esp32wroomAt.GetDNS(ctx, Esp32); len(Servers) != 2 || !Servers[1].Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatal("default DNS not restored:", Servers)
+	}
+}
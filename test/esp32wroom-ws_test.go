@@ -0,0 +1,146 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+// go test -timeout 30s -run ^Test_Esp32_WebSocket$ rhilex-goat/test -v -count=1
+func Test_Esp32_WebSocket(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	ctx := context.Background()
+	Server := simulator.NewWSServer()
+	Server.SetEcho(true)
+	const URL = "ws://relay.rhilex.io/live"
+	Sim.AddWSServer(URL, Server)
+	Conn, err := esp32wroomAt.WSConfig{BufferSize: 4096}.Dial(ctx, Esp32, URL,
+		http.Header{"Authorization": {"Bearer rhilex"}})
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	if Headers := Server.Headers(); len(Headers) != 1 || Headers[0] != "Authorization: Bearer rhilex" {
+		t.Fatal("unexpected handshake headers", Headers)
+	}
+	if err := Conn.WriteMessage(esp32wroomAt.TextMessage, []byte(`{"temp":25.5}`)); err != nil {
+		t.Fatal("WriteMessage:", err)
+	}
+	if Type, Data, err := Conn.ReadMessage(); err != nil || Type != esp32wroomAt.TextMessage ||
+		string(Data) != `{"temp":25.5}` {
+		t.Fatal("unexpected echo", Type, string(Data), err)
+	}
+	Binary := []byte{0x00, 0xFF, '\r', '\n', ','}
+	if err := Conn.WriteMessage(esp32wroomAt.BinaryMessage, Binary); err != nil {
+		t.Fatal("WriteMessage:", err)
+	}
+	if Type, Data, err := Conn.ReadMessage(); err != nil || Type != esp32wroomAt.BinaryMessage ||
+		!bytes.Equal(Data, Binary) {
+		t.Fatal("unexpected echo", Type, Data, err)
+	}
+	// A message within the buffer size arrives in one piece.
+	Large := bytes.Repeat([]byte("rhilex "), 500)
+	Server.Send(Large)
+	if _, Data, err := Conn.ReadMessage(); err != nil || !bytes.Equal(Data, Large) {
+		t.Fatal("unexpected message", len(Data), err)
+	}
+	if err := Conn.WriteMessage(esp32wroomAt.PingMessage, nil); err != nil {
+		t.Fatal("ping:", err)
+	}
+	if Messages := Server.Messages(); Messages[len(Messages)-1].Opcode != esp32wroomAt.PingMessage {
+		t.Fatal("expected ping, got", Messages[len(Messages)-1])
+	}
+	Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := Conn.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline, got", err)
+	}
+	Conn.SetReadDeadline(time.Time{})
+	// Link IDs run out after three connections.
+	Conns := []*esp32wroomAt.WSConn{}
+	for i := 1; i < esp32wroomAt.MaxWSLinks; i++ {
+		Conn, err := esp32wroomAt.DialWebSocket(ctx, Esp32, URL, nil)
+		if err != nil {
+			t.Fatal("Dial:", err)
+		}
+		Conns = append(Conns, Conn)
+	}
+	if _, err := esp32wroomAt.DialWebSocket(ctx, Esp32, URL, nil); !errors.Is(err, esp32wroomAt.ErrNoFreeLink) {
+		t.Fatal("expected no free link, got", err)
+	}
+	for _, Conn := range Conns {
+		if err := Conn.Close(); err != nil {
+			t.Fatal("Close:", err)
+		}
+	}
+	if Server.Clients() != 1 {
+		t.Fatal("expected one client, got", Server.Clients())
+	}
+	// The server goes away.
+	Server.Disconnect()
+	if _, _, err := Conn.ReadMessage(); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	if err := Conn.WriteMessage(esp32wroomAt.TextMessage, []byte("x")); err == nil {
+		t.Fatal("write after disconnect succeeded")
+	}
+	Conn.Close()
+	Server.SetDown(true)
+	if _, err := esp32wroomAt.DialWebSocket(ctx, Esp32, URL, nil); err == nil {
+		t.Fatal("dial to a down server succeeded")
+	}
+}
+
+// go test -timeout 30s -run ^Test_Esp32_WebSocket_Abort$ rhilex-goat/test -v -count=1
+func Test_Esp32_WebSocket_Abort(t *testing.T) {
+	Sim, Esp32 := newOnlineEsp32(t)
+	Server := simulator.NewWSServer()
+	Server.SetEcho(true)
+	const URL = "ws://relay.rhilex.io/live"
+	Sim.AddWSServer(URL, Server)
+	// The handshake finishes after Dial gave up, its AT+WSCLOSE must not
+	// hit the next connection.
+	Sim.SetDelay("+WSOPEN", 300*time.Millisecond)
+	ctx, Cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer Cancel()
+	if _, err := esp32wroomAt.DialWebSocket(ctx, Esp32, URL, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	Sim.SetDelay("+WSOPEN", 0)
+	Conn, err := esp32wroomAt.DialWebSocket(context.Background(), Esp32, URL, nil)
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer Conn.Close()
+	time.Sleep(500 * time.Millisecond)
+	if err := Conn.WriteMessage(esp32wroomAt.TextMessage, []byte("alive")); err != nil {
+		t.Fatal("WriteMessage:", err)
+	}
+	if _, Data, err := Conn.ReadMessage(); err != nil || string(Data) != "alive" {
+		t.Fatal("unexpected echo", string(Data), err)
+	}
+	if Server.Clients() != 1 {
+		t.Fatal("expected one client, got", Server.Clients())
+	}
+}
@@ -16,6 +16,7 @@
 package test
 
 import (
+	"context"
 	"testing"
 
 	mx01 "github.com/hootrhino/rhilex-goat/bsp/mx01"
@@ -39,11 +40,11 @@ func Test_MX01_AT_Mac(t *testing.T) {
 	}
 	serialPort, err := serial.Open(&config)
 	if err != nil {
-		panic(err)
+		t.Skip("no module attached:", err)
 	}
 	mx01 := mx01.NewMX01("mx01", serialPort)
 	mx01.Flush()
-	MACResponse, err := mx01At.MAC(mx01)
+	MACResponse, err := mx01At.MAC(context.Background(), mx01)
 	if err != nil {
 		panic(err)
 	}
@@ -63,11 +64,11 @@ func Test_MX01_AT_Name(t *testing.T) {
 	}
 	serialPort, err := serial.Open(&config)
 	if err != nil {
-		panic(err)
+		t.Skip("no module attached:", err)
 	}
 	mx01 := mx01.NewMX01("mx01", serialPort)
 	mx01.Flush()
-	MACResponse, err := mx01At.NAME(mx01)
+	MACResponse, err := mx01At.NAME(context.Background(), mx01)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,148 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	esp32wroom "github.com/hootrhino/rhilex-goat/bsp/esp32wroom"
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/device"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+func newSimEsp32(t *testing.T) (*simulator.Esp32, *esp32wroom.Esp32Wroom) {
+	Sim := simulator.NewEsp32()
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Sim)
+	t.Cleanup(func() { Esp32.Close() })
+	return Sim, Esp32
+}
+
+// go test -timeout 30s -run ^Test_Sim_Esp32_Basic$ rhilex-goat/test -v -count=1
+func Test_Sim_Esp32_Basic(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	if ok, err := esp32wroomAt.AT(ctx, Esp32); !ok {
+		t.Fatal("AT:", err)
+	}
+	GMRResponse, err := esp32wroomAt.GMR(ctx, Esp32)
+	if err != nil || GMRResponse.BinVersion != "Bin version:v3.2.0.0(WROOM-32)" {
+		t.Fatal("GMR:", GMRResponse, err)
+	}
+	if ok, err := esp32wroomAt.ATE0(ctx, Esp32); !ok {
+		t.Fatal("ATE0:", err)
+	}
+	if ok, err := esp32wroomAt.AT(ctx, Esp32); !ok {
+		t.Fatal("AT without echo:", err)
+	}
+	if ok, err := esp32wroomAt.ATE1(ctx, Esp32); !ok {
+		t.Fatal("ATE1:", err)
+	}
+	Ready := Esp32.Subscribe("ready")
+	if ok, err := esp32wroomAt.RST(ctx, Esp32); !ok {
+		t.Fatal("RST:", err)
+	}
+	select {
+	case <-Ready:
+	case <-time.After(time.Second):
+		t.Fatal("no ready after RST")
+	}
+	if ok, err := esp32wroomAt.Deep_sleep(ctx, Esp32, 50); !ok {
+		t.Fatal("Deep_sleep:", err)
+	}
+	<-Ready
+	if ok, err := esp32wroomAt.TcpSslSTL(ctx, Esp32, esp32wroomAt.TcpSslSTLRequest{
+		Mode: 1, Remote_host: "192.168.1.10", Remote_port: 8080, STL_type: "TCP", Keep_alive: 60,
+	}); !ok {
+		t.Fatal("TcpSslSTL:", err)
+	}
+	if ok, err := esp32wroomAt.UdpSTL(ctx, Esp32, esp32wroomAt.UDPRequest{
+		Mode: 1, Remote_host: "192.168.1.10", Remote_port: 8080, STL_type: "UDP", Local_port: 2000,
+	}); !ok {
+		t.Fatal("UdpSTL:", err)
+	}
+	if ok, err := esp32wroomAt.BleSTL(ctx, Esp32, esp32wroomAt.BLERequest{Mode: 0}); !ok {
+		t.Fatal("BleSTL:", err)
+	}
+	if Commands := Sim.Commands(); Commands[len(Commands)-1] != "AT+SAVETRANSLINK=0" {
+		t.Fatal("unexpected commands:", Commands)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Sim_Esp32_Faults$ rhilex-goat/test -v -count=1
+func Test_Sim_Esp32_Faults(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	ctx := context.Background()
+	Sim.InjectFault("AT", simulator.FaultNoEcho)
+	if _, err := esp32wroomAt.AT(ctx, Esp32); !errors.Is(err, device.ErrEchoMismatch) {
+		t.Fatal("expected echo mismatch, got", err)
+	}
+	Sim.InjectFault("+GMR", simulator.FaultBusy)
+	if _, err := esp32wroomAt.GMR(ctx, Esp32); !errors.Is(err, device.ErrBusy) {
+		t.Fatal("expected busy, got", err)
+	}
+	Sim.InjectFault("+GMR", simulator.FaultSilent)
+	if _, err := esp32wroomAt.GMR(ctx, Esp32); !errors.Is(err, device.ErrTimeout) {
+		t.Fatal("expected timeout, got", err)
+	}
+	Sim.InjectFault("AT", simulator.FaultNoise)
+	if ok, err := esp32wroomAt.AT(ctx, Esp32); !ok {
+		t.Fatal("noise broke AT:", err)
+	}
+	if _, err := Esp32.AT("AT+SYSLOG=1\r\n", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	Sim.InjectFault("+GMR", simulator.FaultError)
+	var CommandError *device.CommandError
+	if _, err := esp32wroomAt.GMR(ctx, Esp32); !errors.As(err, &CommandError) ||
+		CommandError.Category != "ESP_AT_SUB_CMD_EXEC_FAIL" {
+		t.Fatal("expected CommandError, got", err)
+	}
+	Events := Esp32.Subscribe("+BLECONN:")
+	Sim.ConnectBLE(0, "5b:3b:6c:51:90:49")
+	if U := <-Events; U.Line != `+BLECONN:0,"5b:3b:6c:51:90:49"` {
+		t.Fatal("unexpected URC:", U)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Sim_Esp32_Wifi_Tcp$ rhilex-goat/test -v -count=1
+func Test_Sim_Esp32_Wifi_Tcp(t *testing.T) {
+	Sim, Esp32 := newSimEsp32(t)
+	Sim.AddAccessPoint(simulator.AccessPoint{SSID: "rhilex", Password: "12345678",
+		BSSID: "aa:bb:cc:dd:ee:ff", Encryption: 3, RSSI: -40, Channel: 6})
+	Events := Esp32.Subscribe("WIFI")
+	if _, err := Esp32.AT("AT+CWJAP=\"rhilex\",\"12345678\"\r\n", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if U := <-Events; U.Line != "WIFI CONNECTED" {
+		t.Fatal("unexpected URC:", U)
+	}
+	ATResponse, err := Esp32.AT("AT+CWSTATE?\r\n", time.Second)
+	if err != nil || ATResponse.Data[0] != `+CWSTATE:2,"rhilex"` {
+		t.Fatal("CWSTATE:", ATResponse, err)
+	}
+	ATResponse, err = Esp32.AT("AT+BLEINIT=1\r\n", time.Second)
+	if err != nil {
+		t.Fatal("BLEINIT:", ATResponse, err)
+	}
+	ATResponse, err = Esp32.AT("AT+BLEADDR?\r\n", time.Second)
+	if err != nil || ATResponse.Data[0] != `+BLEADDR:"24:0a:c4:d6:e4:46"` {
+		t.Fatal("BLEADDR:", ATResponse, err)
+	}
+}
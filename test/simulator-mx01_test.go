@@ -0,0 +1,142 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mx01 "github.com/hootrhino/rhilex-goat/bsp/mx01"
+	mx01At "github.com/hootrhino/rhilex-goat/bsp/mx01/atcmd"
+	"github.com/hootrhino/rhilex-goat/device"
+	"github.com/hootrhino/rhilex-goat/simulator"
+)
+
+func newSimMX01(t *testing.T) (*simulator.MX01, device.Device) {
+	Sim := simulator.NewMX01()
+	Mx01 := mx01.NewMX01("mx01", Sim)
+	t.Cleanup(func() { Mx01.Close() })
+	return Sim, Mx01
+}
+
+// go test -timeout 30s -run ^Test_Sim_MX01_Config$ rhilex-goat/test -v -count=1
+func Test_Sim_MX01_Config(t *testing.T) {
+	_, Mx01 := newSimMX01(t)
+	ctx := context.Background()
+	Expect := func(Name string, Get func(context.Context, device.Device) (string, error), Want string) {
+		t.Helper()
+		if Got, err := Get(ctx, Mx01); err != nil || Got != Want {
+			t.Fatalf("%s: got %q, %v; want %q", Name, Got, err, Want)
+		}
+	}
+	Set := func(Name string, ok bool, err error) {
+		t.Helper()
+		if !ok || err != nil {
+			t.Fatalf("%s: %v", Name, err)
+		}
+	}
+	Expect("MAC", mx01At.MAC, "+MAC:00:01:02:03:04:05")
+	Expect("NAME", mx01At.NAME, "+NAME:MX-01")
+	Expect("VER", mx01At.VER, "+VER:V0.0.1")
+	Expect("UUIDS", mx01At.UUIDS, "+UUIDS:FFF0")
+	Expect("DEV", mx01At.DEV, "No device connected")
+
+	ok, err := mx01At.SetMAC(ctx, Mx01, "a1b2c3d4e5f6")
+	Set("SetMAC", ok, err)
+	ok, err = mx01At.SetNAME(ctx, Mx01, "rhilex")
+	Set("SetNAME", ok, err)
+	ok, err = mx01At.SetADV(ctx, Mx01, 0)
+	Set("SetADV", ok, err)
+	ok, err = mx01At.SetUART(ctx, Mx01, 5)
+	Set("SetUART", ok, err)
+	ok, err = mx01At.SetAINTVL(ctx, Mx01, 100)
+	Set("SetAINTVL", ok, err)
+	ok, err = mx01At.SetTXPOWER(ctx, Mx01, 7)
+	Set("SetTXPOWER", ok, err)
+	ok, err = mx01At.SetUUIDS(ctx, Mx01, "ffe0")
+	Set("SetUUIDS", ok, err)
+	ok, err = mx01At.SetUUIDN(ctx, Mx01, "FFE1")
+	Set("SetUUIDN", ok, err)
+	ok, err = mx01At.SetUUIDW(ctx, Mx01, "FFE2")
+	Set("SetUUIDW", ok, err)
+	ok, err = mx01At.SetAMDATA(ctx, Mx01, "3132333435")
+	Set("SetAMDATA", ok, err)
+	Expect("ADV", mx01At.ADV, "+ADV:0")
+
+	Ready := Mx01.Subscribe("+READY")
+	ok, err = mx01At.REBOOT(ctx, Mx01)
+	Set("REBOOT", ok, err)
+	<-Ready
+	Expect("MAC", mx01At.MAC, "+MAC:A1:B2:C3:D4:E5:F6")
+	Expect("NAME", mx01At.NAME, "+NAME:rhilex")
+	Expect("ADV", mx01At.ADV, "+ADV:1")
+	Expect("UART", mx01At.UART, "+UART:5")
+	Expect("AINTVL", mx01At.AINTVL, "+AINTVL:100")
+	Expect("TXPOWER", mx01At.TXPOWER, "+TXPOWER:7")
+	Expect("UUIDS", mx01At.UUIDS, "+UUIDS:FFE0")
+	Expect("UUIDN", mx01At.UUIDN, "+UUIDN:FFE1")
+	Expect("UUIDW", mx01At.UUIDW, "+UUIDW:FFE2")
+	Expect("AMDATA", mx01At.AMDATA, "+AMDATA:3132333435")
+
+	ok, err = mx01At.RESET(ctx, Mx01)
+	Set("RESET", ok, err)
+	<-Ready
+	Expect("NAME", mx01At.NAME, "+NAME:MX-01")
+	Expect("UUIDS", mx01At.UUIDS, "+UUIDS:FFF0")
+	Expect("MAC", mx01At.MAC, "+MAC:A1:B2:C3:D4:E5:F6")
+}
+
+// go test -timeout 30s -run ^Test_Sim_MX01_Passthrough$ rhilex-goat/test -v -count=1
+func Test_Sim_MX01_Passthrough(t *testing.T) {
+	Sim, Mx01 := newSimMX01(t)
+	ctx := context.Background()
+	Events := Mx01.Subscribe("+")
+	Data := Mx01.Subscribe("")
+	Sim.Connect("11:22:33:44:55:66")
+	if U := <-Events; U.Line != "+CONNECTED:1,11:22:33:44:55:66" {
+		t.Fatal("unexpected URC:", U)
+	}
+	<-Data
+	Sim.PhoneSend([]byte("hello rhilex\r\n"))
+	if U := <-Data; U.Line != "hello rhilex" {
+		t.Fatal("unexpected data:", U)
+	}
+	// AT 指令在透传模式下直接发给手机
+	if _, err := mx01At.NAME(ctx, Mx01); err == nil {
+		t.Fatal("NAME answered in pass-through mode")
+	}
+	if Got := string(Sim.PhoneReceived()); Got != "AT+NAME?\r\n" {
+		t.Fatalf("phone got %q", Got)
+	}
+	Sim.SetCommandMode(true)
+	// AT+NAME? went to the phone, nothing will answer it.
+	Mx01.Flush()
+	if Got, err := mx01At.DEV(ctx, Mx01); err != nil || Got != "+DEV:1,11:22:33:44:55:66" {
+		t.Fatal("DEV:", Got, err)
+	}
+	if Got, err := mx01At.DISCONN(ctx, Mx01, 1); err != nil || Got != "+DISCONN:1,11:22:33:44:55:66" {
+		t.Fatal("DISCONN:", Got, err)
+	}
+	if _, err := mx01At.DISCONN(ctx, Mx01, 1); err == nil {
+		t.Fatal("DISCONN without a link should fail")
+	}
+	select {
+	case U := <-Events:
+		t.Fatal("DISCONN answer leaked as URC:", U)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
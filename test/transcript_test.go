@@ -0,0 +1,92 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	esp32wroom "github.com/hootrhino/rhilex-goat/bsp/esp32wroom"
+	esp32wroomAt "github.com/hootrhino/rhilex-goat/bsp/esp32wroom/atcmd"
+	"github.com/hootrhino/rhilex-goat/simulator"
+	"github.com/hootrhino/rhilex-goat/transcript"
+)
+
+// go test -timeout 30s -run ^Test_Transcript_Replay$ rhilex-goat/test -v -count=1
+func Test_Transcript_Replay(t *testing.T) {
+	ctx := context.Background()
+	Golden := bytes.Buffer{}
+	Recorder := transcript.NewRecorder(simulator.NewEsp32(), &Golden)
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Recorder)
+	Recorded, err := esp32wroomAt.GMR(ctx, Esp32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := esp32wroomAt.AT(ctx, Esp32); err != nil {
+		t.Fatal(err)
+	}
+	Esp32.Close()
+	if err := Recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+	Records, err := transcript.Parse(strings.NewReader(Golden.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Records) < 4 || Records[0].Direction != transcript.Tx || string(Records[0].Data) != "AT+GMR\r\n" {
+		t.Fatal("unexpected transcript:", Golden.String())
+	}
+
+	Replayer := transcript.NewReplayer(Records)
+	Esp32 = esp32wroom.NewEsp32Wroom("ESP32-WROOM", Replayer)
+	defer Esp32.Close()
+	Replayed, err := esp32wroomAt.GMR(ctx, Esp32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Replayed.String() != Recorded.String() {
+		t.Fatal("replay differs:", Replayed, Recorded)
+	}
+	if _, err := esp32wroomAt.AT(ctx, Esp32); err != nil {
+		t.Fatal(err)
+	}
+	if err := Replayer.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test -timeout 30s -run ^Test_Transcript_Mismatch$ rhilex-goat/test -v -count=1
+func Test_Transcript_Mismatch(t *testing.T) {
+	Records, err := transcript.Parse(strings.NewReader(
+		`# golden
+> 0.000000 "AT\r\n"
+< 0.001000 "AT\r\n\r\nOK\r\n"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Replayer := transcript.NewReplayer(Records)
+	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Replayer)
+	defer Esp32.Close()
+	if _, err := esp32wroomAt.RST(context.Background(), Esp32); err == nil {
+		t.Fatal("expected write mismatch")
+	}
+	if err := Replayer.Verify(); err == nil || !strings.Contains(err.Error(), "AT+RST") {
+		t.Fatal("expected mismatch report, got", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transcript
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+*
+* Recorder 包装真实串口, 把双向数据写进抓包文件, 可以直接传给
+* NewEsp32Wroom/NewEsp8266/NewMX01:
+*
+*	Port := transcript.NewRecorder(serialPort, File)
+*	Esp32 := esp32wroom.NewEsp32Wroom("ESP32-WROOM", Port)
+*
+ */
+type Recorder struct {
+	io    io.ReadWriteCloser
+	lock  sync.Mutex
+	out   io.Writer
+	start time.Time
+	err   error
+}
+
+func NewRecorder(io io.ReadWriteCloser, out io.Writer) *Recorder {
+	R := &Recorder{io: io, out: out, start: time.Now()}
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	_, R.err = fmt.Fprintf(out, "# rhilex-goat transcript %s\n", R.start.Format(time.RFC3339))
+	return R
+}
+
+func (R *Recorder) record(Direction Direction, data []byte) {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	if R.err != nil {
+		return
+	}
+	Record := Record{Direction: Direction, Offset: time.Since(R.start), Data: data}
+	_, R.err = fmt.Fprintln(R.out, Record.String())
+}
+
+func (R *Recorder) Read(b []byte) (int, error) {
+	N, err := R.io.Read(b)
+	if N > 0 {
+		R.record(Rx, b[:N])
+	}
+	return N, err
+}
+
+func (R *Recorder) Write(b []byte) (int, error) {
+	N, err := R.io.Write(b)
+	if N > 0 {
+		R.record(Tx, b[:N])
+	}
+	return N, err
+}
+
+// Close closes the wrapped port, the transcript writer is left to the caller.
+func (R *Recorder) Close() error {
+	return R.io.Close()
+}
+
+// Err reports the first error writing the transcript.
+func (R *Recorder) Err() error {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	return R.err
+}
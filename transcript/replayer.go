@@ -0,0 +1,154 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transcript
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+*
+* Replayer 按抓包文件回放模组: 检查主机发出的数据和记录一致,
+* 一致后把记录中模组的响应交给主机读取。
+*
+ */
+type Replayer struct {
+	// Realtime keeps the recorded gaps between responses.
+	Realtime bool
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	records []Record
+	next    int
+	matched int
+	rx      []byte
+	closed  bool
+	err     error
+}
+
+func NewReplayer(Records []Record) *Replayer {
+	R := &Replayer{records: Records}
+	R.cond = sync.NewCond(&R.lock)
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	R.release()
+	return R
+}
+
+// release hands every response up to the next host write to the reader,
+// must be called with R.lock held.
+func (R *Replayer) release() {
+	var Pending []Record
+	for R.next < len(R.records) && R.records[R.next].Direction == Rx {
+		Pending = append(Pending, R.records[R.next])
+		R.next++
+	}
+	if len(Pending) == 0 {
+		return
+	}
+	if !R.Realtime {
+		for _, Record := range Pending {
+			R.rx = append(R.rx, Record.Data...)
+		}
+		R.cond.Broadcast()
+		return
+	}
+	Start := time.Now()
+	Base := Pending[0].Offset
+	if R.next-len(Pending) > 0 {
+		Base = R.records[R.next-len(Pending)-1].Offset
+	}
+	go func() {
+		for _, Record := range Pending {
+			time.Sleep(time.Until(Start.Add(Record.Offset - Base)))
+			R.lock.Lock()
+			R.rx = append(R.rx, Record.Data...)
+			R.cond.Broadcast()
+			R.lock.Unlock()
+		}
+	}()
+}
+
+func (R *Replayer) Read(b []byte) (int, error) {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	for len(R.rx) == 0 && !R.closed {
+		R.cond.Wait()
+	}
+	if len(R.rx) == 0 {
+		return 0, io.EOF
+	}
+	N := copy(b, R.rx)
+	R.rx = R.rx[N:]
+	return N, nil
+}
+
+func (R *Replayer) Write(b []byte) (int, error) {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	if R.err != nil {
+		return 0, R.err
+	}
+	if R.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for Sent := 0; Sent < len(b); {
+		if R.next >= len(R.records) {
+			R.err = fmt.Errorf("transcript: unexpected write %q after the last record", b[Sent:])
+			return Sent, R.err
+		}
+		Want := R.records[R.next].Data[R.matched:]
+		N := min(len(Want), len(b)-Sent)
+		if !bytes.Equal(Want[:N], b[Sent:Sent+N]) {
+			R.err = fmt.Errorf("transcript: record %d: sent %q, want %q", R.next+1, b[Sent:], Want)
+			return Sent, R.err
+		}
+		Sent += N
+		R.matched += N
+		if R.matched == len(R.records[R.next].Data) {
+			R.next++
+			R.matched = 0
+			R.release()
+		}
+	}
+	return len(b), nil
+}
+
+func (R *Replayer) Close() error {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	R.closed = true
+	R.cond.Broadcast()
+	return nil
+}
+
+// Verify reports a mismatch or records that were never played.
+func (R *Replayer) Verify() error {
+	R.lock.Lock()
+	defer R.lock.Unlock()
+	if R.err != nil {
+		return R.err
+	}
+	if R.next < len(R.records) {
+		return fmt.Errorf("transcript: %d of %d records not played, next %s",
+			len(R.records)-R.next, len(R.records), R.records[R.next])
+	}
+	return nil
+}
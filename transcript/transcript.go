@@ -0,0 +1,93 @@
+// Copyright (C) 2024 wwhai
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*
+* 串口抓包文件, 每行一条记录:
+*
+*	> 0.000000 "AT+GMR\r\n"
+*	< 0.012345 "AT+GMR\r\nAT version:..."
+*
+* '>' 是主机发给模组的数据, '<' 是模组发给主机的数据, 第二列是相对开始的秒数,
+* 第三列是 Go 语法转义后的原始字节, '#' 开头的行是注释。
+*
+ */
+type Direction byte
+
+const (
+	Tx Direction = '>'
+	Rx Direction = '<'
+)
+
+type Record struct {
+	Direction Direction
+	Offset    time.Duration
+	Data      []byte
+}
+
+func (O Record) String() string {
+	return fmt.Sprintf("%c %.6f %s", O.Direction, O.Offset.Seconds(), strconv.Quote(string(O.Data)))
+}
+
+func Parse(r io.Reader) ([]Record, error) {
+	Records := []Record{}
+	Scanner := bufio.NewScanner(r)
+	Scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for N := 1; Scanner.Scan(); N++ {
+		Line := strings.TrimSpace(Scanner.Text())
+		if Line == "" || strings.HasPrefix(Line, "#") {
+			continue
+		}
+		Fields := strings.SplitN(Line, " ", 3)
+		if len(Fields) != 3 || (Fields[0] != ">" && Fields[0] != "<") {
+			return nil, fmt.Errorf("transcript line %d: invalid record", N)
+		}
+		Seconds, err := strconv.ParseFloat(Fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("transcript line %d: %v", N, err)
+		}
+		Data, err := strconv.Unquote(Fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("transcript line %d: %v", N, err)
+		}
+		Records = append(Records, Record{
+			Direction: Direction(Fields[0][0]),
+			Offset:    time.Duration(Seconds * float64(time.Second)),
+			Data:      []byte(Data),
+		})
+	}
+	return Records, Scanner.Err()
+}
+
+func Load(path string) ([]Record, error) {
+	File, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer File.Close()
+	return Parse(File)
+}